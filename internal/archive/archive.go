@@ -0,0 +1,366 @@
+// Package archive lets zip archives in the photo library act as read-only
+// folders. Media inside an archive is addressed by a virtual path joining
+// the archive's path and the entry's name with Sep, e.g.
+// /photos/takeout.zip!/Google Photos/IMG_1.jpg. The helpers here accept
+// both virtual and regular paths, so callers only need to switch from the
+// os functions.
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sep separates an archive's path from an entry name in a virtual path.
+const Sep = "!/"
+
+// Exts are the archive formats indexed.
+var Exts = map[string]bool{".zip": true}
+
+// maxBuffered is the largest compressed entry OpenSeeker decompresses into
+// memory; larger ones are extracted to a temporary file.
+const maxBuffered = 32 << 20
+
+// IsArchive reports whether path names an archive file.
+func IsArchive(p string) bool {
+	return Exts[strings.ToLower(filepath.Ext(p))]
+}
+
+// Join returns the virtual path of an entry inside an archive.
+func Join(archivePath, name string) string {
+	return archivePath + Sep + name
+}
+
+// Split splits a virtual path into the archive's path and the entry name.
+// ok is false for regular paths.
+func Split(p string) (archivePath, name string, ok bool) {
+	for i := 0; ; {
+		j := strings.Index(p[i:], Sep)
+		if j < 0 {
+			return "", "", false
+		}
+		i += j
+		if IsArchive(p[:i]) {
+			return p[:i], p[i+len(Sep):], true
+		}
+		i += len(Sep)
+	}
+}
+
+// IsEntry reports whether p is a virtual path into an archive.
+func IsEntry(p string) bool {
+	_, _, ok := Split(p)
+	return ok
+}
+
+// Walk calls fn with the virtual path and header of every regular file in
+// the archive at archivePath, in archive order. An error from fn stops the
+// walk and is returned.
+func Walk(archivePath string, fn func(p string, f *zip.File) error) error {
+	a, err := acquire(archivePath)
+	if err != nil {
+		return err
+	}
+	defer a.release()
+
+	for _, f := range a.zr.File {
+		if f.FileInfo().IsDir() || !validName(f.Name) {
+			continue
+		}
+		if err := fn(Join(archivePath, f.Name), f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validName rejects entry names that can't be addressed unambiguously.
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "/") && !strings.Contains(name, Sep) && path.Clean(name) == name
+}
+
+// Stat returns the file info of a regular file or archive entry.
+func Stat(p string) (fs.FileInfo, error) {
+	archivePath, name, ok := Split(p)
+	if !ok {
+		return os.Stat(p)
+	}
+	a, err := acquire(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer a.release()
+
+	f, err := a.file(p, name)
+	if err != nil {
+		return nil, err
+	}
+	return f.FileInfo(), nil
+}
+
+// Open opens a regular file or archive entry for streaming.
+func Open(p string) (io.ReadCloser, error) {
+	archivePath, name, ok := Split(p)
+	if !ok {
+		return os.Open(p)
+	}
+	a, err := acquire(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := a.file(p, name)
+	if err != nil {
+		a.release()
+		return nil, err
+	}
+	rc, err := f.Open()
+	if err != nil {
+		a.release()
+		return nil, err
+	}
+	return &entryReader{ReadCloser: rc, a: a}, nil
+}
+
+// OpenSeeker opens a regular file or archive entry for random access, as
+// http.ServeContent needs. Stored entries are read in place; compressed
+// ones are decompressed into memory or, when large, a temporary file.
+func OpenSeeker(p string) (io.ReadSeekCloser, fs.FileInfo, error) {
+	archivePath, name, ok := Split(p)
+	if !ok {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return f, info, nil
+	}
+
+	a, err := acquire(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := a.file(p, name)
+	if err != nil {
+		a.release()
+		return nil, nil, err
+	}
+
+	if f.Method == zip.Store {
+		off, err := f.DataOffset()
+		if err != nil {
+			a.release()
+			return nil, nil, err
+		}
+		sr := io.NewSectionReader(a.f, off, int64(f.UncompressedSize64))
+		return &entrySeeker{ReadSeeker: sr, close: a.release}, f.FileInfo(), nil
+	}
+
+	if f.UncompressedSize64 <= maxBuffered {
+		defer a.release()
+		rc, err := f.Open()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &entrySeeker{ReadSeeker: bytes.NewReader(data), close: func() {}}, f.FileInfo(), nil
+	}
+
+	a.release()
+	local, cleanup, err := Local(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmp, err := os.Open(local)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	closeTmp := func() {
+		tmp.Close()
+		cleanup()
+	}
+	return &entrySeeker{ReadSeeker: tmp, close: closeTmp}, f.FileInfo(), nil
+}
+
+// Local returns a path on disk holding p's content, for tools that need a
+// real file such as ffmpeg and libheif: p itself for regular files, or a
+// temporary copy of an archive entry with the same extension. cleanup
+// removes the copy and must always be called.
+func Local(p string) (local string, cleanup func(), err error) {
+	if !IsEntry(p) {
+		return p, func() {}, nil
+	}
+
+	rc, err := Open(p)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rc.Close()
+
+	tmp, err := os.CreateTemp("", "photog-*"+filepath.Ext(p))
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.Remove(tmp.Name()) }
+	if _, err := io.Copy(tmp, rc); err != nil {
+		tmp.Close()
+		remove()
+		return "", nil, fmt.Errorf("extract %s: %w", p, err)
+	}
+	if err := tmp.Close(); err != nil {
+		remove()
+		return "", nil, err
+	}
+	return tmp.Name(), remove, nil
+}
+
+type entryReader struct {
+	io.ReadCloser
+	a *openArchive
+}
+
+func (r *entryReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.a.release()
+	return err
+}
+
+type entrySeeker struct {
+	io.ReadSeeker
+	close func()
+}
+
+func (s *entrySeeker) Close() error {
+	s.close()
+	return nil
+}
+
+// Open archives are cached so thumbnailing many entries of one archive
+// doesn't re-read its central directory every time.
+const maxOpen = 8
+
+var (
+	openMu   sync.Mutex
+	openArch = map[string]*openArchive{}
+)
+
+type openArchive struct {
+	path    string
+	f       *os.File
+	zr      *zip.Reader
+	files   map[string]*zip.File
+	modTime time.Time
+	size    int64
+
+	// guarded by openMu
+	refs    int
+	evicted bool
+	used    time.Time
+}
+
+// acquire returns the open archive at archivePath, opening it or reopening
+// it when the file changed. Callers must release it.
+func acquire(archivePath string) (*openArchive, error) {
+	info, err := os.Stat(archivePath)
+
+	openMu.Lock()
+	defer openMu.Unlock()
+
+	if err != nil {
+		if a := openArch[archivePath]; a != nil {
+			a.evict() // deleted or unmounted; don't hold it open
+		}
+		return nil, err
+	}
+
+	if a := openArch[archivePath]; a != nil {
+		if a.modTime.Equal(info.ModTime()) && a.size == info.Size() {
+			a.refs++
+			a.used = time.Now()
+			return a, nil
+		}
+		a.evict()
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read archive %s: %w", archivePath, err)
+	}
+	a := &openArchive{
+		path:    archivePath,
+		f:       f,
+		zr:      zr,
+		files:   make(map[string]*zip.File, len(zr.File)),
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		refs:    1,
+		used:    time.Now(),
+	}
+	for _, zf := range zr.File {
+		a.files[zf.Name] = zf
+	}
+
+	if len(openArch) >= maxOpen {
+		var oldest *openArchive
+		for _, o := range openArch {
+			if oldest == nil || o.used.Before(oldest.used) {
+				oldest = o
+			}
+		}
+		oldest.evict()
+	}
+	openArch[archivePath] = a
+	return a, nil
+}
+
+// file looks up an entry by name.
+func (a *openArchive) file(p, name string) (*zip.File, error) {
+	f := a.files[name]
+	if f == nil || f.FileInfo().IsDir() {
+		return nil, &fs.PathError{Op: "open", Path: p, Err: fs.ErrNotExist}
+	}
+	return f, nil
+}
+
+// evict drops the archive from the cache, closing it once unused. Callers
+// hold openMu.
+func (a *openArchive) evict() {
+	if openArch[a.path] == a {
+		delete(openArch, a.path)
+	}
+	a.evicted = true
+	if a.refs == 0 {
+		a.f.Close()
+	}
+}
+
+func (a *openArchive) release() {
+	openMu.Lock()
+	defer openMu.Unlock()
+	a.refs--
+	if a.refs == 0 && a.evicted {
+		a.f.Close()
+	}
+}
@@ -0,0 +1,157 @@
+// Package auth provisions the login accounts listed in the config.
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"photog/internal/config"
+	"photog/internal/database"
+	"photog/internal/models"
+)
+
+// Setup creates or updates the configured accounts and removes any others.
+// It returns the folders each account owns, as user ID -> paths, for
+// scoping the library: a user's configured photo paths and
+// <uploadDir>/<username>, where their uploads are stored, plus the WebDAV
+// folder of each WebDAV user naming the account as its user. With auth
+// disabled it does nothing.
+func Setup(db *database.DB, cfg config.AuthConfig, uploadDir string, dav config.WebDAVConfig) (map[int64][]string, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.AdminUsername == "" {
+		return nil, fmt.Errorf("auth.admin_username must not be empty")
+	}
+
+	keep := []string{cfg.AdminUsername}
+	for _, u := range cfg.Users {
+		if u.Username == "" || u.Password == "" {
+			return nil, fmt.Errorf("auth user %q needs a username and password", u.Username)
+		}
+		for _, name := range keep {
+			if name == u.Username {
+				return nil, fmt.Errorf("auth user %q is listed twice or is the admin", u.Username)
+			}
+		}
+		keep = append(keep, u.Username)
+	}
+	if n, err := db.DeleteUsersExcept(keep); err != nil {
+		return nil, fmt.Errorf("removing old accounts: %w", err)
+	} else if n > 0 {
+		log.Printf("Auth: removed %d account(s) no longer in the config", n)
+	}
+
+	admin, err := setupAdmin(db, cfg.AdminUsername, cfg.AdminPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := map[string]int64{admin.Username: admin.ID}
+	owners := make(map[int64][]string)
+	for _, uc := range cfg.Users {
+		u, err := ensure(db, uc.Username, uc.Password, false)
+		if err != nil {
+			return nil, err
+		}
+		ids[u.Username] = u.ID
+		paths := append([]string(nil), uc.Paths...)
+		if uploadDir != "" {
+			paths = append(paths, filepath.Join(uploadDir, uc.Username))
+		}
+		if len(paths) > 0 {
+			owners[u.ID] = paths
+		}
+	}
+	if dav.Dir != "" {
+		for _, du := range dav.Users {
+			id, ok := ids[du.User]
+			if !ok {
+				log.Printf("Auth: WebDAV user %q belongs to no account (user: %q); its uploads are shared with everyone", du.Username, du.User)
+				continue
+			}
+			owners[id] = append(owners[id], filepath.Join(dav.Dir, du.Username))
+		}
+	}
+	return owners, nil
+}
+
+// setupAdmin creates or updates the admin account and returns it. Without
+// a configured password, an existing admin keeps its password and a new one
+// gets a generated password, logged once.
+func setupAdmin(db *database.DB, username, password string) (*models.User, error) {
+	if password == "" {
+		u, _, err := db.GetUserByName(username)
+		if err == nil {
+			return u, setAdmin(db, u, true)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("loading user %q: %w", username, err)
+		}
+		password = randomPassword()
+		log.Printf("Auth: created user %q with password %s (set auth.admin_password to choose one)", username, password)
+	}
+	return ensure(db, username, password, true)
+}
+
+// ensure creates an account with the given password and admin rights, or
+// brings an existing account's in line: a changed password signs it out
+// everywhere, as does losing admin rights.
+func ensure(db *database.DB, username, password string, admin bool) (*models.User, error) {
+	u, hash, err := db.GetUserByName(username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("loading user %q: %w", username, err)
+	}
+	if u != nil && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+		return u, setAdmin(db, u, admin)
+	}
+	newHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("hashing password: %w", err)
+	}
+	if u == nil {
+		u, err = db.CreateUser(username, string(newHash), admin)
+		if err != nil {
+			return nil, fmt.Errorf("creating user %q: %w", username, err)
+		}
+		return u, nil
+	}
+	if err := db.SetUserPassword(u.ID, string(newHash)); err != nil {
+		return nil, fmt.Errorf("updating password of %q: %w", username, err)
+	}
+	log.Printf("Auth: password of %q changed; existing sessions were signed out", username)
+	return u, setAdmin(db, u, admin)
+}
+
+// setAdmin grants or revokes u's admin rights if they differ from admin.
+func setAdmin(db *database.DB, u *models.User, admin bool) error {
+	if u.Admin == admin {
+		return nil
+	}
+	if err := db.SetUserAdmin(u.ID, admin); err != nil {
+		return fmt.Errorf("updating admin rights of %q: %w", u.Username, err)
+	}
+	u.Admin = admin
+	if admin {
+		log.Printf("Auth: %q is now the admin", u.Username)
+	} else {
+		log.Printf("Auth: %q is no longer an admin; existing sessions were signed out", u.Username)
+	}
+	return nil
+}
+
+// randomPassword returns a random 24-character hex password.
+func randomPassword() string {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
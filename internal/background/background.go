@@ -0,0 +1,59 @@
+// Package background runs long-lived work (indexing, thumbnail pregen,
+// exports) at reduced CPU and IO priority so interactive browsing stays
+// responsive during large scans.
+package background
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"time"
+
+	"photog/internal/config"
+)
+
+var (
+	mu       sync.RWMutex
+	cfg      config.BackgroundConfig
+	warnOnce sync.Once
+)
+
+// Configure sets the priority settings used by Enter and Pause. Call it once
+// at startup, before any background work begins.
+func Configure(c config.BackgroundConfig) {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg = c
+}
+
+func settings() config.BackgroundConfig {
+	mu.RLock()
+	defer mu.RUnlock()
+	return cfg
+}
+
+// Enter lowers the priority of the calling goroutine. It locks the goroutine
+// to its OS thread and never unlocks it, so the reduced priority (which child
+// processes such as ffmpeg inherit) dies with the goroutine instead of
+// leaking back into the runtime's thread pool. Only call it at the top of a
+// goroutine dedicated to background work.
+func Enter() {
+	c := settings()
+	if c.Nice <= 0 && !c.IOIdle {
+		return
+	}
+	runtime.LockOSThread()
+	if err := lowerPriority(c.Nice, c.IOIdle); err != nil {
+		warnOnce.Do(func() {
+			log.Printf("Background: cannot lower priority (%v); set background.throttle_ms to pace work instead", err)
+		})
+	}
+}
+
+// Pause sleeps for the configured throttle after a unit of background work.
+// It is a no-op unless background.throttle_ms is set.
+func Pause() {
+	if ms := settings().ThrottleMS; ms > 0 {
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+	}
+}
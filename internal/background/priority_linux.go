@@ -0,0 +1,31 @@
+package background
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// ioprio_set arguments, from linux/ioprio.h
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// lowerPriority renices the current thread and moves it to the idle IO
+// class. On Linux both are per-thread, so only the locked thread is affected.
+func lowerPriority(nice int, ioIdle bool) error {
+	tid := syscall.Gettid()
+	if nice > 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil {
+			return fmt.Errorf("setpriority: %w", err)
+		}
+	}
+	if ioIdle {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+		if errno != 0 {
+			return fmt.Errorf("ioprio_set: %w", errno)
+		}
+	}
+	return nil
+}
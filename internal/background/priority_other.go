@@ -0,0 +1,11 @@
+//go:build !linux
+
+package background
+
+import "fmt"
+
+// lowerPriority is unsupported outside Linux: priority there is per-process,
+// which would slow down request handling too.
+func lowerPriority(nice int, ioIdle bool) error {
+	return fmt.Errorf("per-thread priority is only supported on Linux")
+}
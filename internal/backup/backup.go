@@ -0,0 +1,212 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"photog/internal/database"
+)
+
+// snapshotPrefix names every snapshot directory so retention only ever
+// touches directories photog created.
+const snapshotPrefix = "photog-"
+
+// Options controls a backup run.
+type Options struct {
+	CacheDir      string // photog cache dir (database + thumbs)
+	Target        string // local directory or rclone remote ("remote:path")
+	Keep          int    // number of snapshots to retain (0 = keep all)
+	IncludeThumbs bool   // also copy the thumbnail cache
+}
+
+// Run creates a new snapshot in the target and prunes old ones.
+func Run(db *database.DB, opts Options) error {
+	if opts.Target == "" {
+		return fmt.Errorf("no backup target given")
+	}
+
+	name := snapshotPrefix + time.Now().Format("20060102-150405")
+	remote := isRemote(opts.Target)
+
+	// Local targets are written in place; remote targets are staged in a
+	// temp dir and shipped with rclone.
+	var snapDir string
+	if remote {
+		tmp, err := os.MkdirTemp("", "photog-backup-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		snapDir = filepath.Join(tmp, name)
+	} else {
+		snapDir = filepath.Join(opts.Target, name)
+	}
+
+	if err := writeSnapshot(db, opts, snapDir); err != nil {
+		os.RemoveAll(snapDir)
+		return err
+	}
+
+	if remote {
+		dst := strings.TrimSuffix(opts.Target, "/") + "/" + name
+		if err := rclone("copy", snapDir, dst); err != nil {
+			return fmt.Errorf("rclone copy: %w", err)
+		}
+	}
+	log.Printf("Backup: wrote snapshot %s to %s", name, opts.Target)
+
+	if opts.Keep > 0 {
+		if err := prune(opts.Target, opts.Keep, remote); err != nil {
+			return fmt.Errorf("prune: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeSnapshot copies the database, failure cache and (optionally) the
+// thumbnail cache into dir.
+func writeSnapshot(db *database.DB, opts Options, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if err := db.BackupTo(filepath.Join(dir, "photog.db")); err != nil {
+		return fmt.Errorf("snapshot database: %w", err)
+	}
+
+	thumbsDir := filepath.Join(opts.CacheDir, "thumbs")
+	if opts.IncludeThumbs {
+		if err := copyTree(thumbsDir, filepath.Join(dir, "thumbs")); err != nil {
+			return fmt.Errorf("copy thumbnails: %w", err)
+		}
+		return nil
+	}
+
+	failCache := filepath.Join(thumbsDir, "fail_cache.txt")
+	if _, err := os.Stat(failCache); err == nil {
+		if err := os.MkdirAll(filepath.Join(dir, "thumbs"), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(failCache, filepath.Join(dir, "thumbs", "fail_cache.txt")); err != nil {
+			return fmt.Errorf("copy failure cache: %w", err)
+		}
+	}
+	return nil
+}
+
+// prune deletes all but the newest keep snapshots in target. Snapshot names
+// embed a sortable timestamp, so lexical order is chronological.
+func prune(target string, keep int, remote bool) error {
+	var names []string
+	if remote {
+		out, err := exec.Command("rclone", "lsf", "--dirs-only", target).Output()
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			name := strings.TrimSuffix(strings.TrimSpace(line), "/")
+			if strings.HasPrefix(name, snapshotPrefix) {
+				names = append(names, name)
+			}
+		}
+	} else {
+		entries, err := os.ReadDir(target)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.IsDir() && strings.HasPrefix(e.Name(), snapshotPrefix) {
+				names = append(names, e.Name())
+			}
+		}
+	}
+
+	if len(names) <= keep {
+		return nil
+	}
+	sort.Strings(names)
+
+	for _, name := range names[:len(names)-keep] {
+		var err error
+		if remote {
+			err = rclone("purge", strings.TrimSuffix(target, "/")+"/"+name)
+		} else {
+			err = os.RemoveAll(filepath.Join(target, name))
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Backup: removed old snapshot %s", name)
+	}
+	return nil
+}
+
+// isRemote reports whether target is an rclone remote ("name:path") rather
+// than a local directory. Windows drive letters ("C:\...") count as local.
+func isRemote(target string) bool {
+	i := strings.Index(target, ":")
+	if i <= 0 {
+		return false
+	}
+	if i == 1 && len(target) > 2 && (target[2] == '\\' || target[2] == '/') {
+		return false
+	}
+	return !strings.ContainsAny(target[:i], `/\`)
+}
+
+func rclone(args ...string) error {
+	if _, err := exec.LookPath("rclone"); err != nil {
+		return fmt.Errorf("rclone not installed")
+	}
+	cmd := exec.Command("rclone", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		// Skip in-progress temp files from concurrent generation
+		if strings.Contains(d.Name(), ".tmp") {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -9,50 +9,421 @@ import (
 
 // Config holds all application configuration.
 type Config struct {
-	Server    ServerConfig    `yaml:"server"`
-	Photos    PhotosConfig    `yaml:"photos"`
-	Cache     CacheConfig     `yaml:"cache"`
-	Thumbnail ThumbnailConfig `yaml:"thumbnail"`
+	Server      ServerConfig      `yaml:"server"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Photos      PhotosConfig      `yaml:"photos"`
+	Cache       CacheConfig       `yaml:"cache"`
+	Thumbnail   ThumbnailConfig   `yaml:"thumbnail"`
+	Transcode   TranscodeConfig   `yaml:"transcode"`
+	Background  BackgroundConfig  `yaml:"background"`
+	Jobs        JobsConfig        `yaml:"jobs"`
+	Schedule    ScheduleConfig    `yaml:"schedule"`
+	Memories    MemoriesConfig    `yaml:"memories"`
+	Events      EventsConfig      `yaml:"events"`
+	Albums      AlbumsConfig      `yaml:"albums"`
+	Geocode     GeocodeConfig     `yaml:"geocode"`
+	Weather     WeatherConfig     `yaml:"weather"`
+	Views       ViewsConfig       `yaml:"views"`
+	ContentURLs ContentURLsConfig `yaml:"content_urls"`
+	Frame       FrameConfig       `yaml:"frame"`
+	Telegram    TelegramConfig    `yaml:"telegram"`
+	MQTT        MQTTConfig        `yaml:"mqtt"`
+	WebDAV      WebDAVConfig      `yaml:"webdav"`
+	Upload      UploadConfig      `yaml:"upload"`
+	Trash       TrashConfig       `yaml:"trash"`
+	Exports     []ExportConfig    `yaml:"exports"`
+	TagRules    []TagRule         `yaml:"tag_rules"`
 }
 
 type ServerConfig struct {
 	Port int    `yaml:"port"`
 	Host string `yaml:"host"`
+	// ShutdownGraceSeconds is how long shutdown waits for in-flight requests
+	// and jobs to finish before exiting anyway.
+	ShutdownGraceSeconds int `yaml:"shutdown_grace_seconds"`
+}
+
+// AuthConfig controls login. When enabled, every /api route needs a
+// session from POST /api/auth/login, sent as a cookie or bearer token.
+// AdminUsername/AdminPassword create that admin account at startup, or
+// reset its password; if the account doesn't exist yet and no password is
+// set, one is generated and logged once. Users are the other accounts;
+// accounts not listed here are removed at startup.
+type AuthConfig struct {
+	Enabled       bool         `yaml:"enabled"`
+	AdminUsername string       `yaml:"admin_username"`
+	AdminPassword string       `yaml:"admin_password"`
+	SessionDays   int          `yaml:"session_days"` // how long a login lasts
+	Users         []UserConfig `yaml:"users"`
+	// SharedGPS is how precise the GPS position in a photo's metadata is
+	// for accounts that see it without owning it: shared photos for users,
+	// and other users' photos in albums shared with them. "exact", "round"
+	// to about a kilometer, or "strip". Admins and the photo's owner always
+	// get it exact. Original files are served unchanged.
+	SharedGPS string `yaml:"shared_gps"`
+	// AllowedOrigins are the web origins ("https://dash.example.com") other
+	// than photog's own whose pages may call the API from a browser. With
+	// auth disabled any origin may.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+// UserConfig is a non-admin account. Photos under its Paths are its own and
+// hidden from other non-admin users; photos outside every user's paths are
+// shared with everyone. The admin sees the whole library.
+type UserConfig struct {
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	Paths    []string `yaml:"paths"`
 }
 
 type PhotosConfig struct {
-	Paths []string `yaml:"paths"`
+	Paths  []string     `yaml:"paths"`
+	Limits []IndexLimit `yaml:"limits"`
+	// IndexArchives indexes the photos inside .zip files (phone backups,
+	// Takeout exports) in place, without extracting them.
+	IndexArchives bool `yaml:"index_archives"`
+	// PruneMissing lets automatic cleanups drop the index entries of files
+	// no longer on disk. Without it they only report them, and pruning
+	// takes an explicit DELETE /api/index/missing.
+	PruneMissing bool `yaml:"prune_missing"`
+	// RawPairs is which file of a RAW+JPEG pair (same name, other
+	// extension) the timeline shows: "jpeg", "raw" or "both".
+	RawPairs string `yaml:"raw_pairs"`
+}
+
+// IndexLimit skips matching files at index time. A file matches when its
+// path starts with Path (empty matches all) and its extension is listed in
+// Extensions (empty matches all). Matching files are skipped when larger
+// than MaxSizeMB, or always when MaxSizeMB is 0.
+type IndexLimit struct {
+	Path       string   `yaml:"path"`
+	Extensions []string `yaml:"extensions"` // e.g. [".avi", ".mts"]
+	MaxSizeMB  int64    `yaml:"max_size_mb"`
 }
 
 type CacheConfig struct {
-	Dir string `yaml:"dir"`
+	Dir       string `yaml:"dir"`
+	MinFreeMB int    `yaml:"min_free_mb"` // pause thumbnail pregen below this much free space; 0 disables
 }
 
 type ThumbnailConfig struct {
-	SmallSize  int `yaml:"small_size"`
-	MediumSize int `yaml:"medium_size"`
-	LargeSize  int `yaml:"large_size"`
-	Quality    int `yaml:"quality"`
+	SmallSize         int `yaml:"small_size"`
+	MediumSize        int `yaml:"medium_size"`
+	LargeSize         int `yaml:"large_size"`
+	XLargeSize        int `yaml:"xlarge_size"` // lightbox zoom; generated on request only
+	Quality           int `yaml:"quality"`
+	FFmpegConcurrency int `yaml:"ffmpeg_concurrency"` // max simultaneous ffmpeg processes
+
+	// Per-size WebP quality; 0 uses Quality
+	SmallQuality  int `yaml:"small_quality"`
+	MediumQuality int `yaml:"medium_quality"`
+	LargeQuality  int `yaml:"large_quality"`
+	XLargeQuality int `yaml:"xlarge_quality"`
+
+	// Output format: webp, avif (needs ffmpeg with an AV1 encoder) or jpeg.
+	// AVIF and JPEG quality; 0 uses the WebP quality of the size.
+	Format      string `yaml:"format"`
+	AVIFQuality int    `yaml:"avif_quality"`
+	JPEGQuality int    `yaml:"jpeg_quality"`
+
+	Filter  string  `yaml:"filter"`  // resampling filter: lanczos, catmullrom, mitchell, linear, box
+	Sharpen float64 `yaml:"sharpen"` // unsharp mask sigma applied after downscaling; 0 disables
+
+	// On-demand generation limits for /api/thumb: at most MaxPending
+	// generations may be running or queued, and a queued request gives up
+	// after QueueWait seconds. Shed requests get a 503 with Retry-After.
+	MaxPending int `yaml:"max_pending"`
+	QueueWait  int `yaml:"queue_wait"`
+
+	// Commands that convert formats Go can't decode; see ExternalThumbnailer
+	External []ExternalThumbnailer `yaml:"external"`
+}
+
+// ExternalThumbnailer converts files with one of Extensions into an image
+// that is then resized like any other. Command is split on spaces, and
+// {input} and {output} in its arguments are replaced by the source path and
+// a temporary file with the Output extension. Extensions not otherwise
+// supported are indexed as images.
+type ExternalThumbnailer struct {
+	Extensions []string `yaml:"extensions"` // e.g. [".cr3", ".orf"]
+	Command    string   `yaml:"command"`    // e.g. "darktable-cli {input} {output}"
+	Output     string   `yaml:"output"`     // intermediate format: .jpg (default), .png or .tif
+	Timeout    int      `yaml:"timeout"`    // seconds; 0 = 60
+}
+
+// TranscodeConfig controls /api/media/{id}/stream, which converts videos
+// browsers can't play to MP4 with ffmpeg and caches the result. Zero
+// values use the defaults noted.
+type TranscodeConfig struct {
+	Concurrency int    `yaml:"concurrency"`  // simultaneous transcodes; default 1
+	MaxHeight   int    `yaml:"max_height"`   // re-encoded video is scaled down to this; default 1080
+	Preset      string `yaml:"preset"`       // x264 preset; default veryfast
+	CRF         int    `yaml:"crf"`          // x264 quality, lower is better; default 23
+	CacheMaxMB  int64  `yaml:"cache_max_mb"` // oldest transcodes are deleted beyond this; default 10240
+}
+
+// BackgroundConfig lowers the priority of indexing, pregen and export work.
+// Nice and IOIdle apply per thread on Linux only; ThrottleMS pauses after
+// each item on any platform.
+type BackgroundConfig struct {
+	Nice       int  `yaml:"nice"`        // 0-19; 0 keeps normal CPU priority
+	IOIdle     bool `yaml:"io_idle"`     // idle IO scheduling class (like ionice -c3)
+	ThrottleMS int  `yaml:"throttle_ms"` // sleep after each indexed file or thumbnail
+}
+
+// JobsConfig controls the background job queue. Concurrency maps a job class
+// ("scan", "thumbnails", "new_thumbnails", "maintenance") to how many of its jobs may run at
+// once; unlisted classes run one at a time.
+type JobsConfig struct {
+	Concurrency map[string]int `yaml:"concurrency"`
+}
+
+// ScheduleConfig limits heavy background job classes to daily local-time
+// windows such as "01:00-07:00" (ranges may cross midnight). With no windows
+// they run at any time.
+type ScheduleConfig struct {
+	Windows []string `yaml:"windows"`
+	Classes []string `yaml:"classes"` // job classes the windows apply to
+}
+
+// MemoriesConfig controls the "on this day" memories groups.
+type MemoriesConfig struct {
+	WindowDays    int      `yaml:"window_days"` // days either side of today's date to include
+	PerYear       int      `yaml:"per_year"`    // photos returned for each past year
+	IncludeVideos bool     `yaml:"include_videos"`
+	ExcludeTags   []string `yaml:"exclude_tags"` // skip photos with these tags (see tag_rules)
+	MinSize       int      `yaml:"min_size"`     // skip photos whose short side is smaller (px); 0 disables
+}
+
+// EventsConfig controls automatic event detection. Photos taken less than
+// Gap hours apart belong to the same event; clusters smaller than MinPhotos
+// are ignored.
+type EventsConfig struct {
+	Gap       int `yaml:"gap"` // hours
+	MinPhotos int `yaml:"min_photos"`
+}
+
+// AlbumsConfig controls albums made from the folder structure. With
+// FromFolders, the folders FolderDepth levels below a photo path each
+// become an album named after the folder, holding the photos in it and its
+// subfolders; depth 0 uses the deepest folders holding photos instead.
+// These albums follow their folders after every scan and are removed with
+// them, or when FromFolders is turned off.
+type AlbumsConfig struct {
+	FromFolders bool `yaml:"from_folders"`
+	FolderDepth int  `yaml:"folder_depth"`
+}
+
+// GeocodeConfig controls offline reverse geocoding of photo positions into
+// "City, Country" place names. Dataset is a GeoNames cities file such as
+// cities1000.txt (CC BY 4.0, credit GeoNames); empty uses the bundled,
+// hand-maintained list of capitals and large cities, which is sparse enough
+// that MaxDistanceKM defaults to a short 50 km.
+type GeocodeConfig struct {
+	Enabled       bool    `yaml:"enabled"`
+	Dataset       string  `yaml:"dataset"`
+	MaxDistanceKM float64 `yaml:"max_distance_km"` // farther from every city means no place
+}
+
+// WeatherConfig controls looking up the historical weather where and when
+// photos with a GPS position were taken. Off by default, since it sends
+// those positions and dates to the provider.
+type WeatherConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Provider string `yaml:"provider"` // "open-meteo"
+	URL      string `yaml:"url"`      // provider API endpoint; empty uses its own
+}
+
+// ViewsConfig controls per-photo view counting. Off by default, since it
+// records what each photo's viewers looked at and when.
+type ViewsConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// ContentURLsConfig controls content-addressed URLs (/api/c/{hash}/...),
+// which never change meaning and so can be cached for good by a CDN or
+// proxy (only by browsers when auth is enabled, as they need a session).
+// Files get one once hashed; Enabled hashes every file after each scan
+// instead of only possible duplicates, reading the whole library once.
+type ContentURLsConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// FrameConfig controls the kiosk / digital photo frame endpoint.
+// The endpoint is disabled unless a token is set.
+type FrameConfig struct {
+	Token    string `yaml:"token"`
+	Interval int    `yaml:"interval"` // seconds between images
+}
+
+// TelegramConfig controls the optional Telegram bot. The bot is disabled
+// unless a token is set, and only talks to the listed chat IDs.
+type TelegramConfig struct {
+	Token        string  `yaml:"token"`
+	ChatIDs      []int64 `yaml:"chat_ids"`
+	UploadDir    string  `yaml:"upload_dir"`    // where photos sent to the bot are saved
+	MemoriesHour int     `yaml:"memories_hour"` // local hour to send "on this day" memories
+}
+
+// MQTTConfig controls optional event publishing to an MQTT broker.
+// Publishing is disabled unless a broker address is set.
+type MQTTConfig struct {
+	Broker        string `yaml:"broker"` // host:port, e.g. "192.168.1.10:1883"
+	ClientID      string `yaml:"client_id"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	TopicPrefix   string `yaml:"topic_prefix"`
+	StatsInterval int    `yaml:"stats_interval"` // seconds between storage stats messages
+}
+
+// WebDAVConfig controls the write-enabled WebDAV upload target at /dav/.
+// Each user gets their own folder under Dir, so every phone or device can
+// back up into its own directory. Disabled unless Dir and a user are set.
+// With auth enabled, a user's folder belongs to the login account its User
+// names, like that account's photo paths; without one, it is shared.
+type WebDAVConfig struct {
+	Dir   string       `yaml:"dir"`
+	Users []WebDAVUser `yaml:"users"`
+}
+
+type WebDAVUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	User     string `yaml:"user"` // login account owning the uploads
+}
+
+// UploadConfig controls browser and app uploads through /api/upload. Files
+// are stored in Dir, in a folder per user when auth is enabled, which
+// belongs to that user like their photo paths. Disabled when Dir is empty.
+type UploadConfig struct {
+	Dir       string `yaml:"dir"`
+	MaxSizeMB int64  `yaml:"max_size_mb"` // largest accepted file
+
+	// Fixes applied to uploads before they are indexed
+	AutoRotate      bool `yaml:"auto_rotate"`       // turn JPEG pixels upright per their EXIF orientation
+	FixExtensions   bool `yaml:"fix_extensions"`    // rename files whose extension doesn't match their content
+	FillMissingDate bool `yaml:"fill_missing_date"` // record the upload time for images without a capture date
+}
+
+// TrashConfig controls DELETE /api/photo/{id}. Deleted files, with their
+// sidecars, are moved into Dir (default <cache.dir>/trash), where they can
+// be restored until they're purged RetentionDays after deletion. With
+// RetentionDays 0 they're kept until removed from the trash by hand. Dir
+// must not be inside a photo path, or trashed files would be indexed again.
+type TrashConfig struct {
+	Dir           string `yaml:"dir"`
+	RetentionDays int    `yaml:"retention_days"`
+}
+
+// ExportConfig describes a scheduled export: photos matching Filter are
+// written as resized JPEGs into Target and kept in sync every Interval.
+type ExportConfig struct {
+	Name     string       `yaml:"name"`
+	Target   string       `yaml:"target"`
+	Interval int          `yaml:"interval"` // seconds between syncs
+	Size     int          `yaml:"size"`     // max width/height in pixels
+	Filter   ExportFilter `yaml:"filter"`
+}
+
+// ExportFilter selects which photos an export includes. Empty fields match all.
+type ExportFilter struct {
+	From        string `yaml:"from"` // YYYY-MM-DD
+	To          string `yaml:"to"`   // YYYY-MM-DD
+	PathPrefix  string `yaml:"path_prefix"`
+	Orientation string `yaml:"orientation"` // "landscape" or "portrait"
+}
+
+// TagRule tags every file whose path matches Pattern. Patterns are globs
+// where * matches within a path segment and ** across segments, e.g.
+// "**/Screenshots/**".
+type TagRule struct {
+	Pattern string `yaml:"pattern"`
+	Tag     string `yaml:"tag"`
 }
 
 // DefaultConfig returns configuration with sensible defaults.
 func DefaultConfig() *Config {
 	return &Config{
 		Server: ServerConfig{
-			Port: 8080,
-			Host: "0.0.0.0",
+			Port:                 8080,
+			Host:                 "0.0.0.0",
+			ShutdownGraceSeconds: 10,
+		},
+		Auth: AuthConfig{
+			Enabled:       true,
+			AdminUsername: "admin",
+			SessionDays:   30,
+			SharedGPS:     "exact",
 		},
 		Photos: PhotosConfig{
-			Paths: []string{"/photos"},
+			Paths:         []string{"/photos"},
+			IndexArchives: true,
+			RawPairs:      "jpeg",
 		},
 		Cache: CacheConfig{
-			Dir: "/cache",
+			Dir:       "/cache",
+			MinFreeMB: 1024,
 		},
 		Thumbnail: ThumbnailConfig{
-			SmallSize:  250,
-			MediumSize: 600,
-			LargeSize:  1200,
-			Quality:    80,
+			SmallSize:         250,
+			MediumSize:        600,
+			LargeSize:         1200,
+			XLargeSize:        2560,
+			Quality:           80,
+			Format:            "webp",
+			FFmpegConcurrency: 2,
+			Filter:            "lanczos",
+			MaxPending:        32,
+			QueueWait:         5,
+		},
+		Background: BackgroundConfig{
+			Nice:   10,
+			IOIdle: true,
+		},
+		Jobs: JobsConfig{
+			Concurrency: map[string]int{
+				"scan":           1,
+				"thumbnails":     1,
+				"new_thumbnails": 1,
+				"maintenance":    1,
+			},
+		},
+		Schedule: ScheduleConfig{
+			Classes: []string{"thumbnails", "maintenance"},
+		},
+		Memories: MemoriesConfig{
+			WindowDays:    3,
+			PerYear:       6,
+			IncludeVideos: true,
+			ExcludeTags:   []string{"screenshot"},
+		},
+		Events: EventsConfig{
+			Gap:       8,
+			MinPhotos: 10,
+		},
+		Geocode: GeocodeConfig{
+			Enabled:       true,
+			MaxDistanceKM: 50,
+		},
+		Weather: WeatherConfig{
+			Provider: "open-meteo",
+		},
+		Frame: FrameConfig{
+			Interval: 30,
+		},
+		Telegram: TelegramConfig{
+			MemoriesHour: 8,
+		},
+		MQTT: MQTTConfig{
+			ClientID:      "photog",
+			TopicPrefix:   "photog",
+			StatsInterval: 3600,
+		},
+		Upload: UploadConfig{
+			MaxSizeMB: 4096,
+		},
+		Trash: TrashConfig{
+			RetentionDays: 30,
 		},
 	}
 }
@@ -79,6 +450,14 @@ func Load(path string) (*Config, error) {
 		}
 	}
 
+	if user := os.Getenv("PHOTOG_ADMIN_USERNAME"); user != "" {
+		cfg.Auth.AdminUsername = user
+	}
+
+	if password := os.Getenv("PHOTOG_ADMIN_PASSWORD"); password != "" {
+		cfg.Auth.AdminPassword = password
+	}
+
 	if paths := os.Getenv("PHOTOG_PHOTO_PATHS"); paths != "" {
 		cfg.Photos.Paths = strings.Split(paths, ",")
 	}
@@ -87,6 +466,26 @@ func Load(path string) (*Config, error) {
 		cfg.Cache.Dir = dir
 	}
 
+	if token := os.Getenv("PHOTOG_FRAME_TOKEN"); token != "" {
+		cfg.Frame.Token = token
+	}
+
+	if token := os.Getenv("PHOTOG_TELEGRAM_TOKEN"); token != "" {
+		cfg.Telegram.Token = token
+	}
+
+	if broker := os.Getenv("PHOTOG_MQTT_BROKER"); broker != "" {
+		cfg.MQTT.Broker = broker
+	}
+
+	if dir := os.Getenv("PHOTOG_WEBDAV_DIR"); dir != "" {
+		cfg.WebDAV.Dir = dir
+	}
+
+	if dir := os.Getenv("PHOTOG_UPLOAD_DIR"); dir != "" {
+		cfg.Upload.Dir = dir
+	}
+
 	return cfg, nil
 }
 
@@ -2,19 +2,35 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	_ "github.com/mattn/go-sqlite3"
+	"photog/internal/archive"
 	"photog/internal/models"
 )
 
 // DB wraps the SQLite database connection.
 type DB struct {
 	conn *sql.DB
+
+	// writes waiting for the writer goroutine (see startWriter)
+	writes chan writeReq
+
+	// configured photo roots and which are offline (see SetRoots)
+	rootsMu sync.RWMutex
+	roots   []string
+	offline map[string]bool
 }
 
 // New creates or opens the SQLite database at the given cache directory.
@@ -24,7 +40,7 @@ func New(cacheDir string) (*DB, error) {
 	}
 
 	dbPath := filepath.Join(cacheDir, "photog.db")
-	conn, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL")
+	conn, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("open database: %w", err)
 	}
@@ -34,6 +50,7 @@ func New(cacheDir string) (*DB, error) {
 	conn.SetMaxIdleConns(2)
 
 	db := &DB{conn: conn}
+	db.startWriter()
 	if err := db.migrate(); err != nil {
 		return nil, fmt.Errorf("migrate: %w", err)
 	}
@@ -62,300 +79,4992 @@ func (db *DB) migrate() error {
 	CREATE INDEX IF NOT EXISTS idx_photos_path ON photos(path);
 	CREATE INDEX IF NOT EXISTS idx_photos_media_type ON photos(media_type);
 	`
-	_, err := db.conn.Exec(schema)
-	return err
-}
+	if _, err := db.exec(schema); err != nil {
+		return err
+	}
 
-// UpsertPhoto inserts or updates a photo record.
-func (db *DB) UpsertPhoto(p *models.Photo) error {
-	_, err := db.conn.Exec(`
-		INSERT INTO photos (path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-		ON CONFLICT(path) DO UPDATE SET
-			filename=excluded.filename,
-			taken_at=excluded.taken_at,
-			width=excluded.width,
-			height=excluded.height,
-			orientation=excluded.orientation,
-			media_type=excluded.media_type,
-			file_size=excluded.file_size,
-			duration=excluded.duration,
-			thumb_path=excluded.thumb_path,
-			indexed_at=excluded.indexed_at
-	`, p.Path, p.Filename, p.TakenAt, p.Width, p.Height, p.Orientation, p.MediaType, p.FileSize, p.Duration, p.ThumbPath, p.IndexedAt)
-	return err
-}
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS index_errors (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		path TEXT NOT NULL UNIQUE,
+		stage TEXT NOT NULL,
+		message TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 1,
+		occurred_at DATETIME NOT NULL
+	);
+	`); err != nil {
+		return err
+	}
 
-// PhotoExists checks if a photo with the given path is already indexed.
-func (db *DB) PhotoExists(path string) (bool, error) {
-	var count int
-	err := db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE path = ?", path).Scan(&count)
-	return count > 0, err
-}
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS meta (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+	`); err != nil {
+		return err
+	}
 
-// GetTimeline returns photos grouped by month, ordered by taken_at descending.
-func (db *DB) GetTimeline(offset, limit int) (*models.TimelineResponse, error) {
-	// Get total count
-	var totalCount int
-	if err := db.conn.QueryRow("SELECT COUNT(*) FROM photos").Scan(&totalCount); err != nil {
-		return nil, err
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS comments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		photo_id INTEGER NOT NULL,
+		author TEXT NOT NULL,
+		body TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_comments_photo ON comments(photo_id, created_at);
+
+	CREATE TRIGGER IF NOT EXISTS photos_delete_comments AFTER DELETE ON photos
+	BEGIN
+		DELETE FROM comments WHERE photo_id = OLD.id;
+	END;
+	`); err != nil {
+		return err
 	}
 
-	rows, err := db.conn.Query(`
-		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at
-		FROM photos
-		ORDER BY taken_at DESC
-		LIMIT ? OFFSET ?
-	`, limit, offset)
-	if err != nil {
-		return nil, err
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS tags (
+		photo_id INTEGER NOT NULL,
+		tag TEXT NOT NULL,
+		source TEXT NOT NULL, -- "rule" for path rules, "sidecar" for XMP keywords, "manual" for edits
+		UNIQUE(photo_id, tag, source)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_tags_tag ON tags(tag);
+
+	CREATE TRIGGER IF NOT EXISTS photos_delete_tags AFTER DELETE ON photos
+	BEGIN
+		DELETE FROM tags WHERE photo_id = OLD.id;
+	END;
+	`); err != nil {
+		return err
 	}
-	defer rows.Close()
 
-	groupMap := make(map[string]*models.TimelineGroup)
-	var groupOrder []string
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS events (
+		id INTEGER PRIMARY KEY,
+		title TEXT NOT NULL,
+		start_at DATETIME NOT NULL,
+		end_at DATETIME NOT NULL,
+		photo_count INTEGER NOT NULL,
+		cover_id INTEGER NOT NULL
+	);
 
-	for rows.Next() {
-		p := &models.Photo{}
-		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt); err != nil {
-			log.Printf("scan error: %v", err)
-			continue
-		}
+	CREATE INDEX IF NOT EXISTS idx_events_start ON events(start_at DESC);
+	`); err != nil {
+		return err
+	}
 
-		key := p.TakenAt.Format("2006-01")
-		label := p.TakenAt.Format("January 2006")
+	// User-curated albums. cover_id 0 means the album's first photo.
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS albums (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		title TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		cover_id INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
 
-		if _, ok := groupMap[key]; !ok {
-			groupMap[key] = &models.TimelineGroup{
-				Date:   key,
-				Label:  label,
-				Photos: make([]*models.Photo, 0),
-			}
-			groupOrder = append(groupOrder, key)
-		}
-		groupMap[key].Photos = append(groupMap[key].Photos, p)
-		groupMap[key].Count++
+	CREATE TABLE IF NOT EXISTS album_photos (
+		album_id INTEGER NOT NULL,
+		photo_id INTEGER NOT NULL,
+		added_at DATETIME NOT NULL,
+		PRIMARY KEY (album_id, photo_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_album_photos_photo ON album_photos(photo_id);
+
+	CREATE TRIGGER IF NOT EXISTS albums_delete_photos AFTER DELETE ON albums
+	BEGIN
+		DELETE FROM album_photos WHERE album_id = OLD.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS photos_delete_album_photos AFTER DELETE ON photos
+	BEGIN
+		DELETE FROM album_photos WHERE photo_id = OLD.id;
+		UPDATE albums SET cover_id = 0 WHERE cover_id = OLD.id;
+	END;
+	`); err != nil {
+		return err
 	}
 
-	groups := make([]*models.TimelineGroup, 0, len(groupOrder))
-	for _, key := range groupOrder {
-		groups = append(groups, groupMap[key])
+	// Login accounts and their sessions. Only hashes are stored: bcrypt for
+	// passwords, SHA-256 for session tokens. expires_at is a Unix time.
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		is_admin INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+
+	CREATE TRIGGER IF NOT EXISTS users_delete_sessions AFTER DELETE ON users
+	BEGIN
+		DELETE FROM sessions WHERE user_id = OLD.id;
+	END;
+	`); err != nil {
+		return err
 	}
 
-	return &models.TimelineResponse{
-		Groups:     groups,
-		TotalCount: totalCount,
-		HasMore:    offset+limit < totalCount,
-	}, nil
-}
+	// Background job queue (see internal/jobs)
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		type TEXT NOT NULL,
+		class TEXT NOT NULL,
+		state TEXT NOT NULL,
+		payload TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL DEFAULT 1,
+		total INTEGER NOT NULL DEFAULT 0,
+		done INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL,
+		run_after DATETIME NOT NULL,
+		started_at DATETIME,
+		finished_at DATETIME
+	);
 
-// GetPhoto returns a single photo by ID.
-func (db *DB) GetPhoto(id int64) (*models.Photo, error) {
-	p := &models.Photo{}
-	err := db.conn.QueryRow(`
-		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at
-		FROM photos WHERE id = ?
-	`, id).Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt)
-	if err != nil {
-		return nil, err
+	CREATE INDEX IF NOT EXISTS idx_jobs_state ON jobs(state, run_after);
+	`); err != nil {
+		return err
 	}
-	return p, nil
-}
 
-// GetStats returns library statistics.
-func (db *DB) GetStats() (*models.StatsResponse, error) {
-	stats := &models.StatsResponse{}
+	// Thumbnail generation timings, for finding slow source files
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS thumb_timings (
+		path TEXT NOT NULL,
+		size TEXT NOT NULL,
+		duration_ms INTEGER NOT NULL,
+		generated_at DATETIME NOT NULL,
+		PRIMARY KEY (path, size)
+	);
 
-	db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE media_type = 'image'").Scan(&stats.TotalPhotos)
-	db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE media_type = 'video'").Scan(&stats.TotalVideos)
-	db.conn.QueryRow("SELECT COALESCE(SUM(file_size), 0) FROM photos").Scan(&stats.TotalSize)
-	db.conn.QueryRow("SELECT COALESCE(MIN(taken_at), '') FROM photos").Scan(&stats.OldestDate)
-	db.conn.QueryRow("SELECT COALESCE(MAX(taken_at), '') FROM photos").Scan(&stats.NewestDate)
+	CREATE INDEX IF NOT EXISTS idx_thumb_timings_duration ON thumb_timings(duration_ms DESC);
 
-	return stats, nil
-}
+	CREATE TRIGGER IF NOT EXISTS photos_delete_thumb_timings AFTER DELETE ON photos
+	BEGIN
+		DELETE FROM thumb_timings WHERE path = OLD.path;
+	END;
+	`); err != nil {
+		return err
+	}
 
-// RemoveMissing deletes photos from the database whose files no longer exist.
-func (db *DB) RemoveMissing() (int64, error) {
-	rows, err := db.conn.Query("SELECT id, path FROM photos")
-	if err != nil {
-		return 0, err
+	// Per-photo view counts (see views.enabled)
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS photo_views (
+		photo_id INTEGER PRIMARY KEY,
+		views INTEGER NOT NULL,
+		last_viewed_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_photo_views_views ON photo_views(views DESC);
+
+	CREATE TRIGGER IF NOT EXISTS photos_delete_views AFTER DELETE ON photos
+	BEGIN
+		DELETE FROM photo_views WHERE photo_id = OLD.id;
+	END;
+	`); err != nil {
+		return err
 	}
-	defer rows.Close()
 
-	var toDelete []int64
-	for rows.Next() {
-		var id int64
-		var path string
-		if err := rows.Scan(&id, &path); err != nil {
-			continue
+	// Deleted files held in the trash (see internal/trash). albums lists
+	// the albums the photo was in, comma-separated.
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS trash (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		photo_id INTEGER NOT NULL,
+		path TEXT NOT NULL,
+		dir TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		media_type TEXT NOT NULL,
+		taken_at DATETIME NOT NULL,
+		file_size INTEGER NOT NULL DEFAULT 0,
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		owner_id INTEGER NOT NULL DEFAULT 0,
+		albums TEXT NOT NULL DEFAULT '',
+		deleted_at DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_trash_deleted ON trash(deleted_at);
+	`); err != nil {
+		return err
+	}
+
+	// Columns added after the initial schema
+	if err := db.addColumn("photos", "content_hash", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := db.addColumn("photos", "pregen_state", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := db.exec(`CREATE INDEX IF NOT EXISTS idx_photos_pregen ON photos(pregen_state, taken_at, id)`); err != nil {
+		return err
+	}
+	if _, err := db.exec(`CREATE INDEX IF NOT EXISTS idx_photos_file_size ON photos(file_size)`); err != nil {
+		return err
+	}
+	if _, err := db.exec(`CREATE INDEX IF NOT EXISTS idx_photos_content_hash ON photos(content_hash)`); err != nil {
+		return err
+	}
+	if err := db.addColumn("photos", "date_source", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := db.addColumn("photos", "has_gps", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	for _, col := range []string{"container", "video_codec", "audio_codec"} {
+		if err := db.addColumn("photos", col, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
 		}
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			toDelete = append(toDelete, id)
+	}
+	if err := db.addColumn("photos", "rotation", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := db.addColumn("photos", "sidecar_stamp", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// GPS position in decimal degrees, NULL when unknown
+	for _, col := range []string{"latitude", "longitude"} {
+		if err := db.addColumn("photos", col, "REAL"); err != nil {
+			return err
+		}
+	}
+	if _, err := db.exec(`CREATE INDEX IF NOT EXISTS idx_photos_location ON photos(latitude, longitude)`); err != nil {
+		return err
+	}
+	// Reverse-geocoded "City, Country", empty when unknown
+	if err := db.addColumn("photos", "place", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := db.exec(`CREATE INDEX IF NOT EXISTS idx_photos_place ON photos(place)`); err != nil {
+		return err
+	}
+	// HDR kind (see package hdr), empty for SDR photos
+	if err := db.addColumn("photos", "hdr", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Star rating (0-5, 0 unrated) and caption, set through the API
+	if err := db.addColumn("photos", "rating", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := db.addColumn("photos", "description", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Perceptual hash of images (see thumbnail.PHash), NULL until computed
+	if err := db.addColumn("photos", "phash", "INTEGER"); err != nil {
+		return err
+	}
+	// EXIF make and model, empty when unknown
+	if err := db.addColumn("photos", "camera", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := db.exec(`CREATE INDEX IF NOT EXISTS idx_photos_camera ON photos(camera)`); err != nil {
+		return err
+	}
+	// EXIF lens model, empty when unknown
+	if err := db.addColumn("photos", "lens", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// Image kinds, comma-separated (see ImageKinds)
+	if err := db.addColumn("photos", "kinds", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	// User whose configured paths hold the file; 0 for shared photos
+	if err := db.addColumn("photos", "owner_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := db.exec(`CREATE INDEX IF NOT EXISTS idx_photos_owner ON photos(owner_id, taken_at)`); err != nil {
+		return err
+	}
+	// Folder holding the file, for browsing by folder. Rows from before it
+	// are filled in from the path, which always ends in "/" + filename.
+	if err := db.addColumn("photos", "dir", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := db.exec(`UPDATE photos SET dir = substr(path, 1, length(path) - length(filename) - 1) WHERE dir = ''`); err != nil {
+		return err
+	}
+	if _, err := db.exec(`CREATE INDEX IF NOT EXISTS idx_photos_dir ON photos(dir, taken_at)`); err != nil {
+		return err
+	}
+	// GPS altitude (meters), image direction (degrees) and speed (km/h),
+	// NULL when the EXIF doesn't record them
+	for _, col := range []string{"gps_altitude", "gps_direction", "gps_speed"} {
+		if err := db.addColumn("photos", col, "REAL"); err != nil {
+			return err
 		}
 	}
+	// Historical weather where and when the photo was taken (see
+	// WeatherPending): conditions such as "snow" and temperature in °C
+	if err := db.addColumn("photos", "weather", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := db.addColumn("photos", "temperature", "REAL"); err != nil {
+		return err
+	}
+	if err := db.addColumn("photos", "weather_state", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	// Weather is looked up again when the position or time is corrected,
+	// and provider answers are kept per grid cell and day, so photos taken
+	// near each other on the same day cost one request
+	if _, err := db.exec(`
+	CREATE TRIGGER IF NOT EXISTS photos_weather_reset AFTER UPDATE OF latitude, longitude, taken_at ON photos
+	WHEN OLD.latitude IS NOT NEW.latitude OR OLD.longitude IS NOT NEW.longitude OR OLD.taken_at IS NOT NEW.taken_at
+	BEGIN
+		UPDATE photos SET weather = '', temperature = NULL, weather_state = 0 WHERE id = NEW.id;
+	END;
 
-	if len(toDelete) == 0 {
-		return 0, nil
+	CREATE TABLE IF NOT EXISTS weather_cache (
+		provider TEXT NOT NULL,
+		cell TEXT NOT NULL,
+		day TEXT NOT NULL,
+		data TEXT NOT NULL,
+		fetched_at DATETIME NOT NULL,
+		PRIMARY KEY (provider, cell, day)
+	);
+	`); err != nil {
+		return err
 	}
 
-	tx, err := db.conn.Begin()
-	if err != nil {
-		return 0, err
+	// File modification time when indexed, 0 for rows indexed before it
+	// was recorded (see GetIndexedFiles)
+	if err := db.addColumn("photos", "file_mtime", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
 	}
-	defer tx.Rollback()
 
-	stmt, err := tx.Prepare("DELETE FROM photos WHERE id = ?")
-	if err != nil {
-		return 0, err
+	// RAW files and the JPEGs shot with them are paired by path without
+	// the extension (see stemExpr)
+	if _, err := db.exec(`CREATE INDEX IF NOT EXISTS idx_photos_stem ON photos(` + fmt.Sprintf(stemExpr, "") + `)`); err != nil {
+		return err
 	}
-	defer stmt.Close()
 
-	var count int64
-	for _, id := range toDelete {
-		if _, err := stmt.Exec(id); err == nil {
-			count++
-		}
+	// Per-account preferences set from the frontend (see models.Settings),
+	// as JSON. user_id is 0 with auth disabled.
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS user_settings (
+		user_id INTEGER PRIMARY KEY,
+		data TEXT NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+
+	CREATE TRIGGER IF NOT EXISTS users_delete_settings AFTER DELETE ON users
+	BEGIN
+		DELETE FROM user_settings WHERE user_id = OLD.id;
+	END;
+	`); err != nil {
+		return err
 	}
 
-	return count, tx.Commit()
-}
+	// Album photo order: sort is "taken_asc", "taken_desc" or "manual",
+	// which follows album_photos.position. Photos already in albums are
+	// numbered in the order they were taken.
+	if err := db.addColumn("albums", "sort", "TEXT NOT NULL DEFAULT 'taken_asc'"); err != nil {
+		return err
+	}
+	if err := db.addColumn("album_photos", "position", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := db.runOnce("album_positions", `
+		UPDATE album_photos SET position = (
+			SELECT COUNT(*) FROM album_photos o
+			JOIN photos op ON op.id = o.photo_id
+			JOIN photos me ON me.id = album_photos.photo_id
+			WHERE o.album_id = album_photos.album_id
+				AND (op.taken_at < me.taken_at OR (op.taken_at = me.taken_at AND op.id < me.id))
+		)
+	`); err != nil {
+		return err
+	}
 
-// SearchByDateRange returns photos within a date range.
-func (db *DB) SearchByDateRange(start, end time.Time, offset, limit int) ([]*models.Photo, int, error) {
-	var total int
-	db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE taken_at BETWEEN ? AND ?", start, end).Scan(&total)
+	// Per-account marks on photos: favorites, and archived photos, which
+	// the account's timeline leaves out. user_id is 0 with auth disabled.
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS photo_marks (
+		user_id INTEGER NOT NULL,
+		photo_id INTEGER NOT NULL,
+		favorite INTEGER NOT NULL DEFAULT 0,
+		archived INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, photo_id)
+	);
 
-	rows, err := db.conn.Query(`
-		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at
-		FROM photos WHERE taken_at BETWEEN ? AND ?
-		ORDER BY taken_at DESC
-		LIMIT ? OFFSET ?
-	`, start, end, limit, offset)
-	if err != nil {
-		return nil, 0, err
+	CREATE INDEX IF NOT EXISTS idx_photo_marks_photo ON photo_marks(photo_id);
+
+	CREATE TRIGGER IF NOT EXISTS photos_delete_marks AFTER DELETE ON photos
+	BEGIN
+		DELETE FROM photo_marks WHERE photo_id = OLD.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS users_delete_marks AFTER DELETE ON users
+	BEGIN
+		DELETE FROM photo_marks WHERE user_id = OLD.id;
+	END;
+	`); err != nil {
+		return err
+	}
+	// Favorites used to be photos rated FavoriteRating or more, which only
+	// admins can set; they keep them as their own favorites
+	if err := db.runOnce("favorites_from_rating", fmt.Sprintf(`
+		INSERT OR IGNORE INTO photo_marks (user_id, photo_id, favorite)
+		SELECT u.id, p.id, 1
+		FROM photos p, (SELECT 0 AS id UNION SELECT id FROM users WHERE is_admin = 1) u
+		WHERE p.rating >= %d
+	`, FavoriteRating)); err != nil {
+		return err
 	}
-	defer rows.Close()
 
-	var photos []*models.Photo
-	for rows.Next() {
-		p := &models.Photo{}
-		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt); err != nil {
-			continue
-		}
-		photos = append(photos, p)
+	// Accounts an album is shared with. role is "view", or "contribute" to
+	// also add photos. album_photos.added_by is the account that added a
+	// photo, 0 for admins and photos added before albums were shared.
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS album_members (
+		album_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		role TEXT NOT NULL,
+		added_at DATETIME NOT NULL,
+		PRIMARY KEY (album_id, user_id)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_album_members_user ON album_members(user_id);
+
+	CREATE TRIGGER IF NOT EXISTS albums_delete_members AFTER DELETE ON albums
+	BEGIN
+		DELETE FROM album_members WHERE album_id = OLD.id;
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS users_delete_album_members AFTER DELETE ON users
+	BEGIN
+		DELETE FROM album_members WHERE user_id = OLD.id;
+	END;
+	`); err != nil {
+		return err
+	}
+	if err := db.addColumn("album_photos", "added_by", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
 	}
 
-	return photos, total, nil
-}
+	// Folder an album is made from (see internal/folderalbums), '' for
+	// albums curated by hand
+	if err := db.addColumn("albums", "folder", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := db.exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_albums_folder ON albums(folder) WHERE folder != ''`); err != nil {
+		return err
+	}
 
-// GetMonthBuckets returns per-month counts ordered by date descending, with cumulative offsets.
-// This is a lightweight query used by the scrubber to know the full date range and jump to any month.
-func (db *DB) GetMonthBuckets() ([]*models.MonthBucket, error) {
-	rows, err := db.conn.Query(`
-		SELECT strftime('%Y-%m', taken_at) AS month, COUNT(*) AS cnt
-		FROM photos
-		GROUP BY month
-		ORDER BY month DESC
+	// Change log for incremental client sync, maintained by triggers so
+	// every write path is covered. Updates are only logged when a field
+	// clients display actually changes.
+	if _, err := db.exec(`
+	CREATE TABLE IF NOT EXISTS changes (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		photo_id INTEGER NOT NULL,
+		op TEXT NOT NULL,
+		changed_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TRIGGER IF NOT EXISTS photos_log_insert AFTER INSERT ON photos
+	BEGIN
+		INSERT INTO changes (photo_id, op) VALUES (NEW.id, 'add');
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS photos_log_update AFTER UPDATE ON photos
+	WHEN OLD.path IS NOT NEW.path OR OLD.taken_at IS NOT NEW.taken_at
+		OR OLD.width IS NOT NEW.width OR OLD.height IS NOT NEW.height
+		OR OLD.orientation IS NOT NEW.orientation OR OLD.media_type IS NOT NEW.media_type
+		OR OLD.file_size IS NOT NEW.file_size OR OLD.duration IS NOT NEW.duration
+	BEGIN
+		INSERT INTO changes (photo_id, op) VALUES (NEW.id, 'update');
+	END;
+
+	CREATE TRIGGER IF NOT EXISTS photos_log_delete AFTER DELETE ON photos
+	BEGIN
+		INSERT INTO changes (photo_id, op) VALUES (OLD.id, 'remove');
+	END;
+	`); err != nil {
+		return err
+	}
+
+	// Photos indexed before the change log existed are logged as added so a
+	// client syncing from zero sees the whole library.
+	if err := db.runOnce("changes_seed", `
+		INSERT INTO changes (photo_id, op) SELECT id, 'add' FROM photos ORDER BY id
+	`); err != nil {
+		return err
+	}
+
+	// Rows indexed before dimensions were normalized still store raw pixel
+	// dimensions for rotated orientations; swap them once.
+	return db.runOnce("display_dimensions", `
+		UPDATE photos SET width = height, height = width
+		WHERE orientation BETWEEN 5 AND 8
 	`)
+}
+
+// runOnce executes a one-off data migration, recording it in the meta table
+// so it never runs twice.
+func (db *DB) runOnce(name, query string) error {
+	key := "migration:" + name
+	var done int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM meta WHERE key = ?", key).Scan(&done); err != nil {
+		return err
+	}
+	if done > 0 {
+		return nil
+	}
+
+	tx, err := db.begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	var buckets []*models.MonthBucket
-	cumulative := 0
-	for rows.Next() {
-		var month string
-		var count int
-		if err := rows.Scan(&month, &count); err != nil {
-			continue
-		}
-		// Parse the month string to generate a label
-		t, _ := time.Parse("2006-01", month)
-		label := t.Format("January 2006")
+	if _, err := tx.Exec(query); err != nil {
+		return fmt.Errorf("migration %s: %w", name, err)
+	}
+	if _, err := tx.Exec("INSERT INTO meta (key, value) VALUES (?, ?)", key, time.Now().Format(time.RFC3339)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-		buckets = append(buckets, &models.MonthBucket{
-			Month:            month,
-			Label:            label,
-			Count:            count,
-			CumulativeOffset: cumulative,
-		})
-		cumulative += count
+// GetMeta returns a value from the meta table, or "" if it isn't set.
+func (db *DB) GetMeta(key string) (string, error) {
+	var value string
+	err := db.conn.QueryRow("SELECT value FROM meta WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
 	}
-	return buckets, nil
+	return value, err
+}
+
+// SetMeta stores a value in the meta table.
+func (db *DB) SetMeta(key, value string) error {
+	_, err := db.exec(`
+		INSERT INTO meta (key, value) VALUES (?, ?)
+		ON CONFLICT(key) DO UPDATE SET value = excluded.value
+	`, key, value)
+	return err
 }
 
-// GetAllPaths returns all photo/video paths and media types for thumbnail pre-generation.
-func (db *DB) GetAllPaths() ([]struct{ Path, MediaType string }, error) {
-	rows, err := db.conn.Query("SELECT path, media_type FROM photos ORDER BY taken_at DESC")
+// addColumn adds a column to an existing table if it isn't there yet.
+func (db *DB) addColumn(table, column, def string) error {
+	rows, err := db.conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var items []struct{ Path, MediaType string }
 	for rows.Next() {
-		var item struct{ Path, MediaType string }
-		if err := rows.Scan(&item.Path, &item.MediaType); err != nil {
-			continue
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
 		}
-		items = append(items, item)
 	}
-	return items, nil
+	rows.Close()
+
+	_, err = db.exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, def))
+	return err
 }
 
-// GetMemories returns random photos from the past at 5-year intervals
-// (e.g. 5, 10, 15, 20 years ago). Each interval contributes at most one photo.
-// Returns up to maxCount photos, ordered oldest first.
-func (db *DB) GetMemories(maxCount int) ([]*models.Photo, error) {
-	if maxCount <= 0 {
-		maxCount = 5
+// upsertPhotoSQL inserts a photo or updates the one at its path; its
+// arguments come from upsertPhotoArgs.
+const upsertPhotoSQL = `
+	INSERT INTO photos (path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, date_source, has_gps, container, video_codec, audio_codec, rotation, sidecar_stamp, latitude, longitude, place, hdr, camera, lens, kinds, owner_id, dir, gps_altitude, gps_direction, gps_speed, file_mtime)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(path) DO UPDATE SET
+		filename=excluded.filename,
+		content_hash=CASE WHEN photos.file_size = excluded.file_size AND photos.file_mtime IN (0, excluded.file_mtime) THEN photos.content_hash ELSE '' END,
+		phash=CASE WHEN photos.file_size = excluded.file_size AND photos.file_mtime IN (0, excluded.file_mtime) THEN photos.phash ELSE NULL END,
+		pregen_state=CASE WHEN photos.file_size = excluded.file_size AND photos.file_mtime IN (0, excluded.file_mtime) THEN photos.pregen_state ELSE 0 END,
+		taken_at=excluded.taken_at,
+		width=excluded.width,
+		height=excluded.height,
+		orientation=excluded.orientation,
+		media_type=excluded.media_type,
+		file_size=excluded.file_size,
+		duration=excluded.duration,
+		thumb_path=excluded.thumb_path,
+		indexed_at=excluded.indexed_at,
+		date_source=excluded.date_source,
+		has_gps=excluded.has_gps,
+		container=excluded.container,
+		video_codec=excluded.video_codec,
+		audio_codec=excluded.audio_codec,
+		rotation=excluded.rotation,
+		sidecar_stamp=excluded.sidecar_stamp,
+		latitude=excluded.latitude,
+		longitude=excluded.longitude,
+		place=excluded.place,
+		hdr=excluded.hdr,
+		camera=excluded.camera,
+		lens=excluded.lens,
+		kinds=excluded.kinds,
+		owner_id=excluded.owner_id,
+		dir=excluded.dir,
+		gps_altitude=excluded.gps_altitude,
+		gps_direction=excluded.gps_direction,
+		gps_speed=excluded.gps_speed,
+		file_mtime=excluded.file_mtime
+`
+
+// upsertPhotoArgs returns the arguments of upsertPhotoSQL for p.
+func upsertPhotoArgs(p *models.Photo) []interface{} {
+	altitude, direction, speed := gpsColumns(p.GPS)
+	return []interface{}{p.Path, p.Filename, p.TakenAt, p.Width, p.Height, p.Orientation, p.MediaType, p.FileSize, p.Duration, p.ThumbPath, p.IndexedAt, p.DateSource, p.HasGPS, p.Container, p.VideoCodec, p.AudioCodec, p.Rotation, p.SidecarStamp, nullCoord(p, p.Latitude), nullCoord(p, p.Longitude), p.Place, p.HDR, p.Camera, p.Lens, p.Kinds, p.OwnerID, filepath.Dir(p.Path), altitude, direction, speed, p.FileMtime}
+}
+
+// UpsertPhoto inserts or updates a photo record.
+func (db *DB) UpsertPhoto(p *models.Photo) error {
+	_, err := db.exec(upsertPhotoSQL, upsertPhotoArgs(p)...)
+	return err
+}
+
+// UpsertPhotos inserts or updates photo records in one transaction, which
+// is far faster than one at a time for the many files of a scan. If any
+// fails, none are written.
+func (db *DB) UpsertPhotos(photos []*models.Photo) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(upsertPhotoSQL)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, p := range photos {
+		if _, err := stmt.Exec(upsertPhotoArgs(p)...); err != nil {
+			return fmt.Errorf("%s: %w", p.Path, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// gpsColumns returns the GPS details of a photo for storage, in the order
+// gps_altitude, gps_direction, gps_speed; nil for those it doesn't have.
+func gpsColumns(g *models.GPSDetails) (interface{}, interface{}, interface{}) {
+	if g == nil {
+		return nil, nil, nil
+	}
+	value := func(v *float64) interface{} {
+		if v == nil {
+			return nil
+		}
+		return *v
+	}
+	return value(g.Altitude), value(g.Direction), value(g.Speed)
+}
+
+// scanGPS turns the GPS detail columns back into a photo's GPSDetails, nil
+// when none are set.
+func scanGPS(altitude, direction, speed sql.NullFloat64) *models.GPSDetails {
+	if !altitude.Valid && !direction.Valid && !speed.Valid {
+		return nil
+	}
+	value := func(v sql.NullFloat64) *float64 {
+		if !v.Valid {
+			return nil
+		}
+		return &v.Float64
+	}
+	return &models.GPSDetails{Altitude: value(altitude), Direction: value(direction), Speed: value(speed)}
+}
+
+// nullCoord returns a coordinate of p for storage, or nil if p has no known
+// position. 0,0 is what broken GPS units write, so it counts as unknown.
+func nullCoord(p *models.Photo, v float64) interface{} {
+	if !p.HasGPS || (p.Latitude == 0 && p.Longitude == 0) {
+		return nil
+	}
+	return v
+}
+
+// UpdateSidecarMetadata rewrites the fields a sidecar can override for an
+// already indexed photo, leaving indexed_at and thumbnail state alone.
+func (db *DB) UpdateSidecarMetadata(p *models.Photo) error {
+	_, err := db.exec(`
+		UPDATE photos SET taken_at = ?, width = ?, height = ?, orientation = ?, date_source = ?, has_gps = ?, sidecar_stamp = ?, latitude = ?, longitude = ?, place = ?
+		WHERE path = ?
+	`, p.TakenAt, p.Width, p.Height, p.Orientation, p.DateSource, p.HasGPS, p.SidecarStamp, nullCoord(p, p.Latitude), nullCoord(p, p.Longitude), p.Place, p.Path)
+	return err
+}
+
+// GetSidecarStamps returns the stored sidecar stamp of every photo that had
+// sidecars when it was last indexed, keyed by path.
+func (db *DB) GetSidecarStamps() (map[string]int64, error) {
+	rows, err := db.conn.Query("SELECT path, sidecar_stamp FROM photos WHERE sidecar_stamp != 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stamps := make(map[string]int64)
+	for rows.Next() {
+		var path string
+		var stamp int64
+		if err := rows.Scan(&path, &stamp); err != nil {
+			continue
+		}
+		stamps[path] = stamp
+	}
+	return stamps, rows.Err()
+}
+
+// FileStamp is the size and modification time (Unix seconds) of a file
+// when it was indexed. Mtime is 0 for files indexed before it was recorded.
+type FileStamp struct {
+	Size  int64
+	Mtime int64
+}
+
+// GetIndexedFiles returns the stamps of every indexed file by path, so
+// scans can skip unchanged files without a query per file.
+func (db *DB) GetIndexedFiles() (map[string]FileStamp, error) {
+	rows, err := db.conn.Query("SELECT path, file_size, file_mtime FROM photos")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make(map[string]FileStamp)
+	for rows.Next() {
+		var path string
+		var st FileStamp
+		if err := rows.Scan(&path, &st.Size, &st.Mtime); err != nil {
+			return nil, err
+		}
+		files[path] = st
+	}
+	return files, rows.Err()
+}
+
+// GetPhotoPaths returns the path of every indexed file.
+func (db *DB) GetPhotoPaths() ([]string, error) {
+	rows, err := db.conn.Query("SELECT path FROM photos")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, rows.Err()
+}
+
+// SetFileMtimes records the modification times of indexed files, by path,
+// in one transaction.
+func (db *DB) SetFileMtimes(mtimes map[string]int64) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE photos SET file_mtime = ? WHERE path = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for path, mtime := range mtimes {
+		if _, err := stmt.Exec(mtime, path); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPhotosAfter returns up to limit of the photos visible to owner (see
+// ownerClause) with IDs above afterID, in ID order. Paging by ID keeps each
+// query short, so streaming the whole library to a slow reader doesn't hold
+// a read open the whole time, and lets an interrupted reader resume.
+func (db *DB) GetPhotosAfter(owner, afterID int64, limit int) ([]*models.Photo, error) {
+	visible, args := ownerClause(owner)
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, indexed_at, place, hdr, content_hash, kinds, camera, lens, rating, description
+		FROM photos
+		WHERE id > ? AND `+visible+`
+		ORDER BY id
+		LIMIT ?
+	`, append(append([]interface{}{afterID}, args...), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var photos []*models.Photo
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.IndexedAt, &p.Place, &p.HDR, &p.ContentHash, &p.Kinds, &p.Camera, &p.Lens, &p.Rating, &p.Description); err != nil {
+			return nil, err
+		}
+		db.markAvailability(p)
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
+}
+
+// GetFileStamp returns the stamp of an indexed file, or sql.ErrNoRows if
+// the path isn't indexed.
+func (db *DB) GetFileStamp(path string) (FileStamp, error) {
+	var st FileStamp
+	err := db.conn.QueryRow("SELECT file_size, file_mtime FROM photos WHERE path = ?", path).Scan(&st.Size, &st.Mtime)
+	return st, err
+}
+
+// PhotoExists checks if a photo with the given path is already indexed.
+func (db *DB) PhotoExists(path string) (bool, error) {
+	var count int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE path = ?", path).Scan(&count)
+	return count > 0, err
+}
+
+// GetTimeline returns the photos visible to owner (see ownerClause),
+// grouped by month in loc and ordered by taken_at descending.
+func (db *DB) GetTimeline(offset, limit int, loc *time.Location, f TimelineFilter) (*models.TimelineResponse, error) {
+	visible, args := f.where()
+
+	// Get total count
+	var totalCount int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE "+visible, args...).Scan(&totalCount); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr, content_hash, kinds
+		FROM photos
+		WHERE `+visible+`
+		ORDER BY taken_at DESC
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groupMap := make(map[string]*models.TimelineGroup)
+	var groupOrder []string
+
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR, &p.ContentHash, &p.Kinds); err != nil {
+			log.Printf("scan error: %v", err)
+			continue
+		}
+		db.markAvailability(p)
+
+		taken := p.TakenAt.In(loc)
+		key := taken.Format("2006-01")
+		label := taken.Format("January 2006")
+
+		if _, ok := groupMap[key]; !ok {
+			groupMap[key] = &models.TimelineGroup{
+				Date:   key,
+				Label:  label,
+				Photos: make([]*models.Photo, 0),
+			}
+			groupOrder = append(groupOrder, key)
+		}
+		groupMap[key].Photos = append(groupMap[key].Photos, p)
+		groupMap[key].Count++
+	}
+
+	groups := make([]*models.TimelineGroup, 0, len(groupOrder))
+	for _, key := range groupOrder {
+		groups = append(groups, groupMap[key])
+	}
+
+	return &models.TimelineResponse{
+		Groups:     groups,
+		TotalCount: totalCount,
+		HasMore:    offset+limit < totalCount,
+	}, nil
+}
+
+// GetPhoto returns a single photo by ID.
+func (db *DB) GetPhoto(id int64) (*models.Photo, error) {
+	p := &models.Photo{}
+	var altitude, direction, speed, temperature sql.NullFloat64
+	var conditions string
+	err := db.conn.QueryRow(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr, owner_id, rating, description, container, video_codec, audio_codec, rotation, content_hash, camera, lens, kinds, gps_altitude, gps_direction, gps_speed, weather, temperature
+		FROM photos WHERE id = ?
+	`, id).Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR, &p.OwnerID, &p.Rating, &p.Description, &p.Container, &p.VideoCodec, &p.AudioCodec, &p.Rotation, &p.ContentHash, &p.Camera, &p.Lens, &p.Kinds, &altitude, &direction, &speed, &conditions, &temperature)
+	if err != nil {
+		return nil, err
+	}
+	p.GPS = scanGPS(altitude, direction, speed)
+	if conditions != "" {
+		p.Weather = &models.Weather{Conditions: conditions}
+		if temperature.Valid {
+			p.Weather.Temperature = &temperature.Float64
+		}
+	}
+	if p.MediaType == "raw" || p.MediaType == "image" {
+		other := "raw"
+		if p.MediaType == "raw" {
+			other = "image"
+		}
+		err := db.conn.QueryRow(`
+			SELECT c.id FROM photos p JOIN photos c ON `+fmt.Sprintf(stemExpr, "c.")+` = `+fmt.Sprintf(stemExpr, "p.")+`
+			WHERE p.id = ? AND c.media_type = ?
+			ORDER BY c.id LIMIT 1
+		`, id, other).Scan(&p.CompanionID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+	db.markAvailability(p)
+	return p, nil
+}
+
+// GetPhotoByPath returns a single photo by its file path.
+func (db *DB) GetPhotoByPath(path string) (*models.Photo, error) {
+	p := &models.Photo{}
+	err := db.conn.QueryRow(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr, content_hash
+		FROM photos WHERE path = ?
+	`, path).Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR, &p.ContentHash)
+	if err != nil {
+		return nil, err
+	}
+	db.markAvailability(p)
+	return p, nil
+}
+
+// GetLatestPhoto returns the most recently indexed photo or video.
+func (db *DB) GetLatestPhoto() (*models.Photo, error) {
+	p := &models.Photo{}
+	err := db.conn.QueryRow(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr
+		FROM photos ORDER BY indexed_at DESC, id DESC LIMIT 1
+	`).Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR)
+	if err != nil {
+		return nil, err
+	}
+	db.markAvailability(p)
+	return p, nil
+}
+
+// GetStats returns library statistics.
+func (db *DB) GetStats() (*models.StatsResponse, error) {
+	stats := &models.StatsResponse{}
+
+	db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE media_type IN ('image', 'raw')").Scan(&stats.TotalPhotos)
+	db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE media_type = 'video'").Scan(&stats.TotalVideos)
+	db.conn.QueryRow("SELECT COALESCE(SUM(file_size), 0) FROM photos").Scan(&stats.TotalSize)
+	db.conn.QueryRow("SELECT COALESCE(MIN(taken_at), '') FROM photos").Scan(&stats.OldestDate)
+	db.conn.QueryRow("SELECT COALESCE(MAX(taken_at), '') FROM photos").Scan(&stats.NewestDate)
+
+	roots, err := db.GetRootStatus()
+	if err != nil {
+		return nil, err
+	}
+	stats.Roots = roots
+
+	counts, err := db.kindCounts("1 = 1", nil)
+	if err != nil {
+		return nil, err
+	}
+	stats.Kinds = make(map[string]int, len(ImageKinds))
+	for i, kind := range ImageKinds {
+		stats.Kinds[kind] = counts[i]
+	}
+
+	return stats, nil
+}
+
+// kindCounts counts the photos matching where of each of ImageKinds, in
+// that order.
+func (db *DB) kindCounts(where string, args []interface{}) ([]int, error) {
+	sums := make([]string, len(ImageKinds))
+	for i, kind := range ImageKinds {
+		sums[i] = fmt.Sprintf("COALESCE(SUM(instr(',' || kinds || ',', ',%s,') > 0), 0)", kind)
+	}
+	counts := make([]int, len(ImageKinds))
+	dest := make([]interface{}, len(counts))
+	for i := range counts {
+		dest[i] = &counts[i]
+	}
+	err := db.conn.QueryRow(`SELECT `+strings.Join(sums, ", ")+` FROM photos WHERE `+where, args...).Scan(dest...)
+	return counts, err
+}
+
+// SetRoots sets the configured photo roots, all initially online.
+func (db *DB) SetRoots(paths []string) {
+	roots := make([]string, len(paths))
+	for i, p := range paths {
+		roots[i] = filepath.Clean(p)
+	}
+	// Longest first, so a root nested in another one matches first
+	sort.SliceStable(roots, func(i, j int) bool { return len(roots[i]) > len(roots[j]) })
+
+	db.rootsMu.Lock()
+	defer db.rootsMu.Unlock()
+	db.roots = roots
+	db.offline = make(map[string]bool)
+}
+
+// RootOf returns the configured root holding path, or "" if none does.
+func (db *DB) RootOf(path string) string {
+	db.rootsMu.RLock()
+	defer db.rootsMu.RUnlock()
+	for _, root := range db.roots {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return root
+		}
+	}
+	return ""
+}
+
+// SetRootOffline records whether a root's disk is offline and reports
+// whether that changed.
+func (db *DB) SetRootOffline(root string, offline bool) bool {
+	root = filepath.Clean(root)
+	db.rootsMu.Lock()
+	defer db.rootsMu.Unlock()
+	if db.offline[root] == offline {
+		return false
+	}
+	db.offline[root] = offline
+	return true
+}
+
+// RootOffline reports whether a root's disk is offline.
+func (db *DB) RootOffline(root string) bool {
+	db.rootsMu.RLock()
+	defer db.rootsMu.RUnlock()
+	return db.offline[filepath.Clean(root)]
+}
+
+// markAvailability sets the root of a loaded photo and flags it unavailable
+// when that root is offline.
+func (db *DB) markAvailability(p *models.Photo) {
+	p.Root = db.RootOf(p.Path)
+	if p.Root != "" {
+		p.Unavailable = db.RootOffline(p.Root)
+	}
+}
+
+// ownerClause returns the SQL condition for the photos a user may see: their
+// own and those no user owns. Owner 0 sees the whole library.
+func ownerClause(owner int64) (string, []interface{}) {
+	if owner == 0 {
+		return "1 = 1", nil
+	}
+	return "owner_id IN (0, ?)", []interface{}{owner}
+}
+
+// ImageKinds are the kinds of image told apart at index time: RAW files,
+// GIFs, screenshots, scans and panoramas. A photo may be of several.
+var ImageKinds = []string{"raw", "gif", "screenshot", "scan", "panorama"}
+
+// kindClause matches photos of the given image kind.
+func kindClause(kind string) (string, []interface{}) {
+	return "instr(',' || kinds || ',', ?) > 0", []interface{}{"," + kind + ","}
+}
+
+// stemExpr is a photo's path without its extension, lowercased, which is
+// the same for a RAW file and the JPEG the camera saved with it. rtrim
+// strips every character but "." from the end, up to the extension's dot.
+// Its %s is the table alias with a dot, or "" for the photos table; the
+// expression must match idx_photos_stem exactly for it to be used.
+const stemExpr = "lower(rtrim(%[1]spath, replace(%[1]spath, '.', '')))"
+
+// companionClause matches photos with a companion of the other kind: a
+// JPEG (or other image) for RAW files, a RAW file for images.
+func companionClause(mediaType string) string {
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM photos c WHERE %s = %s AND c.media_type = '%s')",
+		fmt.Sprintf(stemExpr, "c."), fmt.Sprintf(stemExpr, "photos."), mediaType)
+}
+
+// FavoriteRating is the star rating from which a photo counted as a
+// favorite, before favorites were kept per account.
+const FavoriteRating = 4
+
+// TimelineFilter narrows the timeline queries. Zero fields match all
+// photos but those User archived.
+type TimelineFilter struct {
+	Owner  int64  // see ownerClause
+	User   int64  // account whose marks apply; 0 with auth disabled
+	Kind   string // one of ImageKinds
+	Camera string // as in the camera column, e.g. "FUJIFILM X100V"
+	// Media type: "image" (which includes RAW), "raw" or "video"
+	Type string
+	// Taken in [From, To)
+	From, To time.Time
+	// Only User's favorites
+	Favorites bool
+	// Only the photos User archived, instead of leaving them out
+	Archived bool
+	// Only files in this folder or below it
+	PathPrefix string
+	// Which file of a RAW+JPEG pair to show: "jpeg", "raw", or either
+	// for "" and "both". Pairs aren't hidden when asking for RAW files.
+	RawPairs string
+}
+
+// where returns the conditions for f.
+func (f TimelineFilter) where() (string, []interface{}) {
+	clause, args := ownerClause(f.Owner)
+	switch f.Type {
+	case "":
+	case "image":
+		clause += " AND media_type IN ('image', 'raw')"
+	default:
+		clause += " AND media_type = ?"
+		args = append(args, f.Type)
+	}
+	if !f.From.IsZero() {
+		clause += " AND taken_at >= ?"
+		args = append(args, f.From.In(time.Local))
+	}
+	if !f.To.IsZero() {
+		clause += " AND taken_at < ?"
+		args = append(args, f.To.In(time.Local))
+	}
+	if f.Favorites {
+		clause += " AND id IN (SELECT photo_id FROM photo_marks WHERE user_id = ? AND favorite = 1)"
+		args = append(args, f.User)
+	}
+	if f.Archived {
+		clause += " AND id IN (SELECT photo_id FROM photo_marks WHERE user_id = ? AND archived = 1)"
+	} else {
+		clause += " AND id NOT IN (SELECT photo_id FROM photo_marks WHERE user_id = ? AND archived = 1)"
+	}
+	args = append(args, f.User)
+	if f.PathPrefix != "" {
+		dir := strings.TrimSuffix(filepath.Clean(f.PathPrefix), string(filepath.Separator))
+		clause += ` AND path LIKE ? ESCAPE '\'`
+		args = append(args, escapeLike(dir+string(filepath.Separator))+"%")
+	}
+	if f.Camera != "" {
+		clause += " AND camera = ?"
+		args = append(args, f.Camera)
+	}
+	if f.Kind != "" {
+		kind, kindArgs := kindClause(f.Kind)
+		clause += " AND " + kind
+		args = append(args, kindArgs...)
+	}
+	if f.Type != "raw" && f.Kind != "raw" {
+		switch f.RawPairs {
+		case "jpeg":
+			clause += " AND NOT (media_type = 'raw' AND " + companionClause("image") + ")"
+		case "raw":
+			clause += " AND NOT (media_type = 'image' AND " + companionClause("raw") + ")"
+		}
+	}
+	return clause, args
+}
+
+// CountUnderRoot returns how many indexed files lie under root.
+func (db *DB) CountUnderRoot(root string) (int, error) {
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM photos WHERE path LIKE ? ESCAPE '\'`,
+		escapeLike(filepath.Clean(root)+string(filepath.Separator))+"%").Scan(&n)
+	return n, err
+}
+
+// GetRootStatus returns each configured root with its availability and the
+// number and size of files indexed from it.
+func (db *DB) GetRootStatus() ([]*models.RootStatus, error) {
+	db.rootsMu.RLock()
+	roots := append([]string(nil), db.roots...)
+	db.rootsMu.RUnlock()
+	sort.Strings(roots)
+
+	result := make([]*models.RootStatus, 0, len(roots))
+	for _, root := range roots {
+		rs := &models.RootStatus{Path: root, Available: !db.RootOffline(root)}
+		err := db.conn.QueryRow(`SELECT COUNT(*), COALESCE(SUM(file_size), 0) FROM photos WHERE path LIKE ? ESCAPE '\'`,
+			escapeLike(root+string(filepath.Separator))+"%").Scan(&rs.Count, &rs.Size)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rs)
+	}
+	return result, nil
+}
+
+// missingSample is how many paths a MissingReport lists.
+const missingSample = 20
+
+// RemoveMissing deletes photos from the database whose files no longer exist
+// and reports them. With dryRun nothing is deleted, so the report shows what
+// would be. Photos under an offline root are kept: their disk is just not
+// mounted.
+func (db *DB) RemoveMissing(dryRun bool) (*models.MissingReport, error) {
+	rows, err := db.conn.Query("SELECT id, path, file_size FROM photos ORDER BY path")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	report := &models.MissingReport{Sample: []string{}, DryRun: dryRun}
+	var toDelete []int64
+	for rows.Next() {
+		var id, size int64
+		var path string
+		if err := rows.Scan(&id, &path, &size); err != nil {
+			continue
+		}
+		if root := db.RootOf(path); root != "" && db.RootOffline(root) {
+			continue
+		}
+		if _, err := archive.Stat(path); os.IsNotExist(err) {
+			toDelete = append(toDelete, id)
+			report.Count++
+			report.Size += size
+			if len(report.Sample) < missingSample {
+				report.Sample = append(report.Sample, path)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if dryRun || len(toDelete) == 0 {
+		return report, nil
+	}
+
+	tx, err := db.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("DELETE FROM photos WHERE id = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	for _, id := range toDelete {
+		if _, err := stmt.Exec(id); err == nil {
+			report.Removed++
+		}
+	}
+
+	return report, tx.Commit()
+}
+
+// RemovePhotoByPath deletes the photo at path from the index and reports
+// whether it was indexed.
+func (db *DB) RemovePhotoByPath(path string) (bool, error) {
+	res, err := db.exec("DELETE FROM photos WHERE path = ?", path)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// RemovePhotosUnder deletes the photo at path, or every photo under it if
+// it was a folder, from the index and returns how many were indexed.
+func (db *DB) RemovePhotosUnder(path string) (int64, error) {
+	path = filepath.Clean(path)
+	res, err := db.exec(`DELETE FROM photos WHERE path = ? OR path LIKE ? ESCAPE '\'`,
+		path, escapeLike(path+string(filepath.Separator))+"%")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// SearchByDateRange returns photos within a date range.
+func (db *DB) SearchByDateRange(start, end time.Time, offset, limit int) ([]*models.Photo, int, error) {
+	var total int
+	db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE taken_at BETWEEN ? AND ?", start, end).Scan(&total)
+
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr
+		FROM photos WHERE taken_at BETWEEN ? AND ?
+		ORDER BY taken_at DESC
+		LIMIT ? OFFSET ?
+	`, start, end, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var photos []*models.Photo
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+		photos = append(photos, p)
+	}
+
+	return photos, total, nil
+}
+
+// GetChanges returns photos added, updated and removed after the cursor,
+// reading at most limit log entries. Several changes to one photo collapse
+// into one entry. The returned Cursor is passed back as since next time.
+func (db *DB) GetChanges(since int64, limit int) (*models.ChangesResponse, error) {
+	rows, err := db.conn.Query(`
+		SELECT seq, photo_id, op FROM changes
+		WHERE seq > ?
+		ORDER BY seq
+		LIMIT ?
+	`, since, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	resp := &models.ChangesResponse{
+		Cursor:  since,
+		Added:   make([]*models.Photo, 0),
+		Updated: make([]*models.Photo, 0),
+		Removed: make([]int64, 0),
+	}
+
+	// Latest state per photo, in first-seen order
+	ops := make(map[int64]string)
+	var order []int64
+	n := 0
+	for rows.Next() {
+		var seq, id int64
+		var op string
+		if err := rows.Scan(&seq, &id, &op); err != nil {
+			return nil, err
+		}
+		if n++; n > limit {
+			resp.HasMore = true
+			break
+		}
+		resp.Cursor = seq
+
+		prev, seen := ops[id]
+		if !seen {
+			order = append(order, id)
+		}
+		// An add followed by updates is still an add for the client
+		if op == "update" && prev == "add" {
+			continue
+		}
+		ops[id] = op
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for _, id := range order {
+		op := ops[id]
+		if op == "remove" {
+			resp.Removed = append(resp.Removed, id)
+			continue
+		}
+		p, err := db.GetPhoto(id)
+		if err == sql.ErrNoRows {
+			continue // removed after the cursor; reported on a later page
+		} else if err != nil {
+			return nil, err
+		}
+		if op == "add" {
+			resp.Added = append(resp.Added, p)
+		} else {
+			resp.Updated = append(resp.Updated, p)
+		}
+	}
+	return resp, nil
+}
+
+// GetIndexedSince returns how many photos were indexed after t and the IDs
+// of up to limit of them, newest first.
+func (db *DB) GetIndexedSince(t time.Time, limit int) (int, []int64, error) {
+	// indexed_at is written in local time and compared as text
+	t = t.Local()
+
+	var count int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE indexed_at > ?", t).Scan(&count); err != nil {
+		return 0, nil, err
+	}
+
+	ids := make([]int64, 0, limit)
+	if count == 0 {
+		return 0, ids, nil
+	}
+	rows, err := db.conn.Query(`
+		SELECT id FROM photos
+		WHERE indexed_at > ?
+		ORDER BY taken_at DESC
+		LIMIT ?
+	`, t, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return count, ids, rows.Err()
+}
+
+// GetRecentlyAdded returns a page of photos indexed since the given time,
+// grouped by the day they were indexed (newest import first) rather than the
+// day they were taken, so old scans imported recently are easy to find.
+func (db *DB) GetRecentlyAdded(since time.Time, offset, limit int) (*models.TimelineResponse, error) {
+	// indexed_at is written in local time and compared as text
+	since = since.Local()
+
+	var totalCount int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE indexed_at > ?", since).Scan(&totalCount); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr
+		FROM photos
+		WHERE indexed_at > ?
+		ORDER BY indexed_at DESC, taken_at DESC
+		LIMIT ? OFFSET ?
+	`, since, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make([]*models.TimelineGroup, 0)
+	var current *models.TimelineGroup
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+
+		key := p.IndexedAt.Format("2006-01-02")
+		if current == nil || current.Date != key {
+			current = &models.TimelineGroup{
+				Date:   key,
+				Label:  "Added " + p.IndexedAt.Format("January 2, 2006"),
+				Photos: make([]*models.Photo, 0),
+			}
+			groups = append(groups, current)
+		}
+		current.Photos = append(current.Photos, p)
+		current.Count++
+	}
+
+	return &models.TimelineResponse{
+		Groups:     groups,
+		TotalCount: totalCount,
+		HasMore:    offset+limit < totalCount,
+	}, rows.Err()
+}
+
+// GetMonthBuckets returns per-month counts ordered by date descending, with cumulative offsets.
+// This is a lightweight query used by the scrubber to know the full date range and jump to any month.
+// Months in the server's zone are grouped by SQLite; for other zones, which it can't do, capture
+// times are grouped here. Only photos matching f are counted.
+func (db *DB) GetMonthBuckets(loc *time.Location, f TimelineFilter) ([]*models.MonthBucket, error) {
+	var counts map[string]int
+	var months []string
+	var err error
+	if loc == time.Local {
+		counts, months, err = db.monthCountsLocal(f)
+	} else {
+		counts, months, err = db.monthCountsIn(loc, f)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets []*models.MonthBucket
+	cumulative := 0
+	for _, month := range months {
+		// Parse the month string to generate a label
+		t, _ := time.Parse("2006-01", month)
+		label := t.Format("January 2006")
+
+		buckets = append(buckets, &models.MonthBucket{
+			Month:            month,
+			Label:            label,
+			Count:            counts[month],
+			CumulativeOffset: cumulative,
+		})
+		cumulative += counts[month]
+	}
+	return buckets, nil
+}
+
+// monthCountsLocal counts the photos matching f per month ("2006-01") in
+// the server's zone, and returns the months newest first. Stored capture
+// times carry their UTC offset, which 'localtime' turns into the same zone
+// as time.Local.
+func (db *DB) monthCountsLocal(f TimelineFilter) (map[string]int, []string, error) {
+	visible, args := f.where()
+	rows, err := db.conn.Query(`
+		SELECT strftime('%Y-%m', taken_at, 'localtime') AS month, COUNT(*)
+		FROM photos
+		WHERE `+visible+`
+		GROUP BY month
+		ORDER BY month DESC
+	`, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	var months []string
+	for rows.Next() {
+		var month sql.NullString
+		var count int
+		if err := rows.Scan(&month, &count); err != nil || !month.Valid {
+			continue
+		}
+		counts[month.String] = count
+		months = append(months, month.String)
+	}
+	return counts, months, rows.Err()
+}
+
+// monthCountsIn is monthCountsLocal for any zone, grouping capture times
+// in Go.
+func (db *DB) monthCountsIn(loc *time.Location, f TimelineFilter) (map[string]int, []string, error) {
+	visible, args := f.where()
+	rows, err := db.conn.Query("SELECT taken_at FROM photos WHERE "+visible+" ORDER BY taken_at DESC", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	var months []string
+	for rows.Next() {
+		var taken time.Time
+		if err := rows.Scan(&taken); err != nil {
+			continue
+		}
+		month := taken.In(loc).Format("2006-01")
+		if counts[month] == 0 {
+			months = append(months, month)
+		}
+		counts[month]++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(months)))
+	return counts, months, nil
+}
+
+// GetMonthLayout returns the ordered photo IDs and aspect ratios for one
+// month ("2006-01") in loc, in the same order as the timeline. Only photos
+// matching f are included.
+func (db *DB) GetMonthLayout(month string, loc *time.Location, f TimelineFilter) (*models.MonthLayout, error) {
+	start, end, err := monthRange(month, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	visible, args := f.where()
+	rows, err := db.conn.Query(`
+		SELECT id, width, height, media_type
+		FROM photos
+		WHERE taken_at >= ? AND taken_at < ? AND `+visible+`
+		ORDER BY taken_at DESC
+	`, append([]interface{}{start, end}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	layout := &models.MonthLayout{Month: month, Items: make([]*models.LayoutItem, 0)}
+	for rows.Next() {
+		var id int64
+		var w, h int
+		var mediaType string
+		if err := rows.Scan(&id, &w, &h, &mediaType); err != nil {
+			continue
+		}
+		item := &models.LayoutItem{ID: id, Video: mediaType == "video"}
+		if w > 0 && h > 0 {
+			item.Aspect = math.Round(float64(w)/float64(h)*1000) / 1000
+		}
+		layout.Items = append(layout.Items, item)
+	}
+	layout.Count = len(layout.Items)
+	return layout, rows.Err()
+}
+
+// monthRange returns the bounds of a month ("2006-01") in loc. They are
+// expressed in the server's zone, which capture times are stored in, so
+// comparing them with the taken_at column's text holds.
+func monthRange(month string, loc *time.Location) (start, end time.Time, err error) {
+	start, err = time.ParseInLocation("2006-01", month, loc)
+	if err != nil {
+		return start, end, err
+	}
+	end = start.AddDate(0, 1, 0)
+	return start.In(time.Local), end.In(time.Local), nil
+}
+
+// GetFolderTree returns the folder hierarchy under each root with media
+// counts, date range and a cover photo, built from a single pass over the
+// library so the sidebar doesn't need a query per directory.
+func (db *DB) GetFolderTree(roots []string) ([]*models.Folder, error) {
+	rows, err := db.conn.Query("SELECT id, path, media_type, taken_at FROM photos ORDER BY taken_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := make(map[string]*models.Folder)
+	tree := make([]*models.Folder, 0, len(roots))
+	for _, root := range roots {
+		root = filepath.Clean(root)
+		if nodes[root] != nil {
+			continue
+		}
+		node := &models.Folder{Path: root, Name: filepath.Base(root), Children: make([]*models.Folder, 0)}
+		nodes[root] = node
+		tree = append(tree, node)
+	}
+
+	// folder returns the node for dir, creating it and any missing
+	// ancestors up to the root
+	var folder func(dir string) *models.Folder
+	folder = func(dir string) *models.Folder {
+		if node := nodes[dir]; node != nil {
+			return node
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		p := folder(parent)
+		if p == nil {
+			return nil
+		}
+		node := &models.Folder{Path: dir, Name: filepath.Base(dir), Children: make([]*models.Folder, 0)}
+		nodes[dir] = node
+		p.Children = append(p.Children, node)
+		return node
+	}
+
+	for rows.Next() {
+		var id int64
+		var path, mediaType string
+		var takenAt time.Time
+		if err := rows.Scan(&id, &path, &mediaType, &takenAt); err != nil {
+			continue
+		}
+		dir := filepath.Dir(path)
+		node := folder(dir)
+		if node == nil {
+			continue // outside every configured root
+		}
+		if mediaType == "video" {
+			node.VideoCount++
+		} else {
+			node.PhotoCount++
+		}
+
+		// Roll the photo up into every ancestor. Rows arrive newest first,
+		// so the first photo seen in a subtree is its cover.
+		for d := dir; ; d = filepath.Dir(d) {
+			n := nodes[d]
+			if n == nil {
+				break
+			}
+			if n.TotalCount == 0 {
+				n.CoverID = id
+				n.NewestDate = takenAt
+			}
+			n.OldestDate = takenAt
+			n.TotalCount++
+			if filepath.Dir(d) == d {
+				break
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+		sort.Slice(node.Children, func(i, j int) bool {
+			return node.Children[i].Name < node.Children[j].Name
+		})
+	}
+	return tree, nil
+}
+
+// GetMonthIDs returns the ordered photo IDs and media types for one month
+// ("2006-01") in loc, in the same order as the timeline. Only photos matching
+// f are included.
+func (db *DB) GetMonthIDs(month string, loc *time.Location, f TimelineFilter) (*models.MonthIDs, error) {
+	start, end, err := monthRange(month, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	visible, args := f.where()
+	rows, err := db.conn.Query(`
+		SELECT id, media_type
+		FROM photos
+		WHERE taken_at >= ? AND taken_at < ? AND `+visible+`
+		ORDER BY taken_at DESC
+	`, append([]interface{}{start, end}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := &models.MonthIDs{Month: month, IDs: make([]int64, 0), Types: make([]string, 0)}
+	for rows.Next() {
+		var id int64
+		var mediaType string
+		if err := rows.Scan(&id, &mediaType); err != nil {
+			continue
+		}
+		res.IDs = append(res.IDs, id)
+		res.Types = append(res.Types, mediaType)
+	}
+	res.Count = len(res.IDs)
+	return res, rows.Err()
+}
+
+// GetImageIDs returns the IDs of all images taken between start and end,
+// leaving out those under an offline root. orientation may be "landscape"
+// or "portrait" to restrict by aspect ratio; images with unknown dimensions
+// are excluded when it is set.
+func (db *DB) GetImageIDs(start, end time.Time, orientation string) ([]int64, error) {
+	query := "SELECT id, path FROM photos WHERE media_type IN ('image', 'raw') AND taken_at BETWEEN ? AND ?"
+	switch orientation {
+	case "landscape":
+		query += " AND width > height"
+	case "portrait":
+		query += " AND height > width"
+	}
+
+	rows, err := db.conn.Query(query, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var path string
+		if err := rows.Scan(&id, &path); err != nil {
+			continue
+		}
+		if root := db.RootOf(path); root != "" && db.RootOffline(root) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetWallpaperCandidates returns the IDs of landscape images at least
+// minWidth pixels wide and not under an offline root, ordered by ID so the
+// list is stable between calls.
+func (db *DB) GetWallpaperCandidates(minWidth int) ([]int64, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, path FROM photos
+		WHERE media_type IN ('image', 'raw') AND width > height AND width >= ?
+		ORDER BY id
+	`, minWidth)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var path string
+		if err := rows.Scan(&id, &path); err != nil {
+			continue
+		}
+		if root := db.RootOf(path); root != "" && db.RootOffline(root) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// PhotoFilter narrows bulk photo queries. Zero values mean "no restriction".
+type PhotoFilter struct {
+	From        time.Time
+	To          time.Time
+	PathPrefix  string
+	MediaType   string // "image", "raw" or "video"
+	Orientation string // "landscape" or "portrait"
+}
+
+// where builds the SQL WHERE clause and arguments for the filter.
+func (f PhotoFilter) where() (string, []interface{}) {
+	clauses := []string{"1=1"}
+	var args []interface{}
+	if !f.From.IsZero() {
+		clauses = append(clauses, "taken_at >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		clauses = append(clauses, "taken_at <= ?")
+		args = append(args, f.To)
+	}
+	if f.PathPrefix != "" {
+		clauses = append(clauses, `path LIKE ? ESCAPE '\'`)
+		args = append(args, escapeLike(f.PathPrefix)+"%")
+	}
+	if f.MediaType != "" {
+		clauses = append(clauses, "media_type = ?")
+		args = append(args, f.MediaType)
+	}
+	switch f.Orientation {
+	case "landscape":
+		clauses = append(clauses, "width > height")
+	case "portrait":
+		clauses = append(clauses, "height > width")
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// FilterPhotos returns all photos matching the filter, newest first.
+func (db *DB) FilterPhotos(f PhotoFilter) ([]*models.Photo, error) {
+	where, args := f.where()
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr
+		FROM photos WHERE `+where+`
+		ORDER BY taken_at DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var photos []*models.Photo
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
+}
+
+// Pregen states stored per photo, so background thumbnail generation can
+// resume where it left off after a restart.
+const (
+	PregenPending = 0
+	PregenDone    = 1
+	PregenFailed  = 2
+)
+
+// MediaEntry is a lightweight id/path/type row for background work queues.
+type MediaEntry struct {
+	ID        int64
+	Path      string
+	MediaType string
+}
+
+// MediaPages reads the rows of a background work queue a page at a time,
+// newest first, so large libraries are never held in memory at once. Pages
+// are keyed on (taken_at, id) rather than offsets, so rows that change state
+// as they're worked on don't shift the pages after them.
+type MediaPages struct {
+	db    *DB
+	where string
+	args  []interface{}
+	size  int
+	// taken_at and id of the last row read
+	taken string
+	id    int64
+	done  bool
+}
+
+// Next returns the next page, or none once every row has been read.
+func (p *MediaPages) Next() ([]MediaEntry, error) {
+	if p.done {
+		return nil, nil
+	}
+	query := "SELECT id, path, media_type, CAST(taken_at AS TEXT) FROM photos WHERE " + p.where
+	args := append([]interface{}{}, p.args...)
+	if p.taken != "" {
+		query += " AND (taken_at < ? OR (taken_at = ? AND id < ?))"
+		args = append(args, p.taken, p.taken, p.id)
+	}
+	query += " ORDER BY taken_at DESC, id DESC LIMIT ?"
+	args = append(args, p.size)
+
+	rows, err := p.db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []MediaEntry
+	for rows.Next() {
+		var e MediaEntry
+		if err := rows.Scan(&e.ID, &e.Path, &e.MediaType, &p.taken); err != nil {
+			return nil, err
+		}
+		p.id = e.ID
+		items = append(items, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(items) < p.size {
+		p.done = true
+	}
+	return items, nil
+}
+
+// PregenPending pages through the photos whose small thumbnail hasn't been
+// settled yet, newest first, size at a time.
+func (db *DB) PregenPending(size int) *MediaPages {
+	return &MediaPages{db: db, where: "pregen_state = ?", args: []interface{}{PregenPending}, size: size}
+}
+
+// PregenPendingIDs returns those of the photos with the given IDs whose
+// small thumbnail hasn't been settled yet.
+func (db *DB) PregenPendingIDs(ids []int64) ([]MediaEntry, error) {
+	var items []MediaEntry
+	// Stay well under SQLite's limit on query parameters
+	const chunk = 500
+	for start := 0; start < len(ids); start += chunk {
+		part := ids[start:min(start+chunk, len(ids))]
+		args := make([]interface{}, 0, len(part)+1)
+		for _, id := range part {
+			args = append(args, id)
+		}
+		args = append(args, PregenPending)
+		rows, err := db.conn.Query(`SELECT id, path, media_type FROM photos WHERE id IN (?`+strings.Repeat(", ?", len(part)-1)+`) AND pregen_state = ?`, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var e MediaEntry
+			if err := rows.Scan(&e.ID, &e.Path, &e.MediaType); err == nil {
+				items = append(items, e)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// CountPregenPending returns how many photos PregenPending would return.
+func (db *DB) CountPregenPending() (int64, error) {
+	var n int64
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE pregen_state = ?", PregenPending).Scan(&n)
+	return n, err
+}
+
+// SetPregenState records the pregen outcome for a photo.
+func (db *DB) SetPregenState(id int64, state int) error {
+	_, err := db.exec("UPDATE photos SET pregen_state = ? WHERE id = ?", state, id)
+	return err
+}
+
+// PregenCounts summarizes lifetime pregen progress across the library.
+type PregenCounts struct {
+	Total  int64 `json:"lifetime_total"`
+	Done   int64 `json:"lifetime_done"`
+	Failed int64 `json:"lifetime_failed"`
+}
+
+// GetPregenCounts returns how many photos have settled small thumbnails.
+func (db *DB) GetPregenCounts() (PregenCounts, error) {
+	var c PregenCounts
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*),
+			COALESCE(SUM(CASE WHEN pregen_state = ? THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN pregen_state = ? THEN 1 ELSE 0 END), 0)
+		FROM photos
+	`, PregenDone, PregenFailed).Scan(&c.Total, &c.Done, &c.Failed)
+	return c, err
+}
+
+// GetVideosToProbe returns videos with no recorded dimensions, duration or
+// codecs, leaving out those ffprobe already failed on (a "probe" index
+// error, cleared when the file is indexed again).
+func (db *DB) GetVideosToProbe() ([]MediaEntry, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, path, media_type FROM photos
+		WHERE media_type = 'video' AND (width = 0 OR height = 0 OR duration = 0 OR video_codec = '')
+			AND path NOT IN (SELECT path FROM index_errors WHERE stage = 'probe')
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []MediaEntry
+	for rows.Next() {
+		var e MediaEntry
+		if err := rows.Scan(&e.ID, &e.Path, &e.MediaType); err != nil {
+			continue
+		}
+		items = append(items, e)
+	}
+	return items, rows.Err()
+}
+
+// SetVideoInfo records a video's probed container, codecs, duration and
+// rotation, and its display dimensions when known (0 keeps the stored ones).
+func (db *DB) SetVideoInfo(id int64, width, height int, duration float64, rotation int, container, videoCodec, audioCodec string) error {
+	_, err := db.exec(`
+		UPDATE photos SET
+			width = CASE WHEN ? > 0 AND ? > 0 THEN ? ELSE width END,
+			height = CASE WHEN ? > 0 AND ? > 0 THEN ? ELSE height END,
+			duration = CASE WHEN ? > 0 THEN ? ELSE duration END,
+			rotation = ?, container = ?, video_codec = ?, audio_codec = ?
+		WHERE id = ?
+	`, width, height, width, width, height, height, duration, duration, rotation, container, videoCodec, audioCodec, id)
+	return err
+}
+
+// GetVideoCodecGroups counts indexed videos by container and codecs, most
+// common first. Videos that haven't been probed have empty codecs.
+func (db *DB) GetVideoCodecGroups() ([]*models.VideoCodecGroup, error) {
+	rows, err := db.conn.Query(`
+		SELECT container, video_codec, audio_codec, COUNT(*) AS n
+		FROM photos
+		WHERE media_type = 'video'
+		GROUP BY container, video_codec, audio_codec
+		ORDER BY n DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := make([]*models.VideoCodecGroup, 0)
+	for rows.Next() {
+		g := &models.VideoCodecGroup{}
+		if err := rows.Scan(&g.Container, &g.VideoCodec, &g.AudioCodec, &g.Count); err != nil {
+			continue
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// GetUnauditedImages returns images indexed before date source and GPS
+// presence were recorded.
+func (db *DB) GetUnauditedImages() ([]MediaEntry, error) {
+	if _, err := db.exec(`UPDATE photos SET date_source = 'mtime' WHERE media_type = 'video' AND date_source = ''`); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query(`SELECT id, path, media_type FROM photos WHERE date_source = ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []MediaEntry
+	for rows.Next() {
+		var e MediaEntry
+		if err := rows.Scan(&e.ID, &e.Path, &e.MediaType); err != nil {
+			continue
+		}
+		items = append(items, e)
+	}
+	return items, rows.Err()
+}
+
+// SetAuditFlags records where a photo's date came from and whether it has
+// GPS coordinates.
+func (db *DB) SetAuditFlags(id int64, dateSource string, hasGPS bool) error {
+	_, err := db.exec("UPDATE photos SET date_source = ?, has_gps = ? WHERE id = ?", dateSource, hasGPS, id)
+	return err
+}
+
+// GetUnlocatedImages returns images flagged as having GPS data whose
+// coordinates were never stored: those indexed before positions were kept.
+func (db *DB) GetUnlocatedImages() ([]MediaEntry, error) {
+	rows, err := db.conn.Query(`SELECT id, path, media_type FROM photos WHERE has_gps = 1 AND latitude IS NULL AND media_type != 'video'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []MediaEntry
+	for rows.Next() {
+		var e MediaEntry
+		if err := rows.Scan(&e.ID, &e.Path, &e.MediaType); err != nil {
+			continue
+		}
+		items = append(items, e)
+	}
+	return items, rows.Err()
+}
+
+// SetLocation records a photo's GPS position, or clears its GPS flag when
+// ok is false so it isn't looked at again. The place name is reset, to be
+// resolved again from the new position.
+func (db *DB) SetLocation(id int64, lat, lon float64, ok bool) error {
+	if !ok {
+		_, err := db.exec("UPDATE photos SET has_gps = 0, latitude = NULL, longitude = NULL, place = '' WHERE id = ?", id)
+		return err
+	}
+	_, err := db.exec("UPDATE photos SET has_gps = 1, latitude = ?, longitude = ?, place = '' WHERE id = ?", lat, lon, id)
+	return err
+}
+
+// GetHDRCandidates returns the images in formats that can carry HDR
+// content: JPEG, HEIC/HEIF and AVIF.
+func (db *DB) GetHDRCandidates() ([]MediaEntry, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, path, media_type FROM photos
+		WHERE media_type = 'image' AND (path LIKE '%.jpg' OR path LIKE '%.jpeg' OR path LIKE '%.heic' OR path LIKE '%.heif' OR path LIKE '%.avif')
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []MediaEntry
+	for rows.Next() {
+		var e MediaEntry
+		if err := rows.Scan(&e.ID, &e.Path, &e.MediaType); err != nil {
+			continue
+		}
+		items = append(items, e)
+	}
+	return items, rows.Err()
+}
+
+// SetHDR records a photo's HDR kind, "" for SDR.
+func (db *DB) SetHDR(id int64, kind string) error {
+	_, err := db.exec("UPDATE photos SET hdr = ? WHERE id = ?", kind, id)
+	return err
+}
+
+// GetCameraCandidates returns the images with no camera recorded.
+func (db *DB) GetCameraCandidates() ([]MediaEntry, error) {
+	rows, err := db.conn.Query(`SELECT id, path, media_type FROM photos WHERE media_type != 'video' AND camera = ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []MediaEntry
+	for rows.Next() {
+		var e MediaEntry
+		if err := rows.Scan(&e.ID, &e.Path, &e.MediaType); err != nil {
+			continue
+		}
+		items = append(items, e)
+	}
+	return items, rows.Err()
+}
+
+// SetCamera records a photo's camera make and model.
+func (db *DB) SetCamera(id int64, camera string) error {
+	_, err := db.exec("UPDATE photos SET camera = ? WHERE id = ?", camera, id)
+	return err
+}
+
+// GetLensCandidates returns the images with no lens recorded.
+func (db *DB) GetLensCandidates() ([]MediaEntry, error) {
+	rows, err := db.conn.Query(`SELECT id, path, media_type FROM photos WHERE media_type != 'video' AND lens = ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []MediaEntry
+	for rows.Next() {
+		var e MediaEntry
+		if err := rows.Scan(&e.ID, &e.Path, &e.MediaType); err != nil {
+			continue
+		}
+		items = append(items, e)
+	}
+	return items, rows.Err()
+}
+
+// SetLens records a photo's lens model.
+func (db *DB) SetLens(id int64, lens string) error {
+	_, err := db.exec("UPDATE photos SET lens = ? WHERE id = ?", lens, id)
+	return err
+}
+
+// GetGPSDetailCandidates returns the images with a GPS position but no GPS
+// details recorded.
+func (db *DB) GetGPSDetailCandidates() ([]MediaEntry, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, path, media_type FROM photos
+		WHERE media_type != 'video' AND has_gps = 1
+			AND gps_altitude IS NULL AND gps_direction IS NULL AND gps_speed IS NULL
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []MediaEntry
+	for rows.Next() {
+		var e MediaEntry
+		if err := rows.Scan(&e.ID, &e.Path, &e.MediaType); err != nil {
+			continue
+		}
+		items = append(items, e)
+	}
+	return items, rows.Err()
+}
+
+// SetGPSDetails records a photo's GPS altitude, direction and speed.
+func (db *DB) SetGPSDetails(id int64, g *models.GPSDetails) error {
+	altitude, direction, speed := gpsColumns(g)
+	_, err := db.exec("UPDATE photos SET gps_altitude = ?, gps_direction = ?, gps_speed = ? WHERE id = ?", altitude, direction, speed, id)
+	return err
+}
+
+// Weather states stored per photo with a GPS position.
+const (
+	WeatherPending = 0
+	WeatherDone    = 1
+	WeatherNone    = 2 // the provider has no data for the place and time
+)
+
+// WeatherEntry is a photo waiting for its weather to be looked up.
+type WeatherEntry struct {
+	ID        int64
+	Latitude  float64
+	Longitude float64
+	TakenAt   time.Time
+}
+
+// GetWeatherPending returns the photos with a GPS position taken before
+// before whose weather hasn't been looked up yet, oldest first.
+func (db *DB) GetWeatherPending(before time.Time) ([]WeatherEntry, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, latitude, longitude, taken_at FROM photos
+		WHERE weather_state = ? AND latitude IS NOT NULL AND taken_at < ?
+		ORDER BY taken_at
+	`, WeatherPending, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []WeatherEntry
+	for rows.Next() {
+		var e WeatherEntry
+		if err := rows.Scan(&e.ID, &e.Latitude, &e.Longitude, &e.TakenAt); err != nil {
+			continue
+		}
+		items = append(items, e)
+	}
+	return items, rows.Err()
+}
+
+// CountWeatherPending returns how many photos GetWeatherPending would
+// return.
+func (db *DB) CountWeatherPending(before time.Time) (int, error) {
+	var n int
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM photos WHERE weather_state = ? AND latitude IS NOT NULL AND taken_at < ?
+	`, WeatherPending, before).Scan(&n)
+	return n, err
+}
+
+// SetWeather records the weather of a photo, or that there is none to be
+// had when w is nil.
+func (db *DB) SetWeather(id int64, w *models.Weather) error {
+	if w == nil {
+		_, err := db.exec("UPDATE photos SET weather = '', temperature = NULL, weather_state = ? WHERE id = ?", WeatherNone, id)
+		return err
+	}
+	var temperature interface{}
+	if w.Temperature != nil {
+		temperature = *w.Temperature
+	}
+	_, err := db.exec("UPDATE photos SET weather = ?, temperature = ?, weather_state = ? WHERE id = ?", w.Conditions, temperature, WeatherDone, id)
+	return err
+}
+
+// GetWeatherCache returns a weather provider's cached answer for a grid
+// cell and day, or "" if it isn't cached.
+func (db *DB) GetWeatherCache(provider, cell, day string) (string, error) {
+	var data string
+	err := db.conn.QueryRow("SELECT data FROM weather_cache WHERE provider = ? AND cell = ? AND day = ?", provider, cell, day).Scan(&data)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return data, err
+}
+
+// SetWeatherCache stores a weather provider's answer for a grid cell and
+// day.
+func (db *DB) SetWeatherCache(provider, cell, day, data string) error {
+	_, err := db.exec(`
+		INSERT INTO weather_cache (provider, cell, day, data, fetched_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(provider, cell, day) DO UPDATE SET data = excluded.data, fetched_at = excluded.fetched_at
+	`, provider, cell, day, data, time.Now())
+	return err
+}
+
+// GetCameraCounts returns the cameras of the photos visible to owner, most
+// used first, each with the lenses used on it.
+func (db *DB) GetCameraCounts(owner int64) ([]*models.CameraCount, error) {
+	visible, args := ownerClause(owner)
+	rows, err := db.conn.Query(`
+		SELECT camera, lens, COUNT(*) AS cnt
+		FROM photos
+		WHERE camera != '' AND `+visible+`
+		GROUP BY camera, lens
+		ORDER BY cnt DESC, lens
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]*models.CameraCount, 0)
+	byCamera := make(map[string]*models.CameraCount)
+	for rows.Next() {
+		var camera, lens string
+		var n int
+		if err := rows.Scan(&camera, &lens, &n); err != nil {
+			continue
+		}
+		cc := byCamera[camera]
+		if cc == nil {
+			cc = &models.CameraCount{Camera: camera, Lenses: make([]*models.LensCount, 0)}
+			byCamera[camera] = cc
+			counts = append(counts, cc)
+		}
+		cc.Count += n
+		if lens != "" {
+			cc.Lenses = append(cc.Lenses, &models.LensCount{Lens: lens, Count: n})
+		}
+	}
+	sort.SliceStable(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Camera < counts[j].Camera
+	})
+	return counts, rows.Err()
+}
+
+// GetKindCandidates returns all images and RAW files, for detecting their
+// kinds in photos indexed before kinds were recorded.
+func (db *DB) GetKindCandidates() ([]MediaEntry, error) {
+	rows, err := db.conn.Query(`SELECT id, path, media_type FROM photos WHERE media_type != 'video'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []MediaEntry
+	for rows.Next() {
+		var e MediaEntry
+		if err := rows.Scan(&e.ID, &e.Path, &e.MediaType); err != nil {
+			continue
+		}
+		items = append(items, e)
+	}
+	return items, rows.Err()
+}
+
+// SetKinds records a photo's image kinds, comma-separated.
+func (db *DB) SetKinds(id int64, kinds string) error {
+	_, err := db.exec("UPDATE photos SET kinds = ? WHERE id = ?", kinds, id)
+	return err
+}
+
+// SetPHash records the perceptual hash of the photo at path.
+func (db *DB) SetPHash(path string, hash uint64) error {
+	_, err := db.exec("UPDATE photos SET phash = ? WHERE path = ?", int64(hash), path)
+	return err
+}
+
+// GetPHashPending returns the images without a perceptual hash whose
+// small thumbnail exists, so hashing them never retries a failed decode.
+func (db *DB) GetPHashPending() ([]MediaEntry, error) {
+	rows, err := db.conn.Query(`SELECT id, path, media_type FROM photos WHERE phash IS NULL AND media_type != 'video' AND pregen_state = ?`, PregenDone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []MediaEntry
+	for rows.Next() {
+		var e MediaEntry
+		if err := rows.Scan(&e.ID, &e.Path, &e.MediaType); err != nil {
+			continue
+		}
+		items = append(items, e)
+	}
+	return items, rows.Err()
+}
+
+// PHash is a photo's perceptual hash.
+type PHash struct {
+	ID   int64
+	Hash uint64
+}
+
+// CountPHashes returns how many photos have a perceptual hash.
+func (db *DB) CountPHashes() (int, error) {
+	var n int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE phash IS NOT NULL").Scan(&n)
+	return n, err
+}
+
+// GetPHashes returns every stored perceptual hash.
+func (db *DB) GetPHashes() ([]PHash, error) {
+	rows, err := db.conn.Query("SELECT id, phash FROM photos WHERE phash IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []PHash
+	for rows.Next() {
+		var id, hash int64
+		if err := rows.Scan(&id, &hash); err != nil {
+			continue
+		}
+		hashes = append(hashes, PHash{ID: id, Hash: uint64(hash)})
+	}
+	return hashes, rows.Err()
+}
+
+// GetPHash returns a photo's perceptual hash, and false if it has none yet.
+func (db *DB) GetPHash(id int64) (uint64, bool, error) {
+	var hash sql.NullInt64
+	if err := db.conn.QueryRow("SELECT phash FROM photos WHERE id = ?", id).Scan(&hash); err != nil {
+		return 0, false, err
+	}
+	return uint64(hash.Int64), hash.Valid, nil
+}
+
+// PlacedPhoto is a located photo's ID and position, used for reverse
+// geocoding.
+type PlacedPhoto struct {
+	ID       int64
+	Lat, Lon float64
+}
+
+// GetUnplacedPhotos returns located photos with no place name yet.
+func (db *DB) GetUnplacedPhotos() ([]PlacedPhoto, error) {
+	rows, err := db.conn.Query("SELECT id, latitude, longitude FROM photos WHERE latitude IS NOT NULL AND place = ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []PlacedPhoto
+	for rows.Next() {
+		var pp PlacedPhoto
+		if err := rows.Scan(&pp.ID, &pp.Lat, &pp.Lon); err != nil {
+			continue
+		}
+		items = append(items, pp)
+	}
+	return items, rows.Err()
+}
+
+// SetPlaces stores the place names of photos, keyed by ID, in one
+// transaction.
+func (db *DB) SetPlaces(places map[int64]string) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE photos SET place = ? WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for id, place := range places {
+		if _, err := stmt.Exec(place, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ClearPlaces forgets every stored place name so they are resolved again,
+// after the geocoding dataset changed.
+func (db *DB) ClearPlaces() error {
+	_, err := db.exec("UPDATE photos SET place = '' WHERE place != ''")
+	return err
+}
+
+// MapBounds is a bounding box in decimal degrees. West is greater than East
+// when the box crosses the antimeridian.
+type MapBounds struct {
+	North, South, East, West float64
+}
+
+// GetMapClusters groups the located photos inside b into square grid cells
+// of cell degrees, largest clusters first.
+func (db *DB) GetMapClusters(b MapBounds, cell float64) ([]*models.MapCluster, error) {
+	where := "latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?"
+	args := []interface{}{cell, cell, b.South, b.North, b.West, b.East}
+	if b.West > b.East {
+		where = "latitude BETWEEN ? AND ? AND (longitude >= ? OR longitude <= ?)"
+	}
+
+	// Offsetting by 90/180 keeps cell indexes positive, so the integer
+	// cast floors. The bare id column comes from the MAX(taken_at) row.
+	rows, err := db.conn.Query(`
+		SELECT CAST((latitude + 90) / ? AS INTEGER) AS gy, CAST((longitude + 180) / ? AS INTEGER) AS gx,
+			COUNT(*), AVG(latitude), AVG(longitude), MAX(taken_at), id,
+			MAX(latitude), MIN(latitude), MAX(longitude), MIN(longitude)
+		FROM photos
+		WHERE `+where+`
+		GROUP BY gy, gx
+		ORDER BY COUNT(*) DESC
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clusters := make([]*models.MapCluster, 0)
+	for rows.Next() {
+		c := &models.MapCluster{}
+		var gy, gx int
+		var newest sql.NullString
+		if err := rows.Scan(&gy, &gx, &c.Count, &c.Lat, &c.Lon, &newest, &c.PhotoID, &c.North, &c.South, &c.East, &c.West); err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, rows.Err()
+}
+
+// auditIssues lists the metadata problems the audit reports, in display order.
+var auditIssues = []string{"no_exif_date", "zero_dimensions", "future_date", "ancient_date", "missing_gps"}
+
+// auditWhere returns the WHERE clause selecting photos with the given issue.
+func auditWhere(issue string, now time.Time) (string, []interface{}, bool) {
+	switch issue {
+	case "no_exif_date":
+		return "media_type IN ('image', 'raw') AND date_source = 'mtime'", nil, true
+	case "zero_dimensions":
+		return "(width = 0 OR height = 0)", nil, true
+	case "future_date":
+		return "taken_at > ?", []interface{}{now.AddDate(0, 0, 1)}, true
+	case "ancient_date":
+		return "taken_at < ?", []interface{}{time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)}, true
+	case "missing_gps":
+		return "media_type IN ('image', 'raw') AND date_source != '' AND has_gps = 0", nil, true
+	}
+	return "", nil, false
+}
+
+// GetAuditCounts returns the number of photos with each audit issue.
+func (db *DB) GetAuditCounts(now time.Time) (map[string]int, error) {
+	counts := make(map[string]int, len(auditIssues))
+	for _, issue := range auditIssues {
+		where, args, _ := auditWhere(issue, now)
+		var n int
+		if err := db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE "+where, args...).Scan(&n); err != nil {
+			return nil, err
+		}
+		counts[issue] = n
+	}
+	return counts, nil
+}
+
+// GetAuditPhotos returns a page of photos with the given audit issue,
+// ordered by path so related files sit together.
+func (db *DB) GetAuditPhotos(issue string, now time.Time, offset, limit int) ([]*models.Photo, error) {
+	where, args, ok := auditWhere(issue, now)
+	if !ok {
+		return nil, fmt.Errorf("unknown audit issue %q", issue)
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr, date_source
+		FROM photos WHERE `+where+`
+		ORDER BY path
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	photos := make([]*models.Photo, 0)
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR, &p.DateSource); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
+}
+
+// MemoryOptions controls which photos GetMemories considers.
+type MemoryOptions struct {
+	WindowDays    int // days either side of the anniversary
+	PerYear       int // photos returned per year
+	IncludeVideos bool
+	ExcludeTags   []string // e.g. "screenshot"
+	MinSize       int      // minimum short side in pixels; 0 disables
+	Owner         int64    // only photos visible to this user (see ownerClause)
+}
+
+// where builds the SQL conditions (beyond the date range) for the options.
+func (o MemoryOptions) where() (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	if !o.IncludeVideos {
+		clauses = append(clauses, "media_type IN ('image', 'raw')")
+	}
+	if o.MinSize > 0 {
+		clauses = append(clauses, "MIN(width, height) >= ?")
+		args = append(args, o.MinSize)
+	}
+	if len(o.ExcludeTags) > 0 {
+		clauses = append(clauses, "id NOT IN (SELECT photo_id FROM tags WHERE tag IN (?"+strings.Repeat(",?", len(o.ExcludeTags)-1)+"))")
+		for _, t := range o.ExcludeTags {
+			args = append(args, t)
+		}
+	}
+	if o.Owner != 0 {
+		visible, ownerArgs := ownerClause(o.Owner)
+		clauses = append(clauses, visible)
+		args = append(args, ownerArgs...)
+	}
+	if len(clauses) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(clauses, " AND "), args
+}
+
+// GetMemories returns one group per past year that has photos taken within
+// opts.WindowDays of now's month and day, newest year first. Each group
+// holds between one and opts.PerYear random photos, ordered by time taken.
+func (db *DB) GetMemories(now time.Time, opts MemoryOptions) ([]*models.MemoryGroup, error) {
+	perYear, windowDays := opts.PerYear, opts.WindowDays
+	if perYear <= 0 {
+		perYear = 6
+	}
+	if windowDays < 0 {
+		windowDays = 0
+	}
+	filter, filterArgs := opts.where()
+
+	var oldest sql.NullString
+	if err := db.conn.QueryRow("SELECT MIN(strftime('%Y', taken_at)) FROM photos").Scan(&oldest); err != nil {
+		return nil, err
+	}
+	groups := make([]*models.MemoryGroup, 0)
+	if !oldest.Valid {
+		return groups, nil
+	}
+	firstYear, _ := strconv.Atoi(oldest.String)
+
+	for year := now.Year() - 1; year >= firstYear && year >= 1900; year-- {
+		// time.Date normalizes Feb 29 to Mar 1 in non-leap years
+		day := time.Date(year, now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		start := day.AddDate(0, 0, -windowDays)
+		end := day.AddDate(0, 0, windowDays+1).Add(-time.Nanosecond)
+		args := append([]interface{}{start, end}, filterArgs...)
+
+		var count int
+		if err := db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE taken_at BETWEEN ? AND ?"+filter, args...).Scan(&count); err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			continue
+		}
+
+		rows, err := db.conn.Query(`
+			SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr
+			FROM (
+				SELECT * FROM photos
+				WHERE taken_at BETWEEN ? AND ?`+filter+`
+				ORDER BY RANDOM()
+				LIMIT ?
+			)
+			ORDER BY taken_at
+		`, append(args, perYear)...)
+		if err != nil {
+			return nil, err
+		}
+
+		group := &models.MemoryGroup{Year: year, YearsAgo: now.Year() - year, Count: count}
+		for rows.Next() {
+			p := &models.Photo{}
+			if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR); err != nil {
+				continue
+			}
+			db.markAvailability(p)
+			group.Photos = append(group.Photos, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		// Every group has a photo to show, even if the rows found by the
+		// count failed to load
+		if len(group.Photos) == 0 {
+			continue
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+// SearchFilename returns photos whose filename contains the query
+// (case-insensitive), newest first.
+func (db *DB) SearchFilename(query string, limit int) ([]*models.Photo, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr
+		FROM photos WHERE filename LIKE ? ESCAPE '\'
+		ORDER BY taken_at DESC
+		LIMIT ?
+	`, "%"+escapeLike(query)+"%", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var photos []*models.Photo
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+		photos = append(photos, p)
+	}
+	return photos, nil
+}
+
+// SearchQuery selects photos by text and facet values. Empty fields don't
+// filter.
+type SearchQuery struct {
+	Text    string // matched against filename, place, camera and tags
+	Year    string // e.g. "2024"
+	Type    string // media type: "image", "raw" or "video"
+	Tag     string
+	Camera  string
+	Lens    string
+	Kind    string // one of ImageKinds
+	Weather string // conditions, one of weather.Conditions
+	Owner   int64  // see ownerClause
+	Offset  int
+	Limit   int
+}
+
+// searchFacetLimit caps the values listed for the tag, camera and lens
+// facets.
+const searchFacetLimit = 20
+
+// where returns the conditions for q, leaving out the filter of the facet
+// named skip so that facet's counts cover its other values too.
+func (q SearchQuery) where(skip string) (string, []interface{}) {
+	visible, args := ownerClause(q.Owner)
+	clauses := []string{visible}
+	if q.Text != "" {
+		like := "%" + escapeLike(q.Text) + "%"
+		clauses = append(clauses, `(filename LIKE ? ESCAPE '\' OR place LIKE ? ESCAPE '\' OR camera LIKE ? ESCAPE '\' OR id IN (SELECT photo_id FROM tags WHERE tag LIKE ? ESCAPE '\'))`)
+		args = append(args, like, like, like, like)
+	}
+	if q.Year != "" && skip != "year" {
+		// taken_at is stored in local time with its offset, so its first
+		// four characters are the local year
+		clauses = append(clauses, "substr(taken_at, 1, 4) = ?")
+		args = append(args, q.Year)
+	}
+	if q.Type != "" && skip != "type" {
+		clauses = append(clauses, "media_type = ?")
+		args = append(args, q.Type)
+	}
+	if q.Tag != "" && skip != "tag" {
+		clauses = append(clauses, "id IN (SELECT photo_id FROM tags WHERE tag = ?)")
+		args = append(args, q.Tag)
+	}
+	if q.Camera != "" && skip != "camera" {
+		clauses = append(clauses, "camera = ?")
+		args = append(args, q.Camera)
+	}
+	if q.Lens != "" && skip != "lens" {
+		clauses = append(clauses, "lens = ?")
+		args = append(args, q.Lens)
+	}
+	if q.Kind != "" && skip != "kind" {
+		kind, kindArgs := kindClause(q.Kind)
+		clauses = append(clauses, kind)
+		args = append(args, kindArgs...)
+	}
+	if q.Weather != "" && skip != "weather" {
+		clauses = append(clauses, "weather = ?")
+		args = append(args, q.Weather)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// Search returns a page of photos matching q, newest first, with the total
+// number of matches and the facet counts. Each facet is counted with the
+// other filters applied but not its own, so a selected value's siblings
+// stay listed.
+func (db *DB) Search(q SearchQuery) (*models.SearchResponse, error) {
+	resp := &models.SearchResponse{
+		Results: make([]*models.SearchResult, 0),
+		Facets:  make(map[string][]*models.FacetCount),
+	}
+
+	where, args := q.where("")
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM photos WHERE `+where, args...).Scan(&resp.Total); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr, camera, lens, kinds
+		FROM photos WHERE `+where+`
+		ORDER BY taken_at DESC
+		LIMIT ? OFFSET ?
+	`, append(args, q.Limit, q.Offset)...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR, &p.Camera, &p.Lens, &p.Kinds); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+		resp.Results = append(resp.Results, &models.SearchResult{Photo: p})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	resp.HasMore = q.Offset+len(resp.Results) < resp.Total
+
+	if q.Text != "" {
+		if err := db.highlight(resp.Results, q.Text); err != nil {
+			return nil, err
+		}
+	}
+
+	facets := []struct {
+		name  string
+		query string
+	}{
+		{"year", `SELECT substr(taken_at, 1, 4) AS value, COUNT(*) FROM photos WHERE %s GROUP BY value ORDER BY value DESC`},
+		{"type", `SELECT media_type AS value, COUNT(*) AS cnt FROM photos WHERE %s GROUP BY value ORDER BY cnt DESC, value`},
+		{"tag", `SELECT tag AS value, COUNT(DISTINCT photo_id) AS cnt FROM tags WHERE photo_id IN (SELECT id FROM photos WHERE %s) GROUP BY value ORDER BY cnt DESC, value LIMIT ` + strconv.Itoa(searchFacetLimit)},
+		{"camera", `SELECT camera AS value, COUNT(*) AS cnt FROM photos WHERE camera != '' AND %s GROUP BY value ORDER BY cnt DESC, value LIMIT ` + strconv.Itoa(searchFacetLimit)},
+		{"lens", `SELECT lens AS value, COUNT(*) AS cnt FROM photos WHERE lens != '' AND %s GROUP BY value ORDER BY cnt DESC, value LIMIT ` + strconv.Itoa(searchFacetLimit)},
+		{"weather", `SELECT weather AS value, COUNT(*) AS cnt FROM photos WHERE weather != '' AND %s GROUP BY value ORDER BY cnt DESC, value`},
+	}
+	for _, f := range facets {
+		where, args := q.where(f.name)
+		counts, err := db.facetCounts(fmt.Sprintf(f.query, where), args)
+		if err != nil {
+			return nil, fmt.Errorf("counting %s facet: %w", f.name, err)
+		}
+		resp.Facets[f.name] = counts
+	}
+
+	// Kinds are a list per photo, so they're counted one column each
+	where, args = q.where("kind")
+	counts, err := db.kindCounts(where, args)
+	if err != nil {
+		return nil, fmt.Errorf("counting kind facet: %w", err)
+	}
+	kinds := make([]*models.FacetCount, 0)
+	for i, kind := range ImageKinds {
+		if counts[i] > 0 {
+			kinds = append(kinds, &models.FacetCount{Value: kind, Count: counts[i]})
+		}
+	}
+	sort.SliceStable(kinds, func(i, j int) bool { return kinds[i].Count > kinds[j].Count })
+	resp.Facets["kind"] = kinds
+	return resp, nil
+}
+
+// facetCounts runs a grouped query returning value, count rows.
+func (db *DB) facetCounts(query string, args []interface{}) ([]*models.FacetCount, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]*models.FacetCount, 0)
+	for rows.Next() {
+		fc := &models.FacetCount{}
+		if err := rows.Scan(&fc.Value, &fc.Count); err != nil {
+			continue
+		}
+		counts = append(counts, fc)
+	}
+	return counts, rows.Err()
+}
+
+// highlight records where text occurs in each result's filename, place,
+// camera and tags.
+func (db *DB) highlight(results []*models.SearchResult, text string) error {
+	if len(results) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*models.SearchResult, len(results))
+	placeholders := make([]string, 0, len(results))
+	args := []interface{}{"%" + escapeLike(text) + "%"}
+	for _, r := range results {
+		byID[r.Photo.ID] = r
+		placeholders = append(placeholders, "?")
+		args = append(args, r.Photo.ID)
+	}
+	for _, r := range results {
+		addHighlight(r, "filename", r.Photo.Filename, text)
+		addHighlight(r, "place", r.Photo.Place, text)
+		addHighlight(r, "camera", r.Photo.Camera, text)
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT DISTINCT photo_id, tag FROM tags
+		WHERE tag LIKE ? ESCAPE '\' AND photo_id IN (`+strings.Join(placeholders, ",")+`)
+		ORDER BY tag
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			continue
+		}
+		if r := byID[id]; r != nil {
+			addHighlight(r, "tag", tag, text)
+		}
+	}
+	return rows.Err()
+}
+
+// addHighlight adds the first case-insensitive occurrence of text in value
+// to r's highlights. Offsets count characters, not bytes.
+func addHighlight(r *models.SearchResult, field, value, text string) {
+	lower := func(s string) []rune {
+		rs := []rune(s)
+		for i, c := range rs {
+			rs[i] = unicode.ToLower(c)
+		}
+		return rs
+	}
+	v, t := lower(value), lower(text)
+	for i := 0; i+len(t) <= len(v); i++ {
+		if string(v[i:i+len(t)]) == string(t) {
+			r.Highlights = append(r.Highlights, &models.Highlight{Field: field, Value: value, Start: i, End: i + len(t)})
+			return
+		}
+	}
+}
+
+// escapeLike escapes LIKE wildcards so user input matches literally.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// RemoveDotfiles deletes indexed entries whose filename starts with a dot
+// (hidden files, .pending-* sync temp files, etc.). These should never have
+// been indexed and will never produce valid thumbnails.
+func (db *DB) RemoveDotfiles() (int64, error) {
+	result, err := db.exec(`DELETE FROM photos WHERE filename LIKE '.%'`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// BackupTo writes a consistent snapshot of the database to path using
+// VACUUM INTO, which is safe to run while the app is serving requests.
+func (db *DB) BackupTo(path string) error {
+	_, err := db.exec("VACUUM INTO ?", path)
+	return err
+}
+
+// AddComment stores a comment and fills in its ID and creation time.
+func (db *DB) AddComment(c *models.Comment) error {
+	c.CreatedAt = time.Now()
+	res, err := db.exec(`
+		INSERT INTO comments (photo_id, author, body, created_at)
+		VALUES (?, ?, ?, ?)
+	`, c.PhotoID, c.Author, c.Body, c.CreatedAt)
+	if err != nil {
+		return err
+	}
+	c.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetComments returns a photo's comments, oldest first.
+func (db *DB) GetComments(photoID int64) ([]*models.Comment, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, photo_id, author, body, created_at
+		FROM comments WHERE photo_id = ?
+		ORDER BY created_at, id
+	`, photoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := make([]*models.Comment, 0)
+	for rows.Next() {
+		c := &models.Comment{}
+		if err := rows.Scan(&c.ID, &c.PhotoID, &c.Author, &c.Body, &c.CreatedAt); err != nil {
+			continue
+		}
+		comments = append(comments, c)
+	}
+	return comments, rows.Err()
+}
+
+// DeleteComment removes a comment. It returns sql.ErrNoRows if there is no
+// comment with that ID.
+func (db *DB) DeleteComment(id int64) error {
+	res, err := db.exec("DELETE FROM comments WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetRuleTags replaces the rule-derived tags of the photo at path.
+func (db *DB) SetRuleTags(path string, tags []string) error {
+	return db.setTags(path, "rule", tags)
+}
+
+// SetSidecarTags replaces the sidecar keyword tags of the photo at path.
+func (db *DB) SetSidecarTags(path string, tags []string) error {
+	return db.setTags(path, "sidecar", tags)
+}
+
+// setTags replaces the tags of one source for the photo at path.
+func (db *DB) setTags(path, source string, tags []string) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DELETE FROM tags WHERE source = ?
+		AND photo_id = (SELECT id FROM photos WHERE path = ?)
+	`, source, path); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec(`
+			INSERT OR IGNORE INTO tags (photo_id, tag, source)
+			SELECT id, ?, ? FROM photos WHERE path = ?
+		`, tag, source, path); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// MetadataPatch is a metadata edit applied to a batch of photos. Nil and
+// empty fields leave that metadata alone.
+type MetadataPatch struct {
+	AddTags    []string
+	RemoveTags []string // from every source; rule and sidecar tags return when reapplied
+	Rating     *int
+	// Description returns the new description of the index-th photo of the
+	// batch
+	Description func(p *models.Photo, index int) string
+	// New GPS position. The place name is looked up again by the next scan,
+	// and a changed file or sidecar brings back its own position.
+	Latitude, Longitude *float64
+}
+
+// PatchMetadata applies patch to the photos with the given IDs in one
+// transaction and returns what changed on each. With dryRun nothing is
+// written. An unknown ID fails the whole batch with sql.ErrNoRows.
+func (db *DB) PatchMetadata(ids []int64, patch MetadataPatch, dryRun bool) ([]*models.MetadataChange, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	changes := make([]*models.MetadataChange, 0, len(ids))
+	for i, id := range ids {
+		p := &models.Photo{}
+		var lat, lon sql.NullFloat64
+		err := tx.QueryRow(`
+			SELECT id, path, filename, taken_at, media_type, place, camera, rating, description, latitude, longitude
+			FROM photos WHERE id = ?
+		`, id).Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.MediaType, &p.Place, &p.Camera, &p.Rating, &p.Description, &lat, &lon)
+		if err != nil {
+			return nil, fmt.Errorf("photo %d: %w", id, err)
+		}
+
+		have := make(map[string]bool)
+		rows, err := tx.Query("SELECT DISTINCT tag FROM tags WHERE photo_id = ?", id)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var tag string
+			if err := rows.Scan(&tag); err == nil {
+				have[tag] = true
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		c := &models.MetadataChange{PhotoID: p.ID, Filename: p.Filename}
+		for _, tag := range patch.AddTags {
+			if !have[tag] {
+				have[tag] = true
+				c.AddedTags = append(c.AddedTags, tag)
+				if _, err := tx.Exec("INSERT OR IGNORE INTO tags (photo_id, tag, source) VALUES (?, ?, 'manual')", id, tag); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, tag := range patch.RemoveTags {
+			if have[tag] {
+				delete(have, tag)
+				c.RemovedTags = append(c.RemovedTags, tag)
+				if _, err := tx.Exec("DELETE FROM tags WHERE photo_id = ? AND tag = ?", id, tag); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if patch.Rating != nil && *patch.Rating != p.Rating {
+			c.Rating = &models.ValueChange{From: p.Rating, To: *patch.Rating}
+			if _, err := tx.Exec("UPDATE photos SET rating = ? WHERE id = ?", *patch.Rating, id); err != nil {
+				return nil, err
+			}
+		}
+		if patch.Description != nil {
+			if desc := patch.Description(p, i); desc != p.Description {
+				c.Description = &models.ValueChange{From: p.Description, To: desc}
+				if _, err := tx.Exec("UPDATE photos SET description = ? WHERE id = ?", desc, id); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if patch.Latitude != nil && patch.Longitude != nil &&
+			(!lat.Valid || lat.Float64 != *patch.Latitude || lon.Float64 != *patch.Longitude) {
+			to := []float64{*patch.Latitude, *patch.Longitude}
+			c.Location = &models.ValueChange{To: to}
+			if lat.Valid {
+				c.Location.From = []float64{lat.Float64, lon.Float64}
+			}
+			if _, err := tx.Exec("UPDATE photos SET has_gps = 1, latitude = ?, longitude = ?, place = '' WHERE id = ?", to[0], to[1], id); err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, c)
+	}
+
+	if dryRun {
+		return changes, nil
+	}
+	return changes, tx.Commit()
+}
+
+// ReassignOwners recomputes the owner of every photo with ownerFor, which
+// maps a path to a user ID (0 for shared), and returns the number of photos
+// whose owner changed.
+func (db *DB) ReassignOwners(ownerFor func(path string) int64) (int, error) {
+	rows, err := db.conn.Query("SELECT id, path, owner_id FROM photos")
+	if err != nil {
+		return 0, err
+	}
+	changed := make(map[int64]int64)
+	for rows.Next() {
+		var id, owner int64
+		var path string
+		if err := rows.Scan(&id, &path, &owner); err != nil {
+			continue
+		}
+		if o := ownerFor(path); o != owner {
+			changed[id] = o
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE photos SET owner_id = ? WHERE id = ?")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for id, owner := range changed {
+		if _, err := stmt.Exec(owner, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(changed), tx.Commit()
+}
+
+// RetagAll recomputes rule-derived tags for the whole library in one
+// transaction, using tagsFor to map each path to its tags. It returns the
+// number of tags written.
+func (db *DB) RetagAll(tagsFor func(path string) []string) (int, error) {
+	rows, err := db.conn.Query("SELECT id, path FROM photos")
+	if err != nil {
+		return 0, err
+	}
+	type entry struct {
+		id   int64
+		tags []string
+	}
+	var entries []entry
+	for rows.Next() {
+		var id int64
+		var path string
+		if err := rows.Scan(&id, &path); err != nil {
+			continue
+		}
+		if tags := tagsFor(path); len(tags) > 0 {
+			entries = append(entries, entry{id, tags})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM tags WHERE source = 'rule'"); err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO tags (photo_id, tag, source) VALUES (?, ?, 'rule')")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	var count int
+	for _, e := range entries {
+		for _, tag := range e.tags {
+			if _, err := stmt.Exec(e.id, tag); err != nil {
+				return 0, err
+			}
+			count++
+		}
+	}
+	return count, tx.Commit()
+}
+
+// GetTagCounts returns every tag with the number of photos visible to
+// owner carrying it, most used first.
+func (db *DB) GetTagCounts(owner int64) ([]*models.TagCount, error) {
+	visible, args := ownerClause(owner)
+	rows, err := db.conn.Query(`
+		SELECT tag, COUNT(DISTINCT photo_id) AS cnt
+		FROM tags
+		WHERE photo_id IN (SELECT id FROM photos WHERE `+visible+`)
+		GROUP BY tag
+		ORDER BY cnt DESC, tag
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]*models.TagCount, 0)
+	for rows.Next() {
+		tc := &models.TagCount{}
+		if err := rows.Scan(&tc.Tag, &tc.Count); err != nil {
+			continue
+		}
+		counts = append(counts, tc)
+	}
+	return counts, rows.Err()
+}
+
+// GetPhotosByTag returns a page of photos visible to owner with the given
+// tag, newest first, and the total number of such photos.
+func (db *DB) GetPhotosByTag(tag string, offset, limit int, owner int64) ([]*models.Photo, int, error) {
+	visible, ownerArgs := ownerClause(owner)
+	args := append([]interface{}{tag}, ownerArgs...)
+
+	var total int
+	if err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM photos
+		WHERE id IN (SELECT photo_id FROM tags WHERE tag = ?) AND `+visible, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr
+		FROM photos
+		WHERE id IN (SELECT photo_id FROM tags WHERE tag = ?) AND `+visible+`
+		ORDER BY taken_at DESC
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	photos := make([]*models.Photo, 0)
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+		photos = append(photos, p)
+	}
+	return photos, total, rows.Err()
+}
+
+// GetFolderPhotos returns a page of the photos directly in the folder dir,
+// newest first, and the total number of them.
+func (db *DB) GetFolderPhotos(dir string, offset, limit int) ([]*models.Photo, int, error) {
+	dir = filepath.Clean(dir)
+	var total int
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM photos WHERE dir = ?`, dir).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr
+		FROM photos
+		WHERE dir = ?
+		ORDER BY taken_at DESC
+		LIMIT ? OFFSET ?
+	`, dir, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	photos := make([]*models.Photo, 0)
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+		photos = append(photos, p)
+	}
+	return photos, total, rows.Err()
+}
+
+// GetPlaceCounts returns every place with the number of photos visible to
+// owner taken there, most photographed first.
+func (db *DB) GetPlaceCounts(owner int64) ([]*models.PlaceCount, error) {
+	visible, args := ownerClause(owner)
+	rows, err := db.conn.Query(`
+		SELECT place, COUNT(*) AS cnt, AVG(latitude), AVG(longitude)
+		FROM photos
+		WHERE place != '' AND `+visible+`
+		GROUP BY place
+		ORDER BY cnt DESC, place
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make([]*models.PlaceCount, 0)
+	for rows.Next() {
+		pc := &models.PlaceCount{}
+		if err := rows.Scan(&pc.Place, &pc.Count, &pc.Lat, &pc.Lon); err != nil {
+			continue
+		}
+		counts = append(counts, pc)
+	}
+	return counts, rows.Err()
+}
+
+// GetPhotosByPlace returns a page of photos visible to owner taken at the
+// given place, newest first, and the total number of such photos.
+func (db *DB) GetPhotosByPlace(place string, offset, limit int, owner int64) ([]*models.Photo, int, error) {
+	visible, ownerArgs := ownerClause(owner)
+	args := append([]interface{}{place}, ownerArgs...)
+
+	var total int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM photos WHERE place = ? AND "+visible, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr
+		FROM photos
+		WHERE place = ? AND `+visible+`
+		ORDER BY taken_at DESC
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	photos := make([]*models.Photo, 0)
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+		photos = append(photos, p)
+	}
+	return photos, total, rows.Err()
+}
+
+// PhotoTime is a photo's ID and capture time, used for event detection.
+type PhotoTime struct {
+	ID        int64
+	TakenAt   time.Time
+	MediaType string
+}
+
+// GetPhotoTimes returns every photo's capture time, oldest first.
+func (db *DB) GetPhotoTimes() ([]PhotoTime, error) {
+	rows, err := db.conn.Query("SELECT id, taken_at, media_type FROM photos ORDER BY taken_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var times []PhotoTime
+	for rows.Next() {
+		var pt PhotoTime
+		if err := rows.Scan(&pt.ID, &pt.TakenAt, &pt.MediaType); err != nil {
+			continue
+		}
+		times = append(times, pt)
+	}
+	return times, rows.Err()
+}
+
+// ReplaceEvents swaps the stored events for a freshly detected set.
+func (db *DB) ReplaceEvents(events []*models.Event) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM events"); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO events (id, title, start_at, end_at, photo_count, cover_id)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range events {
+		if _, err := stmt.Exec(e.ID, e.Title, e.StartAt, e.EndAt, e.PhotoCount, e.CoverID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetEvents returns a page of events, newest first, and the total count.
+func (db *DB) GetEvents(offset, limit int) ([]*models.Event, int, error) {
+	var total int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM events").Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT id, title, start_at, end_at, photo_count, cover_id
+		FROM events
+		ORDER BY start_at DESC
+		LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	events := make([]*models.Event, 0)
+	for rows.Next() {
+		e := &models.Event{}
+		if err := rows.Scan(&e.ID, &e.Title, &e.StartAt, &e.EndAt, &e.PhotoCount, &e.CoverID); err != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+	return events, total, rows.Err()
+}
+
+// GetEvent returns an event with its photos in the order they were taken.
+func (db *DB) GetEvent(id int64) (*models.Event, error) {
+	e := &models.Event{}
+	err := db.conn.QueryRow(`
+		SELECT id, title, start_at, end_at, photo_count, cover_id
+		FROM events WHERE id = ?
+	`, id).Scan(&e.ID, &e.Title, &e.StartAt, &e.EndAt, &e.PhotoCount, &e.CoverID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr
+		FROM photos
+		WHERE taken_at BETWEEN ? AND ?
+		ORDER BY taken_at
+	`, e.StartAt, e.EndAt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	e.Photos = make([]*models.Photo, 0, e.PhotoCount)
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+		e.Photos = append(e.Photos, p)
+	}
+	return e, rows.Err()
+}
+
+// AlbumSorts are the orders an album's photos can be shown in: by capture
+// time, oldest or newest first, or as arranged with ReorderAlbum.
+var AlbumSorts = []string{"taken_asc", "taken_desc", "manual"}
+
+// albumOrder returns the ORDER BY terms for album_photos ap joined with
+// photos p and with the album, aliased album, in the album's sort.
+func albumOrder(album string) string {
+	return fmt.Sprintf(`CASE WHEN %[1]s.sort = 'manual' THEN ap.position END,
+		CASE WHEN %[1]s.sort = 'taken_desc' THEN p.taken_at END DESC,
+		p.taken_at, p.id`, album)
+}
+
+// albumColumns selects an album row with its photo count and effective
+// cover: the chosen cover, or else the first photo in the album's order.
+var albumColumns = `a.id, a.title, a.description, a.sort, a.folder, a.created_at, a.updated_at,
+	(SELECT COUNT(*) FROM album_photos WHERE album_id = a.id),
+	COALESCE(NULLIF(a.cover_id, 0), (
+		SELECT ap.photo_id FROM albums s JOIN album_photos ap ON ap.album_id = s.id JOIN photos p ON p.id = ap.photo_id
+		WHERE s.id = a.id ORDER BY ` + albumOrder("s") + ` LIMIT 1
+	), 0)`
+
+func scanAlbum(row interface{ Scan(...interface{}) error }) (*models.Album, error) {
+	a := &models.Album{}
+	err := row.Scan(&a.ID, &a.Title, &a.Description, &a.Sort, &a.Folder, &a.CreatedAt, &a.UpdatedAt, &a.PhotoCount, &a.CoverID)
+	return a, err
+}
+
+// CreateAlbum inserts a new, empty album and fills in its ID and timestamps.
+func (db *DB) CreateAlbum(a *models.Album) error {
+	a.CreatedAt = time.Now()
+	a.UpdatedAt = a.CreatedAt
+	res, err := db.exec(`
+		INSERT INTO albums (title, description, folder, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, a.Title, a.Description, a.Folder, a.CreatedAt, a.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	a.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetAlbums returns every album without its photos, most recently changed
+// first.
+func (db *DB) GetAlbums() ([]*models.Album, error) {
+	rows, err := db.conn.Query(`SELECT ` + albumColumns + ` FROM albums a ORDER BY a.updated_at DESC, a.id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	albums := make([]*models.Album, 0)
+	for rows.Next() {
+		a, err := scanAlbum(rows)
+		if err != nil {
+			continue
+		}
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
+
+// GetAlbum returns an album with its photos in the album's sort order. It
+// returns sql.ErrNoRows if the album doesn't exist.
+func (db *DB) GetAlbum(id int64) (*models.Album, error) {
+	a, err := scanAlbum(db.conn.QueryRow(`SELECT `+albumColumns+` FROM albums a WHERE a.id = ?`, id))
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Members, err = db.albumMembers(id); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT p.id, p.path, p.filename, p.taken_at, p.width, p.height, p.orientation, p.media_type, p.file_size, p.duration, p.thumb_path, p.indexed_at, p.place, p.hdr,
+			COALESCE(u.username, '')
+		FROM album_photos ap JOIN photos p ON p.id = ap.photo_id JOIN albums a ON a.id = ap.album_id
+		LEFT JOIN users u ON u.id = ap.added_by
+		WHERE ap.album_id = ?
+		ORDER BY `+albumOrder("a")+`
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	a.Photos = make([]*models.Photo, 0, a.PhotoCount)
+	for rows.Next() {
+		p := &models.Photo{}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR, &p.AddedBy); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+		a.Photos = append(a.Photos, p)
+	}
+	return a, rows.Err()
+}
+
+// albumMembers returns the accounts an album is shared with, by name.
+func (db *DB) albumMembers(albumID int64) ([]*models.AlbumMember, error) {
+	rows, err := db.conn.Query(`
+		SELECT m.user_id, u.username, m.role, m.added_at
+		FROM album_members m JOIN users u ON u.id = m.user_id
+		WHERE m.album_id = ?
+		ORDER BY u.username
+	`, albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := make([]*models.AlbumMember, 0)
+	for rows.Next() {
+		m := &models.AlbumMember{}
+		if err := rows.Scan(&m.UserID, &m.Username, &m.Role, &m.AddedAt); err != nil {
+			continue
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// GetMemberAlbums returns the albums shared with an account, without their
+// photos and with its role, most recently changed first.
+func (db *DB) GetMemberAlbums(userID int64) ([]*models.Album, error) {
+	rows, err := db.conn.Query(`
+		SELECT `+albumColumns+`, m.role
+		FROM albums a JOIN album_members m ON m.album_id = a.id
+		WHERE m.user_id = ?
+		ORDER BY a.updated_at DESC, a.id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	albums := make([]*models.Album, 0)
+	for rows.Next() {
+		a := &models.Album{}
+		if err := rows.Scan(&a.ID, &a.Title, &a.Description, &a.Sort, &a.Folder, &a.CreatedAt, &a.UpdatedAt, &a.PhotoCount, &a.CoverID, &a.Role); err != nil {
+			continue
+		}
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
+
+// AlbumRoles are the roles an album can be shared with: "view" to see its
+// photos, "contribute" to also add photos and remove the ones added.
+var AlbumRoles = []string{"view", "contribute"}
+
+// AlbumRole returns an account's role in an album, or "" if the album
+// isn't shared with it.
+func (db *DB) AlbumRole(albumID, userID int64) (string, error) {
+	var role string
+	err := db.conn.QueryRow("SELECT role FROM album_members WHERE album_id = ? AND user_id = ?", albumID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// SetAlbumMember shares an album with an account, or changes its role if
+// it's already shared with it.
+func (db *DB) SetAlbumMember(albumID, userID int64, role string) error {
+	_, err := db.exec(`
+		INSERT INTO album_members (album_id, user_id, role, added_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(album_id, user_id) DO UPDATE SET role = excluded.role
+	`, albumID, userID, role, time.Now())
+	return err
+}
+
+// RemoveAlbumMember stops sharing an album with an account. Photos it
+// added stay in the album. It returns sql.ErrNoRows if the album wasn't
+// shared with it.
+func (db *DB) RemoveAlbumMember(albumID, userID int64) error {
+	res, err := db.exec("DELETE FROM album_members WHERE album_id = ? AND user_id = ?", albumID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// InMemberAlbum reports whether a photo is in an album shared with an
+// account.
+func (db *DB) InMemberAlbum(userID, photoID int64) (bool, error) {
+	var count int
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM album_photos ap JOIN album_members m ON m.album_id = ap.album_id
+		WHERE ap.photo_id = ? AND m.user_id = ?
+	`, photoID, userID).Scan(&count)
+	return count > 0, err
+}
+
+// AlbumUpdate lists the album fields to change; nil fields are kept.
+type AlbumUpdate struct {
+	Title       *string
+	Description *string
+	CoverID     *int64  // 0 reverts to the first photo
+	Sort        *string // one of AlbumSorts
+}
+
+// UpdateAlbum applies u to an album. It returns sql.ErrNoRows if the album
+// doesn't exist.
+func (db *DB) UpdateAlbum(id int64, u AlbumUpdate) error {
+	sets := []string{"updated_at = ?"}
+	args := []interface{}{time.Now()}
+	if u.Title != nil {
+		sets = append(sets, "title = ?")
+		args = append(args, *u.Title)
+	}
+	if u.Description != nil {
+		sets = append(sets, "description = ?")
+		args = append(args, *u.Description)
+	}
+	if u.CoverID != nil {
+		sets = append(sets, "cover_id = ?")
+		args = append(args, *u.CoverID)
+	}
+	if u.Sort != nil {
+		sets = append(sets, "sort = ?")
+		args = append(args, *u.Sort)
+	}
+	args = append(args, id)
+
+	res, err := db.exec("UPDATE albums SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteAlbum removes an album. Its photos stay in the library.
+func (db *DB) DeleteAlbum(id int64) error {
+	res, err := db.exec("DELETE FROM albums WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// AlbumHasPhoto reports whether a photo is in an album.
+func (db *DB) AlbumHasPhoto(albumID, photoID int64) (bool, error) {
+	var count int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM album_photos WHERE album_id = ? AND photo_id = ?", albumID, photoID).Scan(&count)
+	return count > 0, err
+}
+
+// VisiblePhotoIDs returns the IDs among ids of photos that exist and are
+// visible to owner (see ownerClause), in the order given.
+func (db *DB) VisiblePhotoIDs(ids []int64, owner int64) ([]int64, error) {
+	visible, ownerArgs := ownerClause(owner)
+	found := make(map[int64]bool, len(ids))
+	// Stay well under SQLite's limit on query parameters
+	const chunk = 500
+	for start := 0; start < len(ids); start += chunk {
+		part := ids[start:min(start+chunk, len(ids))]
+		args := make([]interface{}, 0, len(part)+len(ownerArgs))
+		for _, id := range part {
+			args = append(args, id)
+		}
+		args = append(args, ownerArgs...)
+		rows, err := db.conn.Query(`SELECT id FROM photos WHERE id IN (?`+strings.Repeat(", ?", len(part)-1)+`) AND `+visible, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err == nil {
+				found[id] = true
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]int64, 0, len(found))
+	for _, id := range ids {
+		if found[id] {
+			out = append(out, id)
+			delete(found, id) // once each
+		}
+	}
+	return out, nil
+}
+
+// AddAlbumPhotos adds photos to the end of an album, skipping IDs that are
+// already in it or don't exist, and returns how many were added. addedBy
+// is the account adding them, 0 if unknown.
+func (db *DB) AddAlbumPhotos(albumID int64, photoIDs []int64, addedBy int64) (int, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO album_photos (album_id, photo_id, added_at, added_by, position)
+		SELECT ?, id, ?, ?, (SELECT COALESCE(MAX(position), -1) + 1 FROM album_photos WHERE album_id = ?)
+		FROM photos WHERE id = ?
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	added := 0
+	for _, id := range photoIDs {
+		res, err := stmt.Exec(albumID, now, addedBy, albumID, id)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			added++
+		}
+	}
+	if added > 0 {
+		if _, err := tx.Exec("UPDATE albums SET updated_at = ? WHERE id = ?", now, albumID); err != nil {
+			return 0, err
+		}
+	}
+	return added, tx.Commit()
+}
+
+// RemoveAlbumPhotos takes photos out of an album and returns how many were
+// removed. A removed cover reverts to the first photo. When addedBy isn't
+// 0, only photos that account added are removed.
+func (db *DB) RemoveAlbumPhotos(albumID int64, photoIDs []int64, addedBy int64) (int, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("DELETE FROM album_photos WHERE album_id = ? AND photo_id = ? AND (? = 0 OR added_by = ?)")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	removed := 0
+	for _, id := range photoIDs {
+		res, err := stmt.Exec(albumID, id, addedBy, addedBy)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			removed++
+		}
+	}
+	if removed > 0 {
+		if _, err := tx.Exec(`
+			UPDATE albums SET updated_at = ?,
+				cover_id = CASE WHEN cover_id IN (SELECT photo_id FROM album_photos WHERE album_id = ?) THEN cover_id ELSE 0 END
+			WHERE id = ?
+		`, time.Now(), albumID, albumID); err != nil {
+			return 0, err
+		}
+	}
+	return removed, tx.Commit()
+}
+
+// PhotoDir is a photo's ID and the folder holding it, used to make albums
+// from folders.
+type PhotoDir struct {
+	ID  int64
+	Dir string
+}
+
+// GetPhotoDirs returns every photo's folder, ordered by folder and then
+// capture time.
+func (db *DB) GetPhotoDirs() ([]PhotoDir, error) {
+	rows, err := db.conn.Query("SELECT id, dir FROM photos ORDER BY dir, taken_at, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var dirs []PhotoDir
+	for rows.Next() {
+		var pd PhotoDir
+		if err := rows.Scan(&pd.ID, &pd.Dir); err != nil {
+			continue
+		}
+		dirs = append(dirs, pd)
+	}
+	return dirs, rows.Err()
+}
+
+// GetFolderAlbums returns the IDs of the albums made from folders, by
+// folder.
+func (db *DB) GetFolderAlbums() (map[string]int64, error) {
+	rows, err := db.conn.Query("SELECT id, folder FROM albums WHERE folder != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	albums := make(map[string]int64)
+	for rows.Next() {
+		var id int64
+		var folder string
+		if err := rows.Scan(&id, &folder); err != nil {
+			continue
+		}
+		albums[folder] = id
+	}
+	return albums, rows.Err()
+}
+
+// SetAlbumPhotos makes an album hold exactly photoIDs: photos not among
+// them are taken out and missing ones added at the end. It reports whether
+// anything changed.
+func (db *DB) SetAlbumPhotos(albumID int64, photoIDs []int64) (bool, error) {
+	tx, err := db.begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT photo_id FROM album_photos WHERE album_id = ?", albumID)
+	if err != nil {
+		return false, err
+	}
+	current := make(map[int64]bool)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			current[id] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	add, err := tx.Prepare(`
+		INSERT OR IGNORE INTO album_photos (album_id, photo_id, added_at, position)
+		SELECT ?, id, ?, (SELECT COALESCE(MAX(position), -1) + 1 FROM album_photos WHERE album_id = ?)
+		FROM photos WHERE id = ?
+	`)
+	if err != nil {
+		return false, err
+	}
+	defer add.Close()
+	changed := false
+	for _, id := range photoIDs {
+		if current[id] {
+			delete(current, id)
+			continue
+		}
+		res, err := add.Exec(albumID, now, albumID, id)
+		if err != nil {
+			return false, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			changed = true
+		}
+	}
+
+	remove, err := tx.Prepare("DELETE FROM album_photos WHERE album_id = ? AND photo_id = ?")
+	if err != nil {
+		return false, err
+	}
+	defer remove.Close()
+	for id := range current {
+		if _, err := remove.Exec(albumID, id); err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	if changed {
+		if _, err := tx.Exec(`
+			UPDATE albums SET updated_at = ?,
+				cover_id = CASE WHEN cover_id IN (SELECT photo_id FROM album_photos WHERE album_id = ?) THEN cover_id ELSE 0 END
+			WHERE id = ?
+		`, now, albumID, albumID); err != nil {
+			return false, err
+		}
+	}
+	return changed, tx.Commit()
+}
+
+// ReorderAlbum arranges an album's photos with photoIDs first, in that
+// order, and the rest after them in their current order, and switches the
+// album to manual sorting. IDs not in the album are ignored. It returns
+// sql.ErrNoRows if the album doesn't exist.
+func (db *DB) ReorderAlbum(albumID int64, photoIDs []int64) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The order the album is shown in now, which the rest keep
+	rows, err := tx.Query(`
+		SELECT ap.photo_id FROM album_photos ap JOIN photos p ON p.id = ap.photo_id JOIN albums a ON a.id = ap.album_id
+		WHERE ap.album_id = ?
+		ORDER BY `+albumOrder("a"), albumID)
+	if err != nil {
+		return err
+	}
+	var current []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		current = append(current, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	in := make(map[int64]bool, len(current))
+	for _, id := range current {
+		in[id] = true
+	}
+	order := make([]int64, 0, len(current))
+	for _, id := range photoIDs {
+		if in[id] {
+			order = append(order, id)
+			delete(in, id) // once each
+		}
+	}
+	for _, id := range current {
+		if in[id] {
+			order = append(order, id)
+		}
+	}
+
+	res, err := tx.Exec("UPDATE albums SET sort = 'manual', updated_at = ? WHERE id = ?", time.Now(), albumID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	stmt, err := tx.Prepare("UPDATE album_photos SET position = ? WHERE album_id = ? AND photo_id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, id := range order {
+		if _, err := stmt.Exec(i, albumID, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+const jobColumns = `id, type, class, state, payload, attempts, max_attempts, total, done, error, created_at, run_after, started_at, finished_at`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*models.Job, error) {
+	j := &models.Job{}
+	err := row.Scan(&j.ID, &j.Type, &j.Class, &j.State, &j.Payload, &j.Attempts, &j.MaxAttempts,
+		&j.Total, &j.Done, &j.Error, &j.CreatedAt, &j.RunAfter, &j.StartedAt, &j.FinishedAt)
+	return j, err
+}
+
+// InsertJob stores a new job and fills in its ID.
+func (db *DB) InsertJob(j *models.Job) error {
+	res, err := db.exec(`
+		INSERT INTO jobs (type, class, state, payload, attempts, max_attempts, created_at, run_after)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, j.Type, j.Class, j.State, j.Payload, j.Attempts, j.MaxAttempts, j.CreatedAt, j.RunAfter)
+	if err != nil {
+		return err
+	}
+	j.ID, err = res.LastInsertId()
+	return err
+}
+
+// UpdateJob saves a job's state, progress and timestamps.
+func (db *DB) UpdateJob(j *models.Job) error {
+	_, err := db.exec(`
+		UPDATE jobs SET state = ?, attempts = ?, total = ?, done = ?, error = ?,
+			run_after = ?, started_at = ?, finished_at = ?
+		WHERE id = ?
+	`, j.State, j.Attempts, j.Total, j.Done, j.Error, j.RunAfter, j.StartedAt, j.FinishedAt, j.ID)
+	return err
+}
+
+// ClaimJob marks a queued job as running and counts the attempt. It returns
+// false if the job is no longer queued.
+func (db *DB) ClaimJob(id int64, now time.Time) (bool, error) {
+	res, err := db.exec(`
+		UPDATE jobs SET state = 'running', attempts = attempts + 1, error = '',
+			started_at = ?, finished_at = NULL
+		WHERE id = ? AND state = 'queued'
+	`, now, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// CancelQueuedJob marks a queued job as canceled. It returns false if the
+// job is not queued.
+func (db *DB) CancelQueuedJob(id int64, now time.Time) (bool, error) {
+	res, err := db.exec(`
+		UPDATE jobs SET state = 'canceled', finished_at = ?
+		WHERE id = ? AND state = 'queued'
+	`, now, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// GetJob returns a single job by ID.
+func (db *DB) GetJob(id int64) (*models.Job, error) {
+	return scanJob(db.conn.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE id = ?", id))
+}
+
+// GetJobs returns the most recent jobs, newest first.
+func (db *DB) GetJobs(limit int) ([]*models.Job, error) {
+	return db.queryJobs("SELECT "+jobColumns+" FROM jobs ORDER BY id DESC LIMIT ?", limit)
+}
+
+// GetRunnableJobs returns queued jobs whose retry delay has passed, oldest
+// first.
+func (db *DB) GetRunnableJobs(now time.Time) ([]*models.Job, error) {
+	return db.queryJobs("SELECT "+jobColumns+" FROM jobs WHERE state = 'queued' AND run_after <= ? ORDER BY id", now)
+}
+
+// GetActiveJob returns the oldest queued or running job of a type, or nil
+// if there is none.
+func (db *DB) GetActiveJob(jobType string) (*models.Job, error) {
+	j, err := scanJob(db.conn.QueryRow(
+		"SELECT "+jobColumns+" FROM jobs WHERE type = ? AND state IN ('queued', 'running') ORDER BY id LIMIT 1", jobType))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return j, err
+}
+
+func (db *DB) queryJobs(query string, args ...interface{}) ([]*models.Job, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]*models.Job, 0)
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// RequeueInterruptedJobs puts jobs left running by a previous process back
+// in the queue. Returns the number requeued.
+func (db *DB) RequeueInterruptedJobs() (int64, error) {
+	res, err := db.exec("UPDATE jobs SET state = 'queued' WHERE state = 'running'")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// PruneJobs deletes finished jobs older than the given time.
+func (db *DB) PruneJobs(before time.Time) (int64, error) {
+	res, err := db.exec(`
+		DELETE FROM jobs
+		WHERE state IN ('done', 'failed', 'canceled') AND finished_at < ?
+	`, before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// RecordThumbTiming stores how long a thumbnail took to generate, replacing
+// any earlier timing for the same file and size.
+func (db *DB) RecordThumbTiming(path, size string, took time.Duration) error {
+	_, err := db.exec(`
+		INSERT OR REPLACE INTO thumb_timings (path, size, duration_ms, generated_at)
+		VALUES (?, ?, ?, ?)
+	`, path, size, took.Milliseconds(), time.Now())
+	return err
+}
+
+// GetSlowestThumbs returns the slowest thumbnail generations, slowest first.
+func (db *DB) GetSlowestThumbs(limit int) ([]*models.ThumbTiming, error) {
+	rows, err := db.conn.Query(`
+		SELECT p.id, p.path, p.media_type, p.width, p.height, p.file_size,
+			t.size, t.duration_ms, t.generated_at
+		FROM thumb_timings t
+		JOIN photos p ON p.path = t.path
+		ORDER BY t.duration_ms DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	timings := make([]*models.ThumbTiming, 0)
+	for rows.Next() {
+		t := &models.ThumbTiming{}
+		if err := rows.Scan(&t.PhotoID, &t.Path, &t.MediaType, &t.Width, &t.Height, &t.FileSize,
+			&t.Size, &t.DurationMS, &t.GeneratedAt); err != nil {
+			continue
+		}
+		timings = append(timings, t)
 	}
+	return timings, rows.Err()
+}
 
-	now := time.Now()
-	currentYear := now.Year()
-	var memories []*models.Photo
+// GetThumbLatencies returns generation time percentiles for each thumbnail
+// size.
+func (db *DB) GetThumbLatencies() (map[string]*models.ThumbLatency, error) {
+	rows, err := db.conn.Query("SELECT size, duration_ms FROM thumb_timings ORDER BY size, duration_ms")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	for i := 1; i <= maxCount; i++ {
-		targetYear := currentYear - (i * 5)
-		if targetYear < 1900 {
-			break
+	durations := make(map[string][]int64)
+	for rows.Next() {
+		var size string
+		var ms int64
+		if err := rows.Scan(&size, &ms); err != nil {
+			continue
+		}
+		durations[size] = append(durations[size], ms)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Rows arrive sorted, so percentiles are direct lookups
+	stats := make(map[string]*models.ThumbLatency, len(durations))
+	for size, d := range durations {
+		n := len(d)
+		stats[size] = &models.ThumbLatency{
+			Count: n,
+			P50MS: d[(n-1)*50/100],
+			P95MS: d[(n-1)*95/100],
+			MaxMS: d[n-1],
 		}
+	}
+	return stats, nil
+}
 
-		start := time.Date(targetYear, 1, 1, 0, 0, 0, 0, time.UTC)
-		end := time.Date(targetYear, 12, 31, 23, 59, 59, 999999999, time.UTC)
+// RecordView counts one view of a photo.
+func (db *DB) RecordView(photoID int64) error {
+	_, err := db.exec(`
+		INSERT INTO photo_views (photo_id, views, last_viewed_at) VALUES (?, 1, ?)
+		ON CONFLICT(photo_id) DO UPDATE SET
+			views = views + 1,
+			last_viewed_at = excluded.last_viewed_at
+	`, photoID, time.Now())
+	return err
+}
 
-		row := db.conn.QueryRow(`
-			SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at
-			FROM photos
-			WHERE taken_at BETWEEN ? AND ?
-			ORDER BY RANDOM()
-			LIMIT 1
-		`, start, end)
+// GetPopularPhotos returns the most viewed photos, most views first.
+func (db *DB) GetPopularPhotos(limit int) ([]*models.PhotoViews, error) {
+	rows, err := db.conn.Query(`
+		SELECT p.id, p.path, p.filename, p.taken_at, p.width, p.height, p.orientation, p.media_type, p.file_size, p.duration, p.thumb_path, p.indexed_at, p.place, p.hdr,
+			v.views, v.last_viewed_at
+		FROM photo_views v
+		JOIN photos p ON p.id = v.photo_id
+		ORDER BY v.views DESC, v.last_viewed_at DESC
+		LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	result := make([]*models.PhotoViews, 0)
+	for rows.Next() {
 		p := &models.Photo{}
-		if err := row.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt); err != nil {
-			if err == sql.ErrNoRows {
+		pv := &models.PhotoViews{Photo: p}
+		if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR,
+			&pv.Views, &pv.LastViewedAt); err != nil {
+			continue
+		}
+		db.markAvailability(p)
+		result = append(result, pv)
+	}
+	return result, rows.Err()
+}
+
+// HashCandidate is an indexed file that may share content with an upload.
+type HashCandidate struct {
+	ID   int64
+	Path string
+	Hash string // empty if not computed yet
+}
+
+// GetHashCandidates returns every indexed file with the given size, along
+// with its stored content hash (if any). Size is checked first so uploads
+// only ever need to hash a handful of existing files.
+func (db *DB) GetHashCandidates(size int64) ([]HashCandidate, error) {
+	rows, err := db.conn.Query("SELECT id, path, content_hash FROM photos WHERE file_size = ?", size)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []HashCandidate
+	for rows.Next() {
+		var c HashCandidate
+		if err := rows.Scan(&c.ID, &c.Path, &c.Hash); err != nil {
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// SetContentHash stores the content hash for a photo.
+func (db *DB) SetContentHash(id int64, hash string) error {
+	_, err := db.exec("UPDATE photos SET content_hash = ? WHERE id = ?", hash, id)
+	return err
+}
+
+// GetUnhashedDuplicateSizes returns the files without a content hash that
+// share their size with another file: the only ones that can be duplicates.
+func (db *DB) GetUnhashedDuplicateSizes() ([]HashCandidate, error) {
+	return db.unhashed(`
+		SELECT id, path, content_hash FROM photos
+		WHERE content_hash = '' AND file_size IN (
+			SELECT file_size FROM photos GROUP BY file_size HAVING COUNT(*) > 1
+		)
+		ORDER BY file_size DESC
+	`)
+}
+
+// GetUnhashedFiles returns every file without a content hash, newest
+// indexed first.
+func (db *DB) GetUnhashedFiles() ([]HashCandidate, error) {
+	return db.unhashed(`SELECT id, path, content_hash FROM photos WHERE content_hash = '' ORDER BY indexed_at DESC`)
+}
+
+func (db *DB) unhashed(query string) ([]HashCandidate, error) {
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []HashCandidate
+	for rows.Next() {
+		var c HashCandidate
+		if err := rows.Scan(&c.ID, &c.Path, &c.Hash); err != nil {
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// GetPhotoIDsByHash returns the IDs of the files with the given content
+// hash, oldest indexed first.
+func (db *DB) GetPhotoIDsByHash(hash string) ([]int64, error) {
+	rows, err := db.conn.Query("SELECT id FROM photos WHERE content_hash = ? ORDER BY id", hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetDuplicateGroups returns a page of groups of files with identical
+// content, those wasting the most space first, with the total number of
+// groups and the bytes taken by redundant copies across all of them. Each
+// group's photos are oldest indexed first. An empty hash lists every
+// group, otherwise just that one.
+func (db *DB) GetDuplicateGroups(hash string, offset, limit int) ([]*models.DuplicateGroup, int, int64, error) {
+	filter := "content_hash != ''"
+	var args []interface{}
+	if hash != "" {
+		filter = "content_hash = ?"
+		args = append(args, hash)
+	}
+
+	var total int
+	var wasted int64
+	if err := db.conn.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(file_size * (n - 1)), 0) FROM (
+			SELECT file_size, COUNT(*) AS n FROM photos WHERE `+filter+`
+			GROUP BY content_hash HAVING n > 1
+		)
+	`, args...).Scan(&total, &wasted); err != nil {
+		return nil, 0, 0, err
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT content_hash, file_size FROM photos WHERE `+filter+`
+		GROUP BY content_hash HAVING COUNT(*) > 1
+		ORDER BY file_size * (COUNT(*) - 1) DESC, content_hash
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	groups := make([]*models.DuplicateGroup, 0)
+	for rows.Next() {
+		g := &models.DuplicateGroup{}
+		if err := rows.Scan(&g.Hash, &g.Size); err != nil {
+			continue
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	for _, g := range groups {
+		rows, err := db.conn.Query(`
+			SELECT id, path, filename, taken_at, width, height, orientation, media_type, file_size, duration, thumb_path, indexed_at, place, hdr
+			FROM photos WHERE content_hash = ?
+			ORDER BY id
+		`, g.Hash)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		for rows.Next() {
+			p := &models.Photo{}
+			if err := rows.Scan(&p.ID, &p.Path, &p.Filename, &p.TakenAt, &p.Width, &p.Height, &p.Orientation, &p.MediaType, &p.FileSize, &p.Duration, &p.ThumbPath, &p.IndexedAt, &p.Place, &p.HDR); err != nil {
 				continue
 			}
+			db.markAvailability(p)
+			g.Photos = append(g.Photos, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return groups, total, wasted, nil
+}
+
+// RecordIndexError stores (or updates) the most recent indexing error for a
+// path, counting how many times it has failed.
+func (db *DB) RecordIndexError(path, stage, message string) error {
+	_, err := db.exec(`
+		INSERT INTO index_errors (path, stage, message, attempts, occurred_at)
+		VALUES (?, ?, ?, 1, ?)
+		ON CONFLICT(path) DO UPDATE SET
+			stage=excluded.stage,
+			message=excluded.message,
+			attempts=attempts+1,
+			occurred_at=excluded.occurred_at
+	`, path, stage, message, time.Now())
+	return err
+}
+
+// ClearIndexError removes the error record for a path (after it indexed fine).
+func (db *DB) ClearIndexError(path string) error {
+	_, err := db.exec("DELETE FROM index_errors WHERE path = ?", path)
+	return err
+}
+
+// DeleteIndexError dismisses an error record by ID.
+func (db *DB) DeleteIndexError(id int64) error {
+	_, err := db.exec("DELETE FROM index_errors WHERE id = ?", id)
+	return err
+}
+
+// GetIndexErrors returns all recorded indexing errors, most recent first.
+func (db *DB) GetIndexErrors() ([]*models.IndexError, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, path, stage, message, attempts, occurred_at
+		FROM index_errors ORDER BY occurred_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	errs := make([]*models.IndexError, 0)
+	for rows.Next() {
+		e := &models.IndexError{}
+		if err := rows.Scan(&e.ID, &e.Path, &e.Stage, &e.Message, &e.Attempts, &e.OccurredAt); err != nil {
+			continue
+		}
+		errs = append(errs, e)
+	}
+	return errs, rows.Err()
+}
+
+// GetIndexErrorPaths returns the set of paths with a recorded error.
+func (db *DB) GetIndexErrorPaths() (map[string]bool, error) {
+	rows, err := db.conn.Query("SELECT path FROM index_errors")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			continue
+		}
+		paths[path] = true
+	}
+	return paths, rows.Err()
+}
+
+// IntegrityCheck runs SQLite's integrity_check (or the faster quick_check)
+// and returns its findings, which are empty when the database is healthy.
+func (db *DB) IntegrityCheck(quick bool) ([]string, error) {
+	pragma := "PRAGMA integrity_check"
+	if quick {
+		pragma = "PRAGMA quick_check"
+	}
+	rows, err := db.conn.Query(pragma)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
 			return nil, err
 		}
-		memories = append(memories, p)
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// DeleteUsersExcept removes every login account not named in keep, with
+// its sessions, and returns the number removed.
+func (db *DB) DeleteUsersExcept(keep []string) (int64, error) {
+	if len(keep) == 0 {
+		res, err := db.exec("DELETE FROM users")
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+	args := make([]interface{}, len(keep))
+	for i, name := range keep {
+		args[i] = name
 	}
+	res, err := db.exec("DELETE FROM users WHERE username NOT IN (?"+strings.Repeat(",?", len(keep)-1)+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
 
-	return memories, nil
+// CreateUser adds a login account with an already hashed password.
+func (db *DB) CreateUser(username, passwordHash string, admin bool) (*models.User, error) {
+	u := &models.User{Username: username, Admin: admin, CreatedAt: time.Now()}
+	res, err := db.exec(`
+		INSERT INTO users (username, password_hash, is_admin, created_at)
+		VALUES (?, ?, ?, ?)
+	`, username, passwordHash, admin, u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	u.ID, err = res.LastInsertId()
+	return u, err
 }
 
-// RemoveDotfiles deletes indexed entries whose filename starts with a dot
-// (hidden files, .pending-* sync temp files, etc.). These should never have
-// been indexed and will never produce valid thumbnails.
-func (db *DB) RemoveDotfiles() (int64, error) {
-	result, err := db.conn.Exec(`DELETE FROM photos WHERE filename LIKE '.%'`)
+// GetUserByName returns an account and its password hash, or
+// sql.ErrNoRows if there is none.
+func (db *DB) GetUserByName(username string) (*models.User, string, error) {
+	u := &models.User{}
+	var hash string
+	err := db.conn.QueryRow(`
+		SELECT id, username, is_admin, created_at, password_hash FROM users WHERE username = ?
+	`, username).Scan(&u.ID, &u.Username, &u.Admin, &u.CreatedAt, &hash)
+	if err != nil {
+		return nil, "", err
+	}
+	return u, hash, nil
+}
+
+// SetUserPassword replaces an account's password hash and signs it out
+// everywhere.
+func (db *DB) SetUserPassword(id int64, passwordHash string) error {
+	if _, err := db.exec("UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, id); err != nil {
+		return err
+	}
+	_, err := db.exec("DELETE FROM sessions WHERE user_id = ?", id)
+	return err
+}
+
+// SetUserAdmin grants or revokes an account's admin rights. Revoking them
+// signs it out everywhere, so no session keeps admin access.
+func (db *DB) SetUserAdmin(id int64, admin bool) error {
+	if _, err := db.exec("UPDATE users SET is_admin = ? WHERE id = ?", admin, id); err != nil {
+		return err
+	}
+	if admin {
+		return nil
+	}
+	_, err := db.exec("DELETE FROM sessions WHERE user_id = ?", id)
+	return err
+}
+
+// CreateSession stores a session for a user, keyed by its token's hash.
+func (db *DB) CreateSession(tokenHash string, userID int64, expires time.Time) error {
+	_, err := db.exec(`
+		INSERT INTO sessions (token_hash, user_id, created_at, expires_at)
+		VALUES (?, ?, ?, ?)
+	`, tokenHash, userID, time.Now(), expires.Unix())
+	return err
+}
+
+// GetSessionUser returns the account of an unexpired session, or
+// sql.ErrNoRows if the session is unknown or expired.
+func (db *DB) GetSessionUser(tokenHash string) (*models.User, error) {
+	u := &models.User{}
+	err := db.conn.QueryRow(`
+		SELECT u.id, u.username, u.is_admin, u.created_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ?
+	`, tokenHash, time.Now().Unix()).Scan(&u.ID, &u.Username, &u.Admin, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// DeleteSession ends a session.
+func (db *DB) DeleteSession(tokenHash string) error {
+	_, err := db.exec("DELETE FROM sessions WHERE token_hash = ?", tokenHash)
+	return err
+}
+
+// DeleteExpiredSessions removes sessions past their expiry.
+func (db *DB) DeleteExpiredSessions() error {
+	_, err := db.exec("DELETE FROM sessions WHERE expires_at <= ?", time.Now().Unix())
+	return err
+}
+
+// GetSettings fills in s with an account's saved preferences. Fields it
+// never saved keep the values s already has.
+func (db *DB) GetSettings(userID int64, s *models.Settings) error {
+	var data string
+	err := db.conn.QueryRow("SELECT data FROM user_settings WHERE user_id = ?", userID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), s)
+}
+
+// SetSettings saves an account's preferences.
+func (db *DB) SetSettings(userID int64, s *models.Settings) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = db.exec(`
+		INSERT INTO user_settings (user_id, data, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at
+	`, userID, string(data), time.Now())
+	return err
+}
+
+// PhotoMark is a per-account mark on a photo.
+type PhotoMark string
+
+const (
+	MarkFavorite PhotoMark = "favorite"
+	MarkArchived PhotoMark = "archived"
+)
+
+// GetPhotoMarks fills in p.Favorite and p.Archived from an account's marks.
+func (db *DB) GetPhotoMarks(userID int64, p *models.Photo) error {
+	err := db.conn.QueryRow("SELECT favorite, archived FROM photo_marks WHERE user_id = ? AND photo_id = ?",
+		userID, p.ID).Scan(&p.Favorite, &p.Archived)
+	if err == sql.ErrNoRows {
+		p.Favorite, p.Archived = false, false
+		return nil
+	}
+	return err
+}
+
+// SetPhotoMark sets or clears one of an account's marks on a photo.
+func (db *DB) SetPhotoMark(userID, photoID int64, mark PhotoMark, on bool) error {
+	if mark != MarkFavorite && mark != MarkArchived {
+		return fmt.Errorf("unknown photo mark %q", mark)
+	}
+	_, err := db.exec(fmt.Sprintf(`
+		INSERT INTO photo_marks (user_id, photo_id, %[1]s) VALUES (?, ?, ?)
+		ON CONFLICT(user_id, photo_id) DO UPDATE SET %[1]s = excluded.%[1]s
+	`, mark), userID, photoID, on)
+	return err
+}
+
+// TrashPhoto records item, a photo whose file has been moved into the
+// trash, and removes the photo from the library. The albums it was in are
+// saved in item.Albums first, and item.ID is set.
+func (db *DB) TrashPhoto(item *models.TrashItem) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT album_id FROM album_photos WHERE photo_id = ? ORDER BY album_id", item.PhotoID)
+	if err != nil {
+		return err
+	}
+	item.Albums = nil
+	var albums []string
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		item.Albums = append(item.Albums, id)
+		albums = append(albums, strconv.FormatInt(id, 10))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO trash (photo_id, path, dir, filename, media_type, taken_at, file_size, width, height, owner_id, albums, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, item.PhotoID, item.Path, item.Dir, item.Filename, item.MediaType, item.TakenAt, item.FileSize,
+		item.Width, item.Height, item.OwnerID, strings.Join(albums, ","), item.DeletedAt)
+	if err != nil {
+		return err
+	}
+	if item.ID, err = res.LastInsertId(); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM photos WHERE id = ?", item.PhotoID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const trashColumns = `id, photo_id, path, dir, filename, media_type, taken_at, file_size, width, height, owner_id, albums, deleted_at`
+
+// GetTrash returns the items in the trash, most recently deleted first.
+// With owner set, only that user's items are returned.
+func (db *DB) GetTrash(owner int64) ([]*models.TrashItem, error) {
+	query := "SELECT " + trashColumns + " FROM trash"
+	var args []interface{}
+	if owner != 0 {
+		query += " WHERE owner_id = ?"
+		args = append(args, owner)
+	}
+	return db.trashItems(query+" ORDER BY deleted_at DESC, id DESC", args...)
+}
+
+// GetTrashItem returns the item in the trash with the given ID, or
+// sql.ErrNoRows.
+func (db *DB) GetTrashItem(id int64) (*models.TrashItem, error) {
+	items, err := db.trashItems("SELECT "+trashColumns+" FROM trash WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return items[0], nil
+}
+
+// GetExpiredTrash returns the items deleted before the given time.
+func (db *DB) GetExpiredTrash(before time.Time) ([]*models.TrashItem, error) {
+	return db.trashItems("SELECT "+trashColumns+" FROM trash WHERE deleted_at < ? ORDER BY deleted_at", before)
+}
+
+func (db *DB) trashItems(query string, args ...interface{}) ([]*models.TrashItem, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]*models.TrashItem, 0)
+	for rows.Next() {
+		t := &models.TrashItem{}
+		var albums string
+		if err := rows.Scan(&t.ID, &t.PhotoID, &t.Path, &t.Dir, &t.Filename, &t.MediaType, &t.TakenAt,
+			&t.FileSize, &t.Width, &t.Height, &t.OwnerID, &albums, &t.DeletedAt); err != nil {
+			continue
+		}
+		for _, a := range strings.Split(albums, ",") {
+			if id, err := strconv.ParseInt(a, 10, 64); err == nil {
+				t.Albums = append(t.Albums, id)
+			}
+		}
+		items = append(items, t)
+	}
+	return items, rows.Err()
+}
+
+// DeleteTrashItem forgets an item in the trash, once its files have been
+// restored or purged.
+func (db *DB) DeleteTrashItem(id int64) error {
+	_, err := db.exec("DELETE FROM trash WHERE id = ?", id)
+	return err
+}
+
+// ResetDanglingCovers points albums whose chosen cover no longer exists back
+// at their first photo. It returns the number of albums changed.
+func (db *DB) ResetDanglingCovers() (int64, error) {
+	res, err := db.exec(`
+		UPDATE albums SET cover_id = 0
+		WHERE cover_id != 0 AND cover_id NOT IN (SELECT id FROM photos)
+	`)
 	if err != nil {
 		return 0, err
 	}
-	return result.RowsAffected()
+	return res.RowsAffected()
+}
+
+// Analyze refreshes SQLite's table statistics, which the query planner
+// relies on after bulk changes.
+func (db *DB) Analyze() error {
+	_, err := db.exec("ANALYZE")
+	return err
 }
 
 // Close closes the database connection.
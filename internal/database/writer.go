@@ -0,0 +1,88 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Writes that find the database locked, by another process such as
+// `photog backup` or by a WAL checkpoint, are retried this many times,
+// waiting writeBackoff, then twice as long each time, in between. Each
+// attempt already waits out the connection's busy timeout.
+const (
+	writeAttempts = 5
+	writeBackoff  = 100 * time.Millisecond
+)
+
+// writeReq is a write waiting in the queue.
+type writeReq struct {
+	fn   func() error
+	done chan error
+}
+
+// startWriter starts the goroutine all writes go through, one at a time.
+func (db *DB) startWriter() {
+	db.writes = make(chan writeReq)
+	go func() {
+		for req := range db.writes {
+			req.done <- retryBusy(req.fn)
+		}
+	}()
+}
+
+// write runs fn on the writer goroutine and returns its error, retrying it
+// while the database is locked.
+func (db *DB) write(fn func() error) error {
+	done := make(chan error, 1)
+	db.writes <- writeReq{fn: fn, done: done}
+	return <-done
+}
+
+// exec runs a statement that changes the database through the write queue.
+func (db *DB) exec(query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := db.write(func() error {
+		var err error
+		res, err = db.conn.Exec(query, args...)
+		return err
+	})
+	return res, err
+}
+
+// begin starts a transaction through the write queue. Transactions take
+// the write lock up front (see _txlock in New), so a locked database shows
+// here, where it can be retried, rather than halfway through.
+func (db *DB) begin() (*sql.Tx, error) {
+	var tx *sql.Tx
+	err := db.write(func() error {
+		var err error
+		tx, err = db.conn.Begin()
+		return err
+	})
+	return tx, err
+}
+
+// retryBusy runs fn, again after a backoff while it fails because the
+// database is locked.
+func retryBusy(fn func() error) error {
+	wait := writeBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); !isBusy(err) || attempt == writeAttempts {
+			return err
+		}
+		log.Printf("Database: locked, retrying write in %v", wait)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// isBusy reports whether err means the database was locked.
+func isBusy(err error) bool {
+	var serr sqlite3.Error
+	return errors.As(err, &serr) && (serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+
+// Package diskspace reports free space on the volume holding a path.
+package diskspace
+
+import "errors"
+
+// ErrUnsupported is returned on platforms where free space can't be read.
+var ErrUnsupported = errors.New("free space check not supported on this platform")
+
+// Free returns the bytes available on the volume holding path.
+func Free(path string) (uint64, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+// Package diskspace reports free space on the volume holding a path.
+package diskspace
+
+import "syscall"
+
+// Free returns the bytes available to unprivileged users on the volume
+// holding path.
+func Free(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,91 @@
+package events
+
+import (
+	"fmt"
+	"time"
+
+	"photog/internal/config"
+	"photog/internal/database"
+	"photog/internal/models"
+)
+
+// Rebuild clusters the library into events by gaps in capture time and
+// replaces the stored events. It returns the number of events found.
+func Rebuild(db *database.DB, cfg config.EventsConfig) (int, error) {
+	gap := time.Duration(cfg.Gap) * time.Hour
+	if gap <= 0 {
+		gap = 8 * time.Hour
+	}
+	minPhotos := cfg.MinPhotos
+	if minPhotos < 2 {
+		minPhotos = 2
+	}
+
+	times, err := db.GetPhotoTimes()
+	if err != nil {
+		return 0, err
+	}
+
+	var events []*models.Event
+	flush := func(cluster []database.PhotoTime) {
+		if len(cluster) < minPhotos {
+			return
+		}
+		events = append(events, newEvent(cluster))
+	}
+
+	start := 0
+	for i := 1; i <= len(times); i++ {
+		if i == len(times) || times[i].TakenAt.Sub(times[i-1].TakenAt) > gap {
+			flush(times[start:i])
+			start = i
+		}
+	}
+
+	if err := db.ReplaceEvents(events); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// newEvent builds an event from a time-ordered cluster. The cover is the
+// image nearest the middle of the event.
+func newEvent(cluster []database.PhotoTime) *models.Event {
+	first, last := cluster[0], cluster[len(cluster)-1]
+	e := &models.Event{
+		ID:         first.ID,
+		StartAt:    first.TakenAt,
+		EndAt:      last.TakenAt,
+		PhotoCount: len(cluster),
+		CoverID:    cluster[len(cluster)/2].ID,
+	}
+	e.Title = Title(e.StartAt, e.EndAt)
+
+	mid := len(cluster) / 2
+	for d := 0; d <= mid; d++ {
+		if i := mid - d; cluster[i].MediaType != "video" {
+			e.CoverID = cluster[i].ID
+			break
+		}
+		if i := mid + d; i < len(cluster) && cluster[i].MediaType != "video" {
+			e.CoverID = cluster[i].ID
+			break
+		}
+	}
+	return e
+}
+
+// Title formats a date range as a short event title, e.g.
+// "Saturday, July 12, 2025", "July 12–15, 2025" or "Dec 30, 2024 – Jan 2, 2025".
+func Title(start, end time.Time) string {
+	switch {
+	case start.Year() != end.Year():
+		return fmt.Sprintf("%s – %s", start.Format("Jan 2, 2006"), end.Format("Jan 2, 2006"))
+	case start.Month() != end.Month():
+		return fmt.Sprintf("%s – %s", start.Format("January 2"), end.Format("January 2, 2006"))
+	case start.Day() != end.Day():
+		return fmt.Sprintf("%s–%d, %d", start.Format("January 2"), end.Day(), end.Year())
+	default:
+		return start.Format("Monday, January 2, 2006")
+	}
+}
@@ -0,0 +1,184 @@
+package export
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"photog/internal/background"
+	"photog/internal/config"
+	"photog/internal/database"
+	"photog/internal/thumbnail"
+)
+
+// exportedName matches files written by an export
+// ("photog-<id>-<name>.jpg"), so syncing never deletes files photog didn't
+// create. The prefix keeps camera names like 20230512_143022.jpg out.
+var exportedName = regexp.MustCompile(`^photog-\d+-.+\.jpg$`)
+
+// Scheduler periodically syncs each configured export folder.
+type Scheduler struct {
+	exports []config.ExportConfig
+	db      *database.DB
+	thumbs  *thumbnail.Generator
+	stop    chan struct{}
+}
+
+// New creates an export scheduler for the configured exports.
+func New(exports []config.ExportConfig, db *database.DB, thumbs *thumbnail.Generator) *Scheduler {
+	return &Scheduler{
+		exports: exports,
+		db:      db,
+		thumbs:  thumbs,
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start begins one sync loop per export. Each export syncs once at start.
+func (s *Scheduler) Start() {
+	for _, e := range s.exports {
+		if e.Target == "" {
+			log.Printf("Export: %q has no target, skipping", e.Name)
+			continue
+		}
+		go s.loop(e)
+	}
+}
+
+// Stop signals all export loops to stop.
+func (s *Scheduler) Stop() {
+	close(s.stop)
+}
+
+func (s *Scheduler) loop(e config.ExportConfig) {
+	background.Enter()
+	interval := time.Duration(e.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	log.Printf("Export: %q syncing to %s every %s", e.Name, e.Target, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Sync(e); err != nil {
+			log.Printf("Export: %q sync error: %v", e.Name, err)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync writes any missing photos matching the export's filter into its
+// target folder and removes exported files that no longer match.
+func (s *Scheduler) Sync(e config.ExportConfig) error {
+	filter, err := toFilter(e.Filter)
+	if err != nil {
+		return err
+	}
+	photos, err := s.db.FilterPhotos(filter)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(e.Target, 0755); err != nil {
+		return err
+	}
+
+	size := e.Size
+	if size <= 0 {
+		size = 1920
+	}
+
+	want := make(map[string]bool, len(photos))
+	var added, errors int
+	for _, p := range photos {
+		select {
+		case <-s.stop:
+			return nil
+		default:
+		}
+
+		base := strings.TrimSuffix(p.Filename, filepath.Ext(p.Filename))
+		name := fmt.Sprintf("photog-%d-%s.jpg", p.ID, base)
+		want[name] = true
+
+		dst := filepath.Join(e.Target, name)
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+
+		data, err := s.thumbs.RenderJPEGMax(p.Path, size)
+		if err != nil {
+			errors++
+			continue
+		}
+		// Write under a dotfile name first so sync clients never pick up
+		// a partial file.
+		tmp := filepath.Join(e.Target, ".pending-"+name)
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			errors++
+			continue
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			os.Remove(tmp)
+			errors++
+			continue
+		}
+		added++
+	}
+
+	// Remove exported files that fell out of the filter (or were deleted)
+	var removed int
+	entries, err := os.ReadDir(e.Target)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !exportedName.MatchString(name) || want[name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(e.Target, name)); err == nil {
+			removed++
+		}
+	}
+
+	if added > 0 || removed > 0 || errors > 0 {
+		log.Printf("Export: %q synced — added %d, removed %d, errors %d", e.Name, added, removed, errors)
+	}
+	return nil
+}
+
+// toFilter converts the config filter into a database filter. Exports are
+// JPEG only, so videos are always excluded.
+func toFilter(f config.ExportFilter) (database.PhotoFilter, error) {
+	df := database.PhotoFilter{
+		PathPrefix:  f.PathPrefix,
+		MediaType:   "image",
+		Orientation: f.Orientation,
+	}
+	if f.From != "" {
+		t, err := time.Parse("2006-01-02", f.From)
+		if err != nil {
+			return df, fmt.Errorf("invalid filter.from %q: %w", f.From, err)
+		}
+		df.From = t
+	}
+	if f.To != "" {
+		t, err := time.Parse("2006-01-02", f.To)
+		if err != nil {
+			return df, fmt.Errorf("invalid filter.to %q: %w", f.To, err)
+		}
+		df.To = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return df, nil
+}
@@ -0,0 +1,103 @@
+// Package folderalbums makes albums from the folder structure of the
+// library and keeps them in step with it.
+package folderalbums
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+
+	"photog/internal/config"
+	"photog/internal/database"
+	"photog/internal/models"
+)
+
+// Sync creates an album for each folder picked by cfg that doesn't have
+// one yet, sets every folder album's photos to those of its folder, and
+// removes the albums of folders that no longer hold photos. It returns the
+// number of folder albums.
+func Sync(db *database.DB, cfg config.AlbumsConfig) (int, error) {
+	existing, err := db.GetFolderAlbums()
+	if err != nil {
+		return 0, err
+	}
+	folders := make(map[string][]int64)
+	if cfg.FromFolders {
+		dirs, err := db.GetPhotoDirs()
+		if err != nil {
+			return 0, err
+		}
+		folders = group(db, dirs, cfg.FolderDepth)
+	}
+
+	for folder, ids := range folders {
+		id, ok := existing[folder]
+		if !ok {
+			a := &models.Album{Title: filepath.Base(folder), Folder: folder}
+			if err := db.CreateAlbum(a); err != nil {
+				return 0, err
+			}
+			id = a.ID
+		}
+		delete(existing, folder)
+		if _, err := db.SetAlbumPhotos(id, ids); err != nil {
+			return 0, err
+		}
+	}
+	for _, id := range existing {
+		if err := db.DeleteAlbum(id); err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+	return len(folders), nil
+}
+
+// group assigns photos to the folders their albums are made from: the
+// folder depth levels below the photo's root, or with depth 0 the photo's
+// own folder if no folder below it holds photos. Photos in no such folder
+// are left out.
+func group(db *database.DB, dirs []database.PhotoDir, depth int) map[string][]int64 {
+	// Folders with photos further down, which aren't leaves
+	parents := make(map[string]bool)
+	if depth <= 0 {
+		seen := make(map[string]bool)
+		for _, pd := range dirs {
+			if seen[pd.Dir] {
+				continue
+			}
+			seen[pd.Dir] = true
+			for dir := pd.Dir; ; {
+				parent := filepath.Dir(dir)
+				if parent == dir || parents[parent] || db.RootOf(parent) == "" {
+					break
+				}
+				parents[parent] = true
+				dir = parent
+			}
+		}
+	}
+
+	folders := make(map[string][]int64)
+	for _, pd := range dirs {
+		root := db.RootOf(pd.Dir)
+		if root == "" {
+			continue
+		}
+		folder := pd.Dir
+		if depth > 0 {
+			rel, err := filepath.Rel(root, pd.Dir)
+			if err != nil || rel == "." {
+				continue
+			}
+			parts := strings.Split(rel, string(filepath.Separator))
+			if len(parts) < depth {
+				continue
+			}
+			folder = filepath.Join(root, filepath.Join(parts[:depth]...))
+		} else if parents[folder] {
+			continue
+		}
+		folders[folder] = append(folders[folder], pd.ID)
+	}
+	return folders
+}
@@ -0,0 +1,192 @@
+// Package geocode turns GPS positions into place names ("Lyon, France")
+// without any network access. A small dataset of capitals and well-known
+// cities is bundled; a GeoNames cities export (e.g. cities1000.txt from
+// download.geonames.org) can be loaded instead for finer results.
+//
+// The bundled cities.tsv is a hand-maintained list of about 800 national
+// capitals and large cities, with coordinates to two decimals; it is not a
+// GeoNames extract. It is sparse outside big cities, which is why the
+// default distance limit is kept short. GeoNames files are licensed under
+// CC BY 4.0, so a deployment using one should credit GeoNames
+// (geonames.org).
+package geocode
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//go:embed countries.tsv
+var countriesTSV string
+
+//go:embed cities.tsv
+var citiesTSV string
+
+// bundledID identifies the bundled dataset; bump it when cities.tsv changes
+// so stored places are resolved again.
+const bundledID = "bundled-1"
+
+// earthRadiusKm is the mean radius used for distances.
+const earthRadiusKm = 6371.0
+
+type city struct {
+	name    string
+	country string // ISO 3166-1 alpha-2
+	lat     float64
+	lon     float64
+}
+
+// cellKey addresses a 1x1 degree grid cell.
+type cellKey struct{ lat, lon int }
+
+// Geocoder resolves positions to the nearest known city.
+type Geocoder struct {
+	id        string
+	maxDistKm float64
+	countries map[string]string
+	cities    []city
+	grid      map[cellKey][]int
+}
+
+// New loads the GeoNames cities file at dataset, or the bundled dataset
+// when dataset is empty. Positions farther than maxDistKm from every city
+// resolve to no place.
+func New(dataset string, maxDistKm float64) (*Geocoder, error) {
+	g := &Geocoder{
+		maxDistKm: maxDistKm,
+		countries: make(map[string]string),
+		grid:      make(map[cellKey][]int),
+	}
+	for _, line := range strings.Split(countriesTSV, "\n") {
+		if code, name, ok := strings.Cut(line, "\t"); ok {
+			g.countries[code] = name
+		}
+	}
+
+	if dataset == "" {
+		g.id = bundledID
+		if err := g.readCities(strings.NewReader(citiesTSV), 0, 2, 3, 1); err != nil {
+			return nil, err
+		}
+	} else {
+		f, err := os.Open(dataset)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		g.id = fmt.Sprintf("%s:%d:%d", dataset, info.Size(), info.ModTime().Unix())
+		// geonameid, name, asciiname, alternatenames, latitude, longitude,
+		// feature class, feature code, country code, ...
+		if err := g.readCities(f, 1, 4, 5, 8); err != nil {
+			return nil, fmt.Errorf("read %s: %w", dataset, err)
+		}
+		if len(g.cities) == 0 {
+			return nil, fmt.Errorf("read %s: no cities found", dataset)
+		}
+	}
+	g.id += ":" + strconv.FormatFloat(maxDistKm, 'f', -1, 64)
+	return g, nil
+}
+
+// readCities loads tab-separated cities, taking the name, coordinates and
+// country code from the given columns. Malformed lines, and so comment
+// lines without tabs, are skipped.
+func (g *Geocoder) readCities(r io.Reader, nameCol, latCol, lonCol, ccCol int) error {
+	need := max(nameCol, latCol, lonCol, ccCol)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) <= need {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(fields[latCol], 64)
+		lon, err2 := strconv.ParseFloat(fields[lonCol], 64)
+		if err1 != nil || err2 != nil || fields[nameCol] == "" {
+			continue
+		}
+		g.cities = append(g.cities, city{name: fields[nameCol], country: fields[ccCol], lat: lat, lon: lon})
+		key := cellOf(lat, lon)
+		g.grid[key] = append(g.grid[key], len(g.cities)-1)
+	}
+	return sc.Err()
+}
+
+// ID identifies the loaded dataset and distance limit. Places stored under
+// a different ID are stale.
+func (g *Geocoder) ID() string {
+	return g.id
+}
+
+// Lookup returns "City, Country" for the nearest city within the distance
+// limit, or "" if there is none.
+func (g *Geocoder) Lookup(lat, lon float64) string {
+	c := g.nearest(lat, lon)
+	if c == nil {
+		return ""
+	}
+	country := g.countries[c.country]
+	if country == "" {
+		country = c.country
+	}
+	if country == "" {
+		return c.name
+	}
+	return c.name + ", " + country
+}
+
+// nearest scans the grid cells the distance limit can reach.
+func (g *Geocoder) nearest(lat, lon float64) *city {
+	dLat := g.maxDistKm / 111.0
+	dLon := 180.0
+	if cos := math.Cos(math.Min(math.Abs(lat)+dLat, 90) * math.Pi / 180); cos > 0.01 {
+		dLon = math.Min(dLat/cos, 180)
+	}
+	lo, hi := cellOf(lat-dLat, lon-dLon), cellOf(lat+dLat, lon+dLon)
+	width := hi.lon - lo.lon
+	if width >= 360 {
+		width = 359
+	}
+
+	var best *city
+	bestDist := g.maxDistKm
+	for y := lo.lat; y <= hi.lat; y++ {
+		for i := 0; i <= width; i++ {
+			x := (lo.lon+i+180)%360 - 180
+			if x < -180 {
+				x += 360
+			}
+			for _, ci := range g.grid[cellKey{y, x}] {
+				c := &g.cities[ci]
+				if d := distanceKm(lat, lon, c.lat, c.lon); d <= bestDist {
+					best, bestDist = c, d
+				}
+			}
+		}
+	}
+	return best
+}
+
+func cellOf(lat, lon float64) cellKey {
+	return cellKey{int(math.Floor(lat)), int(math.Floor(lon))}
+}
+
+// distanceKm is the great-circle distance between two positions.
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const rad = math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
@@ -0,0 +1,402 @@
+// Package hdr recognizes HDR photos and maps HDR pixels into SDR sRGB for
+// thumbnails and other derivatives.
+//
+// Gain-map photos (Android Ultra HDR, Apple and ISO 21496-1 gain maps)
+// store a fully graded SDR base image plus a map to brighten it on HDR
+// screens; derivatives are rendered from the base image alone. HDR10 (PQ)
+// and HLG photos only have HDR code values, which look washed out and dark
+// when shown as sRGB, so they are tone mapped with ToneMap.
+package hdr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"photog/internal/archive"
+)
+
+// HDR kinds, as stored and reported by the API.
+const (
+	GainMap = "gain_map" // SDR base image plus gain map
+	PQ      = "pq"       // HDR10, SMPTE ST 2084
+	HLG     = "hlg"      // hybrid log-gamma, ARIB STD-B67
+)
+
+// Exts are the formats Detect looks into.
+var Exts = map[string]bool{".jpg": true, ".jpeg": true, ".heic": true, ".heif": true, ".avif": true}
+
+// BT2020Primaries is the ITU-T H.273 code point of the BT.2020 primaries.
+const BT2020Primaries = 9
+
+// TransferKind returns the HDR kind of an ITU-T H.273 transfer
+// characteristics code point, or "" for SDR transfers.
+func TransferKind(code int) string {
+	switch code {
+	case 16:
+		return PQ
+	case 18:
+		return HLG
+	}
+	return ""
+}
+
+// Markers of gain-map metadata in XMP and HEIF item properties.
+var gainMapMarkers = [][]byte{
+	[]byte("hdrgm:Version"),                           // Ultra HDR / Adobe XMP
+	[]byte("urn:iso:std:iso:ts:21496:-1"),             // ISO 21496-1 metadata
+	[]byte("urn:com:apple:photo:2020:aux:hdrgainmap"), // Apple auxiliary image
+}
+
+// headLimit caps how much of a HEIF file is read: the meta box with the
+// item properties sits before the image data.
+const headLimit = 512 << 10
+
+// Detect returns the HDR kind of an image file (or archive entry), or ""
+// for SDR photos and unreadable files. Only headers are read.
+func Detect(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if !Exts[ext] {
+		return ""
+	}
+	f, err := archive.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	if ext == ".jpg" || ext == ".jpeg" {
+		return detectJPEG(f)
+	}
+	head, err := io.ReadAll(io.LimitReader(f, headLimit))
+	if err != nil {
+		return ""
+	}
+	return detectHEIF(head)
+}
+
+// detectHEIF looks for gain-map items and a PQ/HLG colour profile in the
+// head of a HEIC/HEIF/AVIF file.
+func detectHEIF(head []byte) string {
+	if hasGainMapMarker(head) || hasTmapItem(head) {
+		return GainMap
+	}
+	// colr box of type nclx: primaries, transfer, matrix (uint16 each)
+	for i := 0; ; {
+		j := bytes.Index(head[i:], []byte("colrnclx"))
+		if j < 0 || i+j+12 > len(head) {
+			return ""
+		}
+		i += j + 8
+		if kind := TransferKind(int(binary.BigEndian.Uint16(head[i+2:]))); kind != "" {
+			return kind
+		}
+	}
+}
+
+// hasTmapItem reports whether an infe box declares a tmap item, the ISO
+// 21496-1 gain map derivation in HEIF.
+func hasTmapItem(head []byte) bool {
+	for i := 0; ; {
+		j := bytes.Index(head[i:], []byte("infe"))
+		if j < 0 {
+			return false
+		}
+		i += j + 4
+		// version/flags, item ID (2 bytes in v2, 4 in v3), protection index
+		for _, off := range []int{8, 10} {
+			if i+off+4 <= len(head) && string(head[i+off:i+off+4]) == "tmap" {
+				return true
+			}
+		}
+	}
+}
+
+func hasGainMapMarker(b []byte) bool {
+	for _, m := range gainMapMarkers {
+		if bytes.Contains(b, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// detectJPEG looks for gain-map metadata in the primary image's APP
+// segments and, when an MPF index lists a second image, in that image's.
+func detectJPEG(r io.Reader) string {
+	cr := &countingReader{r: r}
+	found, second, err := scanJPEG(cr, true)
+	if found {
+		return GainMap
+	}
+	if err != nil || second <= cr.n {
+		return ""
+	}
+	if err := cr.skip(second - cr.n); err != nil {
+		return ""
+	}
+	if found, _, _ := scanJPEG(cr, false); found {
+		return GainMap
+	}
+	return ""
+}
+
+// scanJPEG reads the segments of a JPEG up to its image data, reporting
+// whether gain-map metadata was seen and, if mpf is set, the file offset
+// of the second image listed in an MPF segment (0 if none).
+func scanJPEG(cr *countingReader, mpf bool) (found bool, second int64, err error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(cr, hdr[:2]); err != nil {
+		return false, 0, err
+	}
+	if hdr[0] != 0xFF || hdr[1] != 0xD8 {
+		return false, 0, errors.New("not a JPEG")
+	}
+	for {
+		if _, err := io.ReadFull(cr, hdr[:4]); err != nil {
+			return found, second, err
+		}
+		if hdr[0] != 0xFF {
+			return found, second, errors.New("bad JPEG marker")
+		}
+		marker := hdr[1]
+		if marker == 0xDA || marker == 0xD9 { // start of scan, end of image
+			return found, second, nil
+		}
+		length := int64(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if length < 0 {
+			return found, second, errors.New("bad JPEG segment length")
+		}
+		if marker != 0xE1 && marker != 0xE2 { // APP1 (XMP), APP2 (ISO, MPF)
+			if err := cr.skip(length); err != nil {
+				return found, second, err
+			}
+			continue
+		}
+		start := cr.n
+		seg := make([]byte, length)
+		if _, err := io.ReadFull(cr, seg); err != nil {
+			return found, second, err
+		}
+		if hasGainMapMarker(seg) {
+			found = true
+		}
+		if mpf && marker == 0xE2 && bytes.HasPrefix(seg, []byte("MPF\x00")) {
+			if off := mpfSecondImage(seg[4:]); off > 0 {
+				second = start + 4 + off
+			}
+		}
+	}
+}
+
+// mpfSecondImage returns the offset of the second image in an MPF index,
+// relative to the index's TIFF header, or 0.
+func mpfSecondImage(tiff []byte) int64 {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(bo.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(bo.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if bo.Uint16(tiff[e:]) != 0xB002 { // MPEntry
+			continue
+		}
+		n := int(bo.Uint32(tiff[e+4:]))
+		entries := int(bo.Uint32(tiff[e+8:]))
+		// 16 bytes per image: attributes, size, offset, dependencies
+		if n < 32 || entries+32 > len(tiff) {
+			return 0
+		}
+		return int64(bo.Uint32(tiff[entries+16+8:]))
+	}
+	return 0
+}
+
+// countingReader tracks the offset read so far.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// skip advances by n bytes, seeking when the reader allows it.
+func (c *countingReader) skip(n int64) error {
+	if s, ok := c.r.(io.Seeker); ok {
+		if _, err := s.Seek(n, io.SeekCurrent); err != nil {
+			return err
+		}
+		c.n += n
+		return nil
+	}
+	_, err := io.CopyN(io.Discard, c, n)
+	return err
+}
+
+// Tone mapping parameters. Luminance is relative to SDR reference white
+// (BT.2408: 203 nits); phone HDR photos are mastered for about 1000 nits.
+const (
+	referenceWhite = 203.0
+	peakNits       = 1000.0
+	// knee is where the roll-off starts; darker tones are kept as they are
+	knee = 0.75
+	// hlgGamma is the BT.2100 system gamma for a 1000 nit display
+	hlgGamma = 1.2
+)
+
+// bt2020To709 converts linear BT.2020 RGB to linear BT.709 RGB.
+var bt2020To709 = [3][3]float64{
+	{1.6605, -0.5876, -0.0728},
+	{-0.1246, 1.1329, -0.0083},
+	{-0.0182, -0.1006, 1.1187},
+}
+
+// ToneMap converts a PQ or HLG encoded image, as decoded at full depth,
+// into SDR sRGB. bt2020 reports whether the image uses BT.2020 primaries,
+// as HDR10 and HLG photos almost always do.
+func ToneMap(src *image.NRGBA64, kind string, bt2020 bool) *image.NRGBA {
+	toLinear := linearLUT(kind)
+	toSRGB := srgbLUT()
+	white := peakNits / referenceWhite
+
+	b := src.Bounds()
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		si := src.PixOffset(b.Min.X, y)
+		di := out.PixOffset(b.Min.X, y)
+		for x := b.Min.X; x < b.Max.X; x++ {
+			px := src.Pix[si : si+8]
+			rgb := [3]float64{
+				toLinear[uint16(px[0])<<8|uint16(px[1])],
+				toLinear[uint16(px[2])<<8|uint16(px[3])],
+				toLinear[uint16(px[4])<<8|uint16(px[5])],
+			}
+			if kind == HLG {
+				// OOTF: scene light to display light
+				ys := 0.2627*rgb[0] + 0.6780*rgb[1] + 0.0593*rgb[2]
+				scale := peakNits / referenceWhite * math.Pow(ys, hlgGamma-1)
+				for c := range rgb {
+					rgb[c] *= scale
+				}
+			}
+			if bt2020 {
+				var m [3]float64
+				for c := range m {
+					m[c] = bt2020To709[c][0]*rgb[0] + bt2020To709[c][1]*rgb[1] + bt2020To709[c][2]*rgb[2]
+				}
+				rgb = m
+			}
+
+			if l := 0.2126*rgb[0] + 0.7152*rgb[1] + 0.0722*rgb[2]; l > knee {
+				scale := rollOff(l, white) / l
+				for c := range rgb {
+					rgb[c] *= scale
+				}
+			}
+
+			d := out.Pix[di : di+4]
+			for c, v := range rgb {
+				v = math.Max(0, math.Min(1, v))
+				d[c] = toSRGB[int(v*float64(len(toSRGB)-1)+0.5)]
+			}
+			d[3] = px[6]
+			si += 8
+			di += 4
+		}
+	}
+	return out
+}
+
+// rollOff compresses luminance above the knee so that white maps to 1,
+// using extended Reinhard on the range above the knee. The slope is 1 at
+// the knee, so there's no visible seam.
+func rollOff(l, white float64) float64 {
+	if white <= knee {
+		return math.Min(l, 1)
+	}
+	l = math.Min(l, white)
+	x := (l - knee) / (1 - knee)
+	xw := (white - knee) / (1 - knee)
+	return knee + (1-knee)*x*(1+x/(xw*xw))/(1+x)
+}
+
+// linearLUT maps 16-bit code values to linear light relative to SDR
+// reference white (PQ) or to normalized scene light (HLG).
+func linearLUT(kind string) []float64 {
+	lut := make([]float64, 1<<16)
+	for i := range lut {
+		e := float64(i) / 0xFFFF
+		if kind == HLG {
+			lut[i] = hlgInverseOETF(e)
+		} else {
+			lut[i] = pqEOTF(e) / referenceWhite
+		}
+	}
+	return lut
+}
+
+// pqEOTF returns the display luminance in nits of a PQ signal (ST 2084).
+func pqEOTF(e float64) float64 {
+	const (
+		m1 = 2610.0 / 16384
+		m2 = 2523.0 / 4096 * 128
+		c1 = 3424.0 / 4096
+		c2 = 2413.0 / 4096 * 32
+		c3 = 2392.0 / 4096 * 32
+	)
+	p := math.Pow(e, 1/m2)
+	return 10000 * math.Pow(math.Max(p-c1, 0)/(c2-c3*p), 1/m1)
+}
+
+// hlgInverseOETF returns the normalized scene light of an HLG signal.
+func hlgInverseOETF(e float64) float64 {
+	const (
+		a = 0.17883277
+		b = 1 - 4*a
+		c = 0.55991073 // 0.5 - a*ln(4a)
+	)
+	if e <= 0.5 {
+		return e * e / 3
+	}
+	return (math.Exp((e-c)/a) + b) / 12
+}
+
+// srgbLUT maps linear light in [0, 1], quantized to 12 bits, to 8-bit sRGB.
+func srgbLUT() []uint8 {
+	lut := make([]uint8, 4096)
+	for i := range lut {
+		v := float64(i) / float64(len(lut)-1)
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		lut[i] = uint8(v*255 + 0.5)
+	}
+	return lut
+}
@@ -0,0 +1,203 @@
+// Package importer brings a folder of photos, such as a camera card, into
+// the library in two steps: Plan reports what an import would do, and
+// Apply moves the new files once that's been confirmed.
+package importer
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"photog/internal/indexer"
+)
+
+// Item is a file found in an import's source.
+type Item struct {
+	Source string `json:"source"`
+	Target string `json:"target"` // where it goes in the library
+	Size   int64  `json:"size"`
+	// For duplicates: the library photo with the same content, or the
+	// file (in the library or earlier in the import) that has it
+	PhotoID     int64  `json:"photo_id,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+// Report is what an import of Source into Dest would do. Only New files
+// are moved; duplicates of content already in the library and files whose
+// name is taken in Dest by a different file stay where they are.
+type Report struct {
+	Source     string  `json:"source"`
+	Dest       string  `json:"dest"`
+	New        []*Item `json:"new"`
+	Duplicates []*Item `json:"duplicates"`
+	Conflicts  []*Item `json:"conflicts"`
+}
+
+// NewSize returns the total size of the new files.
+func (r *Report) NewSize() int64 {
+	var n int64
+	for _, item := range r.New {
+		n += item.Size
+	}
+	return n
+}
+
+// Plan walks the media files under src and sorts them into new files,
+// duplicates and conflicts for an import into dest, keeping their folders
+// relative to src. Nothing is changed on disk.
+func Plan(idx *indexer.Indexer, src, dest string) (*Report, error) {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return nil, err
+	}
+	dest, err = filepath.Abs(dest)
+	if err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(src, dest); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("destination %s is inside the source", dest)
+	}
+
+	report := &Report{
+		Source:     src,
+		Dest:       dest,
+		New:        make([]*Item, 0),
+		Duplicates: make([]*Item, 0),
+		Conflicts:  make([]*Item, 0),
+	}
+	seen := make(map[string]string) // content hash -> first source with it
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != src && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !indexer.IsMediaFile(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		item := &Item{Source: path, Target: filepath.Join(dest, rel), Size: info.Size()}
+
+		hash, err := indexer.HashFile(path)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		if id, err := idx.FindDuplicate(item.Size, hash); err != nil {
+			return err
+		} else if id != 0 {
+			item.PhotoID = id
+			report.Duplicates = append(report.Duplicates, item)
+			return nil
+		}
+		if first, ok := seen[hash]; ok {
+			item.DuplicateOf = first
+			report.Duplicates = append(report.Duplicates, item)
+			return nil
+		}
+		seen[hash] = path
+
+		if _, err := os.Lstat(item.Target); err == nil {
+			// Not indexed yet, but the same file may already be there
+			if h, err := indexer.HashFile(item.Target); err == nil && h == hash {
+				item.DuplicateOf = item.Target
+				report.Duplicates = append(report.Duplicates, item)
+			} else {
+				report.Conflicts = append(report.Conflicts, item)
+			}
+			return nil
+		}
+		report.New = append(report.New, item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Apply moves the report's new files and their sidecars into place, or
+// copies them when keep is set, and returns how many were imported. A file
+// whose target was taken since Plan is skipped.
+func Apply(report *Report, keep bool) (int, error) {
+	imported := 0
+	for _, item := range report.New {
+		if _, err := os.Lstat(item.Target); err == nil {
+			log.Printf("Import: skipping %s, %s exists now", item.Source, item.Target)
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(item.Target), 0755); err != nil {
+			return imported, err
+		}
+		sidecars := indexer.OwnSidecars(item.Source)
+		if err := transfer(item.Source, item.Target, keep); err != nil {
+			return imported, fmt.Errorf("importing %s: %w", item.Source, err)
+		}
+		imported++
+		for _, sc := range sidecars {
+			dst := filepath.Join(filepath.Dir(item.Target), filepath.Base(sc))
+			if _, err := os.Lstat(dst); err == nil {
+				continue
+			}
+			if err := transfer(sc, dst, keep); err != nil {
+				log.Printf("Import: sidecar %s: %v", sc, err)
+			}
+		}
+	}
+	return imported, nil
+}
+
+// transfer moves src to dst, copying across filesystems, or only copies it
+// when keep is set.
+func transfer(src, dst string, keep bool) error {
+	if !keep {
+		if err := os.Rename(src, dst); err == nil {
+			return nil
+		}
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	if keep {
+		return nil
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies src to a new file dst, keeping its mode and mtime. A
+// partial copy is removed.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
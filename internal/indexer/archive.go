@@ -0,0 +1,69 @@
+package indexer
+
+import (
+	"archive/zip"
+	"context"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+
+	"photog/internal/archive"
+)
+
+// SetIndexArchives sets whether scans index the media inside zip archives
+// (see package archive). Call it before the first scan.
+func (idx *Indexer) SetIndexArchives(enabled bool) {
+	idx.archives = enabled
+}
+
+// IndexesArchive reports whether scans index the entries of the archive at
+// path.
+func (idx *Indexer) IndexesArchive(path string) bool {
+	return idx.archives && archive.IsArchive(path)
+}
+
+// archiveMedia reports whether a scan would index an archive entry and
+// whether it is an image.
+func archiveMedia(f *zip.File) (isMedia, isImage bool) {
+	name := path.Base(f.Name)
+	if shouldSkipFile(name) || strings.HasPrefix(f.Name, "__MACOSX/") {
+		return false, false
+	}
+	ext := strings.ToLower(path.Ext(name))
+	return imageExts[ext] || videoExts[ext], imageExts[ext]
+}
+
+// countArchive returns the number of media entries in an archive.
+func (idx *Indexer) countArchive(archivePath string) int64 {
+	var n int64
+	archive.Walk(archivePath, func(p string, f *zip.File) error {
+		if ok, _ := archiveMedia(f); ok {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// indexArchive indexes the media inside an archive like files in a folder.
+// Entries are read in place; nothing is extracted to the library.
+func (idx *Indexer) indexArchive(ctx context.Context, sc *scanState, archivePath string) error {
+	err := archive.Walk(archivePath, func(p string, f *zip.File) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ok, isImage := archiveMedia(f)
+		if !ok {
+			return nil
+		}
+		idx.indexOne(sc, p, fs.FileInfoToDirEntry(f.FileInfo()), isImage)
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Indexer: reading archive %s: %v", archivePath, err)
+		idx.recordError(archivePath, "archive", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package indexer
+
+import (
+	"io/fs"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"photog/internal/database"
+	"photog/internal/models"
+)
+
+// New and edited files found by a scan are written in batches of up to batchSize, in
+// one transaction each, and at least every batchInterval so they show up
+// while a slow scan (say, of videos) is still filling a batch.
+const (
+	batchSize     = 500
+	batchInterval = 5 * time.Second
+)
+
+// scanState is what a scan loads up front and the files it has yet to
+// write.
+type scanState struct {
+	stamps  map[string]int64              // sidecar stamps of indexed files
+	failed  map[string]bool               // paths with a recorded index error
+	indexed map[string]database.FileStamp // indexed files; nil to query per file
+
+	pending []pendingPhoto
+	since   time.Time        // when the oldest pending file was added
+	mtimes  map[string]int64 // mtimes to record for files indexed without one
+}
+
+// pendingPhoto is a file waiting for its batch to be written.
+type pendingPhoto struct {
+	photo    *models.Photo
+	keywords []string // sidecar keywords, tagged once written
+	changed  bool     // indexed before, and edited since
+}
+
+// isIndexed reports whether path was indexed before the scan started, and
+// whether its size or modification time changed since. Files indexed
+// before mtimes were recorded count as unchanged, and get theirs recorded.
+func (idx *Indexer) isIndexed(sc *scanState, path string, d fs.DirEntry) (exists, changed bool, err error) {
+	if sc.indexed == nil {
+		exists, err = idx.db.PhotoExists(path)
+		return exists, false, err
+	}
+	st, exists := sc.indexed[path]
+	if !exists {
+		return false, false, nil
+	}
+	info, err := d.Info()
+	if err != nil {
+		return true, false, nil // gone already; cleanup deals with it
+	}
+	mtime := info.ModTime().Unix()
+	if st.Mtime == 0 {
+		if sc.mtimes == nil {
+			sc.mtimes = make(map[string]int64)
+		}
+		sc.mtimes[path] = mtime
+		return true, info.Size() != st.Size, nil
+	}
+	return true, info.Size() != st.Size || mtime != st.Mtime, nil
+}
+
+// queue adds a new or edited file to the pending batch.
+func (idx *Indexer) queue(sc *scanState, photo *models.Photo, keywords []string, changed bool) {
+	if len(sc.pending) == 0 {
+		sc.since = time.Now()
+	}
+	sc.pending = append(sc.pending, pendingPhoto{photo: photo, keywords: keywords, changed: changed})
+}
+
+// flushIfDue writes the pending batch when it is full or has waited long
+// enough, and the recorded mtimes once there are as many.
+func (idx *Indexer) flushIfDue(sc *scanState) {
+	if len(sc.pending) >= batchSize || (len(sc.pending) > 0 && time.Since(sc.since) >= batchInterval) {
+		idx.flush(sc)
+	}
+	if len(sc.mtimes) >= batchSize {
+		idx.flushMtimes(sc)
+	}
+}
+
+// flushMtimes records the mtimes of files indexed without one.
+func (idx *Indexer) flushMtimes(sc *scanState) {
+	if len(sc.mtimes) == 0 {
+		return
+	}
+	if err := idx.db.SetFileMtimes(sc.mtimes); err != nil {
+		log.Printf("Indexer: recording file mtimes: %v", err)
+	}
+	sc.mtimes = nil
+}
+
+// flush writes the pending files, then tags them and reports them as
+// added or changed. When the batch fails as a whole, its files are written
+// one at a time so only those that fail are recorded as errors.
+func (idx *Indexer) flush(sc *scanState) {
+	idx.flushMtimes(sc)
+	if len(sc.pending) == 0 {
+		return
+	}
+	batch := sc.pending
+	sc.pending = nil
+
+	photos := make([]*models.Photo, len(batch))
+	for i, b := range batch {
+		photos[i] = b.photo
+	}
+	batchErr := idx.db.UpsertPhotos(photos)
+	if batchErr != nil {
+		log.Printf("Indexer: writing a batch of %d files failed, retrying one by one: %v", len(batch), batchErr)
+	}
+	for _, b := range batch {
+		path := b.photo.Path
+		if batchErr != nil {
+			if err := idx.db.UpsertPhoto(b.photo); err != nil {
+				log.Printf("Indexer: error upserting %s: %v", path, err)
+				idx.recordError(path, "upsert", err)
+				continue
+			}
+		}
+		if sc.failed[path] {
+			idx.db.ClearIndexError(path)
+		}
+		idx.applyTags(path)
+		idx.applySidecarTags(path, b.keywords)
+		if b.changed {
+			atomic.AddInt64(&idx.Progress.Updated, 1)
+			if idx.OnPhotoChanged != nil {
+				idx.OnPhotoChanged(path)
+			}
+		} else if idx.OnPhotoAdded != nil {
+			idx.OnPhotoAdded(b.photo)
+		}
+	}
+}
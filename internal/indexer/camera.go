@@ -0,0 +1,164 @@
+package indexer
+
+import (
+	"log"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+
+	"photog/internal/archive"
+)
+
+// cameraKey is the meta key set once the photos indexed before cameras
+// were recorded have been read.
+const cameraKey = "camera_detection"
+
+// lensKey is the meta key set once the photos indexed before lenses were
+// recorded have been read.
+const lensKey = "lens_detection"
+
+// cameraName returns "Make Model" from EXIF, without repeating the make
+// when the model already starts with it ("Canon Canon EOS R5", "NIKON
+// CORPORATION NIKON D750").
+func cameraName(x *exif.Exif) string {
+	tagString := func(name exif.FieldName) string {
+		t, err := x.Get(name)
+		if err != nil {
+			return ""
+		}
+		s, err := t.StringVal()
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+	}
+	maker, model := tagString(exif.Make), tagString(exif.Model)
+	if model == "" {
+		return maker
+	}
+	brand := strings.Fields(maker)
+	if len(brand) == 0 || strings.HasPrefix(strings.ToLower(model), strings.ToLower(brand[0])) {
+		return model
+	}
+	return maker + " " + model
+}
+
+// backfillCameras records the camera of images indexed before it was
+// tracked, re-reading only the EXIF header.
+func (idx *Indexer) backfillCameras() {
+	done, err := idx.db.GetMeta(cameraKey)
+	if err != nil {
+		log.Printf("Indexer: reading camera detection state: %v", err)
+		return
+	}
+	if done != "" {
+		return
+	}
+	items, err := idx.db.GetCameraCandidates()
+	if err != nil {
+		log.Printf("Indexer: loading images for camera detection: %v", err)
+		return
+	}
+
+	var found int
+	complete := true
+	for _, item := range items {
+		if idx.ctx.Err() != nil {
+			return
+		}
+		if idx.db.RootOffline(idx.db.RootOf(item.Path)) {
+			complete = false // read again once the disk is back
+			continue
+		}
+		camera := readCamera(item.Path)
+		if camera == "" {
+			continue
+		}
+		if err := idx.db.SetCamera(item.ID, camera); err != nil {
+			log.Printf("Indexer: storing camera of %s: %v", item.Path, err)
+			continue
+		}
+		found++
+	}
+	if complete {
+		if err := idx.db.SetMeta(cameraKey, "1"); err != nil {
+			log.Printf("Indexer: saving camera detection state: %v", err)
+		}
+	}
+	log.Printf("Indexer: recorded the camera of %d among %d images", found, len(items))
+}
+
+// readCamera returns the camera an image was taken with, or "" if its
+// EXIF doesn't say.
+func readCamera(path string) string {
+	f, err := archive.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		return ""
+	}
+	return cameraName(x)
+}
+
+// backfillLenses records the lens of images indexed before it was tracked,
+// re-reading only the EXIF header.
+func (idx *Indexer) backfillLenses() {
+	done, err := idx.db.GetMeta(lensKey)
+	if err != nil {
+		log.Printf("Indexer: reading lens detection state: %v", err)
+		return
+	}
+	if done != "" {
+		return
+	}
+	items, err := idx.db.GetLensCandidates()
+	if err != nil {
+		log.Printf("Indexer: loading images for lens detection: %v", err)
+		return
+	}
+
+	var found int
+	complete := true
+	for _, item := range items {
+		if idx.ctx.Err() != nil {
+			return
+		}
+		if idx.db.RootOffline(idx.db.RootOf(item.Path)) {
+			complete = false // read again once the disk is back
+			continue
+		}
+		lens := readLens(item.Path)
+		if lens == "" {
+			continue
+		}
+		if err := idx.db.SetLens(item.ID, lens); err != nil {
+			log.Printf("Indexer: storing lens of %s: %v", item.Path, err)
+			continue
+		}
+		found++
+	}
+	if complete {
+		if err := idx.db.SetMeta(lensKey, "1"); err != nil {
+			log.Printf("Indexer: saving lens detection state: %v", err)
+		}
+	}
+	log.Printf("Indexer: recorded the lens of %d among %d images", found, len(items))
+}
+
+// readLens returns the lens an image was taken with, or "" if its EXIF
+// doesn't say.
+func readLens(path string) string {
+	f, err := archive.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		return ""
+	}
+	return exifString(x, exif.LensModel)
+}
@@ -0,0 +1,126 @@
+package indexer
+
+import (
+	"log"
+	"math"
+
+	"github.com/rwcarlsen/goexif/exif"
+
+	"photog/internal/archive"
+	"photog/internal/models"
+)
+
+// gpsDetailsKey is the meta key set once the photos indexed before GPS
+// altitude, direction and speed were recorded have been read.
+const gpsDetailsKey = "gps_details"
+
+// Speeds in GPSSpeedRef units, in km/h.
+var gpsSpeedUnits = map[string]float64{
+	"K": 1,        // km/h
+	"M": 1.609344, // mph
+	"N": 1.852,    // knots
+}
+
+// gpsDetails returns the altitude, image direction and speed in x's GPS
+// data, or nil if it has none of them.
+func gpsDetails(x *exif.Exif) *models.GPSDetails {
+	var g models.GPSDetails
+	if alt, ok := exifRational(x, exif.GPSAltitude); ok {
+		// GPSAltitudeRef 1 means below sea level
+		if t, err := x.Get(exif.GPSAltitudeRef); err == nil {
+			if ref, err := t.Int(0); err == nil && ref == 1 {
+				alt = -alt
+			}
+		}
+		g.Altitude = &alt
+	}
+	if dir, ok := exifRational(x, exif.GPSImgDirection); ok && dir >= 0 && dir <= 360 {
+		dir = math.Mod(dir, 360)
+		g.Direction = &dir
+	}
+	if speed, ok := exifRational(x, exif.GPSSpeed); ok && speed >= 0 {
+		unit, known := gpsSpeedUnits[exifString(x, exif.GPSSpeedRef)]
+		if !known {
+			unit = 1 // km/h is the default
+		}
+		speed *= unit
+		g.Speed = &speed
+	}
+	if g.Altitude == nil && g.Direction == nil && g.Speed == nil {
+		return nil
+	}
+	return &g
+}
+
+// exifRational returns a rational tag as a float, false when it's missing
+// or has a zero denominator.
+func exifRational(x *exif.Exif, name exif.FieldName) (float64, bool) {
+	t, err := x.Get(name)
+	if err != nil {
+		return 0, false
+	}
+	num, den, err := t.Rat2(0)
+	if err != nil || den == 0 {
+		return 0, false
+	}
+	return float64(num) / float64(den), true
+}
+
+// readGPSDetails returns the GPS details of the image at path, or nil.
+func readGPSDetails(path string) *models.GPSDetails {
+	f, err := archive.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		return nil
+	}
+	return gpsDetails(x)
+}
+
+// backfillGPSDetails records the GPS altitude, direction and speed of
+// images indexed before they were tracked, re-reading only the EXIF header.
+func (idx *Indexer) backfillGPSDetails() {
+	done, err := idx.db.GetMeta(gpsDetailsKey)
+	if err != nil {
+		log.Printf("Indexer: reading GPS details state: %v", err)
+		return
+	}
+	if done != "" {
+		return
+	}
+	items, err := idx.db.GetGPSDetailCandidates()
+	if err != nil {
+		log.Printf("Indexer: loading images for GPS details: %v", err)
+		return
+	}
+
+	var found int
+	complete := true
+	for _, item := range items {
+		if idx.ctx.Err() != nil {
+			return
+		}
+		if idx.db.RootOffline(idx.db.RootOf(item.Path)) {
+			complete = false // read again once the disk is back
+			continue
+		}
+		g := readGPSDetails(item.Path)
+		if g == nil {
+			continue
+		}
+		if err := idx.db.SetGPSDetails(item.ID, g); err != nil {
+			log.Printf("Indexer: storing GPS details of %s: %v", item.Path, err)
+			continue
+		}
+		found++
+	}
+	if complete {
+		if err := idx.db.SetMeta(gpsDetailsKey, "1"); err != nil {
+			log.Printf("Indexer: saving GPS details state: %v", err)
+		}
+	}
+	log.Printf("Indexer: recorded GPS details of %d among %d images", found, len(items))
+}
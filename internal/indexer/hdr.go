@@ -0,0 +1,60 @@
+package indexer
+
+import (
+	"log"
+
+	"photog/internal/hdr"
+)
+
+// hdrKey is the meta key set once the photos indexed before HDR detection
+// have been checked.
+const hdrKey = "hdr_detection"
+
+// backfillHDR detects the HDR content of photos indexed before it was
+// tracked. Photos needing tone mapping are reported through OnHDRDetected
+// so their cached thumbnails can be rendered again.
+func (idx *Indexer) backfillHDR() {
+	done, err := idx.db.GetMeta(hdrKey)
+	if err != nil {
+		log.Printf("Indexer: reading HDR detection state: %v", err)
+		return
+	}
+	if done != "" {
+		return
+	}
+	items, err := idx.db.GetHDRCandidates()
+	if err != nil {
+		log.Printf("Indexer: loading images for HDR detection: %v", err)
+		return
+	}
+
+	var found int
+	complete := true
+	for _, item := range items {
+		if idx.ctx.Err() != nil {
+			return
+		}
+		if idx.db.RootOffline(idx.db.RootOf(item.Path)) {
+			complete = false // check again once the disk is back
+			continue
+		}
+		kind := hdr.Detect(item.Path)
+		if kind == "" {
+			continue
+		}
+		if err := idx.db.SetHDR(item.ID, kind); err != nil {
+			log.Printf("Indexer: storing HDR kind of %s: %v", item.Path, err)
+			continue
+		}
+		found++
+		if kind != hdr.GainMap && idx.OnHDRDetected != nil {
+			idx.OnHDRDetected(item.Path)
+		}
+	}
+	if complete {
+		if err := idx.db.SetMeta(hdrKey, "1"); err != nil {
+			log.Printf("Indexer: saving HDR detection state: %v", err)
+		}
+	}
+	log.Printf("Indexer: found %d HDR photos among %d images", found, len(items))
+}
@@ -1,10 +1,13 @@
 package indexer
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -12,8 +15,13 @@ import (
 	"time"
 
 	"github.com/rwcarlsen/goexif/exif"
+	"photog/internal/archive"
+	"photog/internal/background"
 	"photog/internal/database"
+	"photog/internal/geocode"
+	"photog/internal/hdr"
 	"photog/internal/models"
+	"photog/internal/rawpreview"
 )
 
 // Supported file extensions
@@ -22,6 +30,8 @@ var (
 		".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
 		".webp": true, ".bmp": true, ".tiff": true, ".tif": true,
 		".heic": true, ".heif": true, ".avif": true,
+		// RAW (see rawpreview.Exts), indexed with media type "raw"
+		".cr2": true, ".nef": true, ".arw": true, ".dng": true,
 	}
 	videoExts = map[string]bool{
 		".mp4": true, ".mov": true, ".avi": true, ".mkv": true,
@@ -43,6 +53,30 @@ func shouldSkipFile(name string) bool {
 	return false
 }
 
+// AddImageExts makes scans index files with the given lowercase extensions
+// as images, for formats handled by an external thumbnailer. Call it before
+// the first scan.
+func AddImageExts(exts []string) {
+	for _, ext := range exts {
+		imageExts[ext] = true
+	}
+}
+
+// IsMediaFile reports whether a scan would consider path: a supported
+// image or video extension and not a hidden or system file.
+func IsMediaFile(path string) bool {
+	if shouldSkipFile(filepath.Base(path)) {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	return imageExts[ext] || videoExts[ext]
+}
+
+// IsVideoFile reports whether path has a supported video extension.
+func IsVideoFile(path string) bool {
+	return videoExts[strings.ToLower(filepath.Ext(path))]
+}
+
 // Indexer scans photo directories and populates the database.
 type Indexer struct {
 	db       *database.DB
@@ -50,18 +84,56 @@ type Indexer struct {
 	mu       sync.Mutex
 	running  bool
 	Progress IndexProgress
+
+	// per-root progress of the latest scan, and the root it is in
+	roots    []*rootScan
+	scanning *rootScan
+
+	// OnPhotoAdded, if set, is called after a new file has been indexed.
+	OnPhotoAdded func(p *models.Photo)
+	// OnScanFinished, if set, is called with the final progress of each scan.
+	OnScanFinished func(p IndexProgress)
+	// OnPhotoChanged, if set, is called after a scan has read an indexed
+	// file again because it was edited, so its thumbnails can be redone.
+	OnPhotoChanged func(path string)
+	// OnHDRDetected, if set, is called for already indexed photos found to
+	// be HDR10 or HLG, whose cached thumbnails were rendered without tone
+	// mapping.
+	OnHDRDetected func(path string)
+
+	// path tagging rules (see SetTagRules)
+	tagRules    []tagRule
+	tagRulesKey string
+	// size/type skip policies (see SetLimits)
+	limits []indexLimit
+	// sidecar mtimes by sidecarKey, collected during a scan's counting pass
+	sidecars map[string]int64
+	// parent of ffprobe runs, canceled on shutdown (see SetContext)
+	ctx context.Context
+	// index media inside zip archives (see SetIndexArchives)
+	archives bool
+	// names places from GPS positions (see SetGeocoder)
+	geocoder *geocode.Geocoder
+	// user folders, longest first (see SetOwners)
+	owners    []ownerPath
+	ownersKey string
 }
 
 // IndexProgress tracks the current indexing state.
 type IndexProgress struct {
-	Running    bool   `json:"running"`
-	Total      int64  `json:"total"`
-	Processed  int64  `json:"processed"`
-	Skipped    int64  `json:"skipped"`
-	Errors     int64  `json:"errors"`
-	StartedAt  string `json:"started_at,omitempty"`
-	FinishedAt string `json:"finished_at,omitempty"`
-	FilesPerSec float64 `json:"files_per_sec"`
+	Running         bool    `json:"running"`
+	Total           int64   `json:"total"`
+	Processed       int64   `json:"processed"`
+	Skipped         int64   `json:"skipped"`
+	SkippedByPolicy int64   `json:"skipped_by_policy"` // excluded by photos.limits
+	Errors          int64   `json:"errors"`
+	SidecarUpdates  int64   `json:"sidecar_updates"` // indexed files whose sidecars changed
+	Updated         int64   `json:"updated"`         // indexed files edited since, read again
+	StartedAt       string  `json:"started_at,omitempty"`
+	FinishedAt      string  `json:"finished_at,omitempty"`
+	FilesPerSec     float64 `json:"files_per_sec"`
+	// Per photo root, in config order; set from the first scan on
+	Roots []RootProgress `json:"roots,omitempty"`
 }
 
 // New creates a new Indexer.
@@ -69,14 +141,29 @@ func New(db *database.DB, paths []string) *Indexer {
 	return &Indexer{
 		db:    db,
 		paths: paths,
+		ctx:   context.Background(),
 	}
 }
 
+// SetContext sets the process-wide context. Canceling it kills running
+// ffprobe children, so indexing stops promptly on shutdown. Call it before
+// the first scan.
+func (idx *Indexer) SetContext(ctx context.Context) {
+	idx.ctx = ctx
+}
+
 // GetProgress returns the current indexing progress.
 func (idx *Indexer) GetProgress() IndexProgress {
 	idx.mu.Lock()
 	defer idx.mu.Unlock()
-	return idx.Progress
+	p := idx.Progress
+	if idx.roots != nil {
+		p.Roots = make([]RootProgress, len(idx.roots))
+		for i, r := range idx.roots {
+			p.Roots[i] = r.snapshot()
+		}
+	}
+	return p
 }
 
 // IsRunning returns whether indexing is in progress.
@@ -88,6 +175,12 @@ func (idx *Indexer) IsRunning() bool {
 
 // Scan walks all configured paths and indexes media files.
 func (idx *Indexer) Scan() error {
+	return idx.ScanContext(idx.ctx)
+}
+
+// ScanContext is Scan with cancellation. A canceled scan keeps the files it
+// has already indexed and returns ctx.Err().
+func (idx *Indexer) ScanContext(ctx context.Context) error {
 	idx.mu.Lock()
 	if idx.running {
 		idx.mu.Unlock()
@@ -98,11 +191,14 @@ func (idx *Indexer) Scan() error {
 		Running:   true,
 		StartedAt: time.Now().Format(time.RFC3339),
 	}
+	roots := newRootScans(idx.paths)
+	idx.roots = roots
 	idx.mu.Unlock()
 
 	defer func() {
 		idx.mu.Lock()
 		idx.running = false
+		idx.scanning = nil
 		idx.Progress.Running = false
 		idx.Progress.FinishedAt = time.Now().Format(time.RFC3339)
 		elapsed := time.Since(parseTime(idx.Progress.StartedAt)).Seconds()
@@ -112,10 +208,24 @@ func (idx *Indexer) Scan() error {
 		idx.mu.Unlock()
 	}()
 
-	// First pass: count files
+	// First pass: count files and note sidecars
+	// Offline disks are skipped rather than walked as empty
+	idx.CheckRoots()
+
 	var totalFiles int64
-	for _, root := range idx.paths {
+	idx.sidecars = make(map[string]int64)
+	defer func() { idx.sidecars = nil }()
+	for i, root := range idx.paths {
+		if idx.db.RootOffline(root) {
+			log.Printf("Indexer: skipping offline photo root %s", root)
+			roots[i].finish("offline")
+			continue
+		}
+		var rootFiles int64
 		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if err != nil || d.IsDir() {
 				return nil
 			}
@@ -124,22 +234,58 @@ func (idx *Indexer) Scan() error {
 			}
 			ext := strings.ToLower(filepath.Ext(path))
 			if imageExts[ext] || videoExts[ext] {
-				totalFiles++
+				rootFiles++
+			} else if sidecarExts[ext] {
+				idx.recordSidecar(path, d)
+			} else if idx.IndexesArchive(path) {
+				rootFiles += idx.countArchive(path)
 			}
 			return nil
 		})
+		roots[i].total.Store(rootFiles)
+		totalFiles += rootFiles
 	}
 
 	atomic.StoreInt64(&idx.Progress.Total, totalFiles)
 	log.Printf("Indexer: found %d media files to process", totalFiles)
 
+	sc := &scanState{}
+	// Paths that failed previously, so successes can clear their error rows
+	var err error
+	sc.failed, err = idx.db.GetIndexErrorPaths()
+	if err != nil {
+		log.Printf("Indexer: loading previous errors: %v", err)
+	}
+	// Sidecar state of indexed files, so edited sidecars get re-applied
+	sc.stamps, err = idx.db.GetSidecarStamps()
+	if err != nil {
+		log.Printf("Indexer: loading sidecar state: %v", err)
+	}
+	// Indexed files, so unchanged ones are skipped without a query each
+	sc.indexed, err = idx.db.GetIndexedFiles()
+	if err != nil {
+		log.Printf("Indexer: loading indexed files: %v", err)
+	}
+
 	// Second pass: index files
-	for _, root := range idx.paths {
-		if err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+	for i, root := range idx.paths {
+		if idx.db.RootOffline(root) {
+			roots[i].finish("offline")
+			continue
+		}
+		rs := roots[i]
+		rs.start()
+		idx.setScanning(rs)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
 			if err != nil {
+				idx.recordError(path, "walk", err)
 				return nil // skip errors, keep going
 			}
 			if d.IsDir() {
+				rs.enter(path)
 				return nil
 			}
 
@@ -151,71 +297,248 @@ func (idx *Indexer) Scan() error {
 			isImage := imageExts[ext]
 			isVideo := videoExts[ext]
 
-			if !isImage && !isVideo {
-				return nil
-			}
-
-			// Check if already indexed
-			exists, err := idx.db.PhotoExists(path)
-			if err != nil {
-				atomic.AddInt64(&idx.Progress.Errors, 1)
-				return nil
+			if idx.IndexesArchive(path) {
+				return idx.indexArchive(ctx, sc, path)
 			}
-			if exists {
-				atomic.AddInt64(&idx.Progress.Skipped, 1)
-				atomic.AddInt64(&idx.Progress.Processed, 1)
+			if !isImage && !isVideo {
 				return nil
 			}
 
-			photo := idx.processFile(path, d, isImage)
-			if photo != nil {
-				if err := idx.db.UpsertPhoto(photo); err != nil {
-					log.Printf("Indexer: error upserting %s: %v", path, err)
-					atomic.AddInt64(&idx.Progress.Errors, 1)
-				}
-			}
-
-			atomic.AddInt64(&idx.Progress.Processed, 1)
+			idx.indexOne(sc, path, d, isImage)
 			return nil
-		}); err != nil {
+		})
+		idx.flush(sc)
+		idx.setScanning(nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				rs.finish("canceled")
+				log.Printf("Indexer: scan canceled after %d files", atomic.LoadInt64(&idx.Progress.Processed))
+				return ctx.Err()
+			}
 			log.Printf("Indexer: walk error for %s: %v", root, err)
 		}
+		rs.finish("done")
 	}
 
-	log.Printf("Indexer: complete. Processed %d, skipped %d, errors %d",
-		idx.Progress.Processed, idx.Progress.Skipped, idx.Progress.Errors)
+	idx.backfillVideoInfo()
+	idx.backfillAuditFlags()
+	idx.backfillLocations()
+	idx.backfillPlaces()
+	idx.backfillHDR()
+	idx.backfillCameras()
+	idx.backfillLenses()
+	idx.backfillKinds()
+	idx.backfillGPSDetails()
+	idx.syncTagRules()
+	idx.syncOwners()
+
+	log.Printf("Indexer: complete. Processed %d, skipped %d, skipped by policy %d, updated %d, sidecar updates %d, errors %d",
+		idx.Progress.Processed, idx.Progress.Skipped, idx.Progress.SkippedByPolicy, idx.Progress.Updated, idx.Progress.SidecarUpdates, idx.Progress.Errors)
+
+	if idx.OnScanFinished != nil {
+		idx.OnScanFinished(idx.GetProgress())
+	}
 
 	return nil
 }
 
+// indexOne indexes a single file found by a scan, or skips it when it is
+// already indexed and unchanged or excluded by policy. New and edited files
+// are queued to be written with the scan's next batch.
+func (idx *Indexer) indexOne(sc *scanState, path string, d fs.DirEntry, isImage bool) {
+	idx.flushIfDue(sc)
+
+	// Check if already indexed, and whether the file changed since
+	exists, changed, err := idx.isIndexed(sc, path, d)
+	if err != nil {
+		idx.recordError(path, "lookup", err)
+		return
+	}
+	if exists && !changed {
+		if sc.stamps != nil {
+			idx.syncSidecars(path, d, isImage, sc.stamps[path])
+		}
+		atomic.AddInt64(&idx.Progress.Skipped, 1)
+		idx.countProcessed(path)
+		return
+	}
+
+	if len(idx.limits) > 0 {
+		info, err := d.Info()
+		if err != nil {
+			idx.recordError(path, "stat", err)
+			idx.countProcessed(path)
+			return
+		}
+		if idx.skippedByPolicy(path, info.Size()) {
+			atomic.AddInt64(&idx.Progress.SkippedByPolicy, 1)
+			idx.countProcessed(path)
+			return
+		}
+	}
+
+	photo := idx.processFile(path, d, isImage)
+	if photo != nil {
+		sidecars, stamp := sidecarsFor(path, idx.sidecars)
+		keywords := applySidecars(photo, sidecars, stamp)
+		idx.locate(photo)
+		idx.queue(sc, photo, keywords, changed)
+	}
+
+	idx.countProcessed(path)
+	background.Pause()
+}
+
+// IndexFile indexes a single media file immediately, outside of a full scan.
+// Used when new files arrive through the app (e.g. uploads) so they show up
+// without waiting for the next periodic scan. A file indexed before is
+// re-read and reported to OnPhotoChanged rather than OnPhotoAdded.
+func (idx *Indexer) IndexFile(path string) (*models.Photo, error) {
+	info, err := archive.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() || shouldSkipFile(info.Name()) {
+		return nil, fmt.Errorf("not a media file: %s", path)
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	isImage := imageExts[ext]
+	if !isImage && !videoExts[ext] {
+		return nil, fmt.Errorf("unsupported file type: %s", ext)
+	}
+	if idx.skippedByPolicy(path, info.Size()) {
+		return nil, fmt.Errorf("skipped by policy: %s", path)
+	}
+
+	photo := idx.processFile(path, fs.FileInfoToDirEntry(info), isImage)
+	if photo == nil {
+		return nil, fmt.Errorf("failed to read %s", path)
+	}
+	sidecars, stamp := sidecarsFor(path, nil)
+	keywords := applySidecars(photo, sidecars, stamp)
+	idx.locate(photo)
+	existed, err := idx.db.PhotoExists(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := idx.db.UpsertPhoto(photo); err != nil {
+		return nil, err
+	}
+	idx.db.ClearIndexError(path)
+	idx.applyTags(path)
+	idx.applySidecarTags(path, keywords)
+	if existed {
+		if idx.OnPhotoChanged != nil {
+			idx.OnPhotoChanged(path)
+		}
+	} else if idx.OnPhotoAdded != nil {
+		idx.OnPhotoAdded(photo)
+	}
+	return idx.db.GetPhotoByPath(path)
+}
+
+// HashFile returns the hex-encoded SHA-256 of a file's contents.
+func HashFile(path string) (string, error) {
+	f, err := archive.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// FindDuplicate returns the ID of an indexed file whose content matches the
+// given size and SHA-256 hash, or 0 if there is none. Existing files of the
+// same size that haven't been hashed yet are hashed now and the result is
+// stored, so each library file is only ever read once for this.
+func (idx *Indexer) FindDuplicate(size int64, hash string) (int64, error) {
+	candidates, err := idx.db.GetHashCandidates(size)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, c := range candidates {
+		if c.Hash == "" {
+			c.Hash, err = HashFile(c.Path)
+			if err != nil {
+				continue // file missing or unreadable; RemoveMissing will clean it up
+			}
+			if err := idx.db.SetContentHash(c.ID, c.Hash); err != nil {
+				log.Printf("Indexer: storing hash for %s: %v", c.Path, err)
+			}
+		}
+		if c.Hash == hash {
+			return c.ID, nil
+		}
+	}
+	return 0, nil
+}
+
+// countProcessed counts a file the scan is done with.
+func (idx *Indexer) countProcessed(path string) {
+	atomic.AddInt64(&idx.Progress.Processed, 1)
+	if r := idx.scanningRoot(path); r != nil {
+		r.processed.Add(1)
+	}
+}
+
+// recordError counts a per-file error and persists it so it can be
+// reviewed and retried via the API instead of only showing up in logs.
+func (idx *Indexer) recordError(path, stage string, err error) {
+	atomic.AddInt64(&idx.Progress.Errors, 1)
+	if r := idx.scanningRoot(path); r != nil {
+		r.errors.Add(1)
+	}
+	if dbErr := idx.db.RecordIndexError(path, stage, err.Error()); dbErr != nil {
+		log.Printf("Indexer: recording error for %s: %v", path, dbErr)
+	}
+}
+
 func (idx *Indexer) processFile(path string, d fs.DirEntry, isImage bool) *models.Photo {
 	info, err := d.Info()
 	if err != nil {
-		atomic.AddInt64(&idx.Progress.Errors, 1)
+		idx.recordError(path, "stat", err)
 		return nil
 	}
 
 	photo := &models.Photo{
-		Path:      path,
-		Filename:  d.Name(),
-		FileSize:  info.Size(),
-		IndexedAt: time.Now(),
-		TakenAt:   info.ModTime(), // fallback to file modification time
+		Path:       path,
+		Filename:   d.Name(),
+		FileSize:   info.Size(),
+		FileMtime:  info.ModTime().Unix(),
+		IndexedAt:  time.Now(),
+		TakenAt:    info.ModTime(), // fallback to file modification time
+		DateSource: "mtime",
+		OwnerID:    idx.ownerFor(path),
 	}
 
 	if isImage {
 		photo.MediaType = "image"
+		if rawpreview.Exts[strings.ToLower(filepath.Ext(path))] {
+			photo.MediaType = "raw"
+		}
 		idx.extractExif(photo)
+		if photo.MediaType == "image" {
+			photo.HDR = hdr.Detect(path)
+		}
+		photo.Kinds = detectKinds(photo)
 	} else {
 		photo.MediaType = "video"
 		// Video date falls back to file modification time
+		idx.extractVideoInfo(photo)
 	}
 
 	return photo
 }
 
 func (idx *Indexer) extractExif(photo *models.Photo) {
-	f, err := os.Open(photo.Path)
+	f, err := archive.Open(photo.Path)
 	if err != nil {
 		return
 	}
@@ -229,7 +552,14 @@ func (idx *Indexer) extractExif(photo *models.Photo) {
 	// Extract date taken
 	if dt, err := x.DateTime(); err == nil {
 		photo.TakenAt = dt
+		photo.DateSource = "exif"
+	}
+
+	if lat, lon, err := x.LatLong(); err == nil && validCoord(lat, lon) {
+		photo.HasGPS = true
+		photo.Latitude, photo.Longitude = lat, lon
 	}
+	photo.GPS = gpsDetails(x)
 
 	// Extract dimensions
 	if w, err := x.Get(exif.PixelXDimension); err == nil {
@@ -243,12 +573,53 @@ func (idx *Indexer) extractExif(photo *models.Photo) {
 		}
 	}
 
+	// RAW files rarely carry PixelX/YDimension; use the embedded preview,
+	// which has the sensor's aspect ratio
+	if photo.MediaType == "raw" && (photo.Width == 0 || photo.Height == 0) {
+		if w, h, err := rawpreview.Size(photo.Path); err == nil {
+			photo.Width, photo.Height = w, h
+		}
+	}
+
+	photo.Camera = cameraName(x)
+	photo.Lens = exifString(x, exif.LensModel)
+
 	// Extract orientation
 	if o, err := x.Get(exif.Orientation); err == nil {
 		if val, err := o.Int(0); err == nil {
 			photo.Orientation = val
 		}
 	}
+
+	// Orientations 5-8 are rotated 90°, so the stored pixel dimensions are
+	// transposed relative to how the photo displays. Store display dimensions
+	// so layout math never has to care about orientation.
+	if photo.Orientation >= 5 && photo.Orientation <= 8 {
+		photo.Width, photo.Height = photo.Height, photo.Width
+	}
+}
+
+// backfillAuditFlags records date source and GPS presence for images
+// indexed before they were tracked, re-reading only the EXIF header.
+func (idx *Indexer) backfillAuditFlags() {
+	items, err := idx.db.GetUnauditedImages()
+	if err != nil {
+		log.Printf("Indexer: loading images for audit backfill: %v", err)
+		return
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	for _, item := range items {
+		photo := &models.Photo{Path: item.Path, DateSource: "mtime"}
+		idx.extractExif(photo)
+		idx.db.SetAuditFlags(item.ID, photo.DateSource, photo.HasGPS)
+		if photo.HasGPS {
+			idx.db.SetLocation(item.ID, photo.Latitude, photo.Longitude, true)
+		}
+	}
+	log.Printf("Indexer: recorded date source and GPS presence for %d images", len(items))
 }
 
 func parseTime(s string) time.Time {
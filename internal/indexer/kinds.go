@@ -0,0 +1,155 @@
+package indexer
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+
+	"photog/internal/archive"
+	"photog/internal/models"
+)
+
+// kindsKey is the meta key set once the photos indexed before image kinds
+// were recorded have been checked.
+const kindsKey = "kind_detection"
+
+// kindsHeadSize is how much of a file is read to tell its kind: enough for
+// the EXIF and XMP headers of the formats that carry them.
+const kindsHeadSize = 64 << 10
+
+// panoramaRatio is the aspect ratio from which a photo counts as a
+// panorama when its metadata doesn't say.
+const panoramaRatio = 2.0
+
+// screenshotNames are filename parts that screenshot tools use, lowercased:
+// "Screenshot_20240101-120000.png", "Screen Shot 2020-01-01 at 12.00.00.png".
+var screenshotNames = []string{"screenshot", "screen shot", "screen_shot", "screencap", "bildschirmfoto"}
+
+// detectKinds returns the kinds of an image (see database.ImageKinds),
+// comma-separated. photo's media type, dimensions and camera must already
+// be read; the rest comes from the start of the file.
+func detectKinds(photo *models.Photo) string {
+	var head []byte
+	if f, err := archive.Open(photo.Path); err == nil {
+		head, _ = io.ReadAll(io.LimitReader(f, kindsHeadSize))
+		f.Close()
+	}
+	var software, comment string
+	if x, err := exif.Decode(bytes.NewReader(head)); err == nil {
+		software = exifString(x, exif.Software)
+		comment = exifString(x, exif.UserComment)
+	}
+
+	name := strings.ToLower(photo.Filename)
+	if name == "" {
+		name = strings.ToLower(filepath.Base(photo.Path))
+	}
+	width, height := photo.Width, photo.Height
+	if width == 0 || height == 0 {
+		if cfg, _, err := image.DecodeConfig(bytes.NewReader(head)); err == nil {
+			width, height = cfg.Width, cfg.Height
+		}
+	}
+
+	var kinds []string
+	if photo.MediaType == "raw" {
+		kinds = append(kinds, "raw")
+	}
+	gif := filepath.Ext(name) == ".gif"
+	if gif {
+		kinds = append(kinds, "gif")
+	}
+	// iOS writes "Screenshot" into the EXIF user comment
+	screenshot := strings.Contains(comment, "Screenshot")
+	for _, s := range screenshotNames {
+		if strings.Contains(name, s) {
+			screenshot = true
+		}
+	}
+	if screenshot {
+		kinds = append(kinds, "screenshot")
+	}
+	scanner := strings.ToLower(photo.Camera + " " + software)
+	if strings.HasPrefix(name, "scan") || strings.Contains(scanner, "scan") || strings.Contains(scanner, "silverfast") {
+		kinds = append(kinds, "scan")
+	}
+	// Phones and stitching tools mark panoramas in XMP; otherwise go by the
+	// shape, except for GIFs and screenshots which are often long
+	panorama := bytes.Contains(head, []byte("GPano:"))
+	if !panorama && !gif && !screenshot && width > 0 && height > 0 {
+		long, short := float64(max(width, height)), float64(min(width, height))
+		panorama = long/short >= panoramaRatio
+	}
+	if panorama {
+		kinds = append(kinds, "panorama")
+	}
+	return strings.Join(kinds, ",")
+}
+
+// exifString returns a text tag, or "" when missing.
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	t, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	if s, err := t.StringVal(); err == nil {
+		return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+	}
+	// UserComment is undefined-typed: an 8-byte charset prefix, then text
+	return strings.TrimSpace(strings.TrimRight(string(t.Val), "\x00"))
+}
+
+// backfillKinds records the kinds of images indexed before they were
+// tracked.
+func (idx *Indexer) backfillKinds() {
+	done, err := idx.db.GetMeta(kindsKey)
+	if err != nil {
+		log.Printf("Indexer: reading kind detection state: %v", err)
+		return
+	}
+	if done != "" {
+		return
+	}
+	items, err := idx.db.GetKindCandidates()
+	if err != nil {
+		log.Printf("Indexer: loading images for kind detection: %v", err)
+		return
+	}
+
+	var found int
+	complete := true
+	for _, item := range items {
+		if idx.ctx.Err() != nil {
+			return
+		}
+		if idx.db.RootOffline(idx.db.RootOf(item.Path)) {
+			complete = false // check again once the disk is back
+			continue
+		}
+		photo := &models.Photo{Path: item.Path, MediaType: item.MediaType}
+		idx.extractExif(photo)
+		kinds := detectKinds(photo)
+		if kinds == "" {
+			continue
+		}
+		if err := idx.db.SetKinds(item.ID, kinds); err != nil {
+			log.Printf("Indexer: storing kinds of %s: %v", item.Path, err)
+			continue
+		}
+		found++
+	}
+	if complete {
+		if err := idx.db.SetMeta(kindsKey, "1"); err != nil {
+			log.Printf("Indexer: saving kind detection state: %v", err)
+		}
+	}
+	log.Printf("Indexer: found %d special images among %d images", found, len(items))
+}
@@ -0,0 +1,55 @@
+package indexer
+
+import (
+	"path/filepath"
+	"strings"
+
+	"photog/internal/config"
+)
+
+// indexLimit is a normalized config.IndexLimit.
+type indexLimit struct {
+	prefix  string
+	exts    map[string]bool
+	maxSize int64 // bytes; 0 skips every match
+}
+
+// SetLimits sets the size/type policies checked before indexing new files.
+// Call before the first scan.
+func (idx *Indexer) SetLimits(limits []config.IndexLimit) {
+	idx.limits = make([]indexLimit, 0, len(limits))
+	for _, l := range limits {
+		il := indexLimit{maxSize: l.MaxSizeMB << 20}
+		if l.Path != "" {
+			il.prefix = filepath.Clean(l.Path)
+		}
+		if len(l.Extensions) > 0 {
+			il.exts = make(map[string]bool, len(l.Extensions))
+			for _, ext := range l.Extensions {
+				ext = strings.ToLower(ext)
+				if !strings.HasPrefix(ext, ".") {
+					ext = "." + ext
+				}
+				il.exts[ext] = true
+			}
+		}
+		idx.limits = append(idx.limits, il)
+	}
+}
+
+// skippedByPolicy reports whether a file is excluded by a configured limit.
+func (idx *Indexer) skippedByPolicy(path string, size int64) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, l := range idx.limits {
+		if l.prefix != "" && path != l.prefix && !strings.HasPrefix(path, l.prefix+string(filepath.Separator)) {
+			continue
+		}
+		if l.exts != nil && !l.exts[ext] {
+			continue
+		}
+		if l.maxSize == 0 || size > l.maxSize {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package indexer
+
+import (
+	"log"
+	"math"
+
+	"photog/internal/models"
+)
+
+// validCoord reports whether lat/lon is a usable position. 0,0 is what
+// broken GPS units write, so it counts as unknown.
+func validCoord(lat, lon float64) bool {
+	if math.IsNaN(lat) || math.IsNaN(lon) || (lat == 0 && lon == 0) {
+		return false
+	}
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// backfillLocations stores GPS positions for images indexed before
+// positions were kept, re-reading their EXIF header and sidecars.
+func (idx *Indexer) backfillLocations() {
+	items, err := idx.db.GetUnlocatedImages()
+	if err != nil {
+		log.Printf("Indexer: loading images for location backfill: %v", err)
+		return
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	var located int
+	for _, item := range items {
+		if idx.ctx.Err() != nil {
+			return
+		}
+		photo := &models.Photo{Path: item.Path, MediaType: item.MediaType}
+		idx.extractExif(photo)
+		if paths, _ := sidecarsFor(item.Path, nil); len(paths) > 0 {
+			if m := readSidecars(paths); m.Lat != 0 || m.Lon != 0 {
+				photo.Latitude, photo.Longitude = m.Lat, m.Lon
+			}
+		}
+		ok := validCoord(photo.Latitude, photo.Longitude)
+		if err := idx.db.SetLocation(item.ID, photo.Latitude, photo.Longitude, ok); err != nil {
+			log.Printf("Indexer: storing location of %s: %v", item.Path, err)
+			continue
+		}
+		if ok {
+			located++
+		}
+	}
+	log.Printf("Indexer: recorded GPS positions for %d of %d images", located, len(items))
+}
@@ -0,0 +1,252 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+	"github.com/rwcarlsen/goexif/tiff"
+	"photog/internal/archive"
+	"photog/internal/models"
+)
+
+// xmpScanLimit is how far into a file we look for an embedded XMP packet.
+const xmpScanLimit = 4 << 20
+
+// Metadata is the complete decoded tag set of a media file, beyond the
+// normalized columns stored in the database. GPS repeats the EXIF GPS
+// altitude, direction and speed in plain units.
+type Metadata struct {
+	EXIF    map[string]interface{} `json:"exif,omitempty"`
+	XMP     map[string]interface{} `json:"xmp,omitempty"`
+	GPS     *models.GPSDetails     `json:"gps,omitempty"`
+	FFprobe interface{}            `json:"ffprobe,omitempty"`
+}
+
+// ReadMetadata decodes every EXIF and XMP tag of an image, or the ffprobe
+// format and stream info of a video. Missing metadata is not an error.
+func ReadMetadata(path, mediaType string) (*Metadata, error) {
+	if _, err := archive.Stat(path); err != nil {
+		return nil, err
+	}
+
+	md := &Metadata{}
+	if mediaType == "video" {
+		md.FFprobe = probeAll(path)
+		return md, nil
+	}
+	md.EXIF = readAllExif(path)
+	md.GPS = readGPSDetails(path)
+	md.XMP = readXMP(path)
+	return md, nil
+}
+
+// exifWalker collects EXIF fields into a map.
+type exifWalker map[string]interface{}
+
+func (m exifWalker) Walk(name exif.FieldName, tag *tiff.Tag) error {
+	if name == exif.MakerNote {
+		return nil // vendor binary blob
+	}
+	if v := tagValue(tag); v != nil {
+		m[string(name)] = v
+	}
+	return nil
+}
+
+// tagValue converts a tag into a JSON-friendly value: a scalar for single
+// values, a slice otherwise. Rationals are rendered as "num/den".
+func tagValue(tag *tiff.Tag) interface{} {
+	switch tag.Format() {
+	case tiff.StringVal:
+		s, _ := tag.StringVal()
+		return strings.TrimRight(s, "\x00 ")
+	case tiff.UndefVal:
+		s := tag.String()
+		if len(s) > 256 {
+			return nil
+		}
+		return strings.Trim(s, `"`)
+	case tiff.OtherVal:
+		return nil
+	}
+
+	vals := make([]interface{}, 0, tag.Count)
+	for i := 0; i < int(tag.Count); i++ {
+		switch tag.Format() {
+		case tiff.IntVal:
+			v, err := tag.Int64(i)
+			if err != nil {
+				return nil
+			}
+			vals = append(vals, v)
+		case tiff.FloatVal:
+			v, err := tag.Float(i)
+			if err != nil {
+				return nil
+			}
+			vals = append(vals, v)
+		case tiff.RatVal:
+			n, d, err := tag.Rat2(i)
+			if err != nil {
+				return nil
+			}
+			vals = append(vals, fmt.Sprintf("%d/%d", n, d))
+		}
+	}
+	if len(vals) == 1 {
+		return vals[0]
+	}
+	return vals
+}
+
+func readAllExif(path string) map[string]interface{} {
+	f, err := archive.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	x, err := exif.Decode(f)
+	if err != nil {
+		return nil
+	}
+	tags := exifWalker{}
+	x.Walk(tags)
+	return tags
+}
+
+// readXMP extracts the embedded XMP packet and flattens it to
+// "prefix:Name" keys. Properties given as rdf lists become slices.
+func readXMP(path string) map[string]interface{} {
+	f, err := archive.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, xmpScanLimit))
+	if err != nil {
+		return nil
+	}
+	start := bytes.Index(data, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return nil
+	}
+	end := bytes.Index(data[start:], []byte("</x:xmpmeta>"))
+	if end < 0 {
+		return nil
+	}
+	packet := data[start : start+end+len("</x:xmpmeta>")]
+
+	const rdfNS = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	prefixes := map[string]string{}
+	name := func(n xml.Name) string {
+		if p, ok := prefixes[n.Space]; ok {
+			return p + ":" + n.Local
+		}
+		return n.Local
+	}
+
+	props := map[string]interface{}{}
+	var stack []xml.Name
+	dec := xml.NewDecoder(bytes.NewReader(packet))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			for _, a := range t.Attr {
+				if a.Name.Space == "xmlns" {
+					prefixes[a.Value] = a.Name.Local
+				}
+			}
+			if t.Name.Space == rdfNS && t.Name.Local == "Description" {
+				for _, a := range t.Attr {
+					if a.Name.Space != "xmlns" && a.Name.Space != rdfNS && a.Name.Space != "" {
+						props[name(a.Name)] = a.Value
+					}
+				}
+			}
+			stack = append(stack, t.Name)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if text == "" || len(stack) == 0 {
+				continue
+			}
+			// The property is the innermost non-rdf element
+			var prop xml.Name
+			inList := false
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].Space != rdfNS {
+					prop = stack[i]
+					break
+				}
+				if stack[i].Local == "li" {
+					inList = true
+				}
+			}
+			if prop.Local == "" || prop.Local == "xmpmeta" {
+				continue
+			}
+			key := name(prop)
+			if inList {
+				list, _ := props[key].([]string)
+				props[key] = append(list, text)
+			} else {
+				props[key] = text
+			}
+		}
+	}
+	if len(props) == 0 {
+		return nil
+	}
+	return props
+}
+
+// probeAll returns ffprobe's full format and stream description, or nil if
+// ffprobe isn't installed or fails.
+func probeAll(path string) interface{} {
+	ffprobe := getFFprobe()
+	if ffprobe == "" {
+		return nil
+	}
+
+	local, cleanup, err := archive.Local(path)
+	if err != nil {
+		return nil
+	}
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ffprobeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, ffprobe,
+		"-v", "error",
+		"-show_format",
+		"-show_streams",
+		"-of", "json",
+		local,
+	).Output()
+	if err != nil {
+		return nil
+	}
+
+	var res interface{}
+	if err := json.Unmarshal(out, &res); err != nil {
+		return nil
+	}
+	return res
+}
@@ -0,0 +1,78 @@
+package indexer
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ownersKey is the meta key holding the fingerprint of the user paths the
+// stored photo owners were computed with.
+const ownersKey = "photo_owners"
+
+// ownerPath is a folder whose photos belong to a user.
+type ownerPath struct {
+	path string
+	user int64
+}
+
+// SetOwners sets which users own which folders, as user ID -> paths.
+// Photos outside every folder are shared (owner 0). Call before the first
+// scan.
+func (idx *Indexer) SetOwners(owners map[int64][]string) {
+	var list []ownerPath
+	for user, paths := range owners {
+		for _, p := range paths {
+			list = append(list, ownerPath{path: filepath.Clean(p), user: user})
+		}
+	}
+	// Longest first, so a folder nested in another user's folder wins
+	sort.Slice(list, func(i, j int) bool {
+		if len(list[i].path) != len(list[j].path) {
+			return len(list[i].path) > len(list[j].path)
+		}
+		return list[i].path < list[j].path
+	})
+
+	var key strings.Builder
+	for _, o := range list {
+		fmt.Fprintf(&key, "%d\x00%s\n", o.user, o.path)
+	}
+	idx.owners = list
+	idx.ownersKey = key.String()
+}
+
+// ownerFor returns the user owning path, or 0 if it is shared.
+func (idx *Indexer) ownerFor(path string) int64 {
+	for _, o := range idx.owners {
+		if path == o.path || strings.HasPrefix(path, o.path+string(filepath.Separator)) {
+			return o.user
+		}
+	}
+	return 0
+}
+
+// syncOwners reassigns photo owners across the library if the user paths
+// changed since the stored owners were computed.
+func (idx *Indexer) syncOwners() {
+	stored, err := idx.db.GetMeta(ownersKey)
+	if err != nil {
+		log.Printf("Indexer: reading owner state: %v", err)
+		return
+	}
+	if stored == idx.ownersKey {
+		return
+	}
+
+	n, err := idx.db.ReassignOwners(idx.ownerFor)
+	if err != nil {
+		log.Printf("Indexer: reassigning photo owners: %v", err)
+		return
+	}
+	if err := idx.db.SetMeta(ownersKey, idx.ownersKey); err != nil {
+		log.Printf("Indexer: saving owner state: %v", err)
+	}
+	log.Printf("Indexer: user paths changed, reassigned the owner of %d files", n)
+}
@@ -0,0 +1,70 @@
+package indexer
+
+import (
+	"log"
+
+	"photog/internal/geocode"
+	"photog/internal/models"
+)
+
+// geocodeKey is the meta key holding the ID of the dataset the stored
+// place names were resolved with.
+const geocodeKey = "geocode_dataset"
+
+// SetGeocoder sets the geocoder that names the places of located photos.
+// With none set, photos get no place names. Call before the first scan.
+func (idx *Indexer) SetGeocoder(g *geocode.Geocoder) {
+	idx.geocoder = g
+}
+
+// locate sets a processed photo's place name from its GPS position.
+func (idx *Indexer) locate(photo *models.Photo) {
+	photo.Place = ""
+	if idx.geocoder == nil || !photo.HasGPS || !validCoord(photo.Latitude, photo.Longitude) {
+		return
+	}
+	photo.Place = idx.geocoder.Lookup(photo.Latitude, photo.Longitude)
+}
+
+// backfillPlaces names the places of located photos that have none yet:
+// those indexed before geocoding, or all of them after the dataset changed.
+func (idx *Indexer) backfillPlaces() {
+	if idx.geocoder == nil {
+		return
+	}
+	stored, err := idx.db.GetMeta(geocodeKey)
+	if err != nil {
+		log.Printf("Indexer: reading geocoding state: %v", err)
+		return
+	}
+	if stored != idx.geocoder.ID() {
+		if err := idx.db.ClearPlaces(); err != nil {
+			log.Printf("Indexer: resetting place names: %v", err)
+			return
+		}
+		if err := idx.db.SetMeta(geocodeKey, idx.geocoder.ID()); err != nil {
+			log.Printf("Indexer: saving geocoding state: %v", err)
+		}
+	}
+
+	items, err := idx.db.GetUnplacedPhotos()
+	if err != nil {
+		log.Printf("Indexer: loading photos for place backfill: %v", err)
+		return
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	places := make(map[int64]string)
+	for _, item := range items {
+		if place := idx.geocoder.Lookup(item.Lat, item.Lon); place != "" {
+			places[item.ID] = place
+		}
+	}
+	if err := idx.db.SetPlaces(places); err != nil {
+		log.Printf("Indexer: storing place names: %v", err)
+		return
+	}
+	log.Printf("Indexer: named the places of %d of %d located photos", len(places), len(items))
+}
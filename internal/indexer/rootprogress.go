@@ -0,0 +1,124 @@
+package indexer
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RootProgress is how far a scan has got through one photo root.
+type RootProgress struct {
+	Path        string  `json:"path"`
+	State       string  `json:"state"` // "pending", "scanning", "done", "offline" or "canceled"
+	Total       int64   `json:"total"`
+	Processed   int64   `json:"processed"`
+	Errors      int64   `json:"errors"`
+	CurrentDir  string  `json:"current_dir,omitempty"` // while scanning
+	FilesPerSec float64 `json:"files_per_sec"`
+	StartedAt   string  `json:"started_at,omitempty"`
+	FinishedAt  string  `json:"finished_at,omitempty"`
+}
+
+// rootScan tracks a scan's progress through one root. Counts are updated
+// per file without locking; the rest changes once per directory.
+type rootScan struct {
+	path      string
+	total     atomic.Int64
+	processed atomic.Int64
+	errors    atomic.Int64
+
+	mu       sync.Mutex
+	state    string
+	dir      string
+	started  time.Time
+	finished time.Time
+}
+
+// newRootScans returns the pending progress of a scan through paths.
+func newRootScans(paths []string) []*rootScan {
+	roots := make([]*rootScan, len(paths))
+	for i, p := range paths {
+		roots[i] = &rootScan{path: p, state: "pending"}
+	}
+	return roots
+}
+
+// start marks the root as being scanned.
+func (r *rootScan) start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state = "scanning"
+	r.started = time.Now()
+}
+
+// finish marks the root as done with its scan, or as state when it wasn't
+// scanned to the end.
+func (r *rootScan) finish(state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state = state
+	r.dir = ""
+	if !r.started.IsZero() {
+		r.finished = time.Now()
+	}
+}
+
+// enter records the directory the scan has reached.
+func (r *rootScan) enter(dir string) {
+	r.mu.Lock()
+	r.dir = dir
+	r.mu.Unlock()
+}
+
+// snapshot returns the root's progress, with files per second so far while
+// it is being scanned.
+func (r *rootScan) snapshot() RootProgress {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := RootProgress{
+		Path:       r.path,
+		State:      r.state,
+		Total:      r.total.Load(),
+		Processed:  r.processed.Load(),
+		Errors:     r.errors.Load(),
+		CurrentDir: r.dir,
+	}
+	if r.started.IsZero() {
+		return p
+	}
+	p.StartedAt = r.started.Format(time.RFC3339)
+	end := time.Now()
+	if !r.finished.IsZero() {
+		end = r.finished
+		p.FinishedAt = r.finished.Format(time.RFC3339)
+	}
+	if elapsed := end.Sub(r.started).Seconds(); elapsed > 0 {
+		p.FilesPerSec = float64(p.Processed) / elapsed
+	}
+	return p
+}
+
+// setScanning sets the root the running scan is in, nil between roots.
+func (idx *Indexer) setScanning(r *rootScan) {
+	idx.mu.Lock()
+	idx.scanning = r
+	idx.mu.Unlock()
+}
+
+// scanningRoot returns the root the running scan is in if path is under
+// it, or nil: files indexed outside of the scan, such as uploads, aren't
+// counted against it.
+func (idx *Indexer) scanningRoot(path string) *rootScan {
+	idx.mu.Lock()
+	r := idx.scanning
+	idx.mu.Unlock()
+	if r == nil {
+		return nil
+	}
+	if path != r.path && !strings.HasPrefix(path, strings.TrimSuffix(r.path, string(filepath.Separator))+string(filepath.Separator)) {
+		return nil
+	}
+	return r
+}
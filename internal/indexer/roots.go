@@ -0,0 +1,62 @@
+package indexer
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// CheckRoots marks each photo root online or offline. A root is offline
+// when it is missing or not a directory, or when it is empty while files
+// from it are indexed: what an unplugged or unmounted disk looks like.
+// Scans skip offline roots and cleanup keeps their photos.
+func (idx *Indexer) CheckRoots() {
+	for _, root := range idx.paths {
+		offline := !idx.rootPresent(root)
+		if idx.db.SetRootOffline(root, offline) {
+			if offline {
+				log.Printf("Indexer: photo root %s is offline; its photos are kept as unavailable", root)
+			} else {
+				log.Printf("Indexer: photo root %s is back online", root)
+			}
+		}
+	}
+}
+
+// rootPresent reports whether a root's files are reachable.
+func (idx *Indexer) rootPresent(root string) bool {
+	f, err := os.Open(root)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.IsDir() {
+		return false
+	}
+	if _, err := f.ReadDir(1); err != io.EOF {
+		return err == nil
+	}
+	// Empty: a fresh library, or the mount point of a missing disk
+	n, err := idx.db.CountUnderRoot(root)
+	return err == nil && n == 0
+}
+
+// MonitorRoots runs CheckRoots now and then every interval until ctx is
+// canceled, so disks coming and going show up without a scan.
+func (idx *Indexer) MonitorRoots(ctx context.Context, interval time.Duration) {
+	idx.CheckRoots()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				idx.CheckRoots()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,301 @@
+package indexer
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"photog/internal/models"
+)
+
+// sidecarExts are the sidecar formats whose metadata overrides the file's
+// own: XMP written by darktable/Lightroom and Google Takeout JSON.
+var sidecarExts = map[string]bool{".xmp": true, ".json": true}
+
+// xmpDateKeys are the XMP properties holding the capture date, in order of
+// preference.
+var xmpDateKeys = []string{"exif:DateTimeOriginal", "photoshop:DateCreated", "xmp:CreateDate"}
+
+// xmpDateLayouts are the date forms XMP allows, most specific first.
+var xmpDateLayouts = []string{
+	"2006-01-02T15:04:05.999999999Z07:00",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// sidecarMeta is the metadata read from a photo's sidecars.
+type sidecarMeta struct {
+	TakenAt     time.Time
+	Orientation int
+	HasGPS      bool
+	Lat, Lon    float64 // zero unless parsed
+	Keywords    []string
+}
+
+// sidecarKey normalizes a sidecar path for lookup, so IMG_1.XMP and
+// IMG_1.xmp are found alike.
+func sidecarKey(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + strings.ToLower(ext)
+}
+
+// OwnSidecars returns the sidecars on disk that belong to the media file at
+// path alone. One named after the file without its extension, such as
+// IMG_1.xmp, is left out when another media file (IMG_1.mov) shares it.
+func OwnSidecars(path string) []string {
+	found, _ := sidecarsFor(path, nil)
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	shared := false
+	if entries, err := os.ReadDir(filepath.Dir(path)); err == nil {
+		for _, e := range entries {
+			name := e.Name()
+			if name != filepath.Base(path) && strings.TrimSuffix(name, filepath.Ext(name)) == base && IsMediaFile(name) {
+				shared = true
+				break
+			}
+		}
+	}
+
+	var own []string
+	for _, sc := range found {
+		if shared && !strings.HasPrefix(sc, path+".") {
+			continue
+		}
+		own = append(own, sc)
+	}
+	return own
+}
+
+// sidecarsFor returns the sidecars of a media file, JSON before XMP so that
+// edits from a photo editor win over export metadata. known maps sidecar
+// keys to mtimes as collected during a scan; when nil the disk is checked.
+// The stamp is the sum of the sidecars' mtimes, so adding, editing or
+// removing any of them changes it.
+func sidecarsFor(path string, known map[string]int64) ([]string, int64) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	var found []string
+	var stamp int64
+	seen := map[string]bool{}
+	for _, candidate := range []string{path + ".json", base + ".json", path + ".xmp", base + ".xmp"} {
+		if seen[candidate] {
+			continue
+		}
+		seen[candidate] = true
+
+		var mtime int64
+		if known != nil {
+			mtime = known[sidecarKey(candidate)]
+		} else if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			mtime = info.ModTime().UnixNano()
+		}
+		if mtime != 0 {
+			found = append(found, candidate)
+			stamp += mtime
+		}
+	}
+	return found, stamp
+}
+
+// recordSidecar notes a sidecar seen while counting files.
+func (idx *Indexer) recordSidecar(path string, d fs.DirEntry) {
+	info, err := d.Info()
+	if err != nil {
+		return
+	}
+	idx.sidecars[sidecarKey(path)] = info.ModTime().UnixNano()
+}
+
+// readSidecars merges the metadata of the given sidecar files, later files
+// overriding earlier ones.
+func readSidecars(paths []string) *sidecarMeta {
+	m := &sidecarMeta{}
+	for _, p := range paths {
+		if strings.EqualFold(filepath.Ext(p), ".json") {
+			readTakeoutJSON(p, m)
+		} else {
+			readSidecarXMP(p, m)
+		}
+	}
+	return m
+}
+
+// readSidecarXMP applies the capture date, orientation, GPS position and
+// keywords of an XMP sidecar.
+func readSidecarXMP(path string, m *sidecarMeta) {
+	props := readXMP(path)
+	if props == nil {
+		return
+	}
+	for _, key := range xmpDateKeys {
+		if s, ok := props[key].(string); ok {
+			if t, ok := parseXMPDate(s); ok {
+				m.TakenAt = t
+				break
+			}
+		}
+	}
+	if s, ok := props["tiff:Orientation"].(string); ok {
+		if o, err := strconv.Atoi(s); err == nil && o >= 1 && o <= 8 {
+			m.Orientation = o
+		}
+	}
+	if _, ok := props["exif:GPSLatitude"]; ok {
+		m.HasGPS = true
+		lat, ok1 := parseXMPCoord(props["exif:GPSLatitude"])
+		lon, ok2 := parseXMPCoord(props["exif:GPSLongitude"])
+		if ok1 && ok2 && validCoord(lat, lon) {
+			m.Lat, m.Lon = lat, lon
+		}
+	}
+	switch v := props["dc:subject"].(type) {
+	case []string:
+		m.Keywords = v
+	case string:
+		m.Keywords = []string{v}
+	}
+}
+
+// parseXMPCoord parses an XMP GPS coordinate, "DDD,MM.mmk" or "DDD,MM,SSk"
+// with k one of N, S, E or W, into decimal degrees.
+func parseXMPCoord(v interface{}) (float64, bool) {
+	s, ok := v.(string)
+	if !ok || len(s) < 2 {
+		return 0, false
+	}
+	sign := 1.0
+	switch s[len(s)-1] {
+	case 'N', 'E':
+	case 'S', 'W':
+		sign = -1
+	default:
+		return 0, false
+	}
+	var deg float64
+	scale := 1.0
+	for _, part := range strings.Split(s[:len(s)-1], ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || scale < 1.0/3600 {
+			return 0, false
+		}
+		deg += f * scale
+		scale /= 60
+	}
+	return sign * deg, true
+}
+
+func parseXMPDate(s string) (time.Time, bool) {
+	for _, layout := range xmpDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// takeoutJSON is the part of a Google Takeout sidecar we use.
+type takeoutJSON struct {
+	PhotoTakenTime struct {
+		Timestamp string `json:"timestamp"`
+	} `json:"photoTakenTime"`
+	GeoData struct {
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+	} `json:"geoData"`
+}
+
+// readTakeoutJSON applies the capture date and GPS position of a Google
+// Takeout sidecar. Other JSON files are ignored.
+func readTakeoutJSON(path string, m *sidecarMeta) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	var t takeoutJSON
+	if err := json.Unmarshal(data, &t); err != nil {
+		return
+	}
+	if ts, err := strconv.ParseInt(t.PhotoTakenTime.Timestamp, 10, 64); err == nil && ts > 0 {
+		m.TakenAt = time.Unix(ts, 0)
+	}
+	if t.GeoData.Latitude != 0 || t.GeoData.Longitude != 0 {
+		m.HasGPS = true
+		if validCoord(t.GeoData.Latitude, t.GeoData.Longitude) {
+			m.Lat, m.Lon = t.GeoData.Latitude, t.GeoData.Longitude
+		}
+	}
+}
+
+// applySidecars overlays sidecar metadata onto a freshly processed photo
+// and returns the sidecar keywords.
+func applySidecars(photo *models.Photo, paths []string, stamp int64) []string {
+	photo.SidecarStamp = stamp
+	if len(paths) == 0 {
+		return nil
+	}
+	m := readSidecars(paths)
+	if !m.TakenAt.IsZero() {
+		photo.TakenAt = m.TakenAt
+		photo.DateSource = "sidecar"
+	}
+	if m.HasGPS {
+		photo.HasGPS = true
+	}
+	if m.Lat != 0 || m.Lon != 0 {
+		photo.Latitude, photo.Longitude = m.Lat, m.Lon
+	}
+	if m.Orientation != 0 && photo.MediaType != "video" {
+		// Width/height are stored in display orientation (see extractExif)
+		if isRotated(m.Orientation) != isRotated(photo.Orientation) {
+			photo.Width, photo.Height = photo.Height, photo.Width
+		}
+		photo.Orientation = m.Orientation
+	}
+	return m.Keywords
+}
+
+// applySidecarTags stores the sidecar keywords of a newly indexed file.
+func (idx *Indexer) applySidecarTags(path string, keywords []string) {
+	if len(keywords) == 0 {
+		return
+	}
+	if err := idx.db.SetSidecarTags(path, keywords); err != nil {
+		log.Printf("Indexer: tagging %s from sidecar: %v", path, err)
+	}
+}
+
+func isRotated(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// syncSidecars re-applies sidecar metadata to an already indexed file whose
+// sidecars were added, edited or removed since it was last indexed.
+// Metadata is re-read from the file first so removed overrides revert.
+func (idx *Indexer) syncSidecars(path string, d fs.DirEntry, isImage bool, stored int64) {
+	paths, stamp := sidecarsFor(path, idx.sidecars)
+	if stamp == stored {
+		return
+	}
+
+	photo := idx.processFile(path, d, isImage)
+	if photo == nil {
+		return
+	}
+	keywords := applySidecars(photo, paths, stamp)
+	idx.locate(photo)
+	if err := idx.db.UpdateSidecarMetadata(photo); err != nil {
+		idx.recordError(path, "sidecar", err)
+		return
+	}
+	if err := idx.db.SetSidecarTags(path, keywords); err != nil {
+		log.Printf("Indexer: tagging %s from sidecar: %v", path, err)
+	}
+	atomic.AddInt64(&idx.Progress.SidecarUpdates, 1)
+}
@@ -0,0 +1,126 @@
+package indexer
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"photog/internal/config"
+)
+
+// tagRulesKey is the meta key holding the fingerprint of the rules the
+// stored tags were computed with.
+const tagRulesKey = "tag_rules"
+
+// tagRule is a compiled config.TagRule.
+type tagRule struct {
+	re  *regexp.Regexp
+	tag string
+}
+
+// SetTagRules compiles the path tagging rules applied during indexing.
+// Call before the first scan.
+func (idx *Indexer) SetTagRules(rules []config.TagRule) error {
+	compiled := make([]tagRule, 0, len(rules))
+	var key strings.Builder
+	for _, r := range rules {
+		tag := strings.TrimSpace(r.Tag)
+		if r.Pattern == "" || tag == "" {
+			return fmt.Errorf("tag rule needs both pattern and tag: %+v", r)
+		}
+		re, err := globToRegexp(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("tag rule %q: %w", r.Pattern, err)
+		}
+		compiled = append(compiled, tagRule{re: re, tag: tag})
+		fmt.Fprintf(&key, "%s\x00%s\n", r.Pattern, tag)
+	}
+	idx.tagRules = compiled
+	idx.tagRulesKey = key.String()
+	return nil
+}
+
+// globToRegexp converts a path glob to an anchored regexp. * and ? match
+// within one path segment; ** matches any number of segments.
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	pattern = filepath.ToSlash(pattern)
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// tagsFor returns the tags whose rules match path.
+func (idx *Indexer) tagsFor(path string) []string {
+	path = filepath.ToSlash(path)
+	var tags []string
+	for _, r := range idx.tagRules {
+		if r.re.MatchString(path) {
+			tags = append(tags, r.tag)
+		}
+	}
+	return tags
+}
+
+// applyTags stores the rule tags for a newly indexed file.
+func (idx *Indexer) applyTags(path string) {
+	tags := idx.tagsFor(path)
+	if len(tags) == 0 {
+		return
+	}
+	if err := idx.db.SetRuleTags(path, tags); err != nil {
+		log.Printf("Indexer: tagging %s: %v", path, err)
+	}
+}
+
+// RetagAll re-applies the tag rules to the whole library and returns the
+// number of rule tags written.
+func (idx *Indexer) RetagAll() (int, error) {
+	n, err := idx.db.RetagAll(idx.tagsFor)
+	if err != nil {
+		return 0, err
+	}
+	if err := idx.db.SetMeta(tagRulesKey, idx.tagRulesKey); err != nil {
+		log.Printf("Indexer: saving tag rule state: %v", err)
+	}
+	return n, nil
+}
+
+// syncTagRules re-tags the whole library if the rules changed since the
+// stored tags were computed.
+func (idx *Indexer) syncTagRules() {
+	stored, err := idx.db.GetMeta(tagRulesKey)
+	if err != nil {
+		log.Printf("Indexer: reading tag rule state: %v", err)
+		return
+	}
+	if stored == idx.tagRulesKey {
+		return
+	}
+
+	n, err := idx.RetagAll()
+	if err != nil {
+		log.Printf("Indexer: re-applying tag rules: %v", err)
+		return
+	}
+	log.Printf("Indexer: tag rules changed, applied %d tags across the library", n)
+}
@@ -0,0 +1,202 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"photog/internal/archive"
+	"photog/internal/models"
+)
+
+// ffprobeTimeout is the maximum time allowed for a single ffprobe invocation.
+const ffprobeTimeout = 30 * time.Second
+
+var (
+	ffprobeOnce sync.Once
+	ffprobePath string
+)
+
+// getFFprobe returns the ffprobe path, or "" if it isn't installed.
+func getFFprobe() string {
+	ffprobeOnce.Do(func() {
+		path, err := exec.LookPath("ffprobe")
+		if err == nil {
+			ffprobePath = path
+			log.Printf("Indexer: ffprobe found at %s (video dimensions enabled)", path)
+		} else {
+			log.Printf("Indexer: ffprobe not found (video dimensions disabled)")
+		}
+	})
+	return ffprobePath
+}
+
+// probeResult is the subset of `ffprobe -of json` output we read.
+type probeResult struct {
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+		Tags      struct {
+			Rotate string `json:"rotate"`
+		} `json:"tags"`
+		SideDataList []struct {
+			Rotation float64 `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"` // seconds, e.g. "12.345000"
+	} `json:"format"`
+}
+
+// videoInfo is what we record about a video from ffprobe.
+type videoInfo struct {
+	Width, Height int     // display dimensions, 0 if unknown
+	Duration      float64 // seconds, 0 if unknown
+	Rotation      int     // clockwise degrees to turn the stored frames for display
+	Container     string
+	VideoCodec    string
+	AudioCodec    string // empty if there is no audio stream
+}
+
+// probeVideo returns the display size of a video's first video stream, with
+// rotation metadata applied (phone videos are often stored landscape with a
+// 90° rotation flag), along with its duration, container and codecs.
+func probeVideo(ctx context.Context, path string) (videoInfo, bool) {
+	ffprobe := getFFprobe()
+	if ffprobe == "" {
+		return videoInfo{}, false
+	}
+
+	local, cleanup, err := archive.Local(path)
+	if err != nil {
+		return videoInfo{}, false
+	}
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(ctx, ffprobeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, ffprobe,
+		"-v", "error",
+		"-show_entries", "stream=codec_type,codec_name,width,height:stream_tags=rotate:stream_side_data=rotation:format=format_name,duration",
+		"-of", "json",
+		local,
+	).Output()
+	if err != nil {
+		return videoInfo{}, false
+	}
+
+	var res probeResult
+	if err := json.Unmarshal(out, &res); err != nil {
+		return videoInfo{}, false
+	}
+
+	info := videoInfo{Container: res.Format.FormatName}
+	if d, err := strconv.ParseFloat(res.Format.Duration, 64); err == nil && d > 0 {
+		info.Duration = d
+	}
+	for _, st := range res.Streams {
+		switch st.CodecType {
+		case "video":
+			if info.VideoCodec != "" {
+				continue
+			}
+			info.VideoCodec = st.CodecName
+
+			// The rotate tag is clockwise; the display matrix side data
+			// that replaced it in newer ffprobe is counter-clockwise
+			rotation := 0
+			if st.Tags.Rotate != "" {
+				rotation, _ = strconv.Atoi(st.Tags.Rotate)
+			}
+			for _, sd := range st.SideDataList {
+				if sd.Rotation != 0 {
+					rotation = -int(sd.Rotation)
+				}
+			}
+			info.Rotation = (rotation%360 + 360) % 360
+			info.Width, info.Height = st.Width, st.Height
+			if rotation%180 != 0 {
+				info.Width, info.Height = info.Height, info.Width
+			}
+		case "audio":
+			if info.AudioCodec == "" {
+				info.AudioCodec = st.CodecName
+			}
+		}
+	}
+	return info, info.VideoCodec != ""
+}
+
+// extractVideoInfo fills in display dimensions, duration, rotation and
+// codecs for a video.
+func (idx *Indexer) extractVideoInfo(photo *models.Photo) {
+	info, ok := probeVideo(idx.ctx, photo.Path)
+	if !ok {
+		return
+	}
+	if info.Width > 0 && info.Height > 0 {
+		photo.Width = info.Width
+		photo.Height = info.Height
+	}
+	photo.Duration = info.Duration
+	photo.Rotation = info.Rotation
+	photo.Container = info.Container
+	photo.VideoCodec = info.VideoCodec
+	photo.AudioCodec = info.AudioCodec
+}
+
+// backfillVideoInfo probes videos indexed before dimensions, durations and
+// codecs were recorded (or while ffprobe was unavailable). Videos ffprobe
+// can't read in full get a "probe" index error, so later scans don't probe
+// them again until they change or the error is retried.
+func (idx *Indexer) backfillVideoInfo() {
+	if getFFprobe() == "" {
+		return
+	}
+
+	videos, err := idx.db.GetVideosToProbe()
+	if err != nil {
+		log.Printf("Indexer: loading videos to probe: %v", err)
+		return
+	}
+	if len(videos) == 0 {
+		return
+	}
+
+	var updated int
+	for _, v := range videos {
+		if idx.ctx.Err() != nil {
+			return
+		}
+		info, ok := probeVideo(idx.ctx, v.Path)
+		if !ok {
+			if idx.ctx.Err() != nil {
+				return
+			}
+			idx.recordProbeError(v.Path, "ffprobe could not read a video stream")
+			continue
+		}
+		if err := idx.db.SetVideoInfo(v.ID, info.Width, info.Height, info.Duration, info.Rotation, info.Container, info.VideoCodec, info.AudioCodec); err == nil {
+			updated++
+		}
+		if info.Width == 0 || info.Height == 0 || info.Duration == 0 {
+			idx.recordProbeError(v.Path, "ffprobe reported no dimensions or duration")
+		}
+	}
+	log.Printf("Indexer: backfilled video metadata for %d/%d videos", updated, len(videos))
+}
+
+// recordProbeError records that ffprobe failed on a video.
+func (idx *Indexer) recordProbeError(path, message string) {
+	if err := idx.db.RecordIndexError(path, "probe", message); err != nil {
+		log.Printf("Indexer: recording probe error for %s: %v", path, err)
+	}
+}
@@ -0,0 +1,336 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"photog/internal/background"
+	"photog/internal/database"
+	"photog/internal/indexer"
+	"photog/internal/thumbnail"
+)
+
+// Built-in job types.
+const (
+	TypeScan      = "scan"       // index new files, then queue pregen (and cleanup if asked)
+	TypeCleanup   = "cleanup"    // drop index rows for files that no longer exist
+	TypePregen    = "pregen"     // pre-generate small thumbnails for unsettled items
+	TypePregenNew = "pregen_new" // small thumbnails for just-indexed files, right away
+	TypeDedup     = "dedup"      // hash files that may be duplicates of each other (or all files)
+	TypePHash     = "phash"      // compute perceptual hashes missing from images
+)
+
+// ScanPayload configures a scan job.
+type ScanPayload struct {
+	Cleanup bool `json:"cleanup"` // queue a cleanup job once the scan finishes
+}
+
+// PregenNewPayload lists the photos a pregen_new job makes thumbnails for.
+type PregenNewPayload struct {
+	IDs []int64 `json:"ids"`
+}
+
+// RegisterBuiltin registers the scan, cleanup, pregen, pregen_new, dedup and
+// phash job types. With hashAll the dedup job hashes every file, for content URLs,
+// rather than only those that may be duplicates. Without pruneMissing cleanup
+// jobs only report the files that no longer exist.
+func RegisterBuiltin(q *Queue, db *database.DB, idx *indexer.Indexer, thumbs *thumbnail.Generator, hashAll, pruneMissing bool) {
+	q.Register(TypeScan, Spec{
+		Class:       "scan",
+		MaxAttempts: 3, // a scan started outside the queue makes ours fail; try again later
+		Unique:      true,
+		Run: func(ctx context.Context, payload string, p *Progress) error {
+			var opts ScanPayload
+			if payload != "" {
+				if err := json.Unmarshal([]byte(payload), &opts); err != nil {
+					return fmt.Errorf("decode payload: %w", err)
+				}
+			}
+			if err := runScan(ctx, idx, db, p); err != nil {
+				return err
+			}
+			if opts.Cleanup {
+				if _, err := q.Enqueue(TypeCleanup, nil); err != nil {
+					log.Printf("Jobs: failed to queue cleanup: %v", err)
+				}
+			}
+			if _, err := q.Enqueue(TypePregen, nil); err != nil {
+				log.Printf("Jobs: failed to queue pregen: %v", err)
+			}
+			if _, err := q.Enqueue(TypeDedup, nil); err != nil {
+				log.Printf("Jobs: failed to queue dedup: %v", err)
+			}
+			if _, err := q.Enqueue(TypePHash, nil); err != nil {
+				log.Printf("Jobs: failed to queue phash: %v", err)
+			}
+			return nil
+		},
+	})
+
+	q.Register(TypeCleanup, Spec{
+		Class:  "maintenance",
+		Unique: true,
+		Run: func(ctx context.Context, payload string, p *Progress) error {
+			// Photos on a disk that is not mounted are kept
+			idx.CheckRoots()
+			report, err := db.RemoveMissing(!pruneMissing)
+			if err != nil {
+				return fmt.Errorf("remove missing: %w", err)
+			}
+			switch {
+			case report.Count == 0:
+			case report.DryRun:
+				log.Printf("Cleanup: %d indexed files no longer exist on disk, e.g. %s; kept (prune with DELETE /api/index/missing, or set photos.prune_missing)",
+					report.Count, report.Sample[0])
+			default:
+				log.Printf("Removed %d files that no longer exist on disk", report.Removed)
+			}
+			p.Total.Store(report.Count)
+			p.Done.Store(report.Removed)
+			return nil
+		},
+	})
+
+	q.Register(TypePregen, Spec{
+		Class:  "thumbnails",
+		Unique: true,
+		Run: func(ctx context.Context, payload string, p *Progress) error {
+			return runPregen(ctx, db, thumbs, p)
+		},
+	})
+
+	// Its own class, so new files don't wait behind a full pregen run or for
+	// the quiet hours
+	q.Register(TypePregenNew, Spec{
+		Class: "new_thumbnails",
+		Run: func(ctx context.Context, payload string, p *Progress) error {
+			var opts PregenNewPayload
+			if err := json.Unmarshal([]byte(payload), &opts); err != nil {
+				return fmt.Errorf("decode payload: %w", err)
+			}
+			return runPregenNew(ctx, db, thumbs, opts.IDs, p)
+		},
+	})
+
+	q.Register(TypeDedup, Spec{
+		Class:  "maintenance",
+		Unique: true,
+		Run: func(ctx context.Context, payload string, p *Progress) error {
+			return runDedup(ctx, db, hashAll, p)
+		},
+	})
+
+	q.Register(TypePHash, Spec{
+		Class:  "thumbnails",
+		Unique: true,
+		Run: func(ctx context.Context, payload string, p *Progress) error {
+			return runPHash(ctx, db, thumbs, p)
+		},
+	})
+}
+
+// runScan runs a full index scan, mirroring the indexer's progress into p.
+func runScan(ctx context.Context, idx *indexer.Indexer, db *database.DB, p *Progress) error {
+	mirror := func() {
+		ip := idx.GetProgress()
+		p.Total.Store(ip.Total)
+		p.Done.Store(ip.Processed)
+	}
+
+	// Scan on this goroutine so it keeps the lowered background priority
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				mirror()
+			}
+		}
+	}()
+	err := idx.ScanContext(ctx)
+	close(stop)
+	mirror()
+	if err != nil {
+		return err
+	}
+
+	// Clean out any dotfiles/hidden files (.pending-*, etc.) that were
+	// indexed by older versions. They can never produce valid thumbnails.
+	if removed, err := db.RemoveDotfiles(); err != nil {
+		log.Printf("Error cleaning dotfiles from index: %v", err)
+	} else if removed > 0 {
+		log.Printf("Cleaned %d dotfiles/hidden files from index", removed)
+	}
+	return nil
+}
+
+// runPregen generates small thumbnails in slow batches.
+func runPregen(ctx context.Context, db *database.DB, thumbs *thumbnail.Generator, p *Progress) error {
+	// Only items not yet settled in a previous run, so a restart resumes
+	// instead of re-checking every thumbnail.
+	total, err := db.CountPregenPending()
+	if err != nil {
+		return fmt.Errorf("count pending: %w", err)
+	}
+	if total == 0 {
+		return nil
+	}
+	p.Total.Store(total)
+
+	// Read a page at a time, so big libraries aren't loaded all at once
+	pages := db.PregenPending(1000)
+	next := func() ([]thumbnail.PregenItem, error) {
+		for {
+			items, err := pages.Next()
+			if err != nil || len(items) == 0 {
+				return nil, err
+			}
+			pregenItems := make([]thumbnail.PregenItem, 0, len(items))
+			for _, item := range items {
+				// Files on an offline disk would only fail; they stay pending
+				if root := db.RootOf(item.Path); root != "" && db.RootOffline(root) {
+					p.Total.Add(-1)
+					continue
+				}
+				pregenItems = append(pregenItems, thumbnail.PregenItem{
+					ID:        item.ID,
+					Path:      item.Path,
+					MediaType: item.MediaType,
+				})
+			}
+			if len(pregenItems) > 0 {
+				return pregenItems, nil
+			}
+		}
+	}
+
+	log.Printf("Pregen: starting background thumbnail generation for %d items", total)
+
+	// Process in batches of 10, with a 2-second pause between batches
+	// This keeps resource usage low while steadily building the cache
+	result, err := thumbs.PregenSmallThumbnails(total, next, 10, 2*time.Second, ctx.Done(), &p.Done)
+	if err != nil {
+		return fmt.Errorf("get paths: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Pregen: complete. Generated %d, skipped %d (already cached), errors %d",
+		result.Generated, result.Skipped, result.Errors)
+	return nil
+}
+
+// runPregenNew generates the small thumbnails of the given photos without
+// waiting between batches. Those settled since they were queued, by a full
+// pregen run, are skipped.
+func runPregenNew(ctx context.Context, db *database.DB, thumbs *thumbnail.Generator, ids []int64, p *Progress) error {
+	items, err := db.PregenPendingIDs(ids)
+	if err != nil {
+		return fmt.Errorf("get items: %w", err)
+	}
+	pregenItems := make([]thumbnail.PregenItem, 0, len(items))
+	for _, item := range items {
+		if root := db.RootOf(item.Path); root != "" && db.RootOffline(root) {
+			continue
+		}
+		pregenItems = append(pregenItems, thumbnail.PregenItem{
+			ID:        item.ID,
+			Path:      item.Path,
+			MediaType: item.MediaType,
+		})
+	}
+	p.Total.Store(int64(len(pregenItems)))
+
+	result := thumbs.PregenNew(pregenItems, ctx.Done(), &p.Done)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if result.Generated > 0 || result.Errors > 0 {
+		log.Printf("Pregen: new files: generated %d, errors %d", result.Generated, result.Errors)
+	}
+	return nil
+}
+
+// runDedup stores the content hash of every file sharing its size with
+// another, so GET /api/duplicates can group identical files. Other files
+// can't have a duplicate and are only read with hashAll.
+func runDedup(ctx context.Context, db *database.DB, hashAll bool, p *Progress) error {
+	get := db.GetUnhashedDuplicateSizes
+	if hashAll {
+		get = db.GetUnhashedFiles
+	}
+	items, err := get()
+	if err != nil {
+		return fmt.Errorf("get candidates: %w", err)
+	}
+	p.Total.Store(int64(len(items)))
+
+	var hashed int
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p.Done.Add(1)
+		// Files on an offline disk are hashed by a later run
+		if root := db.RootOf(item.Path); root != "" && db.RootOffline(root) {
+			continue
+		}
+		hash, err := indexer.HashFile(item.Path)
+		if err != nil {
+			continue // missing or unreadable; cleanup deals with it
+		}
+		if err := db.SetContentHash(item.ID, hash); err != nil {
+			return fmt.Errorf("store hash of %s: %w", item.Path, err)
+		}
+		hashed++
+		background.Pause()
+	}
+	if hashed > 0 {
+		log.Printf("Dedup: hashed %d files", hashed)
+	}
+	return nil
+}
+
+// runPHash computes the perceptual hash of images indexed before hashes
+// were taken, or whose small thumbnail was cached before: new thumbnails
+// report theirs through Generator.OnHashed.
+func runPHash(ctx context.Context, db *database.DB, thumbs *thumbnail.Generator, p *Progress) error {
+	items, err := db.GetPHashPending()
+	if err != nil {
+		return fmt.Errorf("get images: %w", err)
+	}
+	p.Total.Store(int64(len(items)))
+
+	var hashed int
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p.Done.Add(1)
+		// Files on an offline disk are hashed by a later run
+		if root := db.RootOf(item.Path); root != "" && db.RootOffline(root) {
+			continue
+		}
+		hash, err := thumbs.PerceptualHash(item.Path)
+		if err != nil {
+			continue // no thumbnail; the failure is tracked by the generator
+		}
+		if err := db.SetPHash(item.Path, hash); err != nil {
+			return fmt.Errorf("store hash of %s: %w", item.Path, err)
+		}
+		hashed++
+		background.Pause()
+	}
+	if hashed > 0 {
+		log.Printf("PHash: hashed %d images", hashed)
+	}
+	return nil
+}
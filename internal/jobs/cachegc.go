@@ -0,0 +1,65 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"photog/internal/database"
+	"photog/internal/thumbnail"
+	"photog/internal/trash"
+)
+
+// TypeCacheGC deletes cached thumbnails of files that are gone from the
+// library and the trash.
+const TypeCacheGC = "cache_gc"
+
+// RegisterCacheGC registers the cache GC job and, until ctx is done, queues
+// it every interval.
+func RegisterCacheGC(ctx context.Context, q *Queue, db *database.DB, thumbs *thumbnail.Generator, bin *trash.Trash, interval time.Duration) {
+	q.Register(TypeCacheGC, Spec{
+		Class:  "maintenance",
+		Unique: true,
+		Run: func(ctx context.Context, payload string, p *Progress) error {
+			result, err := CollectCache(ctx, db, thumbs, bin)
+			p.Total.Store(result.Scanned)
+			p.Done.Store(result.Orphaned + result.Stale + result.Temporary)
+			return err
+		},
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := q.Enqueue(TypeCacheGC, nil); err != nil {
+				log.Printf("Jobs: failed to queue cache GC: %v", err)
+			}
+		}
+	}()
+}
+
+// CollectCache deletes the cached thumbnails of files neither indexed nor
+// in the trash, and those left over from older thumbnail versions.
+func CollectCache(ctx context.Context, db *database.DB, thumbs *thumbnail.Generator, bin *trash.Trash) (thumbnail.GCResult, error) {
+	paths, err := db.GetPhotoPaths()
+	if err != nil {
+		return thumbnail.GCResult{}, fmt.Errorf("get paths: %w", err)
+	}
+	// The trash is listed with the thumbnails made while its files were in
+	// the library, or of the trashed files themselves
+	items, err := db.GetTrash(0)
+	if err != nil {
+		return thumbnail.GCResult{}, fmt.Errorf("get trash: %w", err)
+	}
+	for _, item := range items {
+		paths = append(paths, item.Path, bin.File(item))
+	}
+	return thumbs.CollectGarbage(ctx, paths)
+}
@@ -0,0 +1,56 @@
+package jobs
+
+import (
+	"log"
+
+	"photog/internal/diskspace"
+)
+
+// SetDiskGuard pauses jobs of the given classes while the volume holding dir
+// has less than minFree bytes available. They resume once free space is 10%
+// above the threshold, so a volume hovering around it doesn't flap.
+func (q *Queue) SetDiskGuard(dir string, minFree uint64, classes ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.diskDir = dir
+	q.diskMin = minFree
+	q.diskClasses = make(map[string]bool, len(classes))
+	for _, c := range classes {
+		q.diskClasses[c] = true
+	}
+}
+
+// checkDisk updates the low disk state and reports transitions.
+func (q *Queue) checkDisk() {
+	q.mu.Lock()
+	dir, min, wasLow := q.diskDir, q.diskMin, q.lowDisk
+	q.mu.Unlock()
+	if dir == "" || min == 0 {
+		return
+	}
+
+	free, err := diskspace.Free(dir)
+	if err != nil {
+		return // unsupported platform or transient error; don't block work
+	}
+	low := free < min
+	if wasLow && !low && free < min+min/10 {
+		low = true // not yet reclaimed enough to resume
+	}
+	if low == wasLow {
+		return
+	}
+
+	q.mu.Lock()
+	q.lowDisk = low
+	q.mu.Unlock()
+
+	if low {
+		log.Printf("Jobs: cache disk has %d MB free (minimum %d MB); pausing cache-writing jobs", free>>20, min>>20)
+	} else {
+		log.Printf("Jobs: cache disk has %d MB free again; resuming cache-writing jobs", free>>20)
+	}
+	if q.OnLowDisk != nil {
+		q.OnLowDisk(free, low)
+	}
+}
@@ -0,0 +1,468 @@
+// Package jobs is a persistent queue for background work. Jobs are stored in
+// the database so queued and interrupted work survives restarts, run in
+// concurrency classes (e.g. at most one scan at a time alongside thumbnail
+// generation), are retried with backoff, and report progress through one
+// shared model.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"photog/internal/background"
+	"photog/internal/config"
+	"photog/internal/database"
+	"photog/internal/models"
+)
+
+// Job states.
+const (
+	StateQueued   = "queued"
+	StateRunning  = "running"
+	StateDone     = "done"
+	StateFailed   = "failed"
+	StateCanceled = "canceled"
+)
+
+// pollInterval is how often the queue checks for jobs whose retry delay has
+// passed. New jobs are started immediately.
+const pollInterval = 5 * time.Second
+
+// ErrFinished is returned when canceling a job that has already finished.
+var ErrFinished = errors.New("job already finished")
+
+// retention is how long finished jobs are kept for inspection.
+const retention = 7 * 24 * time.Hour
+
+// Handler runs a job. payload is the JSON the job was enqueued with. It
+// should report progress through p and return promptly once ctx is done.
+type Handler func(ctx context.Context, payload string, p *Progress) error
+
+// Spec describes a job type.
+type Spec struct {
+	Class       string // concurrency class, limited by jobs.concurrency in config
+	MaxAttempts int    // tries before the job fails; 0 means 1
+	Unique      bool   // while one is queued or running, Enqueue returns it instead of adding another
+	Run         Handler
+}
+
+// Progress is a running job's progress, in whatever unit suits the job
+// (files, thumbnails, ...).
+type Progress struct {
+	Total atomic.Int64
+	Done  atomic.Int64
+}
+
+// running is a job currently executing.
+type running struct {
+	job      *models.Job
+	progress *Progress
+	cancel   context.CancelFunc
+	canceled bool // set by Cancel, as opposed to shutdown
+	paused   bool // stopped because its class may not run right now (see blocked)
+}
+
+// Queue dispatches persisted jobs to registered handlers.
+type Queue struct {
+	db     *database.DB
+	limits map[string]int
+
+	mu       sync.Mutex
+	specs    map[string]Spec
+	active   map[string]int // running jobs per class
+	running  map[int64]*running
+	stopping bool
+
+	// quiet-hours schedule (see SetSchedule)
+	windows   []window
+	scheduled map[string]bool
+
+	// low disk space guard (see SetDiskGuard)
+	diskDir     string
+	diskMin     uint64
+	diskClasses map[string]bool
+	lowDisk     bool
+
+	// OnLowDisk, if set, is called when cache free space drops below the
+	// guard's threshold (low=true) and again once it recovers.
+	OnLowDisk func(free uint64, low bool)
+
+	// parent of job contexts; canceling it interrupts running jobs
+	root context.Context
+
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New creates a job queue. Register handlers, then call Start.
+func New(db *database.DB, cfg config.JobsConfig) *Queue {
+	return &Queue{
+		db:      db,
+		limits:  cfg.Concurrency,
+		specs:   make(map[string]Spec),
+		active:  make(map[string]int),
+		running: make(map[int64]*running),
+		root:    context.Background(),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Register adds a job type.
+func (q *Queue) Register(jobType string, spec Spec) {
+	if spec.MaxAttempts <= 0 {
+		spec.MaxAttempts = 1
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.specs[jobType] = spec
+}
+
+// Enqueue adds a job of a registered type. payload is encoded as JSON and
+// may be nil.
+func (q *Queue) Enqueue(jobType string, payload interface{}) (*models.Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	spec, ok := q.specs[jobType]
+	if !ok {
+		return nil, fmt.Errorf("unknown job type %q", jobType)
+	}
+	if spec.Unique {
+		existing, err := q.db.GetActiveJob(jobType)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return q.withProgress(existing), nil
+		}
+	}
+
+	var data []byte
+	if payload != nil {
+		var err error
+		if data, err = json.Marshal(payload); err != nil {
+			return nil, fmt.Errorf("encode payload: %w", err)
+		}
+	}
+
+	now := time.Now()
+	j := &models.Job{
+		Type:        jobType,
+		Class:       spec.Class,
+		State:       StateQueued,
+		Payload:     string(data),
+		MaxAttempts: spec.MaxAttempts,
+		CreatedAt:   now,
+		RunAfter:    now,
+	}
+	if err := q.db.InsertJob(j); err != nil {
+		return nil, err
+	}
+	q.poke()
+	return j, nil
+}
+
+// Start requeues jobs interrupted by a previous shutdown and begins
+// dispatching. Running jobs are interrupted when ctx is canceled and stay
+// queued, as with Stop.
+func (q *Queue) Start(ctx context.Context) {
+	q.root = ctx
+	if n, err := q.db.RequeueInterruptedJobs(); err != nil {
+		log.Printf("Jobs: failed to requeue interrupted jobs: %v", err)
+	} else if n > 0 {
+		log.Printf("Jobs: resuming %d interrupted jobs", n)
+	}
+	if _, err := q.db.PruneJobs(time.Now().Add(-retention)); err != nil {
+		log.Printf("Jobs: failed to prune old jobs: %v", err)
+	}
+	go q.loop()
+}
+
+// Stop cancels running jobs and waits for them to record their progress
+// until ctx is done. Jobs stopped this way stay queued and resume on the
+// next Start.
+func (q *Queue) Stop(ctx context.Context) {
+	q.mu.Lock()
+	q.stopping = true
+	for _, r := range q.running {
+		r.cancel()
+	}
+	q.mu.Unlock()
+	close(q.stop)
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("Jobs: timed out waiting for running jobs")
+	}
+}
+
+// Jobs returns the most recent jobs, newest first, with live progress for
+// running ones.
+func (q *Queue) Jobs(limit int) ([]*models.Job, error) {
+	jobs, err := q.db.GetJobs(limit)
+	if err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, j := range jobs {
+		jobs[i] = q.withProgress(j)
+	}
+	return jobs, nil
+}
+
+// Job returns a single job with live progress if it is running.
+func (q *Queue) Job(id int64) (*models.Job, error) {
+	j, err := q.db.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.withProgress(j), nil
+}
+
+// Cancel stops a job. A queued job is canceled immediately; a running job
+// is signalled and marked canceled once its handler returns. It returns
+// ErrFinished for jobs that have already finished and sql.ErrNoRows for
+// unknown IDs.
+func (q *Queue) Cancel(id int64) (*models.Job, error) {
+	q.mu.Lock()
+	if r, ok := q.running[id]; ok {
+		r.canceled = true
+		r.cancel()
+		q.mu.Unlock()
+		log.Printf("Jobs: canceling %s job %d", r.job.Type, id)
+		return q.Job(id)
+	}
+	canceled, err := q.db.CancelQueuedJob(id, time.Now())
+	q.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := q.Job(id)
+	if err != nil {
+		return nil, err
+	}
+	if !canceled {
+		return j, ErrFinished
+	}
+	log.Printf("Jobs: canceled queued %s job %d", j.Type, id)
+	return j, nil
+}
+
+// withProgress fills in live progress for a running job. Callers hold q.mu.
+func (q *Queue) withProgress(j *models.Job) *models.Job {
+	if r, ok := q.running[j.ID]; ok {
+		j.Total = r.progress.Total.Load()
+		j.Done = r.progress.Done.Load()
+	}
+	return j
+}
+
+// poke wakes the dispatcher without blocking.
+func (q *Queue) poke() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) loop() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		q.dispatch()
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch starts every runnable job whose class has a free slot.
+func (q *Queue) dispatch() {
+	now := time.Now()
+	q.checkDisk()
+	q.pauseBlocked(now)
+
+	jobs, err := q.db.GetRunnableJobs(now)
+	if err != nil {
+		log.Printf("Jobs: failed to load queue: %v", err)
+		return
+	}
+
+	for _, j := range jobs {
+		q.mu.Lock()
+		if q.stopping || q.root.Err() != nil {
+			q.mu.Unlock()
+			return
+		}
+		spec, ok := q.specs[j.Type]
+		if !ok {
+			q.mu.Unlock()
+			q.finish(j, StateFailed, fmt.Errorf("unknown job type %q", j.Type))
+			continue
+		}
+		if q.active[j.Class] >= q.limit(j.Class) || q.blocked(j.Class, now) != "" {
+			q.mu.Unlock()
+			continue
+		}
+
+		// Claim the job, unless it was canceled since the queue was loaded
+		claimed, err := q.db.ClaimJob(j.ID, now)
+		if err != nil || !claimed {
+			q.mu.Unlock()
+			if err != nil {
+				log.Printf("Jobs: failed to claim job %d: %v", j.ID, err)
+			}
+			continue
+		}
+		j.State = StateRunning
+		j.Attempts++
+		j.Error = ""
+		j.StartedAt = &now
+		j.FinishedAt = nil
+
+		ctx, cancel := context.WithCancel(q.root)
+		r := &running{job: j, progress: &Progress{}, cancel: cancel}
+		q.active[j.Class]++
+		q.running[j.ID] = r
+		q.mu.Unlock()
+
+		q.wg.Add(1)
+		go q.run(ctx, r, spec)
+	}
+}
+
+// blocked returns why jobs of a class may not run right now, or "" if they
+// may. Callers hold q.mu.
+func (q *Queue) blocked(class string, now time.Time) string {
+	if !q.inWindow(class, now) {
+		return "outside its scheduled window"
+	}
+	if q.lowDisk && q.diskClasses[class] {
+		return "cache disk is low on space"
+	}
+	return ""
+}
+
+// pauseBlocked signals running jobs that may no longer run to stop; run
+// requeues them and dispatch restarts them once they are allowed again.
+func (q *Queue) pauseBlocked(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, r := range q.running {
+		if r.paused {
+			continue
+		}
+		if reason := q.blocked(r.job.Class, now); reason != "" {
+			r.paused = true
+			r.cancel()
+			log.Printf("Jobs: pausing %s job %d: %s", r.job.Type, id, reason)
+		}
+	}
+}
+
+// limit returns the concurrency limit for a class, defaulting to 1.
+func (q *Queue) limit(class string) int {
+	if n := q.limits[class]; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// run executes a job and records its outcome.
+func (q *Queue) run(ctx context.Context, r *running, spec Spec) {
+	defer q.wg.Done()
+	background.Enter()
+
+	j := r.job
+	log.Printf("Jobs: started %s job %d (attempt %d/%d)", j.Type, j.ID, j.Attempts, j.MaxAttempts)
+	err := runHandler(ctx, spec.Run, j.Payload, r.progress)
+	interrupted := ctx.Err() != nil
+	r.cancel()
+
+	q.mu.Lock()
+	delete(q.running, j.ID)
+	q.active[j.Class]--
+	stopping := q.stopping || q.root.Err() != nil
+	canceled := r.canceled
+	paused := r.paused
+	q.mu.Unlock()
+
+	j.Total = r.progress.Total.Load()
+	j.Done = r.progress.Done.Load()
+
+	switch {
+	case canceled && interrupted:
+		q.finish(j, StateCanceled, nil)
+	case (stopping || paused) && interrupted && err != nil:
+		// Interrupted by shutdown or paused: leave it queued to resume
+		j.State = StateQueued
+		j.Attempts--
+		j.StartedAt = nil
+		if err := q.db.UpdateJob(j); err != nil {
+			log.Printf("Jobs: failed to requeue job %d: %v", j.ID, err)
+		}
+	case err == nil:
+		q.finish(j, StateDone, nil)
+	case j.Attempts < j.MaxAttempts:
+		delay := time.Duration(j.Attempts*j.Attempts) * 30 * time.Second
+		log.Printf("Jobs: %s job %d failed, retrying in %s: %v", j.Type, j.ID, delay, err)
+		j.State = StateQueued
+		j.Error = err.Error()
+		j.RunAfter = time.Now().Add(delay)
+		if err := q.db.UpdateJob(j); err != nil {
+			log.Printf("Jobs: failed to requeue job %d: %v", j.ID, err)
+		}
+	default:
+		q.finish(j, StateFailed, err)
+	}
+	q.poke()
+}
+
+// runHandler calls h, turning a panic into an error so one bad job can't
+// take down the server.
+func runHandler(ctx context.Context, h Handler, payload string, p *Progress) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return h(ctx, payload, p)
+}
+
+// finish records a job's final state.
+func (q *Queue) finish(j *models.Job, state string, err error) {
+	now := time.Now()
+	j.State = state
+	j.FinishedAt = &now
+	if err != nil {
+		j.Error = err.Error()
+		log.Printf("Jobs: %s job %d %s: %v", j.Type, j.ID, state, err)
+	} else {
+		log.Printf("Jobs: %s job %d %s", j.Type, j.ID, state)
+	}
+	if err := q.db.UpdateJob(j); err != nil {
+		log.Printf("Jobs: failed to record result of job %d: %v", j.ID, err)
+	}
+}
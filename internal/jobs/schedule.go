@@ -0,0 +1,83 @@
+package jobs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"photog/internal/config"
+)
+
+// window is a daily time range in minutes since local midnight. End may be
+// before start for ranges that cross midnight.
+type window struct {
+	start, end int
+}
+
+// contains reports whether the minute of day m falls inside the window.
+func (w window) contains(m int) bool {
+	if w.start <= w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// parseWindow parses "HH:MM-HH:MM".
+func parseWindow(s string) (window, error) {
+	from, to, ok := strings.Cut(strings.TrimSpace(s), "-")
+	if !ok {
+		return window{}, fmt.Errorf("window %q: want HH:MM-HH:MM", s)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return window{}, fmt.Errorf("window %q: bad start time", s)
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return window{}, fmt.Errorf("window %q: bad end time", s)
+	}
+	return window{
+		start: start.Hour()*60 + start.Minute(),
+		end:   end.Hour()*60 + end.Minute(),
+	}, nil
+}
+
+// SetSchedule restricts the given job classes to run only inside the
+// configured daily windows. Jobs of those classes still running when a
+// window closes are paused (requeued) and resume when the next one opens.
+// With no windows, every class may run at any time.
+func (q *Queue) SetSchedule(cfg config.ScheduleConfig) error {
+	windows := make([]window, 0, len(cfg.Windows))
+	for _, s := range cfg.Windows {
+		w, err := parseWindow(s)
+		if err != nil {
+			return err
+		}
+		windows = append(windows, w)
+	}
+	classes := make(map[string]bool, len(cfg.Classes))
+	for _, c := range cfg.Classes {
+		classes[c] = true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.windows = windows
+	q.scheduled = classes
+	return nil
+}
+
+// inWindow reports whether jobs of a class may run at t under the quiet-hours
+// schedule. Callers hold q.mu.
+func (q *Queue) inWindow(class string, t time.Time) bool {
+	if len(q.windows) == 0 || !q.scheduled[class] {
+		return true
+	}
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range q.windows {
+		if w.contains(m) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"photog/internal/trash"
+)
+
+// TypeTrashPurge deletes files that have been in the trash past the
+// retention period.
+const TypeTrashPurge = "trash_purge"
+
+// RegisterTrash registers the trash purge job and, until ctx is done, queues
+// it every interval when there is something to purge.
+func RegisterTrash(ctx context.Context, q *Queue, bin *trash.Trash, interval time.Duration) {
+	q.Register(TypeTrashPurge, Spec{
+		Class:  "maintenance",
+		Unique: true,
+		Run: func(ctx context.Context, payload string, p *Progress) error {
+			items, err := bin.Expired()
+			if err != nil {
+				return fmt.Errorf("get expired: %w", err)
+			}
+			p.Total.Store(int64(len(items)))
+			for _, item := range items {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := bin.Purge(item); err != nil {
+					log.Printf("Trash: purging %s: %v", item.Path, err)
+				}
+				p.Done.Add(1)
+			}
+			return nil
+		},
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if items, err := bin.Expired(); err != nil {
+				log.Printf("Trash: checking for expired items: %v", err)
+			} else if len(items) > 0 {
+				if _, err := q.Enqueue(TypeTrashPurge, nil); err != nil {
+					log.Printf("Jobs: failed to queue trash purge: %v", err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,77 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"photog/internal/database"
+	"photog/internal/weather"
+)
+
+// TypeWeather looks up the weather of photos with a GPS position.
+const TypeWeather = "weather"
+
+// RegisterWeather registers the weather job and, until ctx is done, queues
+// it every interval when photos are waiting for their weather.
+func RegisterWeather(ctx context.Context, q *Queue, db *database.DB, svc *weather.Service, interval time.Duration) {
+	q.Register(TypeWeather, Spec{
+		Class:  "maintenance",
+		Unique: true,
+		Run: func(ctx context.Context, payload string, p *Progress) error {
+			return runWeather(ctx, db, svc, p)
+		},
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if n, err := db.CountWeatherPending(time.Now().Add(-weather.Delay)); err != nil {
+				log.Printf("Weather: checking for photos to look up: %v", err)
+			} else if n > 0 {
+				if _, err := q.Enqueue(TypeWeather, nil); err != nil {
+					log.Printf("Jobs: failed to queue weather: %v", err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// runWeather looks up the weather of the photos waiting for it. A failed
+// request ends the run; the rest are tried again the next time.
+func runWeather(ctx context.Context, db *database.DB, svc *weather.Service, p *Progress) error {
+	items, err := db.GetWeatherPending(time.Now().Add(-weather.Delay))
+	if err != nil {
+		return fmt.Errorf("get photos: %w", err)
+	}
+	p.Total.Store(int64(len(items)))
+
+	var found int
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		w, err := svc.Lookup(ctx, item.Latitude, item.Longitude, item.TakenAt)
+		if err != nil {
+			return fmt.Errorf("look up weather: %w", err)
+		}
+		if err := db.SetWeather(item.ID, w); err != nil {
+			return fmt.Errorf("store weather: %w", err)
+		}
+		if w != nil {
+			found++
+		}
+		p.Done.Add(1)
+	}
+	if len(items) > 0 {
+		log.Printf("Weather: recorded the weather of %d among %d photos", found, len(items))
+	}
+	return nil
+}
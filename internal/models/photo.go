@@ -16,6 +16,80 @@ type Photo struct {
 	Duration    float64   `json:"duration,omitempty"` // video duration in seconds
 	ThumbPath   string    `json:"thumb_path,omitempty"`
 	IndexedAt   time.Time `json:"indexed_at"`
+	Place       string    `json:"place,omitempty"` // "City, Country" from the GPS position
+	HDR         string    `json:"hdr,omitempty"`   // "gain_map", "pq" or "hlg" for HDR photos
+	// Set at index time and used by the metadata audit; not loaded by
+	// the regular queries.
+	DateSource string `json:"date_source,omitempty"` // "exif", "sidecar" or "mtime"
+	HasGPS     bool   `json:"-"`
+	Latitude   float64 `json:"-"` // decimal degrees, valid when HasGPS
+	Longitude  float64 `json:"-"`
+	// Altitude, direction and speed from the EXIF GPS data, nil when it
+	// has none of them. Loaded by GetPhoto only.
+	GPS *GPSDetails `json:"gps,omitempty"`
+	// Historical weather where and when the photo was taken, nil until
+	// looked up. Loaded by GetPhoto only.
+	Weather *Weather `json:"weather,omitempty"`
+	Container  string `json:"-"` // ffprobe format_name, videos only
+	VideoCodec string `json:"-"`
+	AudioCodec string `json:"-"`
+	// Clockwise degrees a video is turned for display (0, 90, 180 or 270);
+	// Width and Height are already swapped for it. Loaded by GetPhoto only.
+	Rotation int `json:"rotation,omitempty"`
+	// Combined mtime of the .xmp/.json sidecars applied, 0 if none
+	SidecarStamp int64 `json:"-"`
+	// File modification time (Unix seconds) when indexed; with FileSize,
+	// scans tell from it that a file was edited
+	FileMtime int64 `json:"-"`
+	// EXIF make and model, e.g. "Canon EOS R5". Loaded by GetPhoto and
+	// Search only.
+	Camera string `json:"camera,omitempty"`
+	// EXIF lens model, e.g. "XF23mmF2 R WR". Loaded by GetPhoto and Search
+	// only.
+	Lens string `json:"lens,omitempty"`
+	// Comma-separated image kinds detected at index time, e.g.
+	// "screenshot" or "raw,panorama" (see database.ImageKinds). Loaded by
+	// GetTimeline, GetPhoto and Search only.
+	Kinds string `json:"kinds,omitempty"`
+	// Configured photo root holding the file, and whether that root's disk
+	// is currently offline
+	Root        string `json:"root,omitempty"`
+	Unavailable bool   `json:"unavailable,omitempty"`
+	// User whose configured paths hold the file, 0 if shared. Loaded by
+	// GetPhoto only.
+	OwnerID int64 `json:"-"`
+	// The JPEG shot together with a RAW file, or the RAW file of a JPEG:
+	// the file with the same name but for the extension. 0 if none. Loaded
+	// by GetPhoto only.
+	CompanionID int64 `json:"companion_id,omitempty"`
+	// Whether the requesting account marked the photo as a favorite or
+	// archived it. Loaded for /api/photo/{id} only.
+	Favorite bool `json:"favorite,omitempty"`
+	Archived bool `json:"archived,omitempty"`
+	// Account that added the photo to the album, empty if unknown. Loaded
+	// by GetAlbum only.
+	AddedBy string `json:"added_by,omitempty"`
+	// Star rating (0-5) and caption. Loaded by GetPhoto only.
+	Rating      int    `json:"rating,omitempty"`
+	Description string `json:"description,omitempty"`
+	// SHA-256 of the file, for /api/c/{hash} URLs; empty until hashed.
+	// Loaded by GetTimeline, GetPhoto and GetPhotoByPath only.
+	ContentHash string `json:"hash,omitempty"`
+}
+
+// GPSDetails is what an image's GPS data records besides the position.
+// Each field is nil when missing.
+type GPSDetails struct {
+	Altitude  *float64 `json:"altitude,omitempty"`  // meters above sea level, negative below
+	Direction *float64 `json:"direction,omitempty"` // degrees clockwise from north the camera faced
+	Speed     *float64 `json:"speed,omitempty"`     // km/h
+}
+
+// Weather is the weather at a photo's place and time, from the configured
+// weather provider.
+type Weather struct {
+	Conditions  string   `json:"conditions"`            // e.g. "clear", "rain" or "snow"
+	Temperature *float64 `json:"temperature,omitempty"` // °C
 }
 
 // TimelineGroup represents a group of photos for a date period.
@@ -31,6 +105,8 @@ type TimelineResponse struct {
 	Groups     []*TimelineGroup `json:"groups"`
 	TotalCount int              `json:"total_count"`
 	HasMore    bool             `json:"has_more"`
+	// Format of the cached thumbnails, which content URLs should ask for
+	ThumbFormat string `json:"thumb_format,omitempty"`
 }
 
 // StatsResponse returns library statistics.
@@ -40,6 +116,26 @@ type StatsResponse struct {
 	TotalSize   int64 `json:"total_size"`
 	OldestDate  string `json:"oldest_date"`
 	NewestDate  string `json:"newest_date"`
+	Roots       []*RootStatus `json:"roots"`
+	// Photos of each image kind ("gif", "screenshot", ...); a photo may
+	// count towards several
+	Kinds map[string]int `json:"kinds"`
+}
+
+// RootStatus describes one configured photo root.
+type RootStatus struct {
+	Path      string `json:"path"`
+	Available bool   `json:"available"`
+	Count     int    `json:"count"` // indexed photos and videos
+	Size      int64  `json:"size"`
+}
+
+// MemoryGroup is one past year's photos taken around today's date.
+type MemoryGroup struct {
+	Year     int      `json:"year"`
+	YearsAgo int      `json:"years_ago"`
+	Count    int      `json:"count"` // all photos in the window, not just those returned
+	Photos   []*Photo `json:"photos"`
 }
 
 // MonthBucket represents a single month in the timeline with its count and cumulative offset.
@@ -49,3 +145,348 @@ type MonthBucket struct {
 	Count            int    `json:"count"`             // photos in this month
 	CumulativeOffset int    `json:"cumulative_offset"` // offset of first photo in this month (within full timeline)
 }
+
+// IndexError is a file that failed to index, kept until it succeeds or is dismissed.
+type IndexError struct {
+	ID         int64     `json:"id"`
+	Path       string    `json:"path"`
+	Stage      string    `json:"stage"` // "walk", "stat", "lookup", "upsert"
+	Message    string    `json:"message"`
+	Attempts   int       `json:"attempts"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// LayoutItem is the minimal per-photo data needed for justified-row layout.
+type LayoutItem struct {
+	ID     int64   `json:"id"`
+	Aspect float64 `json:"ar"` // width / height; 0 when dimensions are unknown
+	Video  bool    `json:"video,omitempty"`
+}
+
+// MonthLayout is the API response for the per-month layout endpoint.
+type MonthLayout struct {
+	Month string        `json:"month"` // "2024-01"
+	Count int           `json:"count"`
+	Items []*LayoutItem `json:"items"`
+}
+
+// MonthIDs is the API response for the per-month ID list. Types[i] is the
+// media type of IDs[i].
+type MonthIDs struct {
+	Month string   `json:"month"` // "2024-01"
+	Count int      `json:"count"`
+	IDs   []int64  `json:"ids"`
+	Types []string `json:"types"`
+}
+
+// Folder is a node in the folder tree with aggregate counts for its subtree.
+type Folder struct {
+	Path       string    `json:"path"`
+	Name       string    `json:"name"`
+	PhotoCount int       `json:"photo_count"` // images directly in this folder
+	VideoCount int       `json:"video_count"` // videos directly in this folder
+	TotalCount int       `json:"total_count"` // all media in this folder and below
+	OldestDate time.Time `json:"oldest_date"`
+	NewestDate time.Time `json:"newest_date"`
+	CoverID    int64     `json:"cover_id"` // newest photo in the subtree
+	Children   []*Folder `json:"children"`
+}
+
+// ChangesResponse is the API response for incremental sync.
+type ChangesResponse struct {
+	Cursor  int64    `json:"cursor"` // pass as ?since= on the next call
+	Added   []*Photo `json:"added"`
+	Updated []*Photo `json:"updated"`
+	Removed []int64  `json:"removed"`
+	HasMore bool     `json:"has_more"`
+}
+
+// AuditResponse is the API response for the metadata quality audit.
+type AuditResponse struct {
+	Counts map[string]int `json:"counts"` // issue name -> number of photos
+	Issue  string         `json:"issue,omitempty"`
+	Total  int            `json:"total"`
+	Photos []*Photo       `json:"photos"`
+}
+
+// Comment is a note left on a photo.
+type Comment struct {
+	ID        int64     `json:"id"`
+	PhotoID   int64     `json:"photo_id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PlaceCount is a place name with the number of photos taken there.
+type PlaceCount struct {
+	Place string  `json:"place"`
+	Count int     `json:"count"`
+	Lat   float64 `json:"lat"` // mean position of the photos
+	Lon   float64 `json:"lon"`
+}
+
+// TagCount is a tag with the number of photos carrying it.
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// CameraCount is a camera with the number of photos taken with it, broken
+// down by lens.
+type CameraCount struct {
+	Camera string       `json:"camera"`
+	Count  int          `json:"count"`
+	Lenses []*LensCount `json:"lenses"`
+}
+
+// LensCount is a lens with the number of photos taken with it.
+type LensCount struct {
+	Lens  string `json:"lens"`
+	Count int    `json:"count"`
+}
+
+// Album is a user-curated collection of photos.
+type Album struct {
+	ID          int64     `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	CoverID     int64     `json:"cover_id"` // chosen cover, else the first photo; 0 when empty
+	Sort        string    `json:"sort"`     // photo order: "taken_asc", "taken_desc" or "manual"
+	PhotoCount  int       `json:"photo_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Folder the album is made from and kept in sync with, empty for
+	// albums curated by hand
+	Folder string `json:"folder,omitempty"`
+	// The requesting account's role for albums shared with it: "view" or
+	// "contribute". Empty for admins.
+	Role string `json:"role,omitempty"`
+	// Accounts the album is shared with. Loaded by GetAlbum only.
+	Members []*AlbumMember `json:"members,omitempty"`
+	Photos  []*Photo       `json:"photos,omitempty"`
+}
+
+// AlbumMember is an account an album is shared with.
+type AlbumMember struct {
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username"`
+	Role     string    `json:"role"` // "view" or "contribute"
+	AddedAt  time.Time `json:"added_at"`
+}
+
+// Event is a detected cluster of photos taken close together in time.
+type Event struct {
+	ID         int64     `json:"id"` // ID of the event's first photo, stable across rebuilds
+	Title      string    `json:"title"`
+	StartAt    time.Time `json:"start_at"`
+	EndAt      time.Time `json:"end_at"`
+	PhotoCount int       `json:"photo_count"`
+	CoverID    int64     `json:"cover_id"`
+	Photos     []*Photo  `json:"photos,omitempty"`
+}
+
+// Selection is a set of photos picked in the UI or a script and kept on
+// the server, so bulk actions can name it instead of listing every ID.
+type Selection struct {
+	ID        string    `json:"id"`
+	Count     int       `json:"count"`
+	IDs       []int64   `json:"ids,omitempty"` // in the order added
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Job is a unit of background work tracked by the job queue.
+type Job struct {
+	ID          int64      `json:"id"`
+	Type        string     `json:"type"`
+	Class       string     `json:"class"`
+	State       string     `json:"state"` // queued, running, done, failed or canceled
+	Payload     string     `json:"payload,omitempty"`
+	Attempts    int        `json:"attempts"`
+	MaxAttempts int        `json:"max_attempts"`
+	Total       int64      `json:"total"`
+	Done        int64      `json:"done"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RunAfter    time.Time  `json:"run_after"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// ThumbTiming is how long a thumbnail took to generate, with the source
+// file's details.
+type ThumbTiming struct {
+	PhotoID     int64     `json:"photo_id"`
+	Path        string    `json:"path"`
+	MediaType   string    `json:"media_type"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	FileSize    int64     `json:"file_size"`
+	Size        string    `json:"size"`
+	DurationMS  int64     `json:"duration_ms"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// PhotoViews is a photo with how often it has been viewed.
+type PhotoViews struct {
+	Photo        *Photo    `json:"photo"`
+	Views        int       `json:"views"`
+	LastViewedAt time.Time `json:"last_viewed_at"`
+}
+
+// ThumbLatency summarizes generation times for one thumbnail size.
+type ThumbLatency struct {
+	Count int   `json:"count"`
+	P50MS int64 `json:"p50_ms"`
+	P95MS int64 `json:"p95_ms"`
+	MaxMS int64 `json:"max_ms"`
+}
+
+// VideoCodecGroup counts indexed videos sharing a container and codecs, and
+// how well browsers can play them.
+type VideoCodecGroup struct {
+	Container  string `json:"container"`
+	VideoCodec string `json:"video_codec"`
+	AudioCodec string `json:"audio_codec"`
+	Count      int    `json:"count"`
+	Class      string `json:"class"` // playable, limited, transcode or unknown
+	Reason     string `json:"reason,omitempty"`
+}
+
+// MapCluster is a group of nearby photos on the map.
+type MapCluster struct {
+	Lat     float64 `json:"lat"` // mean position of the photos
+	Lon     float64 `json:"lon"`
+	Count   int     `json:"count"`
+	PhotoID int64   `json:"photo_id"` // most recently taken, for a preview
+	// extent of the photos, so clients can zoom to the cluster
+	North float64 `json:"north"`
+	South float64 `json:"south"`
+	East  float64 `json:"east"`
+	West  float64 `json:"west"`
+}
+
+// User is a login account.
+type User struct {
+	ID        int64     `json:"id"`
+	Username  string    `json:"username"`
+	Admin     bool      `json:"admin"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Settings are an account's frontend preferences, kept on the server so
+// they follow the account across devices.
+type Settings struct {
+	Sort          string           `json:"sort"`  // timeline order: "newest" or "oldest"
+	Theme         string           `json:"theme"` // "system", "light" or "dark"
+	Memories      MemoriesSettings `json:"memories"`
+	HiddenFolders []string         `json:"hidden_folders"` // folders (see /api/folders) left out of the timeline
+	// Where the account last was in the timeline, nil if never saved
+	LastSeen *TimelinePosition `json:"last_seen,omitempty"`
+}
+
+// TimelinePosition is a place in the timeline: a month ("2006-01") and
+// the photo scrolled to in it, 0 for its top.
+type TimelinePosition struct {
+	Month   string    `json:"month"`
+	PhotoID int64     `json:"photo_id,omitempty"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// MemoriesSettings are the preferences for the "on this day" memories.
+type MemoriesSettings struct {
+	Enabled       bool `json:"enabled"`
+	IncludeVideos bool `json:"include_videos"`
+}
+
+// SearchResponse is the API response for search: a page of results and,
+// per facet ("year", "type", "tag", "camera"), how many results each value
+// would leave, for narrowing the search.
+type SearchResponse struct {
+	Total   int                      `json:"total"`
+	Results []*SearchResult          `json:"results"`
+	Facets  map[string][]*FacetCount `json:"facets"`
+	HasMore bool                     `json:"has_more"`
+}
+
+// SearchResult is a photo matching a search, with where the text matched.
+type SearchResult struct {
+	Photo      *Photo       `json:"photo"`
+	Highlights []*Highlight `json:"highlights,omitempty"`
+}
+
+// Highlight is a search text match: Value[Start:End] of the named field
+// ("filename", "place", "camera" or "tag"), in characters.
+type Highlight struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// FacetCount is a facet value with the number of results having it.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// MetadataChange is what a batch metadata edit changes on one photo.
+type MetadataChange struct {
+	PhotoID     int64        `json:"photo_id"`
+	Filename    string       `json:"filename"`
+	AddedTags   []string     `json:"added_tags,omitempty"`
+	RemovedTags []string     `json:"removed_tags,omitempty"`
+	Rating      *ValueChange `json:"rating,omitempty"`
+	Description *ValueChange `json:"description,omitempty"`
+	Location    *ValueChange `json:"location,omitempty"` // [lat, lon], from is null without GPS
+}
+
+// ValueChange is a field's value before and after an edit.
+type ValueChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// DuplicateGroup is a set of files with identical content.
+type DuplicateGroup struct {
+	Hash   string   `json:"hash"` // SHA-256 of the content
+	Size   int64    `json:"size"`
+	Photos []*Photo `json:"photos"`
+}
+
+// SimilarPhoto is a photo that looks like another, with the Hamming
+// distance between their perceptual hashes (0 for the same picture).
+type SimilarPhoto struct {
+	Photo    *Photo `json:"photo"`
+	Distance int    `json:"distance"`
+}
+
+// MissingReport lists the indexed files no longer on disk that a cleanup
+// removed, or would remove in a dry run.
+type MissingReport struct {
+	Count   int64    `json:"count"`
+	Size    int64    `json:"size"`    // bytes the missing files took up
+	Sample  []string `json:"sample"`  // the first few paths, sorted
+	DryRun  bool     `json:"dry_run"` // nothing was removed
+	Removed int64    `json:"removed"`
+}
+
+// TrashItem is a deleted file kept in the trash until it's restored or
+// purged.
+type TrashItem struct {
+	ID        int64     `json:"id"`
+	PhotoID   int64     `json:"photo_id"` // its ID in the library before deletion
+	Path      string    `json:"path"`     // where it's restored to
+	Dir       string    `json:"-"`        // trash folder holding it and its sidecars
+	Filename  string    `json:"filename"`
+	MediaType string    `json:"media_type"`
+	TakenAt   time.Time `json:"taken_at"`
+	FileSize  int64     `json:"file_size"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	OwnerID   int64     `json:"-"`
+	Albums    []int64   `json:"-"` // albums it was in, rejoined on restore
+	DeletedAt time.Time `json:"deleted_at"`
+	PurgeAt   time.Time `json:"purge_at,omitempty"` // zero when kept until removed by hand
+}
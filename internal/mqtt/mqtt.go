@@ -0,0 +1,235 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"photog/internal/config"
+	"photog/internal/database"
+)
+
+// keepAlive is the MQTT keep-alive interval advertised to the broker.
+const keepAlive = 60 * time.Second
+
+// dialTimeout bounds connecting to the broker.
+const dialTimeout = 10 * time.Second
+
+// message is a queued publish.
+type message struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// Publisher publishes photog events to an MQTT broker (MQTT 3.1.1, QoS 0).
+// Publishing never blocks callers: events are queued and dropped if the
+// queue is full or the broker is unreachable.
+type Publisher struct {
+	cfg   config.MQTTConfig
+	db    *database.DB
+	queue chan message
+	stop  chan struct{}
+	conn  net.Conn
+}
+
+// New creates an MQTT publisher. Call Start to connect and begin publishing.
+func New(cfg config.MQTTConfig, db *database.DB) *Publisher {
+	return &Publisher{
+		cfg:   cfg,
+		db:    db,
+		queue: make(chan message, 256),
+		stop:  make(chan struct{}),
+	}
+}
+
+// Start begins the publish loop and periodic storage stats.
+func (p *Publisher) Start() {
+	go p.loop()
+}
+
+// Stop signals the publisher to disconnect and stop.
+func (p *Publisher) Stop() {
+	close(p.stop)
+}
+
+// Publish queues a JSON event under <topic_prefix>/<event>.
+func (p *Publisher) Publish(event string, data interface{}) {
+	p.enqueue(event, data, false)
+}
+
+func (p *Publisher) enqueue(event string, data interface{}, retain bool) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("MQTT: marshal %s: %v", event, err)
+		return
+	}
+	select {
+	case p.queue <- message{topic: p.cfg.TopicPrefix + "/" + event, payload: payload, retain: retain}:
+	default:
+		log.Printf("MQTT: queue full, dropping %s event", event)
+	}
+}
+
+func (p *Publisher) loop() {
+	log.Printf("MQTT: publishing to %s (prefix %q)", p.cfg.Broker, p.cfg.TopicPrefix)
+
+	statsEvery := time.Duration(p.cfg.StatsInterval) * time.Second
+	if statsEvery <= 0 {
+		statsEvery = time.Hour
+	}
+	statsTicker := time.NewTicker(statsEvery)
+	defer statsTicker.Stop()
+
+	pingTicker := time.NewTicker(keepAlive / 2)
+	defer pingTicker.Stop()
+
+	p.publishStats()
+
+	for {
+		select {
+		case <-p.stop:
+			p.disconnect()
+			log.Println("MQTT: stopped")
+			return
+		case m := <-p.queue:
+			if err := p.send(m); err != nil {
+				log.Printf("MQTT: publish %s failed: %v", m.topic, err)
+				p.closeConn()
+			}
+		case <-pingTicker.C:
+			if p.conn != nil {
+				if _, err := p.conn.Write([]byte{0xC0, 0x00}); err != nil {
+					p.closeConn()
+				}
+			}
+		case <-statsTicker.C:
+			p.publishStats()
+		}
+	}
+}
+
+// publishStats queues a retained storage stats message.
+func (p *Publisher) publishStats() {
+	stats, err := p.db.GetStats()
+	if err != nil {
+		log.Printf("MQTT: stats error: %v", err)
+		return
+	}
+	p.enqueue("stats", stats, true)
+}
+
+// send publishes one message, connecting first if needed.
+func (p *Publisher) send(m message) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	flags := byte(0x30) // PUBLISH, QoS 0
+	if m.retain {
+		flags |= 0x01
+	}
+	var body []byte
+	body = appendString(body, m.topic)
+	body = append(body, m.payload...)
+
+	p.conn.SetWriteDeadline(time.Now().Add(dialTimeout))
+	_, err := p.conn.Write(packet(flags, body))
+	return err
+}
+
+func (p *Publisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.cfg.Broker, dialTimeout)
+	if err != nil {
+		return err
+	}
+
+	var flags byte = 0x02 // clean session
+	if p.cfg.Username != "" {
+		flags |= 0x80
+	}
+	if p.cfg.Password != "" {
+		flags |= 0x40
+	}
+
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 0x04, flags, byte(keepAlive/time.Second>>8), byte(keepAlive/time.Second))
+	body = appendString(body, p.cfg.ClientID)
+	if p.cfg.Username != "" {
+		body = appendString(body, p.cfg.Username)
+	}
+	if p.cfg.Password != "" {
+		body = appendString(body, p.cfg.Password)
+	}
+
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	if _, err := conn.Write(packet(0x10, body)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return fmt.Errorf("read connack: %w", err)
+	}
+	if ack[0] != 0x20 || ack[3] != 0x00 {
+		conn.Close()
+		return fmt.Errorf("broker refused connection (code %d)", ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Drain PINGRESPs and anything else the broker sends; a read error
+	// means the connection is gone and the next publish will reconnect.
+	go io.Copy(io.Discard, bufio.NewReader(conn))
+
+	p.conn = conn
+	log.Printf("MQTT: connected to %s", p.cfg.Broker)
+	return nil
+}
+
+func (p *Publisher) disconnect() {
+	if p.conn != nil {
+		p.conn.Write([]byte{0xE0, 0x00}) // DISCONNECT
+		p.closeConn()
+	}
+}
+
+func (p *Publisher) closeConn() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// packet builds an MQTT control packet with the variable-length
+// remaining-length header.
+func packet(header byte, body []byte) []byte {
+	out := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(out, body...)
+}
+
+// appendString appends a length-prefixed UTF-8 string.
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,216 @@
+// Package rawpreview extracts the JPEG previews camera makers embed in
+// TIFF-based RAW files (CR2, NEF, ARW, DNG), so RAW files can be shown
+// without a RAW developer.
+package rawpreview
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"sort"
+)
+
+// TIFF tags that locate embedded previews.
+const (
+	tagCompression     = 0x103
+	tagStripOffsets    = 0x111
+	tagStripByteCounts = 0x117
+	tagSubIFDs         = 0x14a
+	tagJPEGOffset      = 0x201
+	tagJPEGLength      = 0x202
+)
+
+// Exts are the RAW formats handled, all TIFF-based.
+var Exts = map[string]bool{".cr2": true, ".nef": true, ".arw": true, ".dng": true}
+
+// maxIFDs bounds the IFD walk so a corrupt file can't loop forever.
+const maxIFDs = 64
+
+// ErrNoPreview is returned when a file has no decodable JPEG preview.
+var ErrNoPreview = errors.New("no embedded JPEG preview")
+
+// segment is a byte range of the file that may hold a JPEG.
+type segment struct {
+	off, n int64
+}
+
+// Decode returns the largest decodable embedded preview of a RAW file. The
+// preview is not rotated; the file's EXIF orientation still applies.
+func Decode(path string) (image.Image, error) {
+	f, segs, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	for _, s := range segs {
+		img, err := jpeg.Decode(io.NewSectionReader(f, s.off, s.n))
+		if err == nil {
+			return img, nil
+		}
+	}
+	return nil, ErrNoPreview
+}
+
+// Size returns the pixel dimensions of the preview Decode would return.
+func Size(path string) (width, height int, err error) {
+	f, segs, err := open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	for _, s := range segs {
+		cfg, err := jpeg.DecodeConfig(io.NewSectionReader(f, s.off, s.n))
+		if err == nil {
+			return cfg.Width, cfg.Height, nil
+		}
+	}
+	return 0, 0, ErrNoPreview
+}
+
+// open opens a RAW file and lists its JPEG candidates, largest first.
+func open(path string) (*os.File, []segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	segs, err := candidates(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("rawpreview: %w", err)
+	}
+	if len(segs) == 0 {
+		f.Close()
+		return nil, nil, ErrNoPreview
+	}
+	return f, segs, nil
+}
+
+// candidates walks every IFD of a TIFF file, including SubIFDs, and
+// collects byte ranges holding JPEG data: JPEGInterchangeFormat pointers
+// and single-strip images with JPEG compression. Ranges that don't start
+// with a JPEG marker are dropped.
+func candidates(r io.ReaderAt, size int64) ([]segment, error) {
+	var hdr [8]byte
+	if _, err := r.ReadAt(hdr[:], 0); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch {
+	case bytes.Equal(hdr[:4], []byte("II*\x00")):
+		order = binary.LittleEndian
+	case bytes.Equal(hdr[:4], []byte("MM\x00*")):
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("not a TIFF-based RAW file")
+	}
+
+	var segs []segment
+	queue := []int64{int64(order.Uint32(hdr[4:]))}
+	seen := map[int64]bool{}
+	for len(queue) > 0 && len(seen) < maxIFDs {
+		off := queue[0]
+		queue = queue[1:]
+		if off <= 0 || off >= size || seen[off] {
+			continue
+		}
+		seen[off] = true
+
+		ifd, next, subs, err := readIFD(r, order, off)
+		if err != nil {
+			continue
+		}
+		queue = append(queue, subs...)
+		if next != 0 {
+			queue = append(queue, next)
+		}
+
+		if o, n := ifd[tagJPEGOffset], ifd[tagJPEGLength]; o != 0 && n != 0 {
+			segs = append(segs, segment{int64(o), int64(n)})
+		}
+		if c := ifd[tagCompression]; c == 6 || c == 7 {
+			if o, n := ifd[tagStripOffsets], ifd[tagStripByteCounts]; o != 0 && n != 0 {
+				segs = append(segs, segment{int64(o), int64(n)})
+			}
+		}
+	}
+
+	valid := segs[:0]
+	for _, s := range segs {
+		if s.off+s.n > size {
+			continue
+		}
+		var soi [2]byte
+		if _, err := r.ReadAt(soi[:], s.off); err != nil || soi != [2]byte{0xff, 0xd8} {
+			continue
+		}
+		valid = append(valid, s)
+	}
+	sort.Slice(valid, func(i, j int) bool { return valid[i].n > valid[j].n })
+	return valid, nil
+}
+
+// readIFD reads the single-valued integer tags of the IFD at off, plus the
+// offset of the next IFD and any SubIFD offsets. Multi-valued strip tags
+// are left out: only single-strip images can be a self-contained JPEG.
+func readIFD(r io.ReaderAt, order binary.ByteOrder, off int64) (map[uint16]uint32, int64, []int64, error) {
+	var cnt [2]byte
+	if _, err := r.ReadAt(cnt[:], off); err != nil {
+		return nil, 0, nil, err
+	}
+	n := int(order.Uint16(cnt[:]))
+	buf := make([]byte, n*12+4)
+	if _, err := r.ReadAt(buf, off+2); err != nil {
+		return nil, 0, nil, err
+	}
+
+	tags := make(map[uint16]uint32)
+	var subs []int64
+	for i := 0; i < n; i++ {
+		e := buf[i*12 : i*12+12]
+		tag := order.Uint16(e[0:])
+		typ := order.Uint16(e[2:])
+		count := order.Uint32(e[4:])
+
+		if tag == tagSubIFDs {
+			if count == 1 {
+				subs = append(subs, int64(order.Uint32(e[8:])))
+				continue
+			}
+			if count > maxIFDs {
+				continue
+			}
+			arr := make([]byte, 4*count)
+			if _, err := r.ReadAt(arr, int64(order.Uint32(e[8:]))); err != nil {
+				continue
+			}
+			for j := uint32(0); j < count; j++ {
+				subs = append(subs, int64(order.Uint32(arr[j*4:])))
+			}
+			continue
+		}
+
+		if count != 1 {
+			continue
+		}
+		switch typ {
+		case 3: // SHORT
+			tags[tag] = uint32(order.Uint16(e[8:]))
+		case 4, 13: // LONG, IFD
+			tags[tag] = order.Uint32(e[8:])
+		}
+	}
+	next := int64(order.Uint32(buf[n*12:]))
+	return tags, next, subs, nil
+}
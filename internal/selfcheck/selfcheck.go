@@ -0,0 +1,215 @@
+// Package selfcheck verifies that the environment photog runs in is usable:
+// photo roots readable, cache writable with free space, external tools
+// present and the database intact.
+package selfcheck
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"photog/internal/config"
+	"photog/internal/database"
+	"photog/internal/diskspace"
+	"photog/internal/thumbnail"
+)
+
+// Check statuses.
+const (
+	OK   = "ok"
+	Warn = "warn"
+	Fail = "fail"
+)
+
+// minFreeBytes is the cache free space below which a warning is raised.
+const minFreeBytes = 1 << 30
+
+// toolTimeout bounds each external tool version probe.
+const toolTimeout = 10 * time.Second
+
+// Check is the outcome of one verification.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// Report is the result of a self-check run.
+type Report struct {
+	Checks       []Check         `json:"checks"`
+	Capabilities map[string]bool `json:"capabilities"`
+	Failed       bool            `json:"failed"`
+}
+
+func (r *Report) add(name, status, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, Check{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+	if status == Fail {
+		r.Failed = true
+	}
+}
+
+// Run checks the setup described by cfg. db may be nil to skip database
+// checks. The full run also probes tool versions and runs a complete SQLite
+// integrity check; the light run used at startup only looks tools up and
+// skips the integrity check.
+func Run(cfg *config.Config, db *database.DB, full bool) *Report {
+	r := &Report{Capabilities: make(map[string]bool)}
+
+	for _, root := range cfg.Photos.Paths {
+		checkRoot(r, root)
+	}
+	if len(cfg.Photos.Paths) == 0 {
+		r.add("photo roots", Fail, "no photo paths configured")
+	}
+
+	if cfg.Auth.Enabled {
+		checkUserPaths(r, cfg)
+	}
+
+	checkCache(r, cfg.Cache.Dir)
+
+	r.Capabilities["video_thumbnails"] = checkTool(r, "ffmpeg", full, "video thumbnails")
+	r.Capabilities["video_metadata"] = checkTool(r, "ffprobe", full, "video dimensions and metadata")
+	r.Capabilities["remote_backup"] = checkTool(r, "rclone", full, "remote backups and exports")
+
+	r.Capabilities["heif_thumbnails"] = thumbnail.HEIFSupported
+	if thumbnail.HEIFSupported {
+		r.add("libheif", OK, "HEIC/HEIF/AVIF decoding built in")
+	} else {
+		r.add("libheif", Warn, "not built in (HEIC/HEIF/AVIF thumbnails disabled, rebuild with -tags heif)")
+	}
+
+	if db != nil && full {
+		problems, err := db.IntegrityCheck(false)
+		switch {
+		case err != nil:
+			r.add("database", Fail, "integrity check failed to run: %v", err)
+		case len(problems) > 0:
+			r.add("database", Fail, "%d integrity problems, first: %s", len(problems), problems[0])
+		default:
+			r.add("database", OK, "integrity check passed")
+		}
+	}
+	return r
+}
+
+// checkRoot verifies a photo root exists, is a directory and can be listed.
+func checkRoot(r *Report, root string) {
+	name := "photo root " + root
+	info, err := os.Stat(root)
+	if err != nil {
+		r.add(name, Fail, "%v", err)
+		return
+	}
+	if !info.IsDir() {
+		r.add(name, Fail, "not a directory")
+		return
+	}
+	f, err := os.Open(root)
+	if err != nil {
+		r.add(name, Fail, "not readable: %v", err)
+		return
+	}
+	defer f.Close()
+	entries, err := f.ReadDir(1)
+	if err != nil && err != io.EOF {
+		r.add(name, Fail, "cannot list: %v", err)
+		return
+	}
+	if len(entries) == 0 {
+		r.add(name, Warn, "readable but empty (is the volume mounted?)")
+		return
+	}
+	r.add(name, OK, "readable")
+}
+
+// checkUserPaths warns about user paths outside every photo root, which
+// are never indexed, so the user would see no photos of their own.
+func checkUserPaths(r *Report, cfg *config.Config) {
+	for _, u := range cfg.Auth.Users {
+		for _, p := range u.Paths {
+			p = filepath.Clean(p)
+			inside := false
+			for _, root := range cfg.Photos.Paths {
+				root = filepath.Clean(root)
+				if p == root || strings.HasPrefix(p, root+string(filepath.Separator)) {
+					inside = true
+					break
+				}
+			}
+			if !inside {
+				r.add("user "+u.Username, Warn, "path %s is outside every photo root and won't be indexed", p)
+			}
+		}
+	}
+}
+
+// checkCache verifies the cache dir is writable and has free space.
+func checkCache(r *Report, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		r.add("cache dir", Fail, "cannot create %s: %v", dir, err)
+		return
+	}
+	f, err := os.CreateTemp(dir, ".photog-selfcheck-*")
+	if err != nil {
+		r.add("cache dir", Fail, "%s not writable: %v", dir, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+	r.add("cache dir", OK, "%s writable", filepath.Clean(dir))
+
+	free, err := diskspace.Free(dir)
+	switch {
+	case err != nil:
+		r.add("cache free space", Warn, "unknown: %v", err)
+	case free < minFreeBytes:
+		r.add("cache free space", Warn, "only %s free", formatBytes(free))
+	default:
+		r.add("cache free space", OK, "%s free", formatBytes(free))
+	}
+}
+
+// checkTool looks up an optional external tool and, when full is set, reads
+// its version. Missing tools are warnings: photog runs without them, minus
+// the feature they enable.
+func checkTool(r *Report, tool string, full bool, feature string) bool {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		r.add(tool, Warn, "not found (%s disabled)", feature)
+		return false
+	}
+	if !full {
+		r.add(tool, OK, "%s", path)
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), toolTimeout)
+	defer cancel()
+	flag := "-version"
+	if tool == "rclone" {
+		flag = "version"
+	}
+	out, err := exec.CommandContext(ctx, path, flag).Output()
+	if err != nil {
+		r.add(tool, Fail, "%s does not run: %v", path, err)
+		return false
+	}
+	line, _, _ := bytes.Cut(out, []byte("\n"))
+	r.add(tool, OK, "%s", strings.TrimSpace(string(line)))
+	return true
+}
+
+func formatBytes(n uint64) string {
+	const gb = 1 << 30
+	if n >= gb {
+		return fmt.Sprintf("%.1f GB", float64(n)/gb)
+	}
+	return fmt.Sprintf("%d MB", n>>20)
+}
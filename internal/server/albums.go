@@ -0,0 +1,435 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"photog/internal/database"
+	"photog/internal/models"
+)
+
+const (
+	maxAlbumTitle       = 200
+	maxAlbumDescription = 2000
+	maxAlbumBatch       = 10000 // photo IDs per add/remove request
+)
+
+// folderAlbumMessage is the client error for changing the photos of an
+// album made from a folder.
+const folderAlbumMessage = "Album follows a folder; its photos change with the files in it"
+
+// handleAlbums lists albums (GET) or creates one (POST {"title","description"}).
+// Accounts other than admins only see the albums shared with them and
+// can't create albums.
+// /api/albums
+func (s *Server) handleAlbums(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && owner(r) != 0 {
+		jsonError(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var albums []*models.Album
+		var err error
+		if o := owner(r); o != 0 {
+			albums, err = s.db.GetMemberAlbums(o)
+		} else {
+			albums, err = s.db.GetAlbums()
+		}
+		if err != nil {
+			jsonError(w, "Failed to fetch albums", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, albums)
+
+	case http.MethodPost:
+		var req struct {
+			Title       string `json:"title"`
+			Description string `json:"description"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		a := &models.Album{
+			Title:       strings.TrimSpace(req.Title),
+			Description: strings.TrimSpace(req.Description),
+		}
+		if msg := validateAlbum(a.Title, a.Description); msg != "" {
+			jsonError(w, msg, http.StatusBadRequest)
+			return
+		}
+		if err := s.db.CreateAlbum(a); err != nil {
+			jsonError(w, "Failed to create album", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a)
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAlbum shows (GET, with photos), edits (PATCH {"title","description",
+// "cover_id","sort"}) or deletes (DELETE) an album. /api/albums/{id}, plus
+// /api/albums/{id}/photos to add or remove photos, /api/albums/{id}/order
+// to arrange them and /api/albums/{id}/members to share the album. Members
+// can view the album, and contributors add and remove photos; everything
+// else is for admins. Albums made from folders keep the folder's photos and
+// can't be deleted.
+func (s *Server) handleAlbum(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/albums/"), "/", 2)
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		jsonError(w, "Invalid album ID", http.StatusBadRequest)
+		return
+	}
+	role, err := s.albumRole(r, id)
+	if err != nil {
+		jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+		return
+	}
+	if role == "" {
+		jsonError(w, "Album not found", http.StatusNotFound)
+		return
+	}
+	if len(parts) == 2 && parts[1] == "photos" {
+		s.handleAlbumPhotos(w, r, id, role)
+		return
+	}
+	if role != "admin" && (len(parts) == 2 || r.Method != http.MethodGet) {
+		jsonError(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "order":
+			s.handleAlbumOrder(w, r, id)
+		case "members":
+			s.handleAlbumMembers(w, r, id)
+		default:
+			jsonError(w, "Not found", http.StatusNotFound)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		album, err := s.db.GetAlbum(id)
+		if err == sql.ErrNoRows {
+			jsonError(w, "Album not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+			return
+		}
+		if role != "admin" {
+			album.Role = role
+		}
+		jsonResponse(w, album)
+
+	case http.MethodPatch:
+		var req struct {
+			Title       *string `json:"title"`
+			Description *string `json:"description"`
+			CoverID     *int64  `json:"cover_id"`
+			Sort        *string `json:"sort"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		album, err := s.db.GetAlbum(id)
+		if err == sql.ErrNoRows {
+			jsonError(w, "Album not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+			return
+		}
+
+		// Validate the album as it will be after the change
+		u := database.AlbumUpdate{CoverID: req.CoverID, Sort: req.Sort}
+		if req.Title != nil {
+			album.Title = strings.TrimSpace(*req.Title)
+			u.Title = &album.Title
+		}
+		if req.Description != nil {
+			album.Description = strings.TrimSpace(*req.Description)
+			u.Description = &album.Description
+		}
+		if msg := validateAlbum(album.Title, album.Description); msg != "" {
+			jsonError(w, msg, http.StatusBadRequest)
+			return
+		}
+		if req.Sort != nil && !validAlbumSort(*req.Sort) {
+			jsonError(w, "Invalid sort (use taken_asc, taken_desc or manual)", http.StatusBadRequest)
+			return
+		}
+		if req.CoverID != nil && *req.CoverID != 0 {
+			in, err := s.db.AlbumHasPhoto(id, *req.CoverID)
+			if err != nil {
+				jsonError(w, "Failed to update album", http.StatusInternalServerError)
+				return
+			}
+			if !in {
+				jsonError(w, "Cover photo is not in the album", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := s.db.UpdateAlbum(id, u); err == sql.ErrNoRows {
+			jsonError(w, "Album not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			jsonError(w, "Failed to update album", http.StatusInternalServerError)
+			return
+		}
+		s.writeAlbum(w, id)
+
+	case http.MethodDelete:
+		album, err := s.db.GetAlbum(id)
+		if err == sql.ErrNoRows {
+			jsonError(w, "Album not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+			return
+		}
+		if album.Folder != "" {
+			jsonError(w, "Album follows a folder; turn off albums.from_folders to remove it", http.StatusConflict)
+			return
+		}
+		if err := s.db.DeleteAlbum(id); err == sql.ErrNoRows {
+			jsonError(w, "Album not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			jsonError(w, "Failed to delete album", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, map[string]string{"status": "deleted"})
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAlbumPhotos adds (POST) or removes (DELETE) photos given as
+// {"photo_ids": [...]}. IDs already in the album, or not in it when
+// removing, are skipped. Contributors can only add photos they can see and
+// only remove the ones they added. Responds with the counts and the
+// updated album.
+func (s *Server) handleAlbumPhotos(w http.ResponseWriter, r *http.Request, id int64, role string) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if role != "admin" && role != "contribute" {
+		jsonError(w, "Not allowed to change this album", http.StatusForbidden)
+		return
+	}
+	var req struct {
+		PhotoIDs []int64 `json:"photo_ids"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(req.PhotoIDs) == 0 {
+		jsonError(w, "photo_ids is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.PhotoIDs) > maxAlbumBatch {
+		jsonError(w, "Too many photos in one request", http.StatusBadRequest)
+		return
+	}
+
+	if album, err := s.db.GetAlbum(id); err == sql.ErrNoRows {
+		jsonError(w, "Album not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+		return
+	} else if album.Folder != "" {
+		jsonError(w, folderAlbumMessage, http.StatusConflict)
+		return
+	}
+
+	var n int
+	var err error
+	if r.Method == http.MethodPost {
+		var ids []int64
+		if ids, err = s.db.VisiblePhotoIDs(req.PhotoIDs, owner(r)); err != nil {
+			jsonError(w, "Failed to check photos", http.StatusInternalServerError)
+			return
+		}
+		n, err = s.db.AddAlbumPhotos(id, ids, userID(r))
+	} else {
+		n, err = s.db.RemoveAlbumPhotos(id, req.PhotoIDs, owner(r))
+	}
+	if err != nil {
+		jsonError(w, "Failed to update album photos", http.StatusInternalServerError)
+		return
+	}
+
+	album, err := s.db.GetAlbum(id)
+	if err != nil {
+		jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+		return
+	}
+	key := "added"
+	if r.Method == http.MethodDelete {
+		key = "removed"
+	}
+	jsonResponse(w, map[string]interface{}{key: n, "album": album})
+}
+
+// handleAlbumOrder arranges an album's photos by hand: the photos given come
+// first, in that order, and the others follow in the order they were shown
+// in. The album is switched to manual sorting. Responds with the album.
+// PUT /api/albums/{id}/order {"photo_ids": [...]}
+func (s *Server) handleAlbumOrder(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodPut {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		PhotoIDs []int64 `json:"photo_ids"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(req.PhotoIDs) > maxAlbumBatch {
+		jsonError(w, "Too many photos in one request", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.db.ReorderAlbum(id, req.PhotoIDs); err == sql.ErrNoRows {
+		jsonError(w, "Album not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		jsonError(w, "Failed to reorder album", http.StatusInternalServerError)
+		return
+	}
+	s.writeAlbum(w, id)
+}
+
+// handleAlbumMembers shares an album with an account (POST {"username",
+// "role"}, role "view" or "contribute", also to change the role) or stops
+// sharing it (DELETE {"username"}). Responds with the album.
+// /api/albums/{id}/members
+func (s *Server) handleAlbumMembers(w http.ResponseWriter, r *http.Request, id int64) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodPost && !validAlbumRole(req.Role) {
+		jsonError(w, "Invalid role (use view or contribute)", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.db.GetAlbum(id); err == sql.ErrNoRows {
+		jsonError(w, "Album not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+		return
+	}
+	u, _, err := s.db.GetUserByName(strings.TrimSpace(req.Username))
+	if err == sql.ErrNoRows {
+		jsonError(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		jsonError(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+	if u.Admin {
+		jsonError(w, "Admins already have access to every album", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		err = s.db.SetAlbumMember(id, u.ID, req.Role)
+	} else {
+		err = s.db.RemoveAlbumMember(id, u.ID)
+	}
+	if err == sql.ErrNoRows {
+		jsonError(w, "Album is not shared with this user", http.StatusNotFound)
+		return
+	} else if err != nil {
+		jsonError(w, "Failed to update album members", http.StatusInternalServerError)
+		return
+	}
+	s.writeAlbum(w, id)
+}
+
+// albumRole returns what the request's account may do with an album:
+// "admin" for admins, who manage every album, the account's role for
+// albums shared with it, or "" if it has no access, in which case the
+// album should look like it doesn't exist.
+func (s *Server) albumRole(r *http.Request, id int64) (string, error) {
+	o := owner(r)
+	if o == 0 {
+		return "admin", nil
+	}
+	return s.db.AlbumRole(id, o)
+}
+
+// writeAlbum responds with an album and its photos.
+func (s *Server) writeAlbum(w http.ResponseWriter, id int64) {
+	album, err := s.db.GetAlbum(id)
+	if err == sql.ErrNoRows {
+		jsonError(w, "Album not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, album)
+}
+
+// validateAlbum returns a client error message for invalid album fields, or
+// "" if they're fine.
+func validateAlbum(title, description string) string {
+	if title == "" {
+		return "Album title is required"
+	}
+	if utf8.RuneCountInString(title) > maxAlbumTitle || utf8.RuneCountInString(description) > maxAlbumDescription {
+		return "Album title or description too long"
+	}
+	return ""
+}
+
+// validAlbumRole reports whether role is one of database.AlbumRoles.
+func validAlbumRole(role string) bool {
+	for _, r := range database.AlbumRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// validAlbumSort reports whether sort is one of database.AlbumSorts.
+func validAlbumSort(sort string) bool {
+	for _, s := range database.AlbumSorts {
+		if s == sort {
+			return true
+		}
+	}
+	return false
+}
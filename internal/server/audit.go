@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"photog/internal/models"
+)
+
+// handleAudit reports photos with missing or suspicious metadata. Counts for
+// every issue are always returned; ?issue=<name>&offset=&limit= also pages
+// through the photos with that issue.
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	counts, err := s.db.GetAuditCounts(now)
+	if err != nil {
+		jsonError(w, "Failed to run audit", http.StatusInternalServerError)
+		return
+	}
+
+	resp := &models.AuditResponse{Counts: counts, Photos: make([]*models.Photo, 0)}
+
+	issue := r.URL.Query().Get("issue")
+	if issue == "" {
+		jsonResponse(w, resp)
+		return
+	}
+	if _, ok := counts[issue]; !ok {
+		jsonError(w, "Unknown issue", http.StatusBadRequest)
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	photos, err := s.db.GetAuditPhotos(issue, now, offset, limit)
+	if err != nil {
+		jsonError(w, "Failed to fetch photos", http.StatusInternalServerError)
+		return
+	}
+	resp.Issue = issue
+	resp.Total = counts[issue]
+	resp.Photos = photos
+	jsonResponse(w, resp)
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"photog/internal/models"
+)
+
+// sessionCookie is the name of the cookie holding a browser's session token.
+const sessionCookie = "photog_session"
+
+// dummyHash is compared against when a login names an unknown account, so
+// that it takes as long as a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("photog"), bcrypt.DefaultCost)
+
+type userKey struct{}
+
+// userRoutes are the /api routes open to non-admin accounts. They only
+// return photos the account may see; every other route works on the whole
+// library and needs an admin.
+var userRoutes = []string{
+	"/api/auth/",
+	"/api/timeline",
+	"/api/memories",
+	"/api/photo/",
+	"/api/photos/stream",
+	"/api/thumb/",
+	"/api/media/",
+	"/api/c/",
+	"/api/convert/",
+	"/api/tags",
+	"/api/cameras",
+	"/api/places",
+	"/api/search",
+	"/api/settings",
+	"/api/albums",
+	"/api/selections",
+	"/api/download",
+	"/api/upload",
+	"/api/trash",
+	"/api/similar/",
+	"/api/index/progress",
+	"/api/pregen/progress",
+}
+
+// currentUser returns the account a request was authenticated as, or nil
+// when auth is disabled.
+func currentUser(r *http.Request) *models.User {
+	u, _ := r.Context().Value(userKey{}).(*models.User)
+	return u
+}
+
+// owner returns the user whose view of the library a request gets: 0, the
+// whole library, for admins and with auth disabled.
+func owner(r *http.Request) int64 {
+	u := currentUser(r)
+	if u == nil || u.Admin {
+		return 0
+	}
+	return u.ID
+}
+
+// visiblePhoto loads a photo the request's user may see, or returns
+// sql.ErrNoRows, so other users' photos look like they don't exist. Other
+// users' photos in an album shared with the user are visible.
+func (s *Server) visiblePhoto(r *http.Request, id int64) (*models.Photo, error) {
+	photo, err := s.db.GetPhoto(id)
+	if err != nil {
+		return nil, err
+	}
+	if o := owner(r); o != 0 && photo.OwnerID != 0 && photo.OwnerID != o {
+		shared, err := s.db.InMemberAlbum(o, id)
+		if err != nil {
+			return nil, err
+		}
+		if !shared {
+			return nil, sql.ErrNoRows
+		}
+	}
+	return photo, nil
+}
+
+// authMiddleware requires a valid session for /api routes, from the session
+// cookie or an "Authorization: Bearer" header. Non-admin accounts are
+// limited to userRoutes.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/api/auth/login" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := sessionToken(r)
+		if token == "" {
+			jsonError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		u, err := s.db.GetSessionUser(hashToken(token))
+		if errors.Is(err, sql.ErrNoRows) {
+			jsonError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			jsonError(w, "Failed to check session", http.StatusInternalServerError)
+			return
+		}
+		if !u.Admin && !isUserRoute(r.URL.Path) {
+			jsonError(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, u)))
+	})
+}
+
+// handleLogin checks a username and password and starts a session. The
+// token is set as a cookie and also returned, for clients that send it as a
+// bearer token instead.
+// POST /api/auth/login {"username": "...", "password": "..."}
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	u, hash, err := s.db.GetUserByName(req.Username)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		jsonError(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if u == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(req.Password))
+		jsonError(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		log.Printf("Auth: failed login for %q from %s", req.Username, r.RemoteAddr)
+		jsonError(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	if err := s.db.DeleteExpiredSessions(); err != nil {
+		log.Printf("Auth: deleting expired sessions: %v", err)
+	}
+	days := s.cfg.Auth.SessionDays
+	if days <= 0 {
+		days = 30
+	}
+	expires := time.Now().Add(time.Duration(days) * 24 * time.Hour)
+	token := randomToken(32)
+	if err := s.db.CreateSession(hashToken(token), u.ID, expires); err != nil {
+		jsonError(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	jsonResponse(w, map[string]interface{}{
+		"user":       u,
+		"token":      token,
+		"expires_at": expires,
+	})
+}
+
+// handleLogout ends the current session.
+// POST /api/auth/logout
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if token := sessionToken(r); token != "" {
+		if err := s.db.DeleteSession(hashToken(token)); err != nil {
+			jsonError(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMe returns the logged-in account.
+// GET /api/auth/me
+func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
+	u := currentUser(r)
+	if u == nil {
+		jsonError(w, "Auth is disabled", http.StatusNotFound)
+		return
+	}
+	jsonResponse(w, u)
+}
+
+// isUserRoute reports whether path is one of userRoutes.
+func isUserRoute(path string) bool {
+	for _, route := range userRoutes {
+		if path == route || strings.HasPrefix(path, strings.TrimSuffix(route, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionToken returns the session token sent with a request, from the
+// Authorization header or the session cookie.
+func sessionToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// hashToken returns the form a session token is stored in, so a leaked
+// database doesn't hand out working sessions.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns n random bytes, hex-encoded.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
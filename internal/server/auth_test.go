@@ -0,0 +1,86 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"photog/internal/models"
+)
+
+func TestVisiblePhoto(t *testing.T) {
+	s := newTestServer(t)
+	admin := addUser(t, s, "admin", true)
+	alex := addUser(t, s, "alex", false)
+	sam := addUser(t, s, "sam", false)
+
+	shared := addPhoto(t, s, "/photos/shared.jpg", 0)
+	alexs := addPhoto(t, s, "/uploads/alex/a.jpg", alex.ID)
+	sams := addPhoto(t, s, "/uploads/sam/s.jpg", sam.ID)
+
+	tests := []struct {
+		name  string
+		user  *models.User
+		photo *models.Photo
+		want  bool
+	}{
+		{"auth disabled", nil, sams, true},
+		{"admin", admin, sams, true},
+		{"shared photo", alex, shared, true},
+		{"own photo", alex, alexs, true},
+		{"other user's photo", alex, sams, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.user != nil {
+			r = as(r, tt.user)
+		}
+		p, err := s.visiblePhoto(r, tt.photo.ID)
+		if tt.want && (err != nil || p.ID != tt.photo.ID) {
+			t.Errorf("%s: visiblePhoto = %v, %v; want the photo", tt.name, p, err)
+		}
+		if !tt.want && !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("%s: visiblePhoto error = %v, want sql.ErrNoRows", tt.name, err)
+		}
+	}
+}
+
+func TestVisiblePhotoInSharedAlbum(t *testing.T) {
+	s := newTestServer(t)
+	alex := addUser(t, s, "alex", false)
+	sam := addUser(t, s, "sam", false)
+	sams := addPhoto(t, s, "/uploads/sam/s.jpg", sam.ID)
+
+	album := &models.Album{Title: "Holiday"}
+	if err := s.db.CreateAlbum(album); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.AddAlbumPhotos(album.ID, []int64{sams.ID}, sam.ID); err != nil {
+		t.Fatal(err)
+	}
+	r := as(httptest.NewRequest("GET", "/", nil), alex)
+	if _, err := s.visiblePhoto(r, sams.ID); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("before sharing: error = %v, want sql.ErrNoRows", err)
+	}
+
+	if err := s.db.SetAlbumMember(album.ID, alex.ID, "view"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.visiblePhoto(r, sams.ID); err != nil {
+		t.Fatalf("after sharing: error = %v", err)
+	}
+}
+
+func TestOwner(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if o := owner(r); o != 0 {
+		t.Errorf("auth disabled: owner = %d, want 0", o)
+	}
+	if o := owner(as(r, &models.User{ID: 3, Admin: true})); o != 0 {
+		t.Errorf("admin: owner = %d, want 0", o)
+	}
+	if o := owner(as(r, &models.User{ID: 4})); o != 4 {
+		t.Errorf("user: owner = %d, want 4", o)
+	}
+}
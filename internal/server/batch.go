@@ -0,0 +1,168 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"photog/internal/database"
+	"photog/internal/models"
+)
+
+// maxBatchPhotos caps the photos one batch metadata edit may touch.
+const maxBatchPhotos = 10000
+
+// templateField matches a {placeholder} in a description template.
+var templateField = regexp.MustCompile(`\{(\w+)\}`)
+
+// descriptionFields are the placeholders a description template may use.
+var descriptionFields = map[string]func(p *models.Photo, index int) string{
+	"filename":    func(p *models.Photo, _ int) string { return p.Filename },
+	"name":        func(p *models.Photo, _ int) string { return strings.TrimSuffix(p.Filename, filepath.Ext(p.Filename)) },
+	"date":        func(p *models.Photo, _ int) string { return p.TakenAt.Format("2006-01-02") },
+	"year":        func(p *models.Photo, _ int) string { return strconv.Itoa(p.TakenAt.Year()) },
+	"place":       func(p *models.Photo, _ int) string { return p.Place },
+	"camera":      func(p *models.Photo, _ int) string { return p.Camera },
+	"n":           func(_ *models.Photo, index int) string { return strconv.Itoa(index + 1) },
+	"description": func(p *models.Photo, _ int) string { return p.Description },
+}
+
+// handleBatchMetadata applies a metadata edit to a set of photos in one
+// transaction and returns what changed on each. With dry_run nothing is
+// written, for previewing the edit. Description templates may use
+// {filename}, {name}, {date}, {year}, {place}, {camera}, {n} (position in
+// the batch, from 1) and {description} (the current one).
+// POST /api/batch/metadata {"ids": [1, 2], "add_tags": ["trip"], "rating": 4, "dry_run": true}
+func (s *Server) handleBatchMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		IDs         []int64  `json:"ids"`
+		AddTags     []string `json:"add_tags"`
+		RemoveTags  []string `json:"remove_tags"`
+		Rating      *int     `json:"rating"`
+		Description *string  `json:"description"`
+		Location    *struct {
+			Lat float64 `json:"lat"`
+			Lon float64 `json:"lon"`
+		} `json:"location"`
+		DryRun bool `json:"dry_run"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		jsonError(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("dry_run") == "1" || r.URL.Query().Get("dry_run") == "true" {
+		req.DryRun = true
+	}
+	if len(req.IDs) == 0 {
+		jsonError(w, "No photo IDs", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxBatchPhotos {
+		jsonError(w, fmt.Sprintf("At most %d photos per batch", maxBatchPhotos), http.StatusBadRequest)
+		return
+	}
+
+	patch := database.MetadataPatch{
+		AddTags:    cleanTags(req.AddTags),
+		RemoveTags: cleanTags(req.RemoveTags),
+		Rating:     req.Rating,
+	}
+	if req.Rating != nil && (*req.Rating < 0 || *req.Rating > 5) {
+		jsonError(w, "Rating must be between 0 and 5", http.StatusBadRequest)
+		return
+	}
+	if req.Description != nil {
+		describe, err := descriptionTemplate(*req.Description)
+		if err != nil {
+			jsonError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		patch.Description = describe
+	}
+	if loc := req.Location; loc != nil {
+		if loc.Lat < -90 || loc.Lat > 90 || loc.Lon < -180 || loc.Lon > 180 || (loc.Lat == 0 && loc.Lon == 0) {
+			jsonError(w, "Invalid location", http.StatusBadRequest)
+			return
+		}
+		patch.Latitude, patch.Longitude = &loc.Lat, &loc.Lon
+	}
+
+	changes, err := s.db.PatchMetadata(dedupeIDs(req.IDs), patch, req.DryRun)
+	if errors.Is(err, sql.ErrNoRows) {
+		jsonError(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Batch metadata: %v", err)
+		jsonError(w, "Failed to update metadata", http.StatusInternalServerError)
+		return
+	}
+
+	changed := 0
+	for _, c := range changes {
+		if len(c.AddedTags) > 0 || len(c.RemovedTags) > 0 || c.Rating != nil || c.Description != nil || c.Location != nil {
+			changed++
+		}
+	}
+	if !req.DryRun {
+		log.Printf("Batch metadata: changed %d of %d photos", changed, len(changes))
+	}
+	jsonResponse(w, map[string]interface{}{
+		"dry_run": req.DryRun,
+		"changed": changed,
+		"photos":  changes,
+	})
+}
+
+// descriptionTemplate compiles a description template, rejecting unknown
+// placeholders.
+func descriptionTemplate(tmpl string) (func(p *models.Photo, index int) string, error) {
+	for _, m := range templateField.FindAllStringSubmatch(tmpl, -1) {
+		if descriptionFields[m[1]] == nil {
+			return nil, fmt.Errorf("Unknown placeholder {%s} in description", m[1])
+		}
+	}
+	return func(p *models.Photo, index int) string {
+		return strings.TrimSpace(templateField.ReplaceAllStringFunc(tmpl, func(field string) string {
+			return descriptionFields[field[1:len(field)-1]](p, index)
+		}))
+	}, nil
+}
+
+// cleanTags trims tags and drops empty and repeated ones.
+func cleanTags(tags []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+// dedupeIDs drops repeated IDs, keeping the first occurrence's position.
+func dedupeIDs(ids []int64) []int64 {
+	out := make([]int64, 0, len(ids))
+	seen := make(map[int64]bool)
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
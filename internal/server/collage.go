@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"photog/internal/thumbnail"
+)
+
+// maxCollagePhotos caps how many photos a single collage may include.
+const maxCollagePhotos = 100
+
+// collageRequest is the body of POST /api/collage.
+type collageRequest struct {
+	IDs     []int64 `json:"ids"`
+	Layout  string  `json:"layout"` // "grid" (default) or "mosaic"
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Columns int     `json:"columns"`
+	Gap     *int    `json:"gap"`
+}
+
+// handleCollage composes the given photos into a single JPEG, e.g. for a
+// year-in-review cover. Photos that can't be rendered leave a blank cell.
+func (s *Server) handleCollage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req collageRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 || len(req.IDs) > maxCollagePhotos {
+		jsonError(w, "Provide between 1 and 100 photo ids", http.StatusBadRequest)
+		return
+	}
+	if req.Layout != "" && req.Layout != "grid" && req.Layout != "mosaic" {
+		jsonError(w, "Invalid layout (use grid or mosaic)", http.StatusBadRequest)
+		return
+	}
+
+	opts := thumbnail.CollageOptions{
+		Layout:  req.Layout,
+		Width:   req.Width,
+		Height:  req.Height,
+		Columns: req.Columns,
+		Gap:     8,
+	}
+	if opts.Width <= 0 {
+		opts.Width = 1600
+	}
+	if opts.Height <= 0 {
+		opts.Height = opts.Width
+	}
+	if opts.Width > 6000 || opts.Height > 6000 {
+		jsonError(w, "Width and height must be at most 6000", http.StatusBadRequest)
+		return
+	}
+	if req.Gap != nil {
+		opts.Gap = *req.Gap
+	}
+	if opts.Gap < 0 || opts.Gap > 100 {
+		jsonError(w, "Invalid gap", http.StatusBadRequest)
+		return
+	}
+
+	items := make([]thumbnail.CollageItem, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		photo, err := s.db.GetPhoto(id)
+		if err != nil {
+			jsonError(w, "Photo not found", http.StatusNotFound)
+			return
+		}
+		items = append(items, thumbnail.CollageItem{
+			Path:      photo.Path,
+			MediaType: photo.MediaType,
+			Width:     photo.Width,
+			Height:    photo.Height,
+		})
+	}
+
+	data, err := s.thumbs.Collage(items, opts)
+	if err != nil {
+		jsonError(w, "Failed to create collage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Disposition", `inline; filename="collage.jpg"`)
+	w.Write(data)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"photog/internal/models"
+)
+
+const (
+	maxCommentAuthor = 100
+	maxCommentBody   = 2000
+)
+
+// handlePhotoComments lists (GET) or adds (POST {"author","body"}) comments
+// on a photo. New comments are passed to OnComment so the owner can be
+// notified.
+func (s *Server) handlePhotoComments(w http.ResponseWriter, r *http.Request, photo *models.Photo) {
+	switch r.Method {
+	case http.MethodGet:
+		comments, err := s.db.GetComments(photo.ID)
+		if err != nil {
+			jsonError(w, "Failed to fetch comments", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, comments)
+
+	case http.MethodPost:
+		var req struct {
+			Author string `json:"author"`
+			Body   string `json:"body"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		c := &models.Comment{
+			PhotoID: photo.ID,
+			Author:  strings.TrimSpace(req.Author),
+			Body:    strings.TrimSpace(req.Body),
+		}
+		if c.Body == "" {
+			jsonError(w, "Comment body is required", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(c.Body) > maxCommentBody || utf8.RuneCountInString(c.Author) > maxCommentAuthor {
+			jsonError(w, "Comment too long", http.StatusBadRequest)
+			return
+		}
+		if c.Author == "" {
+			c.Author = "Guest"
+		}
+
+		if err := s.db.AddComment(c); err != nil {
+			jsonError(w, "Failed to save comment", http.StatusInternalServerError)
+			return
+		}
+		if s.OnComment != nil {
+			s.OnComment(photo, c)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCommentDelete removes a comment. DELETE /api/comments/{id}
+func (s *Server) handleCommentDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/comments/"), 10, 64)
+	if err != nil {
+		jsonError(w, "Invalid comment ID", http.StatusBadRequest)
+		return
+	}
+	if err := s.db.DeleteComment(id); err == sql.ErrNoRows {
+		jsonError(w, "Comment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		jsonError(w, "Failed to delete comment", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
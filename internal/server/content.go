@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"photog/internal/archive"
+	"photog/internal/models"
+	"photog/internal/thumbnail"
+)
+
+// contentSizes maps content URL thumbnail names to sizes.
+var contentSizes = map[string]thumbnail.Size{
+	"sm": thumbnail.Small,
+	"md": thumbnail.Medium,
+	"lg": thumbnail.Large,
+	"xl": thumbnail.XLarge,
+}
+
+// contentFormats maps content URL thumbnail extensions to formats.
+var contentFormats = map[string]thumbnail.Format{
+	".webp": thumbnail.WebP,
+	".avif": thumbnail.AVIF,
+	".jpg":  thumbnail.JPEG,
+}
+
+// handleContent serves a thumbnail or the original by the file's content
+// hash rather than its ID. What such a URL serves never changes, so it is
+// cached for good: by browsers, and with auth disabled by any CDN or proxy
+// in front too. With auth enabled it needs a session and only shows photos
+// the account may see, so responses are private to its browser. Any file
+// with the hash will do: copies of a file are interchangeable. Thumbnails
+// come in the format the extension names, rather than one negotiated, for
+// the same reason; .avif needs ffmpeg with an AV1 encoder.
+// GET /api/c/{hash}/{sm,md,lg,xl}.{webp,avif,jpg}
+// GET /api/c/{hash}/original
+func (s *Server) handleContent(w http.ResponseWriter, r *http.Request) {
+	hash, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/c/"), "/")
+	if len(hash) != 64 || strings.Trim(hash, "0123456789abcdef") != "" {
+		http.Error(w, "Invalid content hash", http.StatusBadRequest)
+		return
+	}
+	ext := filepath.Ext(name)
+	size, isThumb := contentSizes[strings.TrimSuffix(name, ext)]
+	format, ok := contentFormats[ext]
+	isThumb = isThumb && ok && s.thumbs.CanEncode(format)
+	if !isThumb && name != "original" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	photo := s.contentPhoto(r, hash)
+	if photo == nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if isThumb {
+		s.serveThumb(w, r, photo, size, format, "max-age=31536000, immutable")
+		return
+	}
+
+	if photo.Unavailable {
+		http.Error(w, "Photo is on an offline disk", http.StatusServiceUnavailable)
+		return
+	}
+	if archive.IsEntry(photo.Path) {
+		s.serveArchived(w, r, photo)
+		return
+	}
+	if _, err := os.Stat(photo.Path); err != nil {
+		http.Error(w, "File not found on disk", http.StatusNotFound)
+		return
+	}
+	s.recordView(r, photo)
+	w.Header().Set("Content-Type", mimeForExt(strings.ToLower(filepath.Ext(photo.Path))))
+	s.cacheControl(w, "max-age=31536000, immutable")
+	http.ServeFile(w, r, photo.Path)
+}
+
+// contentPhoto returns a photo the request may see whose file has the given
+// content hash, preferring one whose disk is online, or nil.
+func (s *Server) contentPhoto(r *http.Request, hash string) *models.Photo {
+	ids, err := s.db.GetPhotoIDsByHash(hash)
+	if err != nil {
+		return nil
+	}
+	var found *models.Photo
+	for _, id := range ids {
+		photo, err := s.visiblePhoto(r, id)
+		if err != nil {
+			continue
+		}
+		if !photo.Unavailable {
+			return photo
+		}
+		if found == nil {
+			found = photo
+		}
+	}
+	return found
+}
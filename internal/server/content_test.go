@@ -0,0 +1,56 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"photog/internal/models"
+)
+
+func TestHandleContent(t *testing.T) {
+	s := newTestServer(t)
+	alex := addUser(t, s, "alex", false)
+	sam := addUser(t, s, "sam", false)
+
+	path := filepath.Join(t.TempDir(), "a.jpg")
+	if err := os.WriteFile(path, []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := addPhoto(t, s, path, alex.ID)
+	hash := strings.Repeat("ab", 32)
+	if err := s.db.SetContentHash(p.ID, hash); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user *models.User
+		path string
+		want int
+	}{
+		{"original", nil, "/api/c/" + hash + "/original", http.StatusOK},
+		{"owner", alex, "/api/c/" + hash + "/original", http.StatusOK},
+		{"other user", sam, "/api/c/" + hash + "/original", http.StatusNotFound},
+		{"unknown hash", nil, "/api/c/" + strings.Repeat("cd", 32) + "/original", http.StatusNotFound},
+		{"unknown name", nil, "/api/c/" + hash + "/huge.webp", http.StatusNotFound},
+		{"short hash", nil, "/api/c/abcd/original", http.StatusBadRequest},
+		{"uppercase hash", nil, "/api/c/" + strings.Repeat("AB", 32) + "/original", http.StatusBadRequest},
+		{"path in hash", nil, "/api/c/../../" + strings.Repeat("a", 58) + "/original", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = tt.path
+		if tt.user != nil {
+			r = as(r, tt.user)
+		}
+		w := httptest.NewRecorder()
+		s.handleContent(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"photog/internal/thumbnail"
+)
+
+// convertMaxDim bounds the size of converted images, so a request can't
+// make the server hold an enormous image in memory.
+const convertMaxDim = 16384
+
+// handleConvert serves a photo converted to a format browsers can show, for
+// originals they can't (HEIC, RAW, TIFF). The result is fitted within max x
+// max, never upscaled, and cached.
+// GET /api/convert/{id}?format=jpeg|png|webp&max=4096
+func (s *Server) handleConvert(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/convert/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid photo ID", http.StatusBadRequest)
+		return
+	}
+
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	if format == "" || format == "jpg" {
+		format = "jpeg"
+	}
+	if _, ok := thumbnail.ConvertFormats[format]; !ok {
+		http.Error(w, "Invalid format (use jpeg, png or webp)", http.StatusBadRequest)
+		return
+	}
+	maxDim := 4096
+	if v := r.URL.Query().Get("max"); v != "" {
+		maxDim, err = strconv.Atoi(v)
+		if err != nil || maxDim <= 0 || maxDim > convertMaxDim {
+			http.Error(w, "Invalid max (1-16384)", http.StatusBadRequest)
+			return
+		}
+	}
+
+	photo, err := s.visiblePhoto(r, id)
+	if err != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if photo.MediaType == "video" {
+		http.Error(w, "Not a photo", http.StatusBadRequest)
+		return
+	}
+	if photo.Unavailable {
+		http.Error(w, "Photo is on an offline disk", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Conversions are as heavy as thumbnails and share their slots
+	if _, err := os.Stat(s.thumbs.ConvertedPath(photo.Path, format, maxDim)); err != nil {
+		if !s.thumbQueue.acquire(r.Context()) {
+			w.Header().Set("Retry-After", "2")
+			http.Error(w, "Too many images pending, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.thumbQueue.release()
+	}
+
+	convPath, err := s.thumbs.GetOrCreateConverted(photo.Path, format, maxDim)
+	if err != nil {
+		log.Printf("Convert error for %s: %v", photo.Path, err)
+		http.Error(w, "Failed to convert photo", http.StatusInternalServerError)
+		return
+	}
+	s.recordView(r, photo)
+
+	w.Header().Set("Content-Type", mimeForExt(thumbnail.ConvertFormats[format]))
+	s.cacheControl(w, "max-age=86400")
+	http.ServeFile(w, r, convPath)
+}
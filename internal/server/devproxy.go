@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+// SetDevProxy makes handleFrontend reverse-proxy to a frontend dev server
+// (e.g. Vite at http://localhost:5173) instead of serving ui/dist, so the UI
+// and API share an origin during development. WebSocket upgrades, which
+// Vite uses for HMR, pass through. Call before Start.
+func (s *Server) SetDevProxy(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("dev proxy: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("dev proxy: want an http(s) URL, got %q", target)
+	}
+
+	s.devProxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(u)
+			r.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Dev proxy: %s %s: %v", r.Method, r.URL.Path, err)
+			http.Error(w, fmt.Sprintf("Dev server at %s is not reachable. Run `cd ui && npm run dev`.", u), http.StatusBadGateway)
+		},
+	}
+	log.Printf("Server: proxying frontend requests to %s", u)
+	return nil
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"photog/internal/archive"
+	"photog/internal/models"
+)
+
+// maxDownloadSize caps the photos in one POST /api/download.
+const maxDownloadSize = maxSelectionSize
+
+// handleDownload streams the originals of a list of photos, or of an
+// album, as a zip built on the fly. Photos the user can't see are left out.
+// POST /api/download {"ids": [...]} or {"album_id": 1}
+// A form post (ids=1,2,3 or album_id=1) works too, so a plain HTML form can
+// save the zip straight to disk rather than through the page's memory.
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		IDs     []int64 `json:"ids"`
+		AlbumID int64   `json:"album_id"`
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 8<<20))
+	if err != nil {
+		jsonError(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Told apart by the body, as JSON clients don't always set a type
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] != '{' {
+		form, err := url.ParseQuery(string(trimmed))
+		if err != nil {
+			jsonError(w, "Invalid form body", http.StatusBadRequest)
+			return
+		}
+		var msg string
+		if req.IDs, msg = formIDs(form["ids"]); msg != "" {
+			jsonError(w, msg, http.StatusBadRequest)
+			return
+		}
+		if v := form.Get("album_id"); v != "" {
+			id, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				jsonError(w, "Invalid album ID", http.StatusBadRequest)
+				return
+			}
+			req.AlbumID = id
+		}
+	} else if err := json.Unmarshal(body, &req); err != nil {
+		jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	ids, name := req.IDs, "photos.zip"
+	switch {
+	case req.AlbumID != 0 && len(req.IDs) > 0:
+		jsonError(w, "Give either ids or album_id", http.StatusBadRequest)
+		return
+	case req.AlbumID != 0:
+		// Admins and the accounts the album is shared with, like /api/albums
+		role, err := s.albumRole(r, req.AlbumID)
+		if err != nil {
+			jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+			return
+		}
+		if role == "" {
+			jsonError(w, "Album not found", http.StatusNotFound)
+			return
+		}
+		album, err := s.db.GetAlbum(req.AlbumID)
+		if err == sql.ErrNoRows {
+			jsonError(w, "Album not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+			return
+		}
+		ids = make([]int64, 0, len(album.Photos))
+		for _, p := range album.Photos {
+			ids = append(ids, p.ID)
+		}
+		name = zipFilename(album.Title)
+	case len(req.IDs) == 0:
+		jsonError(w, "No photos given", http.StatusBadRequest)
+		return
+	case len(req.IDs) > maxDownloadSize:
+		jsonError(w, fmt.Sprintf("At most %d photos per download", maxDownloadSize), http.StatusBadRequest)
+		return
+	}
+
+	// Members of a shared album see all of its photos
+	if req.AlbumID == 0 {
+		ids, err = s.db.VisiblePhotoIDs(ids, owner(r))
+		if err != nil {
+			jsonError(w, "Failed to check photos", http.StatusInternalServerError)
+			return
+		}
+	}
+	if len(ids) == 0 {
+		jsonError(w, "No photos to download", http.StatusNotFound)
+		return
+	}
+	s.serveZip(w, r, ids, name)
+}
+
+// formIDs parses photo IDs given as form values, each one ID or a
+// comma-separated list, and returns a client message if one is invalid.
+func formIDs(values []string) ([]int64, string) {
+	var ids []int64
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part == "" {
+				continue
+			}
+			id, err := strconv.ParseInt(part, 10, 64)
+			if err != nil {
+				return nil, "Invalid photo ID: " + part
+			}
+			ids = append(ids, id)
+		}
+	}
+	return ids, ""
+}
+
+// zipFilename returns the download name for an album's zip, with the
+// characters file systems reject replaced.
+func zipFilename(title string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(title))
+	if name == "" {
+		name = "album"
+	}
+	return name + ".zip"
+}
+
+// serveZip streams the originals of the photos with the given IDs as an
+// uncompressed zip named name (photos and videos are compressed already).
+// Each file is flushed to the client once written, and writes wait while
+// the client is slow to read, so memory use stays flat however big the
+// zip. Photos gone since, or on an offline disk, are left out.
+func (s *Server) serveZip(w http.ResponseWriter, r *http.Request, ids []int64, name string) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("Cache-Control", "no-store")
+	rc := http.NewResponseController(w)
+
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool)
+	for _, id := range ids {
+		if r.Context().Err() != nil {
+			return
+		}
+		photo, err := s.visiblePhoto(r, id)
+		if err != nil || photo.Unavailable {
+			continue
+		}
+		f, err := archive.Open(photo.Path)
+		if err != nil {
+			log.Printf("Zip download: %s: %v", photo.Path, err)
+			continue
+		}
+		err = addZipFile(zw, f, photo, zipName(names, photo.Filename))
+		f.Close()
+		if err == nil {
+			err = zw.Flush()
+		}
+		if err != nil {
+			// Headers are sent, so the download can only be cut short
+			log.Printf("Zip download: %s: %v", photo.Path, err)
+			return
+		}
+		rc.Flush()
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Zip download: %v", err)
+	}
+}
+
+// addZipFile copies a photo's original from src into zw as name.
+func addZipFile(zw *zip.Writer, src io.Reader, photo *models.Photo, name string) error {
+	dst, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: photo.TakenAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// zipName returns filename, numbered "IMG_1 (2).jpg" when a file of that
+// name is already in the zip, and records it in used.
+func zipName(used map[string]bool, filename string) string {
+	name := filename
+	ext := filepath.Ext(filename)
+	for n := 2; used[strings.ToLower(name)]; n++ {
+		name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filename, ext), n, ext)
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
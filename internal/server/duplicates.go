@@ -0,0 +1,174 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"photog/internal/archive"
+	"photog/internal/indexer"
+	"photog/internal/jobs"
+	"photog/internal/models"
+)
+
+// duplicateAction is what removing duplicates does, or would do, to one
+// redundant copy.
+type duplicateAction struct {
+	ID     int64  `json:"id"`
+	Path   string `json:"path"`
+	KeptID int64  `json:"kept_id"`
+	Reason string `json:"reason,omitempty"` // why the copy was skipped
+}
+
+// handleDuplicates lists groups of identical files (GET) or removes the
+// redundant copies (DELETE). Files are grouped by the content hashes stored
+// by the dedup job, which runs after each scan.
+// GET /api/duplicates?offset=0&limit=50
+// DELETE /api/duplicates?hash=&dry_run=false
+func (s *Server) handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if offset < 0 {
+			offset = 0
+		}
+		if limit <= 0 || limit > 500 {
+			limit = 50
+		}
+		groups, total, wasted, err := s.db.GetDuplicateGroups(r.URL.Query().Get("hash"), offset, limit)
+		if err != nil {
+			jsonError(w, "Failed to fetch duplicates", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, map[string]interface{}{
+			"groups":       groups,
+			"total":        total,
+			"wasted_bytes": wasted,
+			"has_more":     offset+len(groups) < total,
+		})
+
+	case http.MethodDelete:
+		s.removeDuplicates(w, r)
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// removeDuplicates deletes every copy but the oldest indexed one in each
+// group, or in the group given by ?hash=, from disk and from the library.
+// It only reports what it would do unless ?dry_run=false, so a plain
+// DELETE never loses files. Each copy is hashed again first, and copies
+// inside archives, on offline disks or that are the kept file under
+// another path are skipped. Copies go to the trash when it's enabled.
+func (s *Server) removeDuplicates(w http.ResponseWriter, r *http.Request) {
+	dryRun := true
+	if v := r.URL.Query().Get("dry_run"); v == "false" || v == "0" {
+		dryRun = false
+	}
+	if !dryRun && s.indexer.IsRunning() {
+		jsonError(w, "A scan is running; try again when it has finished", http.StatusConflict)
+		return
+	}
+
+	groups, _, _, err := s.db.GetDuplicateGroups(r.URL.Query().Get("hash"), 0, -1)
+	if err != nil {
+		jsonError(w, "Failed to fetch duplicates", http.StatusInternalServerError)
+		return
+	}
+
+	removed := make([]duplicateAction, 0)
+	skipped := make([]duplicateAction, 0)
+	var freed int64
+	for _, g := range groups {
+		keep := g.Photos[0]
+		keepInfo, err := archive.Stat(keep.Path)
+		if err != nil {
+			for _, p := range g.Photos[1:] {
+				skipped = append(skipped, duplicateAction{ID: p.ID, Path: p.Path, KeptID: keep.ID, Reason: "kept copy is missing"})
+			}
+			continue
+		}
+		for _, p := range g.Photos[1:] {
+			action := duplicateAction{ID: p.ID, Path: p.Path, KeptID: keep.ID}
+			switch {
+			case archive.IsEntry(p.Path):
+				action.Reason = "inside an archive"
+			case p.Unavailable:
+				action.Reason = "disk is offline"
+			case sameFile(keepInfo, p.Path):
+				action.Reason = "same file as the kept copy"
+			default:
+				if hash, err := indexer.HashFile(p.Path); err != nil || hash != g.Hash {
+					action.Reason = "content changed since it was hashed"
+				}
+			}
+			if action.Reason != "" {
+				skipped = append(skipped, action)
+				continue
+			}
+
+			if !dryRun {
+				if err := s.removeDuplicate(p); err != nil {
+					log.Printf("Duplicates: removing %s: %v", p.Path, err)
+					action.Reason = "could not delete the file"
+					skipped = append(skipped, action)
+					continue
+				}
+				log.Printf("Duplicates: removed %s (copy of photo %d)", p.Path, keep.ID)
+			}
+			removed = append(removed, action)
+			freed += g.Size
+		}
+	}
+
+	jsonResponse(w, map[string]interface{}{
+		"dry_run":     dryRun,
+		"removed":     removed,
+		"skipped":     skipped,
+		"freed_bytes": freed,
+	})
+}
+
+// removeDuplicate deletes a redundant copy: into the trash when it's
+// enabled, for good otherwise.
+func (s *Server) removeDuplicate(p *models.Photo) error {
+	if s.trash != nil {
+		_, err := s.trash.Delete(p)
+		return err
+	}
+	if err := os.Remove(p.Path); err != nil {
+		return err
+	}
+	if _, err := s.db.RemovePhotoByPath(p.Path); err != nil {
+		log.Printf("Duplicates: removing %s from the library: %v", p.Path, err)
+	}
+	s.thumbs.Invalidate(p.Path)
+	return nil
+}
+
+// sameFile reports whether path is the file described by kept, reached
+// through another root, a symlink or a bind mount. Deleting it would
+// delete the kept copy too.
+func sameFile(kept os.FileInfo, path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && os.SameFile(kept, info)
+}
+
+// handleDuplicatesScan queues the dedup job, for hashing files added
+// outside a scan.
+// POST /api/duplicates/scan
+func (s *Server) handleDuplicatesScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	job, err := s.jobs.Enqueue(jobs.TypeDedup, nil)
+	if err != nil {
+		jsonError(w, "Failed to queue dedup job", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{"status": "started", "job": job})
+}
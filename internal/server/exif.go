@@ -0,0 +1,256 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"photog/internal/archive"
+	"photog/internal/indexer"
+	"photog/internal/models"
+)
+
+// metadataVersion is part of the metadata cache file names, so entries
+// cached before indexer.Metadata gained fields are read again.
+const metadataVersion = 2
+
+// handlePhotoExif returns the full decoded EXIF/XMP (or ffprobe) tag set
+// for a photo. Results are parsed on first request and cached on disk,
+// keyed by the file's size and modification time so edits are picked up.
+// The GPS position is made as precise as auth.shared_gps allows.
+func (s *Server) handlePhotoExif(w http.ResponseWriter, r *http.Request, photo *models.Photo) {
+	info, err := archive.Stat(photo.Path)
+	if err != nil {
+		jsonError(w, "File not found on disk", http.StatusNotFound)
+		return
+	}
+
+	hash := sha256.Sum256([]byte(photo.Path))
+	cachePath := filepath.Join(s.cfg.Cache.Dir, "metadata",
+		fmt.Sprintf("%x_%d_%d_v%d.json", hash[:16], info.Size(), info.ModTime().Unix(), metadataVersion))
+
+	if data, err := os.ReadFile(cachePath); err == nil {
+		s.writeMetadata(w, r, photo, data)
+		return
+	}
+
+	md, err := indexer.ReadMetadata(photo.Path, photo.MediaType)
+	if err != nil {
+		jsonError(w, "Failed to read metadata", http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(md)
+	if err != nil {
+		jsonError(w, "Failed to encode metadata", http.StatusInternalServerError)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err == nil {
+		os.WriteFile(cachePath, data, 0644)
+	}
+	s.writeMetadata(w, r, photo, data)
+}
+
+// writeMetadata responds with a photo's encoded indexer.Metadata, with its
+// GPS tags rounded or removed if the request's account may not see them
+// exactly.
+func (s *Server) writeMetadata(w http.ResponseWriter, r *http.Request, photo *models.Photo, data []byte) {
+	if mode := s.sharedGPS(r, photo); mode != "exact" {
+		md := &indexer.Metadata{}
+		if err := json.Unmarshal(data, md); err != nil {
+			jsonError(w, "Failed to read metadata", http.StatusInternalServerError)
+			return
+		}
+		hideGPS(md, mode)
+		jsonResponse(w, md)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// sharedGPS returns how precise a photo's GPS position may be for the
+// request's account: "exact" for admins and the photo's owner, otherwise
+// as configured by auth.shared_gps.
+func (s *Server) sharedGPS(r *http.Request, photo *models.Photo) string {
+	o := owner(r)
+	if o == 0 || photo.OwnerID == o || s.cfg.Auth.SharedGPS == "" {
+		return "exact"
+	}
+	return s.cfg.Auth.SharedGPS
+}
+
+// gpsPrecision is the number of decimals coordinates keep when rounded;
+// 2 is about a kilometer.
+const gpsPrecision = 2
+
+// hideGPS rounds ("round") or removes ("strip") the GPS position in
+// metadata, from the EXIF and XMP tags of images and the ffprobe tags of
+// videos. Rounding keeps the other GPS tags, such as altitude, but drops
+// the destination coordinates, which are often as telling.
+func hideGPS(md *indexer.Metadata, mode string) {
+	if mode == "strip" {
+		md.GPS = nil
+	}
+	hideVideoGPS(md.FFprobe, mode)
+	for _, tags := range []map[string]interface{}{md.EXIF, md.XMP} {
+		for key, v := range tags {
+			// XMP keys have a namespace prefix, e.g. "exif:GPSLatitude"
+			name := key[strings.LastIndex(key, ":")+1:]
+			if !strings.HasPrefix(name, "GPS") {
+				continue
+			}
+			if mode == "strip" || strings.HasPrefix(name, "GPSDest") {
+				delete(tags, key)
+				continue
+			}
+			if name != "GPSLatitude" && name != "GPSLongitude" {
+				continue
+			}
+			rounded, ok := roundCoordinate(v)
+			if !ok {
+				delete(tags, key)
+				continue
+			}
+			tags[key] = rounded
+		}
+	}
+}
+
+// hideVideoGPS rounds or removes the position tags in ffprobe output, from
+// the format's and each stream's tags. Phones record the position as an ISO
+// 6709 string such as "+48.8584+002.2945+035.000/" under "location",
+// "location-eng" or "com.apple.quicktime.location.ISO6709"; other location
+// tags, which can't be rounded, are removed.
+func hideVideoGPS(probe interface{}, mode string) {
+	res, ok := probe.(map[string]interface{})
+	if !ok {
+		return
+	}
+	var tagSets []interface{}
+	if format, ok := res["format"].(map[string]interface{}); ok {
+		tagSets = append(tagSets, format["tags"])
+	}
+	streams, _ := res["streams"].([]interface{})
+	for _, st := range streams {
+		if st, ok := st.(map[string]interface{}); ok {
+			tagSets = append(tagSets, st["tags"])
+		}
+	}
+	for _, t := range tagSets {
+		tags, ok := t.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for key, v := range tags {
+			if !strings.Contains(strings.ToLower(key), "location") {
+				continue
+			}
+			s, _ := v.(string)
+			rounded, ok := roundISO6709(s)
+			if mode == "strip" || !ok {
+				delete(tags, key)
+				continue
+			}
+			tags[key] = rounded
+		}
+	}
+}
+
+// iso6709RE matches an ISO 6709 position in decimal degrees: latitude,
+// longitude, then optionally altitude and a trailing "/".
+var iso6709RE = regexp.MustCompile(`^([+-]\d{1,2}(?:\.\d+)?)([+-]\d{1,3}(?:\.\d+)?)([+-]\d+(?:\.\d+)?)?(/?)$`)
+
+// roundISO6709 rounds the latitude and longitude of an ISO 6709 position,
+// keeping its altitude.
+func roundISO6709(s string) (string, bool) {
+	m := iso6709RE.FindStringSubmatch(s)
+	if m == nil {
+		return "", false
+	}
+	lat, _ := strconv.ParseFloat(m[1], 64)
+	lon, _ := strconv.ParseFloat(m[2], 64)
+	return fmt.Sprintf("%+.*f%+.*f", gpsPrecision, roundDegrees(lat), gpsPrecision, roundDegrees(lon)) + m[3] + m[4], true
+}
+
+// roundCoordinate rounds a latitude or longitude as found in metadata: an
+// EXIF list of degrees, minutes and seconds as "num/den" rationals, or an
+// XMP "DDD,MM.mmk" or "DDD,MM,SSk" string with k the compass direction. It
+// returns the value in the same form.
+func roundCoordinate(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case []interface{}:
+		var deg float64
+		for i, part := range v {
+			f, ok := parseRational(part)
+			if !ok || i > 2 {
+				return nil, false
+			}
+			deg += f / math.Pow(60, float64(i))
+		}
+		d, m, sec := dms(roundDegrees(deg))
+		return []interface{}{fmt.Sprintf("%d/1", d), fmt.Sprintf("%d/1", m), fmt.Sprintf("%d/1", sec)}, true
+	case string:
+		if len(v) < 2 {
+			return nil, false
+		}
+		dir := v[len(v)-1]
+		if !strings.ContainsRune("NSEW", rune(dir)) {
+			return nil, false
+		}
+		var deg float64
+		for i, part := range strings.Split(v[:len(v)-1], ",") {
+			f, err := strconv.ParseFloat(part, 64)
+			if err != nil || i > 2 {
+				return nil, false
+			}
+			deg += f / math.Pow(60, float64(i))
+		}
+		d, m, sec := dms(roundDegrees(deg))
+		return fmt.Sprintf("%d,%d,%d%c", d, m, sec, dir), true
+	}
+	return nil, false
+}
+
+// roundDegrees rounds degrees to gpsPrecision decimals.
+func roundDegrees(deg float64) float64 {
+	scale := math.Pow(10, gpsPrecision)
+	return math.Round(deg*scale) / scale
+}
+
+// dms splits non-negative degrees into whole degrees, minutes and seconds.
+func dms(deg float64) (int, int, int) {
+	total := int(math.Round(deg * 3600))
+	return total / 3600, total / 60 % 60, total % 60
+}
+
+// parseRational parses an EXIF rational rendered as "num/den", or a plain
+// number.
+func parseRational(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		num, den, found := strings.Cut(v, "/")
+		n, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return 0, false
+		}
+		if !found {
+			return n, true
+		}
+		d, err := strconv.ParseFloat(den, 64)
+		if err != nil || d == 0 {
+			return 0, false
+		}
+		return n / d, true
+	}
+	return 0, false
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+
+	"photog/internal/indexer"
+	"photog/internal/models"
+)
+
+// loadProbeFixture returns the metadata of a phone video, as ffprobe
+// describes it.
+func loadProbeFixture(t *testing.T) *indexer.Metadata {
+	t.Helper()
+	data, err := os.ReadFile("testdata/ffprobe_phone.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := &indexer.Metadata{}
+	if err := json.Unmarshal(data, &md.FFprobe); err != nil {
+		t.Fatal(err)
+	}
+	return md
+}
+
+// formatTags returns the format tags of ffprobe output in md.
+func formatTags(t *testing.T, md *indexer.Metadata) map[string]interface{} {
+	t.Helper()
+	tags, ok := md.FFprobe.(map[string]interface{})["format"].(map[string]interface{})["tags"].(map[string]interface{})
+	if !ok {
+		t.Fatal("fixture has no format tags")
+	}
+	return tags
+}
+
+func TestHideGPSRoundsVideoLocation(t *testing.T) {
+	md := loadProbeFixture(t)
+	hideGPS(md, "round")
+
+	tags := formatTags(t, md)
+	want := map[string]string{
+		"com.apple.quicktime.location.ISO6709": "+48.86+2.29+035.000/",
+		"location":                             "+48.86+2.29/",
+		"location-eng":                         "+48.86+2.29/",
+	}
+	for key, v := range want {
+		if tags[key] != v {
+			t.Errorf("%s = %v, want %q", key, tags[key], v)
+		}
+	}
+	if _, ok := tags["com.apple.quicktime.location.accuracy.horizontal"]; ok {
+		t.Error("location accuracy was kept")
+	}
+	if tags["com.apple.quicktime.model"] != "iPhone 14" {
+		t.Errorf("unrelated tag changed: model = %v", tags["com.apple.quicktime.model"])
+	}
+}
+
+func TestHideGPSStripsVideoLocation(t *testing.T) {
+	md := loadProbeFixture(t)
+	hideGPS(md, "strip")
+
+	for key := range formatTags(t, md) {
+		switch key {
+		case "com.apple.quicktime.location.ISO6709", "location", "location-eng", "com.apple.quicktime.location.accuracy.horizontal":
+			t.Errorf("%s was kept", key)
+		}
+	}
+}
+
+func TestRoundISO6709(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"+48.8584+002.2945/", "+48.86+2.29/", true},
+		{"-33.8688+151.2093+012.5/", "-33.87+151.21+012.5/", true},
+		{"+40.7128-074.0060", "+40.71-74.01", true},
+		{"+4012.345-07401.2/", "", false}, // degrees and minutes
+		{"Paris", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := roundISO6709(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("roundISO6709(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// imageMetadata returns the GPS tags of a photo taken at the Eiffel Tower,
+// as EXIF and XMP describe them.
+func imageMetadata() *indexer.Metadata {
+	return &indexer.Metadata{
+		EXIF: map[string]interface{}{
+			"GPSLatitude":     []interface{}{"48/1", "51/1", "3024/100"},
+			"GPSLongitude":    []interface{}{"2/1", "17/1", "402/10"},
+			"GPSAltitude":     "35/1",
+			"GPSDestLatitude": []interface{}{"48/1", "51/1", "0/1"},
+			"Model":           "iPhone 14",
+		},
+		XMP: map[string]interface{}{
+			"exif:GPSLatitude":  "48,51.504N",
+			"exif:GPSLongitude": "2,17.67E",
+		},
+		GPS: &models.GPSDetails{},
+	}
+}
+
+func TestHideGPSRoundsImageLocation(t *testing.T) {
+	md := imageMetadata()
+	hideGPS(md, "round")
+
+	want := map[string]interface{}{
+		"GPSLatitude":  []interface{}{"48/1", "51/1", "36/1"},
+		"GPSLongitude": []interface{}{"2/1", "17/1", "24/1"},
+		"GPSAltitude":  "35/1",
+		"Model":        "iPhone 14",
+	}
+	if !reflect.DeepEqual(md.EXIF, want) {
+		t.Errorf("EXIF = %v, want %v", md.EXIF, want)
+	}
+	if md.XMP["exif:GPSLatitude"] != "48,51,36N" || md.XMP["exif:GPSLongitude"] != "2,17,24E" {
+		t.Errorf("XMP = %v", md.XMP)
+	}
+	if md.GPS == nil {
+		t.Error("GPS details were dropped")
+	}
+}
+
+func TestHideGPSStripsImageLocation(t *testing.T) {
+	md := imageMetadata()
+	hideGPS(md, "strip")
+
+	if want := map[string]interface{}{"Model": "iPhone 14"}; !reflect.DeepEqual(md.EXIF, want) {
+		t.Errorf("EXIF = %v, want %v", md.EXIF, want)
+	}
+	if len(md.XMP) != 0 {
+		t.Errorf("XMP = %v, want no tags", md.XMP)
+	}
+	if md.GPS != nil {
+		t.Error("GPS details were kept")
+	}
+}
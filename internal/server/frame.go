@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"photog/internal/thumbnail"
+)
+
+const (
+	// frameDeckIdle is how long a deck is kept after its last use.
+	frameDeckIdle = 24 * time.Hour
+	// maxFrameDecks caps the decks held at once; filters come from the URL,
+	// so any number of them could be asked for.
+	maxFrameDecks = 100
+)
+
+// frameDeck holds a shuffled list of photo IDs for one filter combination.
+// IDs are popped until the deck is empty, then it is reloaded and reshuffled,
+// so every matching photo is shown once before any repeats.
+type frameDeck struct {
+	ids  []int64
+	used time.Time
+}
+
+// frameFilter is the set of optional query filters accepted by /frame.
+type frameFilter struct {
+	from        time.Time
+	to          time.Time
+	orientation string
+}
+
+func (f frameFilter) key() string {
+	return f.from.Format("20060102") + "|" + f.to.Format("20060102") + "|" + f.orientation
+}
+
+// parseFrameFilter reads from/to (YYYY-MM-DD) and orientation from the query.
+func parseFrameFilter(q url.Values) frameFilter {
+	f := frameFilter{
+		from: time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC),
+		to:   time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC),
+	}
+	if t, err := time.Parse("2006-01-02", q.Get("from")); err == nil {
+		f.from = t
+	}
+	if t, err := time.Parse("2006-01-02", q.Get("to")); err == nil {
+		f.to = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	switch q.Get("orientation") {
+	case "landscape", "portrait":
+		f.orientation = q.Get("orientation")
+	}
+	return f
+}
+
+// checkFrameToken validates the frame token. The frame endpoint is disabled
+// entirely when no token is configured.
+func (s *Server) checkFrameToken(w http.ResponseWriter, r *http.Request) bool {
+	token := s.cfg.Frame.Token
+	if token == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	given := r.URL.Query().Get("token")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, "Invalid frame token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// frameInterval returns the refresh interval in seconds, allowing a per-URL
+// override via ?interval= (clamped to something sane for a wall display).
+func (s *Server) frameInterval(r *http.Request) int {
+	interval := s.cfg.Frame.Interval
+	if v, err := strconv.Atoi(r.URL.Query().Get("interval")); err == nil {
+		interval = v
+	}
+	if interval < 5 {
+		interval = 5
+	}
+	if interval > 3600 {
+		interval = 3600
+	}
+	return interval
+}
+
+// nextFrameID pops the next photo ID from the shuffled deck for the filter,
+// refilling the deck from the database when it runs out.
+func (s *Server) nextFrameID(f frameFilter) (int64, error) {
+	s.frameMu.Lock()
+	defer s.frameMu.Unlock()
+
+	now := time.Now()
+	key := f.key()
+	deck := s.frameDecks[key]
+	if deck == nil {
+		s.pruneFrameDecks(now)
+	}
+	if deck == nil || len(deck.ids) == 0 {
+		ids, err := s.db.GetImageIDs(f.from, f.to, f.orientation)
+		if err != nil {
+			return 0, err
+		}
+		if len(ids) == 0 {
+			return 0, fmt.Errorf("no photos match the frame filters")
+		}
+		rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+		deck = &frameDeck{ids: ids}
+		s.frameDecks[key] = deck
+	}
+
+	deck.used = now
+	id := deck.ids[0]
+	deck.ids = deck.ids[1:]
+	return id, nil
+}
+
+// pruneFrameDecks drops the decks unused for frameDeckIdle and, if that
+// leaves no room for another, the least recently used one. Called with
+// frameMu held.
+func (s *Server) pruneFrameDecks(now time.Time) {
+	var oldest string
+	for key, deck := range s.frameDecks {
+		if now.Sub(deck.used) >= frameDeckIdle {
+			delete(s.frameDecks, key)
+		} else if oldest == "" || deck.used.Before(s.frameDecks[oldest].used) {
+			oldest = key
+		}
+	}
+	if len(s.frameDecks) >= maxFrameDecks {
+		delete(s.frameDecks, oldest)
+	}
+}
+
+// handleFrame serves a minimal full-screen page for a digital photo frame.
+// The page reloads itself every interval; each load pulls the next image
+// from /frame/image, so the device only ever needs to open one URL.
+func (s *Server) handleFrame(w http.ResponseWriter, r *http.Request) {
+	if !s.checkFrameToken(w, r) {
+		return
+	}
+
+	interval := s.frameInterval(r)
+
+	q := r.URL.Query()
+	q.Set("n", strconv.FormatInt(time.Now().UnixNano(), 36)) // defeat any caching
+	imgURL := "/frame/image?" + q.Encode()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Refresh", strconv.Itoa(interval))
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html><head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width,initial-scale=1">
+<meta http-equiv="refresh" content="%d">
+<title>Photog Frame</title>
+<style>html,body{margin:0;height:100%%;background:#000;overflow:hidden}
+img{width:100%%;height:100%%;object-fit:contain;display:block}</style>
+</head><body><img src="%s" alt=""></body></html>`, interval, html.EscapeString(imgURL))
+}
+
+// handleFrameImage serves the next large-size image from the shuffled deck.
+func (s *Server) handleFrameImage(w http.ResponseWriter, r *http.Request) {
+	if !s.checkFrameToken(w, r) {
+		return
+	}
+
+	id, err := s.nextFrameID(parseFrameFilter(r.URL.Query()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	photo, err := s.db.GetPhoto(id)
+	if err != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+
+	f := s.thumbFormat(r)
+	thumbPath, err := s.thumbs.GetOrCreateFormat(photo.Path, thumbnail.Large, f)
+	if err != nil {
+		log.Printf("Frame: thumbnail error for %s: %v", photo.Path, err)
+		http.Error(w, "Failed to generate image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Content-Type", f.ContentType())
+	http.ServeFile(w, r, thumbPath)
+}
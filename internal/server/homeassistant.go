@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"photog/internal/thumbnail"
+)
+
+// haSensor is the sensor-style payload for Home Assistant's RESTful sensor.
+// "state" is the headline value; everything else is exposed as attributes.
+type haSensor struct {
+	State       int          `json:"state"`
+	TotalPhotos int          `json:"total_photos"`
+	TotalVideos int          `json:"total_videos"`
+	TotalSize   int64        `json:"total_size"`
+	OldestDate  string       `json:"oldest_date"`
+	NewestDate  string       `json:"newest_date"`
+	Indexing    bool         `json:"indexing"`
+	LastAdded   *haLastPhoto `json:"last_added,omitempty"`
+}
+
+type haLastPhoto struct {
+	ID        int64  `json:"id"`
+	Filename  string `json:"filename"`
+	Type      string `json:"type"`
+	TakenAt   string `json:"taken_at"`
+	IndexedAt string `json:"indexed_at"`
+	ThumbURL  string `json:"thumb_url"`
+}
+
+// handleHASensor returns library stats and the last-added photo in a shape
+// that maps directly onto a Home Assistant RESTful sensor
+// (value_template: "{{ value_json.state }}", json_attributes: [...]).
+func (s *Server) handleHASensor(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.db.GetStats()
+	if err != nil {
+		jsonError(w, "Failed to fetch stats", http.StatusInternalServerError)
+		return
+	}
+
+	sensor := haSensor{
+		State:       stats.TotalPhotos + stats.TotalVideos,
+		TotalPhotos: stats.TotalPhotos,
+		TotalVideos: stats.TotalVideos,
+		TotalSize:   stats.TotalSize,
+		OldestDate:  stats.OldestDate,
+		NewestDate:  stats.NewestDate,
+		Indexing:    s.indexer.IsRunning(),
+	}
+
+	if p, err := s.db.GetLatestPhoto(); err == nil {
+		sensor.LastAdded = &haLastPhoto{
+			ID:        p.ID,
+			Filename:  p.Filename,
+			Type:      p.MediaType,
+			TakenAt:   p.TakenAt.Format(time.RFC3339),
+			IndexedAt: p.IndexedAt.Format(time.RFC3339),
+			ThumbURL:  fmt.Sprintf("/api/thumb/%d/md", p.ID),
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	jsonResponse(w, sensor)
+}
+
+// handleHACamera serves a rotating still image for a Home Assistant generic
+// camera (still_image_url). HA polls every few seconds, so the image only
+// changes once per ?interval= seconds (default 60) rather than per request.
+func (s *Server) handleHACamera(w http.ResponseWriter, r *http.Request) {
+	interval, err := strconv.Atoi(r.URL.Query().Get("interval"))
+	if err != nil || interval < 5 {
+		interval = 60
+	}
+
+	ids, err := s.db.GetImageIDs(time.Time{}, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC), r.URL.Query().Get("orientation"))
+	if err != nil {
+		http.Error(w, "Failed to fetch photos", http.StatusInternalServerError)
+		return
+	}
+	if len(ids) == 0 {
+		http.Error(w, "No photos available", http.StatusNotFound)
+		return
+	}
+
+	slot := time.Now().Unix() / int64(interval)
+	h := fnv.New64a()
+	h.Write([]byte(strconv.FormatInt(slot, 10)))
+	id := ids[h.Sum64()%uint64(len(ids))]
+
+	photo, err := s.db.GetPhoto(id)
+	if err != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+
+	// Home Assistant fetches with no image types in Accept, and JPEG is what
+	// it can always show; clients that list theirs get the usual choice
+	f := thumbnail.JPEG
+	if len(acceptedImageTypes(r.Header.Get("Accept"))) > 0 {
+		f = s.thumbFormat(r)
+	}
+	thumbPath, err := s.thumbs.GetOrCreateFormat(photo.Path, thumbnail.Medium, f)
+	if err != nil {
+		log.Printf("HA camera: thumbnail error for %s: %v", photo.Path, err)
+		http.Error(w, "Failed to generate image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Content-Type", f.ContentType())
+	http.ServeFile(w, r, thumbPath)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"photog/internal/jobs"
+)
+
+// handleJobs lists recent background jobs, newest first, with live progress
+// for running ones. GET /api/jobs?limit=
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	list, err := s.jobs.Jobs(limit)
+	if err != nil {
+		jsonError(w, "Failed to fetch jobs", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{"jobs": list})
+}
+
+// handleJob inspects (GET) or cancels (DELETE) a job. /api/jobs/{id}
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), 10, 64)
+	if err != nil {
+		jsonError(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		job, err := s.jobs.Job(id)
+		if err == sql.ErrNoRows {
+			jsonError(w, "Job not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			jsonError(w, "Failed to fetch job", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, job)
+
+	case http.MethodDelete:
+		job, err := s.jobs.Cancel(id)
+		switch err {
+		case nil:
+			jsonResponse(w, job)
+		case sql.ErrNoRows:
+			jsonError(w, "Job not found", http.StatusNotFound)
+		case jobs.ErrFinished:
+			jsonError(w, "Job already finished", http.StatusConflict)
+		default:
+			jsonError(w, "Failed to cancel job", http.StatusInternalServerError)
+		}
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
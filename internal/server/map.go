@@ -0,0 +1,121 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"photog/internal/database"
+)
+
+// clustersPerTile is how many clusters fit across one 256px map tile, so
+// clusters are roughly 64px apart on screen at any zoom.
+const clustersPerTile = 4
+
+// maxMapZoom is the deepest zoom level clustered; beyond it photos taken at
+// the same spot stay grouped.
+const maxMapZoom = 20
+
+// handleMap returns located photos grouped into clusters for a map view.
+// GET /api/map?north=52.6&south=52.3&east=5.1&west=4.7&zoom=11
+// The bounding box defaults to the whole world and zoom to 2.
+func (s *Server) handleMap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	b := database.MapBounds{North: 90, South: -90, East: 180, West: -180}
+	for _, p := range []struct {
+		name     string
+		dst      *float64
+		min, max float64
+	}{
+		{"north", &b.North, -90, 90},
+		{"south", &b.South, -90, 90},
+		{"east", &b.East, -180, 180},
+		{"west", &b.West, -180, 180},
+	} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || f < p.min || f > p.max {
+			jsonError(w, "Invalid "+p.name, http.StatusBadRequest)
+			return
+		}
+		*p.dst = f
+	}
+	if b.South > b.North {
+		jsonError(w, "south must not be above north", http.StatusBadRequest)
+		return
+	}
+
+	zoom := 2
+	if v := q.Get("zoom"); v != "" {
+		z, err := strconv.Atoi(v)
+		if err != nil || z < 0 {
+			jsonError(w, "Invalid zoom", http.StatusBadRequest)
+			return
+		}
+		zoom = min(z, maxMapZoom)
+	}
+	cell := 360 / math.Exp2(float64(zoom)) / clustersPerTile
+
+	clusters, err := s.db.GetMapClusters(b, cell)
+	if err != nil {
+		jsonError(w, "Failed to fetch map clusters", http.StatusInternalServerError)
+		return
+	}
+	total := 0
+	for _, c := range clusters {
+		total += c.Count
+	}
+	jsonResponse(w, map[string]interface{}{
+		"clusters": clusters,
+		"total":    total,
+		"zoom":     zoom,
+	})
+}
+
+// handlePlaces returns every place name with its photo count.
+func (s *Server) handlePlaces(w http.ResponseWriter, r *http.Request) {
+	places, err := s.db.GetPlaceCounts(owner(r))
+	if err != nil {
+		jsonError(w, "Failed to fetch places", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, places)
+}
+
+// handlePlacePhotos returns a page of photos taken at a place.
+// GET /api/places/photos?place=Lyon,%20France&offset=0&limit=100
+func (s *Server) handlePlacePhotos(w http.ResponseWriter, r *http.Request) {
+	place := r.URL.Query().Get("place")
+	if place == "" {
+		jsonError(w, "Missing place", http.StatusBadRequest)
+		return
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	photos, total, err := s.db.GetPhotosByPlace(place, offset, limit, owner(r))
+	if err != nil {
+		jsonError(w, "Failed to fetch photos", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"place":    place,
+		"photos":   photos,
+		"total":    total,
+		"has_more": offset+len(photos) < total,
+	})
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// uploadQuality is the JPEG quality uploads are re-encoded at when their
+// pixels are rotated.
+const uploadQuality = 95
+
+// EXIF tags patched when rotating a JPEG.
+const (
+	tagOrientation = 0x0112
+	tagExifIFD     = 0x8769
+	tagPixelX      = 0xA002
+	tagPixelY      = 0xA003
+)
+
+// mp4Brands are ISO base media brands of files that play as MP4.
+var mp4Brands = []string{"isom", "iso2", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "M4V ", "M4VP", "mmp4", "dash", "3gp4", "3gp5", "3gp6", "3g2a"}
+
+// heifBrands are ISO base media brands of HEIF images.
+var heifBrands = []string{"heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"}
+
+// normalizeName returns name with its extension replaced when the file's
+// content shows it to be of another type, such as a PNG saved as .jpg. Names
+// whose extension fits, or whose content isn't recognized, are kept.
+func normalizeName(path, name string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return name
+	}
+	head := make([]byte, 64)
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+
+	exts := sniffExts(head[:n])
+	if len(exts) == 0 {
+		return name
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range exts {
+		if ext == e {
+			return name
+		}
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + exts[0]
+}
+
+// sniffExts returns the extensions that fit a file starting with head,
+// preferred first, or nil if its type isn't recognized.
+func sniffExts(head []byte) []string {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return []string{".jpg", ".jpeg"}
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return []string{".png"}
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return []string{".gif"}
+	case bytes.HasPrefix(head, []byte("BM")):
+		return []string{".bmp"}
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		// RAW formats are TIFF-based too
+		return []string{".tif", ".tiff", ".dng", ".nef", ".arw", ".cr2"}
+	case bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return []string{".mkv", ".webm"}
+	case bytes.HasPrefix(head, []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11}):
+		return []string{".wmv"}
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return []string{".webp"}
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "AVI ":
+		return []string{".avi"}
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return ftypExts(head)
+	}
+	return nil
+}
+
+// ftypExts returns the extensions that fit an ISO base media file (MP4,
+// QuickTime, HEIF) by the brands in its ftyp box.
+func ftypExts(head []byte) []string {
+	size := int(binary.BigEndian.Uint32(head))
+	if size > len(head) {
+		size = len(head)
+	}
+	brands := []string{string(head[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(head[i:i+4]))
+	}
+	has := func(list ...string) bool {
+		for _, b := range brands {
+			for _, l := range list {
+				if b == l {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	switch {
+	case has("avif", "avis"):
+		return []string{".avif"}
+	case has(heifBrands...):
+		return []string{".heic", ".heif"}
+	case brands[0] == "qt  ":
+		return []string{".mov"}
+	case has(mp4Brands...):
+		return []string{".mp4", ".m4v", ".mov", ".3gp"}
+	}
+	return nil
+}
+
+// rotateJPEG rewrites a JPEG whose EXIF orientation isn't upright with its
+// pixels turned to match, and reports whether it did. Its metadata is kept,
+// with the orientation reset to 1, the EXIF dimensions updated and the
+// embedded thumbnail, which would still be sideways, dropped.
+func rotateJPEG(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return false, nil
+	}
+	segments, err := jpegMetadata(data)
+	if err != nil {
+		return false, err
+	}
+	var tiff []byte
+	for _, seg := range segments {
+		if seg[1] == 0xE1 && bytes.HasPrefix(seg[4:], []byte("Exif\x00\x00")) {
+			tiff = seg[10:]
+			break
+		}
+	}
+	if o := exifOrientation(tiff); o <= 1 || o > 8 {
+		return false, nil
+	}
+
+	img, err := imaging.Decode(bytes.NewReader(data), imaging.AutoOrientation(true))
+	if err != nil {
+		return false, fmt.Errorf("decode: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: uploadQuality}); err != nil {
+		return false, fmt.Errorf("encode: %w", err)
+	}
+	patchExif(tiff, img.Bounds().Dx(), img.Bounds().Dy())
+
+	// The encoder writes no metadata, so the original segments go right
+	// after its start-of-image marker
+	encoded := buf.Bytes()
+	out := append([]byte{}, encoded[:2]...)
+	for _, seg := range segments {
+		out = append(out, seg...)
+	}
+	out = append(out, encoded[2:]...)
+	if err := os.WriteFile(path+".rotated", out, 0644); err != nil {
+		os.Remove(path + ".rotated")
+		return false, err
+	}
+	if err := os.Rename(path+".rotated", path); err != nil {
+		os.Remove(path + ".rotated")
+		return false, err
+	}
+	return true, nil
+}
+
+// jpegMetadata returns the APPn and comment segments of a JPEG, markers
+// included, except those that would be wrong for a re-encoded image: Adobe
+// color transforms and multi-picture indexes, whose offsets would no
+// longer match. The returned slices alias data.
+func jpegMetadata(data []byte) ([][]byte, error) {
+	var segments [][]byte
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil, errors.New("malformed JPEG")
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return nil, errors.New("malformed JPEG")
+		}
+		seg := data[i : i+2+n]
+		i += 2 + n
+		if (marker < 0xE0 || marker > 0xEF || marker == 0xEE) && marker != 0xFE {
+			continue
+		}
+		if marker == 0xE2 && bytes.HasPrefix(seg[4:], []byte("MPF\x00")) {
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	return segments, nil
+}
+
+// tiffOrder returns the byte order of a TIFF block, or nil if it isn't one.
+func tiffOrder(tiff []byte) binary.ByteOrder {
+	if len(tiff) < 8 {
+		return nil
+	}
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		return binary.LittleEndian
+	case "MM\x00*":
+		return binary.BigEndian
+	}
+	return nil
+}
+
+// ifdEntries returns the offsets of the 12-byte entries of the IFD at off,
+// and of the 4-byte link to the next IFD after them, or -1 for that if the
+// IFD is truncated.
+func ifdEntries(tiff []byte, order binary.ByteOrder, off int) ([]int, int) {
+	if off < 8 || off+2 > len(tiff) {
+		return nil, -1
+	}
+	count := int(order.Uint16(tiff[off:]))
+	var entries []int
+	for i := 0; i < count; i++ {
+		e := off + 2 + 12*i
+		if e+12 > len(tiff) {
+			return entries, -1
+		}
+		entries = append(entries, e)
+	}
+	next := off + 2 + 12*count
+	if next+4 > len(tiff) {
+		return entries, -1
+	}
+	return entries, next
+}
+
+// exifOrientation returns the orientation tag of an EXIF TIFF block, or 0.
+func exifOrientation(tiff []byte) int {
+	order := tiffOrder(tiff)
+	if order == nil {
+		return 0
+	}
+	entries, _ := ifdEntries(tiff, order, int(order.Uint32(tiff[4:])))
+	for _, e := range entries {
+		if order.Uint16(tiff[e:]) == tagOrientation && order.Uint16(tiff[e+2:]) == 3 {
+			return int(order.Uint16(tiff[e+8:]))
+		}
+	}
+	return 0
+}
+
+// patchExif resets the orientation of an EXIF TIFF block in place, sets its
+// pixel dimensions and unlinks its thumbnail IFD.
+func patchExif(tiff []byte, width, height int) {
+	order := tiffOrder(tiff)
+	if order == nil {
+		return
+	}
+	entries, next := ifdEntries(tiff, order, int(order.Uint32(tiff[4:])))
+	if next >= 0 {
+		order.PutUint32(tiff[next:], 0)
+	}
+	for _, e := range entries {
+		switch order.Uint16(tiff[e:]) {
+		case tagOrientation:
+			setIFDValue(tiff, order, e, 1)
+		case tagExifIFD:
+			sub, _ := ifdEntries(tiff, order, int(order.Uint32(tiff[e+8:])))
+			for _, s := range sub {
+				switch order.Uint16(tiff[s:]) {
+				case tagPixelX:
+					setIFDValue(tiff, order, s, width)
+				case tagPixelY:
+					setIFDValue(tiff, order, s, height)
+				}
+			}
+		}
+	}
+}
+
+// setIFDValue sets the single SHORT or LONG value of an IFD entry.
+func setIFDValue(tiff []byte, order binary.ByteOrder, e, v int) {
+	switch order.Uint16(tiff[e+2:]) {
+	case 3:
+		order.PutUint16(tiff[e+8:], uint16(v))
+	case 4:
+		order.PutUint32(tiff[e+8:], uint32(v))
+	}
+}
+
+// needsDate reports whether the indexer would find no capture date in an
+// image. HEIF files keep theirs in a form it can't read, so they're left
+// alone rather than given a wrong date that would override it.
+func needsDate(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".heic", ".heif", ".avif":
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	x, err := exif.Decode(f)
+	if err != nil {
+		return true
+	}
+	_, err = x.DateTime()
+	return err != nil
+}
+
+// writeDateSidecar records t as the capture date of the file at path in an
+// XMP sidecar next to it, unless one already exists.
+func writeDateSidecar(path string, t time.Time) error {
+	f, err := os.OpenFile(path+".xmp", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:exif="http://ns.adobe.com/exif/1.0/" exif:DateTimeOriginal="%s"/>
+ </rdf:RDF>
+</x:xmpmeta>
+`, t.Format(time.RFC3339))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
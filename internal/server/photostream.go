@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// photoStreamPage is how many photos are read from the database at a time
+// while streaming.
+const photoStreamPage = 1000
+
+// handlePhotoStream streams every photo visible to the user as
+// newline-delimited JSON, one photo per line in ID order, for export tools.
+// Photos are read a page at a time and written as fast as the client reads
+// them, so memory use stays flat however big the library. A client that
+// was cut off can resume after the last ID it got.
+// GET /api/photos/stream?after=0
+func (s *Server) handlePhotoStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var after int64
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil || after < 0 {
+			jsonError(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	o := owner(r)
+	for {
+		if r.Context().Err() != nil {
+			return
+		}
+		photos, err := s.db.GetPhotosAfter(o, after, photoStreamPage)
+		if err != nil {
+			// Headers may be sent, so the stream can only be cut short
+			log.Printf("Photo stream: %v", err)
+			if after == 0 {
+				jsonError(w, "Failed to fetch photos", http.StatusInternalServerError)
+			}
+			return
+		}
+		for _, p := range photos {
+			if err := enc.Encode(p); err != nil {
+				return
+			}
+		}
+		if len(photos) < photoStreamPage {
+			return
+		}
+		after = photos[len(photos)-1].ID
+		rc.Flush()
+	}
+}
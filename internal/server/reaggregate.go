@@ -0,0 +1,93 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"photog/internal/database"
+	"photog/internal/events"
+	"photog/internal/folderalbums"
+)
+
+// aggregateStep reports one part of a reaggregate run.
+type aggregateStep struct {
+	Name   string `json:"name"`
+	Rows   int64  `json:"rows"`
+	TookMS int64  `json:"took_ms"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleReaggregate rebuilds data derived from the photos table, for use
+// after bulk edits or direct database changes: detected events, folder
+// albums, rule tags, album covers pointing at deleted photos and the query
+// planner's statistics. Month buckets and library stats are computed per
+// request, so they are only recomputed here to report their size and cost.
+// POST /api/admin/reaggregate
+func (s *Server) handleReaggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.indexer.IsRunning() {
+		jsonError(w, "A scan is running; try again when it finishes", http.StatusConflict)
+		return
+	}
+
+	start := time.Now()
+	var steps []*aggregateStep
+	failed := false
+	run := func(name string, fn func() (int64, error)) {
+		stepStart := time.Now()
+		rows, err := fn()
+		step := &aggregateStep{Name: name, Rows: rows, TookMS: time.Since(stepStart).Milliseconds()}
+		if err != nil {
+			log.Printf("Reaggregate: %s: %v", name, err)
+			step.Error = err.Error()
+			failed = true
+		}
+		steps = append(steps, step)
+	}
+
+	run("events", func() (int64, error) {
+		n, err := events.Rebuild(s.db, s.cfg.Events)
+		return int64(n), err
+	})
+	run("folder_albums", func() (int64, error) {
+		n, err := folderalbums.Sync(s.db, s.cfg.Albums)
+		return int64(n), err
+	})
+	run("rule_tags", func() (int64, error) {
+		n, err := s.indexer.RetagAll()
+		return int64(n), err
+	})
+	run("album_covers", s.db.ResetDanglingCovers)
+	run("analyze", func() (int64, error) {
+		return 0, s.db.Analyze()
+	})
+	run("month_buckets", func() (int64, error) {
+		buckets, err := s.db.GetMonthBuckets(time.Local, database.TimelineFilter{})
+		return int64(len(buckets)), err
+	})
+	run("stats", func() (int64, error) {
+		stats, err := s.db.GetStats()
+		if err != nil {
+			return 0, err
+		}
+		return int64(stats.TotalPhotos + stats.TotalVideos), nil
+	})
+
+	took := time.Since(start)
+	log.Printf("Reaggregate: finished in %v", took.Round(time.Millisecond))
+	status := "ok"
+	if failed {
+		status = "failed"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	jsonResponse(w, map[string]interface{}{
+		"status":  status,
+		"took_ms": took.Milliseconds(),
+		"steps":   steps,
+	})
+}
@@ -0,0 +1,372 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"photog/internal/models"
+)
+
+const (
+	// selectionIdle is how long a selection is kept after its last use.
+	selectionIdle = 24 * time.Hour
+	// maxSelections caps the selections held at once, across all sessions.
+	maxSelections = 1000
+	// maxSelectionSize caps the photos in one selection.
+	maxSelectionSize = 100000
+)
+
+// selection is a set of photo IDs belonging to one login session.
+type selection struct {
+	session string
+	ids     []int64
+	in      map[int64]bool
+	created time.Time
+	used    time.Time
+}
+
+// info describes sel for responses, with a copy of its IDs if withIDs.
+func (sel *selection) info(withIDs bool) *models.Selection {
+	info := &models.Selection{Count: len(sel.ids), CreatedAt: sel.created, UpdatedAt: sel.used}
+	if withIDs {
+		info.IDs = append(make([]int64, 0, len(sel.ids)), sel.ids...)
+	}
+	return info
+}
+
+// add appends the IDs not already in sel, up to maxSelectionSize, and
+// returns how many were added.
+func (sel *selection) add(ids []int64) int {
+	n := 0
+	for _, id := range ids {
+		if sel.in[id] || len(sel.ids) >= maxSelectionSize {
+			continue
+		}
+		sel.in[id] = true
+		sel.ids = append(sel.ids, id)
+		n++
+	}
+	return n
+}
+
+// drop removes ids from sel and returns how many were in it.
+func (sel *selection) drop(ids []int64) int {
+	n := 0
+	for _, id := range ids {
+		if sel.in[id] {
+			delete(sel.in, id)
+			n++
+		}
+	}
+	if n > 0 {
+		kept := sel.ids[:0]
+		for _, id := range sel.ids {
+			if sel.in[id] {
+				kept = append(kept, id)
+			}
+		}
+		sel.ids = kept
+	}
+	return n
+}
+
+// selectionStore holds selections in memory. They are scoped to the
+// session that made them and dropped after selectionIdle unused, or with
+// the server.
+type selectionStore struct {
+	mu    sync.Mutex
+	items map[string]*selection
+}
+
+// create stores a new empty selection for session and returns its ID, or
+// "" when the store is full.
+func (st *selectionStore) create(session string, now time.Time) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.items == nil {
+		st.items = make(map[string]*selection)
+	}
+	for id, sel := range st.items {
+		if now.Sub(sel.used) >= selectionIdle {
+			delete(st.items, id)
+		}
+	}
+	if len(st.items) >= maxSelections {
+		return ""
+	}
+	id := randomToken(16)
+	st.items[id] = &selection{session: session, in: make(map[int64]bool), created: now, used: now}
+	return id
+}
+
+// with calls fn with session's selection id, under the store's lock, and
+// reports whether there is one.
+func (st *selectionStore) with(session, id string, now time.Time, fn func(sel *selection)) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sel := st.items[id]
+	if sel == nil || sel.session != session || now.Sub(sel.used) >= selectionIdle {
+		return false
+	}
+	sel.used = now
+	fn(sel)
+	return true
+}
+
+// list returns session's selections, without their IDs.
+func (st *selectionStore) list(session string, now time.Time) []*models.Selection {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	out := make([]*models.Selection, 0)
+	for id, sel := range st.items {
+		if sel.session == session && now.Sub(sel.used) < selectionIdle {
+			info := sel.info(false)
+			info.ID = id
+			out = append(out, info)
+		}
+	}
+	return out
+}
+
+// remove deletes session's selection id and reports whether it existed.
+func (st *selectionStore) remove(session, id string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sel := st.items[id]
+	if sel == nil || sel.session != session {
+		return false
+	}
+	delete(st.items, id)
+	return true
+}
+
+// selectionSession returns the session a request's selections belong to:
+// its login session, or "" with auth disabled.
+func selectionSession(r *http.Request) string {
+	if currentUser(r) == nil {
+		return ""
+	}
+	return hashToken(sessionToken(r))
+}
+
+// readSelectionIDs decodes {"ids": [...]} and keeps the photos the user
+// may see.
+func (s *Server) readSelectionIDs(w http.ResponseWriter, r *http.Request) ([]int64, bool) {
+	var req struct {
+		IDs []int64 `json:"ids"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8<<20)).Decode(&req); err != nil && err != io.EOF {
+		jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+		return nil, false
+	}
+	if len(req.IDs) > maxSelectionSize {
+		jsonError(w, fmt.Sprintf("At most %d photos per selection", maxSelectionSize), http.StatusBadRequest)
+		return nil, false
+	}
+	ids, err := s.db.VisiblePhotoIDs(req.IDs, owner(r))
+	if err != nil {
+		jsonError(w, "Failed to check photos", http.StatusInternalServerError)
+		return nil, false
+	}
+	return ids, true
+}
+
+// handleSelections lists the session's selections (GET) or creates one
+// (POST {"ids": [...]}, ids optional). IDs of photos that don't exist or
+// that the user can't see are left out.
+// /api/selections
+func (s *Server) handleSelections(w http.ResponseWriter, r *http.Request) {
+	session := selectionSession(r)
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, map[string]interface{}{"selections": s.selections.list(session, time.Now())})
+
+	case http.MethodPost:
+		ids, ok := s.readSelectionIDs(w, r)
+		if !ok {
+			return
+		}
+		now := time.Now()
+		id := s.selections.create(session, now)
+		if id == "" {
+			jsonError(w, "Too many selections, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		var info *models.Selection
+		s.selections.with(session, id, now, func(sel *selection) {
+			sel.add(ids)
+			info = sel.info(false)
+		})
+		info.ID = id
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSelection works on one of the session's selections.
+// GET /api/selections/{id} - the selection with its photo IDs
+// DELETE /api/selections/{id}
+// POST|DELETE /api/selections/{id}/ids {"ids": [...]} - add or remove photos
+// POST /api/selections/{id}/album {"album_id": 1} or {"title": "..."} - add
+// the photos to an album, or to a new one (admins only)
+// GET /api/selections/{id}/zip - download the originals as a zip
+func (s *Server) handleSelection(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/selections/"), "/", 2)
+	id := parts[0]
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	session := selectionSession(r)
+
+	// Copy what's needed out of the selection, so the lock isn't held
+	// through database work or a download
+	var info *models.Selection
+	if !s.selections.with(session, id, time.Now(), func(sel *selection) { info = sel.info(true) }) {
+		jsonError(w, "Selection not found", http.StatusNotFound)
+		return
+	}
+	info.ID = id
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		jsonResponse(w, info)
+	case action == "" && r.Method == http.MethodDelete:
+		s.selections.remove(session, id)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "ids" && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		s.updateSelection(w, r, session, id)
+	case action == "album" && r.Method == http.MethodPost:
+		s.selectionToAlbum(w, r, info)
+	case action == "zip" && r.Method == http.MethodGet:
+		// Photos deleted since they were selected are left out
+		s.serveZip(w, r, info.IDs, "photos.zip")
+	case action == "" || action == "ids" || action == "album" || action == "zip":
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		jsonError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// updateSelection adds (POST) or removes (DELETE) photos and responds with
+// how many changed and the new count.
+func (s *Server) updateSelection(w http.ResponseWriter, r *http.Request, session, id string) {
+	var ids []int64
+	if r.Method == http.MethodPost {
+		var ok bool
+		if ids, ok = s.readSelectionIDs(w, r); !ok {
+			return
+		}
+	} else {
+		var req struct {
+			IDs []int64 `json:"ids"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 8<<20)).Decode(&req); err != nil {
+			jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		ids = req.IDs
+	}
+
+	key := "added"
+	var n, count int
+	found := s.selections.with(session, id, time.Now(), func(sel *selection) {
+		if r.Method == http.MethodPost {
+			n = sel.add(ids)
+		} else {
+			key = "removed"
+			n = sel.drop(ids)
+		}
+		count = len(sel.ids)
+	})
+	if !found {
+		jsonError(w, "Selection not found", http.StatusNotFound)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{key: n, "count": count})
+}
+
+// selectionToAlbum adds a selection's photos to an existing album, or to a
+// new one when no album_id is given. As with /api/albums, only admins
+// create albums, and other accounts need to contribute to the album.
+func (s *Server) selectionToAlbum(w http.ResponseWriter, r *http.Request, info *models.Selection) {
+	var req struct {
+		AlbumID     int64  `json:"album_id"`
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	if req.AlbumID == 0 && owner(r) != 0 {
+		jsonError(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+	if req.AlbumID != 0 {
+		role, err := s.albumRole(r, req.AlbumID)
+		if err != nil {
+			jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+			return
+		}
+		if role == "" {
+			jsonError(w, "Album not found", http.StatusNotFound)
+			return
+		}
+		if role != "admin" && role != "contribute" {
+			jsonError(w, "Not allowed to change this album", http.StatusForbidden)
+			return
+		}
+	}
+	if req.AlbumID == 0 {
+		a := &models.Album{
+			Title:       strings.TrimSpace(req.Title),
+			Description: strings.TrimSpace(req.Description),
+		}
+		if msg := validateAlbum(a.Title, a.Description); msg != "" {
+			jsonError(w, msg, http.StatusBadRequest)
+			return
+		}
+		if err := s.db.CreateAlbum(a); err != nil {
+			jsonError(w, "Failed to create album", http.StatusInternalServerError)
+			return
+		}
+		req.AlbumID = a.ID
+		status = http.StatusCreated
+	} else if album, err := s.db.GetAlbum(req.AlbumID); err == sql.ErrNoRows {
+		jsonError(w, "Album not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+		return
+	} else if album.Folder != "" {
+		jsonError(w, folderAlbumMessage, http.StatusConflict)
+		return
+	}
+
+	n, err := s.db.AddAlbumPhotos(req.AlbumID, info.IDs, userID(r))
+	if err != nil {
+		jsonError(w, "Failed to update album photos", http.StatusInternalServerError)
+		return
+	}
+	album, err := s.db.GetAlbum(req.AlbumID)
+	if err != nil {
+		jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"added": n, "album": album})
+}
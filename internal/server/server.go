@@ -1,21 +1,30 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"photog/internal/archive"
 	"photog/internal/config"
 	"photog/internal/database"
 	"photog/internal/indexer"
+	"photog/internal/jobs"
+	"photog/internal/models"
 	"photog/internal/thumbnail"
+	"photog/internal/transcode"
+	"photog/internal/trash"
+	"photog/internal/weather"
 )
 
 // Server is the main HTTP server.
@@ -24,51 +33,180 @@ type Server struct {
 	db      *database.DB
 	indexer *indexer.Indexer
 	thumbs  *thumbnail.Generator
+	jobs    *jobs.Queue
 	mux     *http.ServeMux
+	httpSrv *http.Server
+
+	// kiosk frame shuffle state, keyed by filter
+	frameMu    sync.Mutex
+	frameDecks map[string]*frameDeck
+
+	// WebDAV upload accounts, keyed by username
+	davUsers map[string]*davUser
+
+	// resumable uploads with a request in progress, by upload ID
+	uploadMu    sync.Mutex
+	uploadsBusy map[string]bool
+
+	// perceptual hash index for /api/similar
+	similar similarIndex
+
+	// limits on-demand thumbnail generation
+	thumbQueue *thumbQueue
+
+	// video transcoding for /api/media/{id}/stream (see SetTranscoder)
+	transcoder *transcode.Transcoder
+
+	// deleted files, for DELETE /api/photo/{id} (see SetTrash)
+	trash *trash.Trash
+
+	// recent views, so repeats aren't counted twice
+	views viewTracker
+
+	// photo sets for bulk actions, by selection ID
+	selections selectionStore
+
+	// frontend dev server proxy (see SetDevProxy)
+	devProxy http.Handler
+
+	// OnComment, if set, is called after a comment is added to a photo.
+	OnComment func(photo *models.Photo, c *models.Comment)
 }
 
 // New creates a new Server.
-func New(cfg *config.Config, db *database.DB, idx *indexer.Indexer, thumbs *thumbnail.Generator) *Server {
+func New(cfg *config.Config, db *database.DB, idx *indexer.Indexer, thumbs *thumbnail.Generator, queue *jobs.Queue) *Server {
 	s := &Server{
 		cfg:     cfg,
 		db:      db,
 		indexer: idx,
 		thumbs:  thumbs,
+		jobs:    queue,
 		mux:     http.NewServeMux(),
+
+		frameDecks: make(map[string]*frameDeck),
+		thumbQueue: newThumbQueue(cfg.Thumbnail.MaxPending, time.Duration(cfg.Thumbnail.QueueWait)*time.Second),
 	}
 	s.routes()
+	var handler http.Handler = s.mux
+	if cfg.Auth.Enabled {
+		handler = s.authMiddleware(handler)
+	}
+	s.httpSrv = &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port),
+		Handler: s.corsMiddleware(handler),
+	}
 	return s
 }
 
 func (s *Server) routes() {
 	// API routes
+	s.mux.HandleFunc("/api/auth/login", s.handleLogin)
+	s.mux.HandleFunc("/api/auth/logout", s.handleLogout)
+	s.mux.HandleFunc("/api/auth/me", s.handleMe)
 	s.mux.HandleFunc("/api/timeline/months", s.handleTimelineMonths)
+	s.mux.HandleFunc("/api/timeline/layout", s.handleTimelineLayout)
+	s.mux.HandleFunc("/api/timeline/ids", s.handleTimelineIDs)
 	s.mux.HandleFunc("/api/timeline", s.handleTimeline)
 	s.mux.HandleFunc("/api/memories", s.handleMemories)
+	s.mux.HandleFunc("/api/changes", s.handleChanges)
+	s.mux.HandleFunc("/api/new", s.handleNew)
+	s.mux.HandleFunc("/api/recent", s.handleRecent)
 	s.mux.HandleFunc("/api/photo/", s.handlePhoto)
+	s.mux.HandleFunc("/api/photos/stream", s.handlePhotoStream)
+	s.mux.HandleFunc("/api/comments/", s.handleCommentDelete)
 	s.mux.HandleFunc("/api/thumb/", s.handleThumb)
 	s.mux.HandleFunc("/api/media/", s.handleMedia)
+	s.mux.HandleFunc("/api/c/", s.handleContent)
+	s.mux.HandleFunc("/api/convert/", s.handleConvert)
+	s.mux.HandleFunc("/api/settings", s.handleSettings)
 	s.mux.HandleFunc("/api/stats", s.handleStats)
+	s.mux.HandleFunc("/api/stats/popular", s.handlePopular)
+	s.mux.HandleFunc("/api/collage", s.handleCollage)
+	s.mux.HandleFunc("/api/admin/audit", s.handleAudit)
+	s.mux.HandleFunc("/api/admin/reaggregate", s.handleReaggregate)
+	s.mux.HandleFunc("/api/admin/thumbs/slowest", s.handleThumbsSlowest)
+	s.mux.HandleFunc("/api/admin/cache/gc", s.handleCacheGC)
+	s.mux.HandleFunc("/api/admin/videos/compatibility", s.handleVideoCompatibility)
+	s.mux.HandleFunc("/api/folders", s.handleFolders)
+	s.mux.HandleFunc("/api/folders/photos", s.handleFolderPhotos)
+	s.mux.HandleFunc("/api/tags", s.handleTags)
+	s.mux.HandleFunc("/api/events", s.handleEvents)
+	s.mux.HandleFunc("/api/events/", s.handleEvent)
+	s.mux.HandleFunc("/api/tags/photos", s.handleTagPhotos)
+	s.mux.HandleFunc("/api/cameras", s.handleCameras)
+	s.mux.HandleFunc("/api/map", s.handleMap)
+	s.mux.HandleFunc("/api/places", s.handlePlaces)
+	s.mux.HandleFunc("/api/places/photos", s.handlePlacePhotos)
+	s.mux.HandleFunc("/api/search", s.handleSearch)
+	s.mux.HandleFunc("/api/upload", s.handleUpload)
+	s.mux.HandleFunc("/api/batch/metadata", s.handleBatchMetadata)
+	s.mux.HandleFunc("/api/selections", s.handleSelections)
+	s.mux.HandleFunc("/api/selections/", s.handleSelection)
+	s.mux.HandleFunc("/api/download", s.handleDownload)
+	s.mux.HandleFunc("/api/trash", s.handleTrash)
+	s.mux.HandleFunc("/api/trash/", s.handleTrashItem)
+	s.mux.HandleFunc("/api/duplicates", s.handleDuplicates)
+	s.mux.HandleFunc("/api/duplicates/scan", s.handleDuplicatesScan)
+	s.mux.HandleFunc("/api/similar/", s.handleSimilar)
+	s.mux.HandleFunc("/api/upload/", s.handleUploadResume)
+	s.mux.HandleFunc("/api/albums", s.handleAlbums)
+	s.mux.HandleFunc("/api/albums/", s.handleAlbum)
 	s.mux.HandleFunc("/api/index", s.handleIndex)
 	s.mux.HandleFunc("/api/index/progress", s.handleIndexProgress)
+	s.mux.HandleFunc("/api/jobs", s.handleJobs)
+	s.mux.HandleFunc("/api/jobs/", s.handleJob)
+	s.mux.HandleFunc("/api/index/missing", s.handleIndexMissing)
+	s.mux.HandleFunc("/api/index/errors", s.handleIndexErrors)
+	s.mux.HandleFunc("/api/index/errors/retry", s.handleIndexErrorsRetry)
+	s.mux.HandleFunc("/api/index/errors/", s.handleIndexErrorDelete)
 	s.mux.HandleFunc("/api/pregen/progress", s.handlePregenProgress)
+	s.mux.HandleFunc("/api/pregen/warm", s.handlePregenWarm)
+	s.mux.HandleFunc("/api/wallpaper/daily", s.handleWallpaperDaily)
+
+	// Home Assistant integration
+	s.mux.HandleFunc("/api/ha/sensor", s.handleHASensor)
+	s.mux.HandleFunc("/api/ha/camera", s.handleHACamera)
+
+	// Kiosk / digital photo frame (token-scoped)
+	s.mux.HandleFunc("/frame", s.handleFrame)
+	s.mux.HandleFunc("/frame/image", s.handleFrameImage)
+
+	// WebDAV upload target (only registered when configured)
+	s.setupWebDAV()
 
 	// Static file serving (embedded frontend in production)
 	s.mux.HandleFunc("/", s.handleFrontend)
 }
 
-// Start begins listening on the configured address.
+// Start begins listening on the configured address. It returns
+// http.ErrServerClosed once Shutdown is called.
 func (s *Server) Start() error {
-	addr := fmt.Sprintf("%s:%d", s.cfg.Server.Host, s.cfg.Server.Port)
-	log.Printf("Server starting on %s", addr)
-	return http.ListenAndServe(addr, s.corsMiddleware(s.mux))
+	log.Printf("Server starting on %s", s.httpSrv.Addr)
+	return s.httpSrv.ListenAndServe()
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests
+// until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpSrv.Shutdown(ctx)
 }
 
 func (s *Server) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range")
+		// WebDAV clients use OPTIONS for capability discovery; let it through.
+		if strings.HasPrefix(r.URL.Path, davPrefix+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if origin := s.allowedOrigin(r); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if s.cfg.Auth.Enabled {
+			w.Header().Add("Vary", "Origin")
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Range, Authorization, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Upload-Offset, Upload-Length, Upload-Photo-Id")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -77,8 +215,159 @@ func (s *Server) corsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// allowedOrigin returns the Access-Control-Allow-Origin for a request: any
+// origin with auth disabled, and otherwise the request's origin if it is
+// photog's own or one of auth.allowed_origins, or "" for none.
+func (s *Server) allowedOrigin(r *http.Request) string {
+	if !s.cfg.Auth.Enabled {
+		return "*"
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return ""
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return origin
+	}
+	for _, o := range s.cfg.Auth.AllowedOrigins {
+		if strings.TrimSuffix(o, "/") == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// timezone returns the location named by the tz query parameter (an IANA
+// name such as "Europe/Paris"), or the server's local zone if it is absent.
+// Timeline months are computed in it, so they match the viewer's calendar.
+func timezone(r *http.Request) (*time.Location, error) {
+	tz := r.URL.Query().Get("tz")
+	if tz == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(tz)
+}
+
+// validKind reports whether kind is empty or one of database.ImageKinds.
+func validKind(kind string) bool {
+	if kind == "" {
+		return true
+	}
+	for _, k := range database.ImageKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// validWeather reports whether conditions is empty or one of
+// weather.Conditions.
+func validWeather(conditions string) bool {
+	if conditions == "" {
+		return true
+	}
+	for _, c := range weather.Conditions {
+		if c == conditions {
+			return true
+		}
+	}
+	return false
+}
+
+// timelineFilter returns the photos the timeline endpoints show: those
+// visible to the user, narrowed by the query parameters
+//
+//	type         image (including RAW), raw or video
+//	year         e.g. 2024, in loc
+//	month        2024-05, or 5 together with year
+//	favorites    1 or true: only the user's favorites
+//	archived     1 or true: only the photos the user archived, which are
+//	             otherwise left out
+//	path_prefix  a folder; its files and those below it
+//	kind         gif, screenshot, scan, raw or panorama
+//	camera       as listed by /api/cameras
+//
+// or a client error message when one of them is invalid. Of RAW+JPEG
+// pairs, only the file photos.raw_pairs prefers is shown.
+func (s *Server) timelineFilter(r *http.Request, loc *time.Location) (database.TimelineFilter, string) {
+	q := r.URL.Query()
+	f := database.TimelineFilter{
+		Owner:      owner(r),
+		User:       userID(r),
+		Kind:       q.Get("kind"),
+		Camera:     q.Get("camera"),
+		Type:       q.Get("type"),
+		PathPrefix: q.Get("path_prefix"),
+		RawPairs:   s.cfg.Photos.RawPairs,
+	}
+	if !validKind(f.Kind) {
+		return f, "Invalid kind"
+	}
+	switch f.Type {
+	case "", "image", "raw", "video":
+	default:
+		return f, "Invalid type (use image, raw or video)"
+	}
+	if f.PathPrefix != "" && !filepath.IsAbs(f.PathPrefix) {
+		return f, "Invalid path_prefix (use an absolute folder path)"
+	}
+	switch v := q.Get("favorites"); v {
+	case "", "0", "false":
+	case "1", "true":
+		f.Favorites = true
+	default:
+		return f, "Invalid favorites (use true or false)"
+	}
+	switch v := q.Get("archived"); v {
+	case "", "0", "false":
+	case "1", "true":
+		f.Archived = true
+	default:
+		return f, "Invalid archived (use true or false)"
+	}
+
+	year, month := q.Get("year"), q.Get("month")
+	switch {
+	case month != "" && year == "":
+		start, err := time.ParseInLocation("2006-01", month, loc)
+		if err != nil {
+			return f, "Invalid month (use YYYY-MM, or a month number with year)"
+		}
+		f.From, f.To = start, start.AddDate(0, 1, 0)
+	case year != "":
+		y, err := strconv.Atoi(year)
+		if err != nil || y < 1 || y > 9999 {
+			return f, "Invalid year"
+		}
+		f.From = time.Date(y, time.January, 1, 0, 0, 0, 0, loc)
+		f.To = f.From.AddDate(1, 0, 0)
+		if month != "" {
+			m, err := strconv.Atoi(month)
+			if err != nil || m < 1 || m > 12 {
+				return f, "Invalid month (use 1-12 with year)"
+			}
+			f.From = f.From.AddDate(0, m-1, 0)
+			f.To = f.From.AddDate(0, 1, 0)
+		}
+	}
+	return f, ""
+}
+
 // handleTimeline returns paginated timeline data grouped by month.
+// GET /api/timeline?offset=0&limit=100&tz=Europe/Paris, filtered with the
+// parameters of timelineFilter
 func (s *Server) handleTimeline(w http.ResponseWriter, r *http.Request) {
+	loc, err := timezone(r)
+	if err != nil {
+		jsonError(w, "Invalid tz", http.StatusBadRequest)
+		return
+	}
+	filter, msg := s.timelineFilter(r, loc)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
 	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
 	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
 	if limit <= 0 || limit > 500 {
@@ -88,58 +377,295 @@ func (s *Server) handleTimeline(w http.ResponseWriter, r *http.Request) {
 		offset = 0
 	}
 
-	timeline, err := s.db.GetTimeline(offset, limit)
+	timeline, err := s.db.GetTimeline(offset, limit, loc, filter)
 	if err != nil {
 		jsonError(w, "Failed to fetch timeline", http.StatusInternalServerError)
 		return
 	}
+	timeline.ThumbFormat = string(s.thumbs.Format())
 
 	jsonResponse(w, timeline)
 }
 
-// handleMemories returns random photos from the past at 5-year intervals.
+// handleMemories returns "on this day" groups: photos taken around today's
+// date in each past year.
 func (s *Server) handleMemories(w http.ResponseWriter, r *http.Request) {
-	memories, err := s.db.GetMemories(5)
+	mc := s.cfg.Memories
+	groups, err := s.db.GetMemories(time.Now(), database.MemoryOptions{
+		WindowDays:    mc.WindowDays,
+		PerYear:       mc.PerYear,
+		IncludeVideos: mc.IncludeVideos,
+		ExcludeTags:   mc.ExcludeTags,
+		MinSize:       mc.MinSize,
+		Owner:         owner(r),
+	})
 	if err != nil {
 		jsonError(w, "Failed to fetch memories", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Cache-Control", "public, max-age=300") // 5 min cache
-	jsonResponse(w, map[string]interface{}{"photos": memories})
+
+	// photos keeps the older flat shape (one photo per year) for clients
+	// that don't read groups yet
+	photos := make([]*models.Photo, 0, len(groups))
+	for _, g := range groups {
+		photos = append(photos, g.Photos[0])
+	}
+
+	s.cacheControl(w, "max-age=300") // 5 min cache
+	jsonResponse(w, map[string]interface{}{"groups": groups, "photos": photos})
 }
 
 // handleTimelineMonths returns the lightweight month-bucket list for the scrubber.
 func (s *Server) handleTimelineMonths(w http.ResponseWriter, r *http.Request) {
-	buckets, err := s.db.GetMonthBuckets()
+	loc, err := timezone(r)
+	if err != nil {
+		jsonError(w, "Invalid tz", http.StatusBadRequest)
+		return
+	}
+	filter, msg := s.timelineFilter(r, loc)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+	buckets, err := s.db.GetMonthBuckets(loc, filter)
 	if err != nil {
 		jsonError(w, "Failed to fetch month buckets", http.StatusInternalServerError)
 		return
 	}
 	// Cache for 5 minutes — lightweight and doesn't change often
-	w.Header().Set("Cache-Control", "public, max-age=300")
+	s.cacheControl(w, "max-age=300")
 	jsonResponse(w, buckets)
 }
 
-// handlePhoto returns photo metadata by ID.
+// handleTimelineLayout returns the ordered photo IDs and aspect ratios for a
+// month, so the frontend can lay out a whole month in one small request.
+func (s *Server) handleTimelineLayout(w http.ResponseWriter, r *http.Request) {
+	month := r.URL.Query().Get("month")
+	if _, err := time.Parse("2006-01", month); err != nil {
+		jsonError(w, "Invalid month (use YYYY-MM)", http.StatusBadRequest)
+		return
+	}
+	loc, err := timezone(r)
+	if err != nil {
+		jsonError(w, "Invalid tz", http.StatusBadRequest)
+		return
+	}
+	filter, msg := s.timelineFilter(r, loc)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	layout, err := s.db.GetMonthLayout(month, loc, filter)
+	if err != nil {
+		jsonError(w, "Failed to fetch layout", http.StatusInternalServerError)
+		return
+	}
+	s.cacheControl(w, "max-age=300")
+	jsonResponse(w, layout)
+}
+
+// handleChanges returns photos added, updated and removed since a cursor
+// so clients can sync incrementally. since=0 (or omitted) starts from the
+// beginning of the log; clients keep calling with the returned cursor
+// while has_more is true.
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			jsonError(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		since = n
+	}
+
+	limit := 1000
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 5000 {
+			limit = n
+		}
+	}
+
+	changes, err := s.db.GetChanges(since, limit)
+	if err != nil {
+		jsonError(w, "Failed to fetch changes", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, changes)
+}
+
+// handleRecent returns photos imported in the last ?days= days (default 30),
+// grouped by import date. Paged with offset/limit like the timeline.
+func (s *Server) handleRecent(w http.ResponseWriter, r *http.Request) {
+	days, _ := strconv.Atoi(r.URL.Query().Get("days"))
+	if days <= 0 || days > 3650 {
+		days = 30
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	since := time.Now().AddDate(0, 0, -days)
+	recent, err := s.db.GetRecentlyAdded(since, offset, limit)
+	if err != nil {
+		jsonError(w, "Failed to fetch recent photos", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, recent)
+}
+
+// handleNew returns the number of photos indexed since a timestamp and the
+// first few of their IDs, for a "12 new photos" banner after a background
+// scan. since accepts RFC 3339 or Unix seconds.
+func (s *Server) handleNew(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query().Get("since")
+	since, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		secs, perr := strconv.ParseInt(v, 10, 64)
+		if perr != nil {
+			jsonError(w, "Invalid since (use RFC 3339 or Unix seconds)", http.StatusBadRequest)
+			return
+		}
+		since = time.Unix(secs, 0)
+	}
+
+	count, ids, err := s.db.GetIndexedSince(since, 8)
+	if err != nil {
+		jsonError(w, "Failed to fetch new photos", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"count": count,
+		"ids":   ids,
+		"now":   time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// handleTimelineIDs returns only the ordered photo IDs and types for a
+// month, so the frontend can virtualize very large months.
+func (s *Server) handleTimelineIDs(w http.ResponseWriter, r *http.Request) {
+	month := r.URL.Query().Get("month")
+	if _, err := time.Parse("2006-01", month); err != nil {
+		jsonError(w, "Invalid month (use YYYY-MM)", http.StatusBadRequest)
+		return
+	}
+	loc, err := timezone(r)
+	if err != nil {
+		jsonError(w, "Invalid tz", http.StatusBadRequest)
+		return
+	}
+	filter, msg := s.timelineFilter(r, loc)
+	if msg != "" {
+		jsonError(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	ids, err := s.db.GetMonthIDs(month, loc, filter)
+	if err != nil {
+		jsonError(w, "Failed to fetch photo IDs", http.StatusInternalServerError)
+		return
+	}
+	s.cacheControl(w, "max-age=300")
+	jsonResponse(w, ids)
+}
+
+// handlePhoto returns photo metadata by ID, without the GPS details if
+// auth.shared_gps strips them for the account. Sub-resources such as
+// /api/photo/{id}/exif are dispatched from here.
 func (s *Server) handlePhoto(w http.ResponseWriter, r *http.Request) {
-	idStr := strings.TrimPrefix(r.URL.Path, "/api/photo/")
-	id, err := strconv.ParseInt(idStr, 10, 64)
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/photo/"), "/", 2)
+	id, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
 		jsonError(w, "Invalid photo ID", http.StatusBadRequest)
 		return
 	}
 
-	photo, err := s.db.GetPhoto(id)
+	photo, err := s.visiblePhoto(r, id)
 	if err != nil {
 		jsonError(w, "Photo not found", http.StatusNotFound)
 		return
 	}
 
+	if len(parts) == 1 && r.Method == http.MethodDelete {
+		s.handlePhotoDelete(w, r, photo)
+		return
+	}
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "exif":
+			s.handlePhotoExif(w, r, photo)
+		case "histogram":
+			s.handlePhotoHistogram(w, r, photo)
+		case "comments":
+			s.handlePhotoComments(w, r, photo)
+		case "favorite":
+			s.handlePhotoMark(w, r, photo, database.MarkFavorite)
+		case "archive":
+			s.handlePhotoMark(w, r, photo, database.MarkArchived)
+		default:
+			jsonError(w, "Not found", http.StatusNotFound)
+		}
+		return
+	}
+
+	if err := s.db.GetPhotoMarks(userID(r), photo); err != nil {
+		log.Printf("Loading marks of photo %d: %v", photo.ID, err)
+	}
+	if s.sharedGPS(r, photo) == "strip" {
+		photo.GPS = nil
+	}
 	jsonResponse(w, photo)
 }
 
+// handlePhotoMark marks a photo as one of the user's favorites or archives
+// it (PUT), or undoes that (DELETE). Marks are per account, so each user
+// has their own favorites and archive.
+// PUT|DELETE /api/photo/{id}/favorite, /api/photo/{id}/archive
+func (s *Server) handlePhotoMark(w http.ResponseWriter, r *http.Request, photo *models.Photo, mark database.PhotoMark) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.db.SetPhotoMark(userID(r), photo.ID, mark, r.Method == http.MethodPut); err != nil {
+		jsonError(w, "Failed to update photo", http.StatusInternalServerError)
+		return
+	}
+	if err := s.db.GetPhotoMarks(userID(r), photo); err != nil {
+		jsonError(w, "Failed to update photo", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]bool{"favorite": photo.Favorite, "archived": photo.Archived})
+}
+
+// handlePhotoHistogram returns RGB and luminance histograms for the detail
+// panel, computed from the cached medium thumbnail.
+func (s *Server) handlePhotoHistogram(w http.ResponseWriter, r *http.Request, photo *models.Photo) {
+	hist, err := s.thumbs.Histogram(photo.Path, photo.MediaType)
+	if err != nil {
+		jsonError(w, "Failed to compute histogram", http.StatusInternalServerError)
+		return
+	}
+	s.cacheControl(w, "max-age=86400")
+	jsonResponse(w, hist)
+}
+
 // handleThumb serves or generates a thumbnail.
 func (s *Server) handleThumb(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		if owner(r) != 0 {
+			jsonError(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		s.handleThumbDelete(w, r)
+		return
+	}
+
 	// URL pattern: /api/thumb/{id}/{size}
 	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/thumb/"), "/")
 	if len(parts) < 1 {
@@ -160,25 +686,96 @@ func (s *Server) handleThumb(w http.ResponseWriter, r *http.Request) {
 			size = thumbnail.Medium
 		case "lg":
 			size = thumbnail.Large
+		case "xl":
+			size = thumbnail.XLarge
 		}
 	}
 
-	photo, err := s.db.GetPhoto(id)
+	photo, err := s.visiblePhoto(r, id)
 	if err != nil {
 		http.Error(w, "Photo not found", http.StatusNotFound)
 		return
 	}
 
+	if r.URL.Query().Get("retry") == "1" && !photo.Unavailable {
+		if owner(r) != 0 {
+			jsonError(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		s.handleThumbRetry(w, r, photo, size)
+		return
+	}
+
+	// The URL stays the same when the file is edited and the thumbnail
+	// redone, so caches check back each time; Last-Modified makes that a
+	// 304 until it changes
+	w.Header().Set("Vary", "Accept")
+	s.serveThumb(w, r, photo, size, s.thumbFormat(r), "no-cache")
+}
+
+// thumbFormat returns the format to serve a thumbnail in: the configured
+// one, unless the request's Accept header lists image types without it.
+// Browsers list the formats they can display, so those without AVIF (or
+// WebP) support get WebP or JPEG; other clients get the configured format.
+func (s *Server) thumbFormat(r *http.Request) thumbnail.Format {
+	f := s.thumbs.Format()
+	accepted := acceptedImageTypes(r.Header.Get("Accept"))
+	if len(accepted) == 0 || accepted[f.ContentType()] {
+		return f
+	}
+	if f != thumbnail.WebP && accepted[thumbnail.WebP.ContentType()] {
+		return thumbnail.WebP
+	}
+	return thumbnail.JPEG
+}
+
+// acceptedImageTypes returns the image MIME types an Accept header lists
+// by name, leaving out wildcards and those refused with q=0.
+func acceptedImageTypes(header string) map[string]bool {
+	types := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		mime, params, _ := strings.Cut(part, ";")
+		mime = strings.ToLower(strings.TrimSpace(mime))
+		if !strings.HasPrefix(mime, "image/") || mime == "image/*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok && strings.Trim(q, "0.") == "" {
+			continue
+		}
+		types[mime] = true
+	}
+	return types
+}
+
+// serveThumb serves a photo's thumbnail in format f, generating it if
+// needed, with the Cache-Control directives given.
+func (s *Server) serveThumb(w http.ResponseWriter, r *http.Request, photo *models.Photo, size thumbnail.Size, f thumbnail.Format, cache string) {
+	// Uncached thumbnails take a generation slot; when too many are pending,
+	// shed this one and let the client come back for it.
+	if !s.thumbs.ExistsFormat(photo.Path, size, f) {
+		if !s.thumbQueue.acquire(r.Context()) {
+			w.Header().Set("Retry-After", "2")
+			http.Error(w, "Too many thumbnails pending, retry later", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.thumbQueue.release()
+	}
+
 	var thumbPath string
+	var err error
 	if photo.MediaType == "video" {
 		// Video thumbnail via ffmpeg
 		if !s.thumbs.HasFFmpeg() {
 			http.Error(w, "Video thumbnails unavailable (ffmpeg not installed)", http.StatusNotImplemented)
 			return
 		}
-		thumbPath, err = s.thumbs.GetOrCreateVideo(photo.Path, size)
+		thumbPath, err = s.thumbs.GetOrCreateVideoFormat(photo.Path, size, f)
 	} else {
-		thumbPath, err = s.thumbs.GetOrCreate(photo.Path, size)
+		thumbPath, err = s.thumbs.GetOrCreateFormat(photo.Path, size, f)
+	}
+	if err != nil && photo.Unavailable {
+		http.Error(w, "Photo is on an offline disk", http.StatusServiceUnavailable)
+		return
 	}
 	if err != nil {
 		log.Printf("Thumbnail error for %s: %v", photo.Path, err)
@@ -186,45 +783,146 @@ func (s *Server) handleThumb(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set aggressive cache headers
-	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
-	w.Header().Set("Content-Type", "image/webp")
+	// Small thumbnails are the grid; larger ones mean the photo was opened
+	if size != thumbnail.Small {
+		s.recordView(r, photo)
+	}
+
+	s.cacheControl(w, cache)
+	w.Header().Set("Content-Type", f.ContentType())
 
 	// Serve with ETag support
 	http.ServeFile(w, r, thumbPath)
 }
 
+// handleThumbRetry regenerates a thumbnail that failed before, bypassing the
+// failure cache, and reports the underlying error instead of a generic one.
+// Admin only, since it skips the on-demand generation limits.
+// GET /api/thumb/{id}/{size}?retry=1
+func (s *Server) handleThumbRetry(w http.ResponseWriter, r *http.Request, photo *models.Photo, size thumbnail.Size) {
+	thumbPath, err := s.thumbs.Retry(photo.Path, photo.MediaType, size)
+	if size == thumbnail.Small {
+		state := database.PregenDone
+		if err != nil {
+			state = database.PregenFailed
+		}
+		s.db.SetPregenState(photo.ID, state)
+	}
+	if err != nil {
+		log.Printf("Thumbnail retry failed for %s: %v", photo.Path, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":  "Failed to generate thumbnail",
+			"detail": err.Error(),
+			"path":   photo.Path,
+		})
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", s.thumbs.Format().ContentType())
+	http.ServeFile(w, r, thumbPath)
+}
+
+// handleThumbDelete removes cached thumbnails for a photo so they regenerate
+// on next request (e.g. after editing the file externally, since cache keys
+// are path-only). Admin only. DELETE /api/thumb/{id}?size=all|sm|md|lg|xl
+func (s *Server) handleThumbDelete(w http.ResponseWriter, r *http.Request) {
+	idStr := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/thumb/"), "/")[0]
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		jsonError(w, "Invalid photo ID", http.StatusBadRequest)
+		return
+	}
+
+	var sizes []thumbnail.Size
+	switch r.URL.Query().Get("size") {
+	case "", "all":
+	case "sm":
+		sizes = []thumbnail.Size{thumbnail.Small}
+	case "md":
+		sizes = []thumbnail.Size{thumbnail.Medium}
+	case "lg":
+		sizes = []thumbnail.Size{thumbnail.Large}
+	case "xl":
+		sizes = []thumbnail.Size{thumbnail.XLarge}
+	default:
+		jsonError(w, "Invalid size (use all, sm, md, lg or xl)", http.StatusBadRequest)
+		return
+	}
+
+	photo, err := s.visiblePhoto(r, id)
+	if err != nil {
+		jsonError(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+
+	removed := s.thumbs.Invalidate(photo.Path, sizes...)
+	s.db.SetPregenState(photo.ID, database.PregenPending)
+	jsonResponse(w, map[string]interface{}{"status": "ok", "removed": removed})
+}
+
 // handleMedia serves the original media file with range request support.
 func (s *Server) handleMedia(w http.ResponseWriter, r *http.Request) {
-	idStr := strings.TrimPrefix(r.URL.Path, "/api/media/")
+	idStr, stream := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/media/"), "/stream")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
 		http.Error(w, "Invalid photo ID", http.StatusBadRequest)
 		return
 	}
 
-	photo, err := s.db.GetPhoto(id)
+	photo, err := s.visiblePhoto(r, id)
 	if err != nil {
 		http.Error(w, "Photo not found", http.StatusNotFound)
 		return
 	}
 
 	// Validate file still exists
+	if photo.Unavailable {
+		http.Error(w, "Photo is on an offline disk", http.StatusServiceUnavailable)
+		return
+	}
+	if stream {
+		s.handleStream(w, r, photo)
+		return
+	}
+	if archive.IsEntry(photo.Path) {
+		s.serveArchived(w, r, photo)
+		return
+	}
 	if _, err := os.Stat(photo.Path); err != nil {
 		http.Error(w, "File not found on disk", http.StatusNotFound)
 		return
 	}
+	s.recordView(r, photo)
 
 	// Set content type based on extension
 	ext := strings.ToLower(filepath.Ext(photo.Path))
 	contentType := mimeForExt(ext)
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", "public, max-age=86400")
+	s.cacheControl(w, "max-age=86400")
 
 	// http.ServeFile handles Range requests, ETag, etc.
 	http.ServeFile(w, r, photo.Path)
 }
 
+// serveArchived serves a photo stored inside a zip archive, straight from
+// the archive.
+func (s *Server) serveArchived(w http.ResponseWriter, r *http.Request, photo *models.Photo) {
+	f, info, err := archive.OpenSeeker(photo.Path)
+	if err != nil {
+		http.Error(w, "File not found in archive", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	s.recordView(r, photo)
+
+	w.Header().Set("Content-Type", mimeForExt(strings.ToLower(filepath.Ext(photo.Path))))
+	s.cacheControl(w, "max-age=86400")
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
 // handleStats returns library statistics.
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	stats, err := s.db.GetStats()
@@ -235,6 +933,188 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, stats)
 }
 
+// handleFolders returns the folder tree under the photo roots with
+// per-folder counts, date range and cover photo. Browse a folder's photos
+// with /api/folders/photos.
+func (s *Server) handleFolders(w http.ResponseWriter, r *http.Request) {
+	tree, err := s.db.GetFolderTree(s.cfg.Photos.Paths)
+	if err != nil {
+		jsonError(w, "Failed to fetch folders", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, tree)
+}
+
+// handleFolderPhotos returns a page of the photos directly in a folder of
+// the tree from /api/folders.
+// GET /api/folders/photos?path=/photos/2024/Trip&offset=0&limit=100
+func (s *Server) handleFolderPhotos(w http.ResponseWriter, r *http.Request) {
+	dir := r.URL.Query().Get("path")
+	if dir == "" || !filepath.IsAbs(dir) {
+		jsonError(w, "Missing or relative path", http.StatusBadRequest)
+		return
+	}
+	if s.db.RootOf(filepath.Clean(dir)) == "" {
+		jsonError(w, "Folder is not under a photo path", http.StatusNotFound)
+		return
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	photos, total, err := s.db.GetFolderPhotos(dir, offset, limit)
+	if err != nil {
+		jsonError(w, "Failed to fetch photos", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"path":     filepath.Clean(dir),
+		"photos":   photos,
+		"total":    total,
+		"has_more": offset+len(photos) < total,
+	})
+}
+
+// handleTags returns every tag with its photo count.
+func (s *Server) handleTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := s.db.GetTagCounts(owner(r))
+	if err != nil {
+		jsonError(w, "Failed to fetch tags", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, tags)
+}
+
+// handleCameras lists the cameras photos were taken with, with photo
+// counts overall and per lens. Pass a camera to /api/timeline or
+// /api/search to browse its photos.
+// GET /api/cameras
+func (s *Server) handleCameras(w http.ResponseWriter, r *http.Request) {
+	cameras, err := s.db.GetCameraCounts(owner(r))
+	if err != nil {
+		jsonError(w, "Failed to fetch cameras", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, cameras)
+}
+
+// handleTagPhotos returns a page of photos with a tag.
+// GET /api/tags/photos?tag=screenshot&offset=0&limit=100
+func (s *Server) handleTagPhotos(w http.ResponseWriter, r *http.Request) {
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		jsonError(w, "Missing tag", http.StatusBadRequest)
+		return
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	photos, total, err := s.db.GetPhotosByTag(tag, offset, limit, owner(r))
+	if err != nil {
+		jsonError(w, "Failed to fetch photos", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"tag":      tag,
+		"photos":   photos,
+		"total":    total,
+		"has_more": offset+len(photos) < total,
+	})
+}
+
+// handleSearch returns a page of photos matching text and facet filters,
+// with counts per year, type, tag, camera, lens and image kind for
+// narrowing further.
+// GET /api/search?q=beach&year=2024&type=image&tag=&camera=&lens=&kind=&offset=0&limit=100
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !validKind(q.Get("kind")) {
+		jsonError(w, "Invalid kind", http.StatusBadRequest)
+		return
+	}
+	if !validWeather(q.Get("weather")) {
+		jsonError(w, "Invalid weather", http.StatusBadRequest)
+		return
+	}
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 500 {
+		limit = 100
+	}
+
+	resp, err := s.db.Search(database.SearchQuery{
+		Text:    strings.TrimSpace(q.Get("q")),
+		Year:    q.Get("year"),
+		Type:    q.Get("type"),
+		Tag:     q.Get("tag"),
+		Camera:  q.Get("camera"),
+		Lens:    q.Get("lens"),
+		Kind:    q.Get("kind"),
+		Weather: q.Get("weather"),
+		Owner:   owner(r),
+		Offset:  offset,
+		Limit:   limit,
+	})
+	if err != nil {
+		log.Printf("Search: %v", err)
+		jsonError(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, resp)
+}
+
+// handleEvents returns a page of detected events, newest first.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	events, total, err := s.db.GetEvents(offset, limit)
+	if err != nil {
+		jsonError(w, "Failed to fetch events", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"events":   events,
+		"total":    total,
+		"has_more": offset+len(events) < total,
+	})
+}
+
+// handleEvent returns one event with its photos.
+func (s *Server) handleEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/events/"), 10, 64)
+	if err != nil {
+		jsonError(w, "Invalid event ID", http.StatusBadRequest)
+		return
+	}
+	event, err := s.db.GetEvent(id)
+	if err != nil {
+		jsonError(w, "Event not found", http.StatusNotFound)
+		return
+	}
+	jsonResponse(w, event)
+}
+
 // handleIndex triggers a re-index.
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -250,36 +1130,217 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Start indexing in background
-	go func() {
-		if err := s.indexer.Scan(); err != nil {
-			log.Printf("Indexing error: %v", err)
+	// Queue the scan; removal of deleted files follows it
+	job, err := s.jobs.Enqueue(jobs.TypeScan, jobs.ScanPayload{Cleanup: true})
+	if err != nil {
+		jsonError(w, "Failed to queue scan", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, map[string]interface{}{"status": "started", "job": job})
+}
+
+// handleIndexProgress returns current indexing progress, overall and, for
+// admins, per photo root.
+func (s *Server) handleIndexProgress(w http.ResponseWriter, r *http.Request) {
+	p := s.indexer.GetProgress()
+	if owner(r) != 0 {
+		// Root paths and the directory being scanned are the admin's layout
+		p.Roots = nil
+	}
+	jsonResponse(w, p)
+}
+
+// handleIndexMissing reports the indexed files no longer on disk (GET, a
+// dry run of cleanup), or removes them from the index (DELETE), for when
+// photos.prune_missing is off. Files under offline roots are left alone.
+// GET|DELETE /api/index/missing
+func (s *Server) handleIndexMissing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.indexer.CheckRoots()
+	report, err := s.db.RemoveMissing(r.Method == http.MethodGet)
+	if err != nil {
+		jsonError(w, "Failed to check for missing files", http.StatusInternalServerError)
+		return
+	}
+	if report.Removed > 0 {
+		log.Printf("Removed %d files that no longer exist on disk", report.Removed)
+	}
+	jsonResponse(w, report)
+}
+
+// handleIndexErrors lists files that failed to index, with the stage and
+// message of the most recent failure.
+func (s *Server) handleIndexErrors(w http.ResponseWriter, r *http.Request) {
+	errs, err := s.db.GetIndexErrors()
+	if err != nil {
+		jsonError(w, "Failed to fetch index errors", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{"errors": errs, "count": len(errs)})
+}
+
+// handleIndexErrorsRetry re-indexes failed files: all of them, or only the
+// one given by ?id=. Files that no longer exist (or directories, which the
+// next scan will revisit) are cleared.
+func (s *Server) handleIndexErrorsRetry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	errs, err := s.db.GetIndexErrors()
+	if err != nil {
+		jsonError(w, "Failed to fetch index errors", http.StatusInternalServerError)
+		return
+	}
+
+	onlyID, _ := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+
+	var retried, fixed, cleared, failed int
+	for _, e := range errs {
+		if onlyID != 0 && e.ID != onlyID {
+			continue
 		}
+		retried++
 
-		// Remove photos/videos whose files no longer exist on disk
-		removed, err := s.db.RemoveMissing()
-		if err != nil {
-			log.Printf("Error removing missing files: %v", err)
-		} else if removed > 0 {
-			log.Printf("Removed %d files that no longer exist on disk", removed)
+		info, statErr := archive.Stat(e.Path)
+		if os.IsNotExist(statErr) || (statErr == nil && info.IsDir()) {
+			s.db.ClearIndexError(e.Path)
+			cleared++
+			continue
 		}
-	}()
 
-	jsonResponse(w, map[string]string{"status": "started"})
+		if _, err := s.indexer.IndexFile(e.Path); err != nil {
+			s.db.RecordIndexError(e.Path, "retry", err.Error())
+			failed++
+			continue
+		}
+		fixed++
+	}
+
+	jsonResponse(w, map[string]int{
+		"retried": retried,
+		"fixed":   fixed,
+		"cleared": cleared,
+		"failed":  failed,
+	})
 }
 
-// handleIndexProgress returns current indexing progress.
-func (s *Server) handleIndexProgress(w http.ResponseWriter, r *http.Request) {
-	jsonResponse(w, s.indexer.GetProgress())
+// handleIndexErrorDelete dismisses one error record: DELETE /api/index/errors/{id}
+func (s *Server) handleIndexErrorDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/index/errors/"), 10, 64)
+	if err != nil {
+		jsonError(w, "Invalid error ID", http.StatusBadRequest)
+		return
+	}
+	if err := s.db.DeleteIndexError(id); err != nil {
+		jsonError(w, "Failed to delete index error", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]string{"status": "ok"})
+}
+
+// handlePregenWarm starts generating md/lg thumbnails for a date range
+// (POST ?month=2006-01 or ?from=2006-01-02&to=2006-01-02, optional
+// size=md|lg|all). GET returns the progress of the current or last job.
+func (s *Server) handlePregenWarm(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		jsonResponse(w, s.thumbs.GetWarmProgress())
+		return
+	}
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	var filter database.PhotoFilter
+	if month := q.Get("month"); month != "" {
+		t, err := time.Parse("2006-01", month)
+		if err != nil {
+			jsonError(w, "Invalid month (use YYYY-MM)", http.StatusBadRequest)
+			return
+		}
+		filter.From = t
+		filter.To = t.AddDate(0, 1, 0).Add(-time.Nanosecond)
+	} else {
+		from, err1 := time.Parse("2006-01-02", q.Get("from"))
+		to, err2 := time.Parse("2006-01-02", q.Get("to"))
+		if err1 != nil || err2 != nil {
+			jsonError(w, "Provide month (YYYY-MM) or from and to (YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+		filter.From = from
+		filter.To = to.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+
+	var sizes []thumbnail.Size
+	switch q.Get("size") {
+	case "", "all":
+		sizes = []thumbnail.Size{thumbnail.Medium, thumbnail.Large}
+	case "md":
+		sizes = []thumbnail.Size{thumbnail.Medium}
+	case "lg":
+		sizes = []thumbnail.Size{thumbnail.Large}
+	default:
+		jsonError(w, "Invalid size (use all, md or lg)", http.StatusBadRequest)
+		return
+	}
+
+	photos, err := s.db.FilterPhotos(filter)
+	if err != nil {
+		jsonError(w, "Failed to fetch photos", http.StatusInternalServerError)
+		return
+	}
+	items := make([]thumbnail.PregenItem, len(photos))
+	for i, p := range photos {
+		items[i] = thumbnail.PregenItem{ID: p.ID, Path: p.Path, MediaType: p.MediaType}
+	}
+
+	if !s.thumbs.Warm(items, sizes) {
+		jsonResponse(w, map[string]interface{}{
+			"status":   "already_running",
+			"progress": s.thumbs.GetWarmProgress(),
+		})
+		return
+	}
+	log.Printf("Warm: generating %v thumbnails for %d items", sizes, len(items))
+	jsonResponse(w, map[string]interface{}{
+		"status":   "started",
+		"progress": s.thumbs.GetWarmProgress(),
+	})
 }
 
 // handlePregenProgress returns current thumbnail pre-generation progress.
+// Lifetime counts come from the database and cover all runs, not just the
+// current one.
 func (s *Server) handlePregenProgress(w http.ResponseWriter, r *http.Request) {
-	jsonResponse(w, s.thumbs.GetPregenProgress())
+	counts, err := s.db.GetPregenCounts()
+	if err != nil {
+		jsonError(w, "Failed to fetch pregen progress", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, struct {
+		thumbnail.PregenProgress
+		database.PregenCounts
+	}{s.thumbs.GetPregenProgress(), counts})
 }
 
 // handleFrontend serves the embedded frontend or proxies in dev mode.
 func (s *Server) handleFrontend(w http.ResponseWriter, r *http.Request) {
+	if s.devProxy != nil {
+		s.devProxy.ServeHTTP(w, r)
+		return
+	}
+
 	// In production, this would serve from embedded filesystem.
 	// During development, Vite dev server handles this.
 	// For now, serve a simple placeholder or the dist directory.
@@ -315,6 +1376,8 @@ func mimeForExt(ext string) string {
 		".gif": "image/gif", ".webp": "image/webp", ".bmp": "image/bmp",
 		".tiff": "image/tiff", ".tif": "image/tiff",
 		".heic": "image/heic", ".heif": "image/heif", ".avif": "image/avif",
+		".cr2": "image/x-canon-cr2", ".nef": "image/x-nikon-nef",
+		".arw": "image/x-sony-arw", ".dng": "image/x-adobe-dng",
 		".mp4": "video/mp4", ".mov": "video/quicktime", ".avi": "video/x-msvideo",
 		".mkv": "video/x-matroska", ".webm": "video/webm", ".m4v": "video/mp4",
 		".3gp": "video/3gpp", ".wmv": "video/x-ms-wmv",
@@ -325,6 +1388,17 @@ func mimeForExt(ext string) string {
 	return "application/octet-stream"
 }
 
+// cacheControl sets a response's Cache-Control to directives, marked
+// public, or private when auth is enabled: responses then depend on the
+// session, so shared caches such as proxies and CDNs must not keep them.
+func (s *Server) cacheControl(w http.ResponseWriter, directives string) {
+	scope := "public"
+	if s.cfg.Auth.Enabled {
+		scope = "private"
+	}
+	w.Header().Set("Cache-Control", scope+", "+directives)
+}
+
 func jsonResponse(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(data)
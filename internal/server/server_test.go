@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"photog/internal/config"
+	"photog/internal/database"
+	"photog/internal/models"
+)
+
+// newTestServer returns a Server backed by an empty database in a temporary
+// directory, without an indexer, thumbnail generator or job queue.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	db, err := database.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return New(config.DefaultConfig(), db, nil, nil, nil)
+}
+
+// addPhoto records an image at path, owned by the given user (0 for
+// shared), and returns it as stored.
+func addPhoto(t *testing.T, s *Server, path string, ownerID int64) *models.Photo {
+	t.Helper()
+	p := &models.Photo{
+		Path:      path,
+		Filename:  filepath.Base(path),
+		TakenAt:   time.Date(2020, 7, 14, 12, 0, 0, 0, time.UTC),
+		MediaType: "image",
+		IndexedAt: time.Now(),
+		OwnerID:   ownerID,
+	}
+	if err := s.db.UpsertPhoto(p); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.db.GetPhotoByPath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored
+}
+
+// addUser creates an account.
+func addUser(t *testing.T, s *Server, name string, admin bool) *models.User {
+	t.Helper()
+	u, err := s.db.CreateUser(name, "x", admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// as returns r authenticated as u, as authMiddleware would leave it.
+func as(r *http.Request, u *models.User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, u))
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"photog/internal/models"
+)
+
+// maxHiddenFolders caps the folders an account can hide.
+const maxHiddenFolders = 1000
+
+// defaultSettings returns the preferences of an account that hasn't saved
+// any yet.
+func (s *Server) defaultSettings() *models.Settings {
+	return &models.Settings{
+		Sort:  "newest",
+		Theme: "system",
+		Memories: models.MemoriesSettings{
+			Enabled:       true,
+			IncludeVideos: s.cfg.Memories.IncludeVideos,
+		},
+		HiddenFolders: []string{},
+	}
+}
+
+// handleSettings returns (GET) or updates (PUT) the logged-in account's
+// frontend preferences, or the shared ones with auth disabled. A PUT only
+// changes the fields it sends and returns the result. The frontend saves
+// the timeline position in last_seen, to reopen where the user left off.
+// PUT /api/settings {"sort": "oldest", "hidden_folders": ["/photos/Scans"]}
+// PUT /api/settings {"last_seen": {"month": "2024-05", "photo_id": 1234}}
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	var userID int64
+	if u := currentUser(r); u != nil {
+		userID = u.ID
+	}
+	settings := s.defaultSettings()
+	if err := s.db.GetSettings(userID, settings); err != nil {
+		log.Printf("Settings: loading settings of user %d: %v", userID, err)
+		jsonError(w, "Failed to load settings", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, settings)
+
+	case http.MethodPut:
+		var lastSeen models.TimelinePosition
+		if settings.LastSeen != nil {
+			lastSeen = *settings.LastSeen
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256<<10)).Decode(settings); err != nil {
+			jsonError(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if pos := settings.LastSeen; pos != nil && (pos.Month != lastSeen.Month || pos.PhotoID != lastSeen.PhotoID) {
+			pos.SavedAt = time.Now()
+		}
+		if msg := validateSettings(settings); msg != "" {
+			jsonError(w, msg, http.StatusBadRequest)
+			return
+		}
+		if err := s.db.SetSettings(userID, settings); err != nil {
+			jsonError(w, "Failed to save settings", http.StatusInternalServerError)
+			return
+		}
+		jsonResponse(w, settings)
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validateSettings checks updated preferences, cleaning the hidden folder
+// paths, and returns what is wrong with them or "".
+func validateSettings(settings *models.Settings) string {
+	switch settings.Sort {
+	case "newest", "oldest":
+	default:
+		return "Invalid sort (newest or oldest)"
+	}
+	switch settings.Theme {
+	case "system", "light", "dark":
+	default:
+		return "Invalid theme (system, light or dark)"
+	}
+	if settings.HiddenFolders == nil {
+		settings.HiddenFolders = []string{}
+	}
+	if len(settings.HiddenFolders) > maxHiddenFolders {
+		return "Too many hidden folders"
+	}
+	for i, dir := range settings.HiddenFolders {
+		if !filepath.IsAbs(dir) {
+			return "Hidden folders must be absolute paths"
+		}
+		settings.HiddenFolders[i] = filepath.Clean(dir)
+	}
+	if pos := settings.LastSeen; pos != nil {
+		if _, err := time.Parse("2006-01", pos.Month); err != nil {
+			return "Invalid last_seen month (use YYYY-MM)"
+		}
+		if pos.PhotoID < 0 {
+			return "Invalid last_seen photo_id"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"photog/internal/models"
+	"photog/internal/similar"
+)
+
+// similarIndex holds a BK-tree of the library's perceptual hashes. It is
+// rebuilt when the number of hashed photos changes; results are loaded
+// from the database, so removed photos never show up.
+type similarIndex struct {
+	mu   sync.Mutex
+	tree *similar.Tree
+}
+
+// similarTree returns an up-to-date tree of the library's perceptual
+// hashes. The tree is never modified once built.
+func (s *Server) similarTree() (*similar.Tree, error) {
+	n, err := s.db.CountPHashes()
+	if err != nil {
+		return nil, err
+	}
+	s.similar.mu.Lock()
+	defer s.similar.mu.Unlock()
+	if s.similar.tree != nil && s.similar.tree.Len() == n {
+		return s.similar.tree, nil
+	}
+	hashes, err := s.db.GetPHashes()
+	if err != nil {
+		return nil, err
+	}
+	tree := &similar.Tree{}
+	for _, h := range hashes {
+		tree.Add(h.ID, h.Hash)
+	}
+	s.similar.tree = tree
+	return tree, nil
+}
+
+// handleSimilar returns photos that look like a photo, such as burst
+// shots, re-encodes and slight crops, nearest first.
+// GET /api/similar/{id}?max_distance=10&limit=50
+func (s *Server) handleSimilar(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/similar/"), 10, 64)
+	if err != nil {
+		jsonError(w, "Invalid photo ID", http.StatusBadRequest)
+		return
+	}
+	maxDistance := 10
+	if v, err := strconv.Atoi(r.URL.Query().Get("max_distance")); err == nil && v >= 0 && v <= 20 {
+		maxDistance = v
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	photo, err := s.visiblePhoto(r, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		jsonError(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to fetch photo", http.StatusInternalServerError)
+		return
+	}
+	if photo.MediaType == "video" {
+		jsonError(w, "Videos have no perceptual hash", http.StatusBadRequest)
+		return
+	}
+
+	hash, ok, err := s.db.GetPHash(id)
+	if err != nil {
+		jsonError(w, "Failed to fetch photo", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		// Not hashed yet (the phash job runs after scans); hash it now
+		hash, err = s.thumbs.PerceptualHash(photo.Path)
+		if err != nil {
+			jsonError(w, "Failed to hash photo", http.StatusInternalServerError)
+			return
+		}
+		if err := s.db.SetPHash(photo.Path, hash); err != nil {
+			log.Printf("Similar: storing hash of %s: %v", photo.Path, err)
+		}
+	}
+
+	tree, err := s.similarTree()
+	if err != nil {
+		jsonError(w, "Failed to load perceptual hashes", http.StatusInternalServerError)
+		return
+	}
+	results := make([]*models.SimilarPhoto, 0)
+	for _, m := range tree.Search(hash, maxDistance) {
+		if len(results) == limit {
+			break
+		}
+		if m.ID == id {
+			continue
+		}
+		p, err := s.visiblePhoto(r, m.ID)
+		if err != nil {
+			continue
+		}
+		results = append(results, &models.SimilarPhoto{Photo: p, Distance: m.Distance})
+	}
+	jsonResponse(w, map[string]interface{}{
+		"photo_id": id,
+		"results":  results,
+	})
+}
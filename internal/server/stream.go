@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"photog/internal/archive"
+	"photog/internal/models"
+	"photog/internal/transcode"
+)
+
+// SetTranscoder enables /api/media/{id}/stream. Call before Start.
+func (s *Server) SetTranscoder(t *transcode.Transcoder) {
+	s.transcoder = t
+}
+
+// handleStream serves a video as MP4 that browsers can play. Videos that
+// already play everywhere are served as they are. Others are transcoded
+// on first request: the fragmented MP4 is streamed as ffmpeg writes it, so
+// playback starts right away, and later requests get the cached result
+// with range support for seeking.
+// GET /api/media/{id}/stream
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request, photo *models.Photo) {
+	if s.transcoder == nil {
+		http.Error(w, "Transcoding is disabled", http.StatusNotFound)
+		return
+	}
+	if photo.MediaType != "video" {
+		http.Error(w, "Not a video", http.StatusBadRequest)
+		return
+	}
+	if archive.IsEntry(photo.Path) {
+		http.Error(w, "Videos inside archives can't be transcoded", http.StatusBadRequest)
+		return
+	}
+	if class, _ := classifyVideo(photo.Container, photo.VideoCodec, photo.AudioCodec); class == playPlayable {
+		s.recordView(r, photo)
+		w.Header().Set("Content-Type", mimeForExt(strings.ToLower(filepath.Ext(photo.Path))))
+		s.cacheControl(w, "max-age=86400")
+		http.ServeFile(w, r, photo.Path)
+		return
+	}
+
+	src := transcode.Source{Path: photo.Path, VideoCodec: photo.VideoCodec, AudioCodec: photo.AudioCodec}
+	path, run, err := s.transcoder.Open(src)
+	if run != nil {
+		if f, err := os.Open(run.Path); err == nil {
+			defer f.Close()
+			s.recordView(r, photo)
+			streamRun(w, r, f, run)
+			return
+		}
+		// The run finished before we got to it
+		<-run.Done()
+		if run.Err() != nil {
+			http.Error(w, "Failed to transcode video", http.StatusInternalServerError)
+			return
+		}
+		path, _, err = s.transcoder.Open(src)
+	}
+	switch {
+	case errors.Is(err, transcode.ErrBusy):
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "Transcoder is busy, try again shortly", http.StatusServiceUnavailable)
+		return
+	case errors.Is(err, transcode.ErrNoFFmpeg):
+		http.Error(w, "ffmpeg is not installed", http.StatusNotImplemented)
+		return
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, "File not found on disk", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Transcode: %s: %v", photo.Path, err)
+		http.Error(w, "Failed to transcode video", http.StatusInternalServerError)
+		return
+	case path == "":
+		http.Error(w, "Failed to transcode video", http.StatusInternalServerError)
+		return
+	}
+
+	s.recordView(r, photo)
+	w.Header().Set("Content-Type", "video/mp4")
+	s.cacheControl(w, "max-age=86400")
+	http.ServeFile(w, r, path)
+}
+
+// streamRun copies a transcode's output to the client as it grows, until
+// the run finishes or the client goes away. Range requests can't be
+// honored for output that doesn't exist yet, so the whole stream is sent.
+func streamRun(w http.ResponseWriter, r *http.Request, f *os.File, run *transcode.Run) {
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	buf := make([]byte, 256<<10)
+	finished := false
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+		if err == nil {
+			continue
+		}
+		if err != io.EOF || finished {
+			return
+		}
+		// Caught up with ffmpeg: wait for more output, then drain what's
+		// left once it's done
+		select {
+		case <-run.Done():
+			finished = true
+		case <-r.Context().Done():
+			return
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// thumbQueue bounds on-demand thumbnail generation. Up to one generation
+// per CPU runs at once and the rest wait for a slot, but no more than
+// maxPending may be running or waiting in total, and none waits past its
+// deadline. Shed requests are answered with a 503 so the browser retries
+// later, instead of hundreds of goroutines decoding full-size images while
+// the user scrolls past.
+type thumbQueue struct {
+	slots      chan struct{}
+	pending    atomic.Int64
+	maxPending int64
+	wait       time.Duration
+}
+
+func newThumbQueue(maxPending int, wait time.Duration) *thumbQueue {
+	if maxPending <= 0 {
+		maxPending = 32
+	}
+	if wait <= 0 {
+		wait = 5 * time.Second
+	}
+	return &thumbQueue{
+		slots:      make(chan struct{}, runtime.NumCPU()),
+		maxPending: int64(maxPending),
+		wait:       wait,
+	}
+}
+
+// acquire waits for a generation slot. It reports false without one when
+// the queue is full, the wait times out or the request is canceled; call
+// release after a successful acquire.
+func (q *thumbQueue) acquire(ctx context.Context) bool {
+	if q.pending.Add(1) > q.maxPending {
+		q.pending.Add(-1)
+		return false
+	}
+	timer := time.NewTimer(q.wait)
+	defer timer.Stop()
+	select {
+	case q.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	q.pending.Add(-1)
+	return false
+}
+
+// release frees a slot taken by acquire.
+func (q *thumbQueue) release() {
+	<-q.slots
+	q.pending.Add(-1)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"photog/internal/jobs"
+	"photog/internal/thumbnail"
+)
+
+// handleThumbsSlowest lists the source files whose thumbnails took longest
+// to generate, plus P50/P95 generation times per size.
+// GET /api/admin/thumbs/slowest?limit=
+func (s *Server) handleThumbsSlowest(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	slowest, err := s.db.GetSlowestThumbs(limit)
+	if err != nil {
+		jsonError(w, "Failed to fetch thumbnail timings", http.StatusInternalServerError)
+		return
+	}
+	latency, err := s.db.GetThumbLatencies()
+	if err != nil {
+		jsonError(w, "Failed to fetch thumbnail timings", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{
+		"slowest": slowest,
+		"latency": latency,
+	})
+}
+
+// handleCacheGC deletes cached thumbnails of files no longer in the library
+// or the trash, and those of older thumbnail versions, and reports how much
+// space that freed. The same collection runs daily as a background job.
+// POST /api/admin/cache/gc
+func (s *Server) handleCacheGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	result, err := jobs.CollectCache(r.Context(), s.db, s.thumbs, s.trash)
+	if errors.Is(err, thumbnail.ErrGCRunning) {
+		jsonError(w, "Cache garbage collection is already running", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Cache GC: %v", err)
+		jsonError(w, "Failed to collect cache garbage", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, result)
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"photog/internal/archive"
+	"photog/internal/models"
+	"photog/internal/thumbnail"
+	"photog/internal/trash"
+)
+
+// SetTrash enables deleting photos through the API. Call before Start.
+func (s *Server) SetTrash(t *trash.Trash) {
+	s.trash = t
+}
+
+// canDelete reports whether the request's user may delete, restore or purge
+// a file owned by ownerID: admins any, other users only their own.
+func canDelete(r *http.Request, ownerID int64) bool {
+	o := owner(r)
+	return o == 0 || ownerID == o
+}
+
+// handlePhotoDelete moves a photo's file into the trash and removes it from
+// the library.
+// DELETE /api/photo/{id}
+func (s *Server) handlePhotoDelete(w http.ResponseWriter, r *http.Request, photo *models.Photo) {
+	if s.trash == nil {
+		jsonError(w, "Deleting is disabled", http.StatusNotFound)
+		return
+	}
+	if !canDelete(r, photo.OwnerID) {
+		jsonError(w, "Only the owner can delete this photo", http.StatusForbidden)
+		return
+	}
+	if archive.IsEntry(photo.Path) {
+		jsonError(w, "Photos inside archives can't be deleted", http.StatusBadRequest)
+		return
+	}
+	if photo.Unavailable {
+		jsonError(w, "Photo is on an offline disk", http.StatusServiceUnavailable)
+		return
+	}
+
+	item, err := s.trash.Delete(photo)
+	if errors.Is(err, os.ErrNotExist) {
+		jsonError(w, "File not found on disk", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Trash: deleting %s: %v", photo.Path, err)
+		jsonError(w, "Failed to delete photo", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, item)
+}
+
+// handleTrash lists the trash: everything for admins, their own deleted
+// files for other users.
+// GET /api/trash
+func (s *Server) handleTrash(w http.ResponseWriter, r *http.Request) {
+	if s.trash == nil {
+		jsonError(w, "Deleting is disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	items, err := s.trash.List(owner(r))
+	if err != nil {
+		jsonError(w, "Failed to fetch trash", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, map[string]interface{}{"items": items})
+}
+
+// handleTrashItem restores an item in the trash, purges it, or serves its
+// small thumbnail.
+// POST /api/trash/{id}/restore
+// DELETE /api/trash/{id}
+// GET /api/trash/{id}/thumb
+func (s *Server) handleTrashItem(w http.ResponseWriter, r *http.Request) {
+	if s.trash == nil {
+		jsonError(w, "Deleting is disabled", http.StatusNotFound)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/trash/"), "/", 2)
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		jsonError(w, "Invalid trash item ID", http.StatusBadRequest)
+		return
+	}
+	item, err := s.trash.Get(id)
+	if err == nil && !canDelete(r, item.OwnerID) {
+		err = sql.ErrNoRows
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		jsonError(w, "Trash item not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		jsonError(w, "Failed to fetch trash item", http.StatusInternalServerError)
+		return
+	}
+
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch {
+	case action == "restore" && r.Method == http.MethodPost:
+		s.restoreTrashItem(w, item)
+	case action == "thumb" && r.Method == http.MethodGet:
+		s.serveTrashThumb(w, r, item)
+	case action == "" && r.Method == http.MethodDelete:
+		if err := s.trash.Purge(item); err != nil {
+			log.Printf("Trash: purging %s: %v", item.Path, err)
+			jsonError(w, "Failed to purge trash item", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "restore" || action == "thumb" || action == "":
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		jsonError(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// restoreTrashItem moves an item back into the library and returns the
+// photo it's indexed as.
+func (s *Server) restoreTrashItem(w http.ResponseWriter, item *models.TrashItem) {
+	photo, err := s.trash.Restore(item)
+	switch {
+	case errors.Is(err, trash.ErrExists):
+		jsonError(w, "Another file is at the original path", http.StatusConflict)
+	case errors.Is(err, os.ErrNotExist):
+		jsonError(w, "Trash item not found", http.StatusNotFound)
+	case err != nil:
+		log.Printf("Trash: restoring %s: %v", item.Path, err)
+		jsonError(w, "Failed to restore trash item", http.StatusInternalServerError)
+	default:
+		jsonResponse(w, photo)
+	}
+}
+
+// serveTrashThumb serves the small thumbnail made while the item was in
+// the library, or makes one from the trashed file.
+func (s *Server) serveTrashThumb(w http.ResponseWriter, r *http.Request, item *models.TrashItem) {
+	f := s.thumbFormat(r)
+	path := item.Path
+	if !s.thumbs.ExistsFormat(path, thumbnail.Small, f) {
+		path = s.trash.File(item)
+	}
+	var thumbPath string
+	var err error
+	if item.MediaType == "video" {
+		thumbPath, err = s.thumbs.GetOrCreateVideoFormat(path, thumbnail.Small, f)
+	} else {
+		thumbPath, err = s.thumbs.GetOrCreateFormat(path, thumbnail.Small, f)
+	}
+	if err != nil {
+		http.Error(w, "Failed to generate thumbnail", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Content-Type", f.ContentType())
+	http.ServeFile(w, r, thumbPath)
+}
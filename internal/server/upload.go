@@ -0,0 +1,594 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"photog/internal/indexer"
+	"photog/internal/models"
+)
+
+// tusVersion is the tus protocol version spoken by the resumable upload
+// endpoints.
+const tusVersion = "1.0.0"
+
+// uploadExpiry is how long an unfinished resumable upload is kept.
+const uploadExpiry = 24 * time.Hour
+
+// pendingUpload is the state of a resumable upload, stored as <id>.json
+// next to its data, <id>.part, in the upload folder's .uploads directory.
+type pendingUpload struct {
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	UserID    int64     `json:"user_id"`
+	Dir       string    `json:"dir"`
+	CreatedAt time.Time `json:"created_at"`
+	AlbumID   int64     `json:"album_id,omitempty"` // album to add the photo to
+	PhotoID   int64     `json:"photo_id,omitempty"` // set once complete
+}
+
+// errDuplicate is returned by finishUpload for content already in the
+// library.
+type errDuplicate struct{ photoID int64 }
+
+func (e errDuplicate) Error() string {
+	return fmt.Sprintf("duplicate of photo %d", e.photoID)
+}
+
+// handleUpload stores a new file and indexes it. A multipart body with a
+// "file" part is stored at once and the new photo returned. A body-less
+// request with an Upload-Length header starts a resumable tus upload whose
+// data is sent to the returned Location with PATCH. With an album_id query
+// parameter the new photo is also added to that album, which the account
+// needs to contribute to.
+// POST /api/upload
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.Upload.Dir == "" {
+		jsonError(w, "Uploads are disabled (set upload.dir)", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Upload-Length") != "" {
+		s.createUpload(w, r)
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		jsonError(w, "Expected a multipart body or an Upload-Length header", http.StatusBadRequest)
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			jsonError(w, "Missing file part", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "file" {
+			albumID, ok := s.uploadAlbum(w, r, r.URL.Query().Get("album_id"))
+			if !ok {
+				return
+			}
+			s.storeMultipart(w, r, part.FileName(), part, albumID)
+			return
+		}
+	}
+}
+
+// storeMultipart writes a multipart upload into the user's upload folder
+// and adds it to an album unless albumID is 0.
+func (s *Server) storeMultipart(w http.ResponseWriter, r *http.Request, name string, src io.Reader, albumID int64) {
+	name = cleanUploadName(name)
+	if name == "" {
+		jsonError(w, "Unsupported file type", http.StatusUnsupportedMediaType)
+		return
+	}
+	dir := s.uploadDir(r)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		jsonError(w, "Failed to create upload folder", http.StatusInternalServerError)
+		return
+	}
+
+	// Write to a dotfile first so a scan never indexes a partial upload
+	tmp, err := os.CreateTemp(dir, ".pending-*")
+	if err != nil {
+		jsonError(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+	tmp.Chmod(0644)
+	uploaded := time.Now()
+	max := s.maxUploadSize()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(src, max+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		jsonError(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+	if size > max {
+		os.Remove(tmp.Name())
+		jsonError(w, "File is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	photo, err := s.finishUpload(tmp.Name(), dir, name, size, hex.EncodeToString(h.Sum(nil)), uploaded)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	s.addUploadToAlbum(albumID, photo, userID(r))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(photo)
+}
+
+// createUpload starts a resumable upload (tus creation). The file name is
+// taken from the "filename" or "name" Upload-Metadata entry, and the album
+// from the album_id query parameter or Upload-Metadata entry.
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		jsonError(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if size > s.maxUploadSize() {
+		jsonError(w, "File is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	meta := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	name = cleanUploadName(name)
+	if name == "" {
+		jsonError(w, "Unsupported file type", http.StatusUnsupportedMediaType)
+		return
+	}
+	album := r.URL.Query().Get("album_id")
+	if album == "" {
+		album = meta["album_id"]
+	}
+	albumID, ok := s.uploadAlbum(w, r, album)
+	if !ok {
+		return
+	}
+
+	pending := s.pendingDir()
+	if err := os.MkdirAll(pending, 0755); err != nil {
+		jsonError(w, "Failed to create upload folder", http.StatusInternalServerError)
+		return
+	}
+	s.removeExpiredUploads()
+
+	id := randomToken(16)
+	up := &pendingUpload{
+		Filename:  name,
+		Size:      size,
+		UserID:    userID(r),
+		Dir:       s.uploadDir(r),
+		CreatedAt: time.Now(),
+		AlbumID:   albumID,
+	}
+	if err := os.WriteFile(filepath.Join(pending, id+".part"), nil, 0644); err != nil {
+		jsonError(w, "Failed to start upload", http.StatusInternalServerError)
+		return
+	}
+	if err := saveUpload(pending, id, up); err != nil {
+		os.Remove(filepath.Join(pending, id+".part"))
+		jsonError(w, "Failed to start upload", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/api/upload/"+id)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleUploadResume serves a resumable upload: HEAD for its offset, PATCH
+// to append data, DELETE to abandon it, and GET for its state, including
+// the new photo once complete.
+// /api/upload/{id}
+func (s *Server) handleUploadResume(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.Upload.Dir == "" {
+		jsonError(w, "Uploads are disabled (set upload.dir)", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Tus-Resumable", tusVersion)
+	id := strings.TrimPrefix(r.URL.Path, "/api/upload/")
+	if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+		jsonError(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if !s.lockUpload(id) {
+		jsonError(w, "Upload is busy", http.StatusLocked)
+		return
+	}
+	defer s.unlockUpload(id)
+
+	pending := s.pendingDir()
+	up, err := loadUpload(pending, id)
+	if err != nil || up.UserID != userID(r) {
+		jsonError(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	part := filepath.Join(pending, id+".part")
+	var offset int64
+	if up.PhotoID != 0 {
+		offset = up.Size
+	} else if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	} else {
+		jsonError(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(up.Size, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		resp := map[string]interface{}{"offset": offset, "size": up.Size}
+		if up.PhotoID != 0 {
+			if photo, err := s.db.GetPhoto(up.PhotoID); err == nil {
+				resp["photo"] = photo
+			}
+		}
+		jsonResponse(w, resp)
+
+	case http.MethodDelete:
+		os.Remove(part)
+		os.Remove(filepath.Join(pending, id+".json"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodPatch:
+		if up.PhotoID != 0 {
+			jsonError(w, "Upload is already complete", http.StatusConflict)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			jsonError(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+			return
+		}
+		if r.Header.Get("Upload-Offset") != strconv.FormatInt(offset, 10) {
+			jsonError(w, "Upload-Offset does not match", http.StatusConflict)
+			return
+		}
+		f, err := os.OpenFile(part, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			jsonError(w, "Failed to store upload", http.StatusInternalServerError)
+			return
+		}
+		// Keep what arrived even if the connection drops; the client
+		// resumes from the new offset
+		n, copyErr := io.Copy(f, io.LimitReader(r.Body, up.Size-offset))
+		if err := f.Close(); copyErr == nil {
+			copyErr = err
+		}
+		offset += n
+		if copyErr != nil {
+			log.Printf("Upload: %s interrupted at %d of %d bytes: %v", up.Filename, offset, up.Size, copyErr)
+			jsonError(w, "Failed to store upload", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		if offset < up.Size {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if err := os.MkdirAll(up.Dir, 0755); err != nil {
+			jsonError(w, "Failed to create upload folder", http.StatusInternalServerError)
+			return
+		}
+		hash, err := indexer.HashFile(part)
+		if err != nil {
+			jsonError(w, "Failed to store upload", http.StatusInternalServerError)
+			return
+		}
+		photo, err := s.finishUpload(part, up.Dir, up.Filename, up.Size, hash, up.CreatedAt)
+		if err != nil {
+			var dup errDuplicate
+			if errors.As(err, &dup) {
+				os.Remove(filepath.Join(pending, id+".json"))
+			}
+			writeUploadError(w, err)
+			return
+		}
+		s.addUploadToAlbum(up.AlbumID, photo, up.UserID)
+		up.PhotoID = photo.ID
+		if err := saveUpload(pending, id, up); err != nil {
+			log.Printf("Upload: saving state of %s: %v", id, err)
+		}
+		w.Header().Set("Upload-Photo-Id", strconv.FormatInt(photo.ID, 10))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		jsonError(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// finishUpload moves a completely received file into dir under name, or a
+// free variant of it, and indexes it, applying the configured fixes first
+// (see normalizeUpload). Content already in the library is removed and
+// reported as errDuplicate.
+func (s *Server) finishUpload(tmp, dir, name string, size int64, hash string, uploaded time.Time) (*models.Photo, error) {
+	if dupID, err := s.indexer.FindDuplicate(size, hash); err == nil && dupID != 0 {
+		os.Remove(tmp)
+		log.Printf("Upload: rejected duplicate %s (matches photo %d)", name, dupID)
+		return nil, errDuplicate{dupID}
+	}
+
+	name, hash = s.normalizeUpload(tmp, name, hash)
+	dest, err := moveToFreePath(tmp, dir, name)
+	if err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("moving upload into place: %w", err)
+	}
+	if s.cfg.Upload.FillMissingDate && !indexer.IsVideoFile(dest) && needsDate(dest) {
+		if err := writeDateSidecar(dest, uploaded); err != nil {
+			log.Printf("Upload: recording date of %s: %v", dest, err)
+		}
+	}
+	photo, err := s.indexer.IndexFile(dest)
+	if err != nil {
+		return nil, fmt.Errorf("indexing %s: %w", dest, err)
+	}
+	s.db.SetContentHash(photo.ID, hash)
+	log.Printf("Upload: indexed %s", dest)
+	return photo, nil
+}
+
+// uploadAlbum parses the album an upload should be added to, 0 for none.
+// It responds with an error and returns false if the album doesn't exist
+// or the account can't add photos to it.
+func (s *Server) uploadAlbum(w http.ResponseWriter, r *http.Request, value string) (int64, bool) {
+	if value == "" {
+		return 0, true
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		jsonError(w, "Invalid album ID", http.StatusBadRequest)
+		return 0, false
+	}
+	role, err := s.albumRole(r, id)
+	var album *models.Album
+	if err == nil && role != "" {
+		// Admins aren't members, so this also checks the album exists
+		if album, err = s.db.GetAlbum(id); err == sql.ErrNoRows {
+			role, err = "", nil
+		}
+	}
+	switch {
+	case err != nil:
+		jsonError(w, "Failed to fetch album", http.StatusInternalServerError)
+		return 0, false
+	case role == "":
+		jsonError(w, "Album not found", http.StatusNotFound)
+		return 0, false
+	case role != "admin" && role != "contribute":
+		jsonError(w, "Not allowed to change this album", http.StatusForbidden)
+		return 0, false
+	case album.Folder != "":
+		jsonError(w, folderAlbumMessage, http.StatusConflict)
+		return 0, false
+	}
+	return id, true
+}
+
+// addUploadToAlbum adds an uploaded photo to an album, attributed to the
+// uploading account. A failure is logged; the upload itself succeeded.
+func (s *Server) addUploadToAlbum(albumID int64, photo *models.Photo, addedBy int64) {
+	if albumID == 0 {
+		return
+	}
+	if _, err := s.db.AddAlbumPhotos(albumID, []int64{photo.ID}, addedBy); err != nil {
+		log.Printf("Upload: adding %s to album %d: %v", photo.Path, albumID, err)
+	}
+}
+
+// normalizeUpload applies the configured upload fixes to a received file
+// before it goes into the library: renaming it to match its content and
+// turning JPEG pixels upright. It returns the name to store it under and
+// its content hash, which changes if it was rewritten. Failures are logged
+// and leave the file as it was.
+func (s *Server) normalizeUpload(tmp, name, hash string) (string, string) {
+	cfg := s.cfg.Upload
+	if cfg.FixExtensions {
+		if fixed := normalizeName(tmp, name); fixed != name && indexer.IsMediaFile(fixed) {
+			log.Printf("Upload: renaming %s to %s to match its content", name, fixed)
+			name = fixed
+		}
+	}
+	if cfg.AutoRotate {
+		rotated, err := rotateJPEG(tmp)
+		if err != nil {
+			log.Printf("Upload: rotating %s: %v", name, err)
+		}
+		if rotated {
+			if h, err := indexer.HashFile(tmp); err == nil {
+				hash = h
+			}
+		}
+	}
+	return name, hash
+}
+
+// writeUploadError reports a finishUpload failure: 409 with the existing
+// photo's ID for duplicates, 500 otherwise.
+func writeUploadError(w http.ResponseWriter, err error) {
+	var dup errDuplicate
+	if errors.As(err, &dup) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "duplicate", "photo_id": dup.photoID})
+		return
+	}
+	log.Printf("Upload: %v", err)
+	jsonError(w, "Failed to store upload", http.StatusInternalServerError)
+}
+
+// uploadDir returns the folder a request's uploads are stored in: a
+// folder per user with auth enabled.
+func (s *Server) uploadDir(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return filepath.Join(s.cfg.Upload.Dir, u.Username)
+	}
+	return s.cfg.Upload.Dir
+}
+
+// pendingDir returns the folder holding unfinished resumable uploads.
+func (s *Server) pendingDir() string {
+	return filepath.Join(s.cfg.Upload.Dir, ".uploads")
+}
+
+// maxUploadSize returns the largest accepted upload in bytes.
+func (s *Server) maxUploadSize() int64 {
+	mb := s.cfg.Upload.MaxSizeMB
+	if mb <= 0 {
+		mb = 4096
+	}
+	return mb << 20
+}
+
+// lockUpload marks a resumable upload as being worked on, reporting false
+// if another request already is.
+func (s *Server) lockUpload(id string) bool {
+	s.uploadMu.Lock()
+	defer s.uploadMu.Unlock()
+	if s.uploadsBusy == nil {
+		s.uploadsBusy = make(map[string]bool)
+	}
+	if s.uploadsBusy[id] {
+		return false
+	}
+	s.uploadsBusy[id] = true
+	return true
+}
+
+func (s *Server) unlockUpload(id string) {
+	s.uploadMu.Lock()
+	delete(s.uploadsBusy, id)
+	s.uploadMu.Unlock()
+}
+
+// removeExpiredUploads deletes resumable uploads started more than
+// uploadExpiry ago.
+func (s *Server) removeExpiredUploads() {
+	pending := s.pendingDir()
+	entries, err := os.ReadDir(pending)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok {
+			continue
+		}
+		up, err := loadUpload(pending, id)
+		if err != nil || time.Since(up.CreatedAt) < uploadExpiry {
+			continue
+		}
+		os.Remove(filepath.Join(pending, id+".part"))
+		os.Remove(filepath.Join(pending, id+".json"))
+	}
+}
+
+func loadUpload(pending, id string) (*pendingUpload, error) {
+	data, err := os.ReadFile(filepath.Join(pending, id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	up := &pendingUpload{}
+	if err := json.Unmarshal(data, up); err != nil {
+		return nil, err
+	}
+	return up, nil
+}
+
+func saveUpload(pending, id string, up *pendingUpload) error {
+	data, err := json.Marshal(up)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(pending, id+".json"), data, 0644)
+}
+
+// userID returns the ID of the request's account, 0 with auth disabled.
+func userID(r *http.Request) int64 {
+	if u := currentUser(r); u != nil {
+		return u.ID
+	}
+	return 0
+}
+
+// cleanUploadName returns the base name of an uploaded file, or "" if it
+// isn't a media file a scan would index.
+func cleanUploadName(name string) string {
+	name = filepath.Base(filepath.Clean("/" + strings.ReplaceAll(name, `\`, "/")))
+	if name == "/" || !indexer.IsMediaFile(name) {
+		return ""
+	}
+	return name
+}
+
+// moveToFreePath moves tmp to dir/name, or to dir/"name (n).ext" for the
+// first n not already taken, and returns the path it moved to. Names are
+// claimed with a hard link, which fails if the name exists, so concurrent
+// uploads of the same name can't overwrite each other.
+func moveToFreePath(tmp, dir, name string) (string, error) {
+	dest := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 1; ; n++ {
+		err := os.Link(tmp, dest)
+		if err == nil {
+			os.Remove(tmp)
+			return dest, nil
+		}
+		if !os.IsExist(err) {
+			return "", err
+		}
+		dest = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, n, ext))
+	}
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header: comma-separated
+// "key base64value" pairs.
+func parseUploadMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		meta[key] = string(decoded)
+	}
+	return meta
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Browser playability classes, best to worst.
+const (
+	playPlayable  = "playable"  // plays in all current browsers
+	playLimited   = "limited"   // plays in some browsers only
+	playTranscode = "transcode" // needs transcoding to play anywhere
+	playUnknown   = "unknown"   // not probed (ffprobe missing or failed)
+)
+
+var playRank = map[string]int{playPlayable: 0, playLimited: 1, playTranscode: 2}
+
+// Codec support in current Chrome, Firefox and Safari. Anything not listed
+// needs transcoding.
+var (
+	videoCodecSupport = map[string]string{
+		"h264": playPlayable,
+		"vp8":  playPlayable,
+		"vp9":  playPlayable,
+		"av1":  playLimited, // Safari needs hardware decode
+		"hevc": playLimited, // Safari, and Chromium with hardware decode
+	}
+	audioCodecSupport = map[string]string{
+		"":       playPlayable, // no audio track
+		"aac":    playPlayable,
+		"mp3":    playPlayable,
+		"opus":   playPlayable,
+		"vorbis": playPlayable,
+		"flac":   playPlayable,
+		"ac3":    playLimited, // Safari and Edge only
+		"eac3":   playLimited,
+		"alac":   playLimited, // Safari only
+	}
+)
+
+// classifyVideo rates how well browsers can play a container/codec
+// combination and explains the limiting factor.
+func classifyVideo(container, videoCodec, audioCodec string) (string, string) {
+	if videoCodec == "" {
+		return playUnknown, "not probed"
+	}
+
+	class, reason := playPlayable, ""
+	worsen := func(c, why string) {
+		if playRank[c] > playRank[class] {
+			class, reason = c, why
+		}
+	}
+
+	switch {
+	case strings.Contains(container, "mp4") || strings.Contains(container, "mov"):
+	case strings.Contains(container, "webm"):
+		// ffprobe reports webm and mkv alike as "matroska,webm"
+		if videoCodec != "vp8" && videoCodec != "vp9" && videoCodec != "av1" {
+			worsen(playLimited, "Matroska (MKV) plays in Chromium and Firefox only")
+		}
+	default:
+		worsen(playTranscode, "container "+container+" is not supported by browsers")
+	}
+
+	if c, ok := videoCodecSupport[videoCodec]; ok {
+		if c != playPlayable {
+			worsen(c, "video codec "+videoCodec+" is not supported by every browser")
+		}
+	} else {
+		worsen(playTranscode, "video codec "+videoCodec+" is not supported by browsers")
+	}
+
+	if c, ok := audioCodecSupport[audioCodec]; ok {
+		if c != playPlayable {
+			worsen(c, "audio codec "+audioCodec+" is not supported by every browser")
+		}
+	} else if strings.HasPrefix(audioCodec, "pcm_") {
+		worsen(playLimited, "uncompressed audio plays in Safari only")
+	} else {
+		worsen(playTranscode, "audio codec "+audioCodec+" is not supported by browsers")
+	}
+	return class, reason
+}
+
+// handleVideoCompatibility classifies indexed videos by how well browsers
+// can play their container and codecs, to size up the need for transcoding.
+// GET /api/admin/videos/compatibility
+func (s *Server) handleVideoCompatibility(w http.ResponseWriter, r *http.Request) {
+	groups, err := s.db.GetVideoCodecGroups()
+	if err != nil {
+		jsonError(w, "Failed to fetch videos", http.StatusInternalServerError)
+		return
+	}
+
+	counts := map[string]int{playPlayable: 0, playLimited: 0, playTranscode: 0, playUnknown: 0}
+	total := 0
+	for _, g := range groups {
+		g.Class, g.Reason = classifyVideo(g.Container, g.VideoCodec, g.AudioCodec)
+		counts[g.Class] += g.Count
+		total += g.Count
+	}
+
+	jsonResponse(w, map[string]interface{}{
+		"total":  total,
+		"counts": counts,
+		"groups": groups,
+	})
+}
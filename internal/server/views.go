@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"photog/internal/models"
+)
+
+// viewWindow is how long repeat views of a photo by the same viewer count
+// as one: opening a photo loads its large thumbnail and the original, and
+// videos are fetched in many range requests.
+const viewWindow = 30 * time.Minute
+
+// viewTracker remembers recent views to deduplicate them.
+type viewTracker struct {
+	mu   sync.Mutex
+	seen map[string]time.Time // viewer + photo ID -> last counted view
+}
+
+// first reports whether key hasn't been seen within viewWindow, and records
+// it.
+func (t *viewTracker) first(key string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seen == nil {
+		t.seen = make(map[string]time.Time)
+	}
+	if last, ok := t.seen[key]; ok && now.Sub(last) < viewWindow {
+		return false
+	}
+	if len(t.seen) >= 10000 {
+		for k, last := range t.seen {
+			if now.Sub(last) >= viewWindow {
+				delete(t.seen, k)
+			}
+		}
+	}
+	t.seen[key] = now
+	return true
+}
+
+// recordView counts a view of photo when view counting is enabled.
+func (s *Server) recordView(r *http.Request, photo *models.Photo) {
+	if !s.cfg.Views.Enabled {
+		return
+	}
+	viewer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(viewer); err == nil {
+		viewer = host
+	}
+	if u := currentUser(r); u != nil {
+		viewer = "user:" + strconv.FormatInt(u.ID, 10)
+	}
+	if !s.views.first(fmt.Sprintf("%s/%d", viewer, photo.ID), time.Now()) {
+		return
+	}
+	if err := s.db.RecordView(photo.ID); err != nil {
+		log.Printf("Views: failed to record view of %s: %v", photo.Path, err)
+	}
+}
+
+// handlePopular lists the most viewed photos.
+// GET /api/stats/popular?limit=50
+func (s *Server) handlePopular(w http.ResponseWriter, r *http.Request) {
+	if !s.cfg.Views.Enabled {
+		jsonError(w, "View counting is disabled (set views.enabled)", http.StatusNotFound)
+		return
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	photos, err := s.db.GetPopularPhotos(limit)
+	if err != nil {
+		jsonError(w, "Failed to fetch popular photos", http.StatusInternalServerError)
+		return
+	}
+	jsonResponse(w, photos)
+}
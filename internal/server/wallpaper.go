@@ -0,0 +1,105 @@
+package server
+
+import (
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// wallpaperSizes are the screen resolutions wallpapers are cropped to.
+// Crops are cached per size, so requests are snapped to one of these rather
+// than each width and height a client asks for adding to the cache.
+var wallpaperSizes = [][2]int{
+	// 16:9
+	{1280, 720}, {1366, 768}, {1600, 900}, {1920, 1080}, {2560, 1440}, {3840, 2160}, {5120, 2880}, {7680, 4320},
+	// 16:10
+	{1280, 800}, {1440, 900}, {1680, 1050}, {1920, 1200}, {2560, 1600}, {2880, 1800},
+	// 21:9
+	{2560, 1080}, {3440, 1440}, {5120, 2160},
+	// 4:3 and 3:2
+	{1024, 768}, {2048, 1536}, {2160, 1440}, {3000, 2000},
+	// phones, portrait
+	{1080, 1920}, {1170, 2532}, {1290, 2796}, {1440, 3200},
+}
+
+// wallpaperSize snaps width x height to the wallpaper size of the closest
+// aspect ratio, taking the narrowest of that shape at least as wide as asked,
+// or the widest if none is.
+func wallpaperSize(width, height int) (int, int) {
+	want := math.Log(float64(width) / float64(height))
+	var best [2]int
+	bestDist := math.Inf(1)
+	for _, sz := range wallpaperSizes {
+		dist := math.Abs(math.Log(float64(sz[0])/float64(sz[1])) - want)
+		switch {
+		case dist < bestDist-0.01:
+		case dist > bestDist+0.01:
+			continue
+		case sz[0] >= width && (best[0] < width || sz[0] < best[0]):
+		case sz[0] < width && best[0] < width && sz[0] > best[0]:
+		default:
+			continue
+		}
+		best, bestDist = sz, dist
+	}
+	return best[0], best[1]
+}
+
+// handleWallpaperDaily serves one landscape photo per day, center-cropped to
+// about the requested resolution: GET /api/wallpaper/daily?w=3840&h=2160. The
+// size is snapped to the nearest of wallpaperSizes, which clients scale from.
+//
+// The pick is deterministic for a given date so every device pulling the
+// wallpaper on the same day gets the same image.
+func (s *Server) handleWallpaperDaily(w http.ResponseWriter, r *http.Request) {
+	width, _ := strconv.Atoi(r.URL.Query().Get("w"))
+	height, _ := strconv.Atoi(r.URL.Query().Get("h"))
+	if width <= 0 || width > 7680 {
+		width = 1920
+	}
+	if height <= 0 || height > 4320 {
+		height = 1080
+	}
+	width, height = wallpaperSize(width, height)
+
+	// Prefer photos at least as wide as the screen; fall back to any landscape
+	// photo so small libraries still get a wallpaper.
+	ids, err := s.db.GetWallpaperCandidates(width)
+	if err == nil && len(ids) == 0 {
+		ids, err = s.db.GetWallpaperCandidates(1)
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch wallpaper candidates", http.StatusInternalServerError)
+		return
+	}
+	if len(ids) == 0 {
+		http.Error(w, "No landscape photos available", http.StatusNotFound)
+		return
+	}
+
+	day := time.Now().Format("2006-01-02")
+	h := fnv.New64a()
+	h.Write([]byte(day))
+	id := ids[h.Sum64()%uint64(len(ids))]
+
+	photo, err := s.db.GetPhoto(id)
+	if err != nil {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+
+	wallPath, err := s.thumbs.GetOrCreateCropped(photo.Path, width, height)
+	if err != nil {
+		log.Printf("Wallpaper error for %s: %v", photo.Path, err)
+		http.Error(w, "Failed to generate wallpaper", http.StatusInternalServerError)
+		return
+	}
+
+	// Changes daily, so only cache until the next pick could differ
+	s.cacheControl(w, "max-age=3600")
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeFile(w, r, wallPath)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// davPrefix is the URL prefix of the WebDAV upload target.
+const davPrefix = "/dav"
+
+// davUser is one configured WebDAV account with its own upload folder.
+type davUser struct {
+	password string
+	root     string
+	handler  *webdav.Handler
+}
+
+// setupWebDAV builds a WebDAV handler per configured user. Each user is
+// jailed to <webdav.dir>/<username>.
+func (s *Server) setupWebDAV() {
+	if s.cfg.WebDAV.Dir == "" || len(s.cfg.WebDAV.Users) == 0 {
+		return
+	}
+
+	s.davUsers = make(map[string]*davUser)
+	for _, u := range s.cfg.WebDAV.Users {
+		if u.Username == "" || u.Password == "" || strings.ContainsAny(u.Username, `/\.`) {
+			log.Printf("WebDAV: skipping invalid user %q", u.Username)
+			continue
+		}
+		root := filepath.Join(s.cfg.WebDAV.Dir, u.Username)
+		if err := os.MkdirAll(root, 0755); err != nil {
+			log.Printf("WebDAV: create folder for %s: %v", u.Username, err)
+			continue
+		}
+		du := &davUser{password: u.Password, root: root}
+		du.handler = &webdav.Handler{
+			Prefix:     davPrefix,
+			FileSystem: webdav.Dir(root),
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err == nil {
+					s.davUnindex(du, r)
+					s.davIndexUpload(du, r)
+				}
+			},
+		}
+		s.davUsers[u.Username] = du
+	}
+
+	if len(s.davUsers) > 0 {
+		s.mux.HandleFunc(davPrefix+"/", s.handleWebDAV)
+		log.Printf("WebDAV: upload target enabled at %s/ for %d user(s)", davPrefix, len(s.davUsers))
+	}
+}
+
+// handleWebDAV authenticates with HTTP basic auth and dispatches to the
+// user's WebDAV handler.
+func (s *Server) handleWebDAV(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	du := s.davUsers[username]
+	if !ok || du == nil || subtle.ConstantTimeCompare([]byte(password), []byte(du.password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Photog WebDAV"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodPut {
+		s.davPut(w, r, du)
+		return
+	}
+	du.handler.ServeHTTP(w, r)
+}
+
+// davLocalPath maps a /dav/... URL path into the user's folder.
+func davLocalPath(du *davUser, urlPath string) string {
+	rel := strings.TrimPrefix(path.Clean(urlPath), davPrefix)
+	return filepath.Join(du.root, filepath.FromSlash(path.Clean("/"+rel)))
+}
+
+// davIfListRE and davIfTokenRE pick the lists out of an If header, and the
+// lock tokens out of a list.
+var (
+	davIfListRE  = regexp.MustCompile(`\(([^)]*)\)`)
+	davIfTokenRE = regexp.MustCompile(`<([^>]*)>`)
+)
+
+// davLock holds the lock a write to name needs, as the webdav handler does
+// for its own methods. Without an If header it takes a lock of its own for
+// the request, which fails with 423 while another client holds one; with
+// one, a list of lock tokens in it must match the lock on name, or it fails
+// with 412. Like the in-memory lock system, only lock tokens are checked,
+// not entity tags. It returns the function releasing the lock.
+func davLock(du *davUser, r *http.Request, name string) (func(), int) {
+	ls := du.handler.LockSystem
+	now := time.Now()
+	hdr := r.Header.Get("If")
+	if hdr == "" {
+		token, err := ls.Create(now, webdav.LockDetails{Root: name, Duration: -1, ZeroDepth: true})
+		if err == webdav.ErrLocked {
+			return nil, http.StatusLocked
+		} else if err != nil {
+			return nil, http.StatusInternalServerError
+		}
+		return func() { ls.Unlock(now, token) }, 0
+	}
+	for _, list := range davIfListRE.FindAllStringSubmatch(hdr, -1) {
+		var conditions []webdav.Condition
+		for _, m := range davIfTokenRE.FindAllStringSubmatch(list[1], -1) {
+			conditions = append(conditions, webdav.Condition{Token: m[1]})
+		}
+		if release, err := ls.Confirm(now, name, "", conditions...); err == nil {
+			return release, 0
+		}
+	}
+	return nil, http.StatusPreconditionFailed
+}
+
+// davPut stores an upload, hashing it on the way in. Content that already
+// exists anywhere in the library is rejected with 409 and the existing
+// photo ID, so repeated phone backups don't create copies.
+func (s *Server) davPut(w http.ResponseWriter, r *http.Request, du *davUser) {
+	local := davLocalPath(du, r.URL.Path)
+	if local == du.root {
+		http.Error(w, "Cannot PUT to a collection", http.StatusMethodNotAllowed)
+		return
+	}
+	release, status := davLock(du, r, path.Clean("/"+strings.TrimPrefix(r.URL.Path, davPrefix)))
+	if release == nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer release()
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		http.Error(w, "Failed to create folder", http.StatusInternalServerError)
+		return
+	}
+
+	// Write to a dotfile first so a scan never indexes a partial upload
+	tmp, err := os.CreateTemp(filepath.Dir(local), ".pending-*")
+	if err != nil {
+		http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	if dupID, err := s.indexer.FindDuplicate(size, hash); err == nil && dupID != 0 {
+		os.Remove(tmp.Name())
+		log.Printf("WebDAV: rejected duplicate upload %s (matches photo %d)", local, dupID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": "duplicate", "photo_id": dupID})
+		return
+	}
+
+	_, statErr := os.Stat(local)
+	if err := os.Rename(tmp.Name(), local); err != nil {
+		os.Remove(tmp.Name())
+		http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+		return
+	}
+
+	s.davIndex(local, hash)
+
+	if statErr == nil {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// davIndex indexes an uploaded file and records its content hash.
+func (s *Server) davIndex(local, hash string) {
+	photo, err := s.indexer.IndexFile(local)
+	if err != nil {
+		log.Printf("WebDAV: not indexing %s: %v", local, err)
+		return
+	}
+	if hash != "" {
+		s.db.SetContentHash(photo.ID, hash)
+	}
+	log.Printf("WebDAV: indexed upload %s", local)
+}
+
+// davUnindex removes what a DELETE removed, or a MOVE took away, from the
+// index: the file, or every file under a deleted or moved folder.
+func (s *Server) davUnindex(du *davUser, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != "MOVE" {
+		return
+	}
+	local := davLocalPath(du, r.URL.Path)
+	n, err := s.db.RemovePhotosUnder(local)
+	if err != nil {
+		log.Printf("WebDAV: unindexing %s: %v", local, err)
+	} else if n > 0 {
+		log.Printf("WebDAV: removed %d file(s) under %s from the index", n, local)
+	}
+}
+
+// davIndexUpload indexes a file after it was moved or copied into place
+// (some apps upload to a temp name first). PUTs are indexed by davPut.
+func (s *Server) davIndexUpload(du *davUser, r *http.Request) {
+	if r.Method != "MOVE" && r.Method != "COPY" {
+		return
+	}
+	dst, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
+		return
+	}
+
+	local := davLocalPath(du, dst.Path)
+	info, err := os.Stat(local)
+	if err != nil || info.IsDir() {
+		return
+	}
+	s.davIndex(local, "")
+}
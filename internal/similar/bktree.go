@@ -0,0 +1,97 @@
+// Package similar finds visually similar photos by the Hamming distance
+// between their perceptual hashes.
+package similar
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// Match is a photo found by Search and its distance from the query hash.
+type Match struct {
+	ID       int64
+	Distance int
+}
+
+// Tree is a BK-tree of 64-bit hashes. Each child edge is labeled with its
+// distance from the parent, so by the triangle inequality a search within
+// radius r only descends into edges within r of the query's distance to
+// the node, skipping most of the tree.
+type Tree struct {
+	root *node
+	size int
+}
+
+type node struct {
+	hash     uint64
+	ids      []int64 // photos with exactly this hash
+	children map[int]*node
+}
+
+// Distance returns the number of differing bits between two hashes.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Len returns the number of photos in the tree.
+func (t *Tree) Len() int {
+	return t.size
+}
+
+// Add inserts a photo's hash.
+func (t *Tree) Add(id int64, hash uint64) {
+	t.size++
+	if t.root == nil {
+		t.root = &node{hash: hash, ids: []int64{id}}
+		return
+	}
+	n := t.root
+	for {
+		d := Distance(n.hash, hash)
+		if d == 0 {
+			n.ids = append(n.ids, id)
+			return
+		}
+		child := n.children[d]
+		if child == nil {
+			if n.children == nil {
+				n.children = make(map[int]*node)
+			}
+			n.children[d] = &node{hash: hash, ids: []int64{id}}
+			return
+		}
+		n = child
+	}
+}
+
+// Search returns the photos whose hash is within maxDistance of hash,
+// nearest first.
+func (t *Tree) Search(hash uint64, maxDistance int) []Match {
+	var matches []Match
+	if t.root == nil {
+		return matches
+	}
+	stack := []*node{t.root}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		d := Distance(n.hash, hash)
+		if d <= maxDistance {
+			for _, id := range n.ids {
+				matches = append(matches, Match{ID: id, Distance: d})
+			}
+		}
+		for edge, child := range n.children {
+			if edge >= d-maxDistance && edge <= d+maxDistance {
+				stack = append(stack, child)
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].ID < matches[j].ID
+	})
+	return matches
+}
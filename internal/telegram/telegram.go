@@ -0,0 +1,491 @@
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"photog/internal/config"
+	"photog/internal/database"
+	"photog/internal/indexer"
+	"photog/internal/models"
+	"photog/internal/thumbnail"
+)
+
+// apiBase is the Telegram Bot API endpoint.
+const apiBase = "https://api.telegram.org"
+
+// pollTimeout is the long-poll timeout passed to getUpdates.
+const pollTimeout = 30 * time.Second
+
+// maxResults caps how many thumbnails are sent back for one search.
+const maxResults = 5
+
+// Bot is a minimal Telegram bot that sends daily memories, saves photos it
+// receives into the upload folder, and answers simple search queries.
+type Bot struct {
+	cfg      config.TelegramConfig
+	memories config.MemoriesConfig
+	db       *database.DB
+	indexer  *indexer.Indexer
+	thumbs   *thumbnail.Generator
+	client   *http.Client
+	allowed  map[int64]bool
+	stop     chan struct{}
+	ctx      context.Context // cancelled by Stop to abort the long poll
+	cancel   context.CancelFunc
+}
+
+// New creates a Telegram bot. Call Start to begin polling. Daily memories
+// are picked with the same settings as the web UI's memories.
+func New(cfg config.TelegramConfig, memories config.MemoriesConfig, db *database.DB, idx *indexer.Indexer, thumbs *thumbnail.Generator) *Bot {
+	allowed := make(map[int64]bool, len(cfg.ChatIDs))
+	for _, id := range cfg.ChatIDs {
+		allowed[id] = true
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Bot{
+		cfg:      cfg,
+		memories: memories,
+		db:       db,
+		indexer:  idx,
+		thumbs:   thumbs,
+		client:   &http.Client{Timeout: pollTimeout + 15*time.Second},
+		allowed:  allowed,
+		stop:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Start begins polling for messages and the daily memories schedule.
+func (b *Bot) Start() {
+	go b.pollLoop()
+	go b.memoriesLoop()
+}
+
+// Stop signals the bot to stop and aborts a getUpdates request in flight.
+func (b *Bot) Stop() {
+	close(b.stop)
+	b.cancel()
+}
+
+// Notify sends a text message to every allowed chat.
+func (b *Bot) Notify(text string) {
+	for id := range b.allowed {
+		b.sendText(id, text)
+	}
+}
+
+// Telegram API types (only the fields we use).
+type update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *message `json:"message"`
+}
+
+type message struct {
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text     string      `json:"text"`
+	Caption  string      `json:"caption"`
+	Photo    []photoSize `json:"photo"`
+	Document *document   `json:"document"`
+}
+
+type photoSize struct {
+	FileID   string `json:"file_id"`
+	FileSize int64  `json:"file_size"`
+}
+
+type document struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+}
+
+type apiResponse struct {
+	OK          bool            `json:"ok"`
+	Description string          `json:"description"`
+	Result      json.RawMessage `json:"result"`
+}
+
+func (b *Bot) pollLoop() {
+	log.Println("Telegram: bot started")
+	var offset int64
+
+	for {
+		select {
+		case <-b.stop:
+			log.Println("Telegram: stopped")
+			return
+		default:
+		}
+
+		updates, err := b.getUpdates(offset)
+		if err != nil {
+			if b.ctx.Err() != nil {
+				log.Println("Telegram: stopped")
+				return
+			}
+			log.Printf("Telegram: getUpdates error: %v", err)
+			select {
+			case <-b.stop:
+				return
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message != nil {
+				b.handleMessage(u.Message)
+			}
+		}
+	}
+}
+
+// memoriesLoop sends memories to every allowed chat once a day
+// at the configured hour.
+func (b *Bot) memoriesLoop() {
+	for {
+		now := time.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day(), b.cfg.MemoriesHour, 0, 0, 0, now.Location())
+		if !next.After(now) {
+			next = next.AddDate(0, 0, 1)
+		}
+
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(time.Until(next)):
+			b.sendMemories()
+		}
+	}
+}
+
+// sendMemories sends one photo from each past year's memories group, newest
+// year first, honouring the memories settings (window, excluded tags,
+// videos, minimum size).
+func (b *Bot) sendMemories() {
+	mc := b.memories
+	groups, err := b.db.GetMemories(time.Now(), database.MemoryOptions{
+		WindowDays:    mc.WindowDays,
+		PerYear:       mc.PerYear,
+		IncludeVideos: mc.IncludeVideos,
+		ExcludeTags:   mc.ExcludeTags,
+		MinSize:       mc.MinSize,
+	})
+	if err != nil {
+		log.Printf("Telegram: memories query error: %v", err)
+		return
+	}
+	var photos []*models.Photo
+	for _, g := range groups {
+		if len(photos) == maxResults {
+			break
+		}
+		// sendPhotos only sends images, so skip past any leading videos
+		for _, p := range g.Photos {
+			if p.MediaType == "image" {
+				photos = append(photos, p)
+				break
+			}
+		}
+	}
+	if len(photos) == 0 {
+		return
+	}
+
+	for chatID := range b.allowed {
+		b.sendText(chatID, "On this day")
+		b.sendPhotos(chatID, photos)
+	}
+}
+
+func (b *Bot) handleMessage(m *message) {
+	chatID := m.Chat.ID
+	if !b.allowed[chatID] {
+		log.Printf("Telegram: ignoring message from unlisted chat %d (add it to telegram.chat_ids to allow)", chatID)
+		return
+	}
+
+	switch {
+	case len(m.Photo) > 0:
+		// Telegram sends several sizes; the last one is the largest.
+		largest := m.Photo[len(m.Photo)-1]
+		name := fmt.Sprintf("telegram_%s.jpg", time.Now().Format("20060102_150405"))
+		b.saveUpload(chatID, largest.FileID, name)
+	case m.Document != nil && strings.HasPrefix(m.Document.MimeType, "image/"),
+		m.Document != nil && strings.HasPrefix(m.Document.MimeType, "video/"):
+		// Sent "as file" — keeps the original bytes and EXIF
+		b.saveUpload(chatID, m.Document.FileID, m.Document.FileName)
+	case strings.TrimSpace(m.Text) != "":
+		b.search(chatID, strings.TrimSpace(m.Text))
+	}
+}
+
+// saveUpload downloads a file from Telegram into the upload directory and
+// indexes it right away.
+func (b *Bot) saveUpload(chatID int64, fileID, name string) {
+	if b.cfg.UploadDir == "" {
+		b.sendText(chatID, "Uploads are disabled (telegram.upload_dir is not set).")
+		return
+	}
+
+	name = filepath.Base(name)
+	if name == "." || strings.HasPrefix(name, ".") {
+		name = fmt.Sprintf("telegram_%d", time.Now().UnixNano())
+	}
+
+	if err := os.MkdirAll(b.cfg.UploadDir, 0755); err != nil {
+		log.Printf("Telegram: create upload dir: %v", err)
+		b.sendText(chatID, "Upload failed.")
+		return
+	}
+
+	dst := uniquePath(filepath.Join(b.cfg.UploadDir, name))
+	if err := b.downloadFile(fileID, dst); err != nil {
+		log.Printf("Telegram: download error: %v", err)
+		b.sendText(chatID, "Upload failed.")
+		return
+	}
+
+	// Reject content that's already somewhere in the library
+	hash, err := indexer.HashFile(dst)
+	if err == nil {
+		if info, statErr := os.Stat(dst); statErr == nil {
+			if dupID, _ := b.indexer.FindDuplicate(info.Size(), hash); dupID != 0 {
+				os.Remove(dst)
+				b.sendText(chatID, "Already in your library.")
+				return
+			}
+		}
+	}
+
+	photo, err := b.indexer.IndexFile(dst)
+	if err != nil {
+		log.Printf("Telegram: index error for %s: %v", dst, err)
+	} else if hash != "" {
+		b.db.SetContentHash(photo.ID, hash)
+	}
+	log.Printf("Telegram: saved upload %s", dst)
+	b.sendText(chatID, "Saved "+filepath.Base(dst))
+}
+
+// search answers a text query. A year, year-month or full date returns
+// photos from that period; anything else matches against filenames.
+func (b *Bot) search(chatID int64, q string) {
+	var photos []*models.Photo
+	var err error
+
+	if start, end, ok := parseDateQuery(q); ok {
+		photos, _, err = b.db.SearchByDateRange(start, end, 0, maxResults)
+	} else {
+		photos, err = b.db.SearchFilename(q, maxResults)
+	}
+	if err != nil {
+		log.Printf("Telegram: search error: %v", err)
+		b.sendText(chatID, "Search failed.")
+		return
+	}
+	if len(photos) == 0 {
+		b.sendText(chatID, "No photos found.")
+		return
+	}
+	b.sendPhotos(chatID, photos)
+}
+
+// parseDateQuery parses "2019", "2019-07" or "2019-07-14" into a range.
+func parseDateQuery(q string) (time.Time, time.Time, bool) {
+	if t, err := time.Parse("2006-01-02", q); err == nil {
+		return t, t.AddDate(0, 0, 1).Add(-time.Nanosecond), true
+	}
+	if t, err := time.Parse("2006-01", q); err == nil {
+		return t, t.AddDate(0, 1, 0).Add(-time.Nanosecond), true
+	}
+	if t, err := time.Parse("2006", q); err == nil {
+		return t, t.AddDate(1, 0, 0).Add(-time.Nanosecond), true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// sendPhotos sends medium-size JPEG renditions of the given images.
+func (b *Bot) sendPhotos(chatID int64, photos []*models.Photo) {
+	for _, p := range photos {
+		if p.MediaType != "image" {
+			continue
+		}
+		data, err := b.thumbs.RenderJPEG(p.Path, thumbnail.Medium)
+		if err != nil {
+			log.Printf("Telegram: render error for %s: %v", p.Path, err)
+			continue
+		}
+		caption := p.TakenAt.Format("January 2, 2006")
+		if err := b.sendPhoto(chatID, data, caption); err != nil {
+			log.Printf("Telegram: sendPhoto error: %v", err)
+		}
+	}
+}
+
+func (b *Bot) methodURL(method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", apiBase, b.cfg.Token, method)
+}
+
+// do sends a request. Request URLs contain the bot token, so it is removed
+// from the URL in errors, which end up in the log.
+func (b *Bot) do(req *http.Request) (*http.Response, error) {
+	resp, err := b.client.Do(req)
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return nil, &url.Error{
+			Op:  uerr.Op,
+			URL: strings.ReplaceAll(uerr.URL, b.cfg.Token, "<token>"),
+			Err: uerr.Err,
+		}
+	}
+	return resp, err
+}
+
+// call performs a Bot API request and decodes the result into out (if non-nil).
+func (b *Bot) call(req *http.Request, out interface{}) error {
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r apiResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	if !r.OK {
+		return fmt.Errorf("telegram: %s", r.Description)
+	}
+	if out != nil {
+		return json.Unmarshal(r.Result, out)
+	}
+	return nil
+}
+
+func (b *Bot) getUpdates(offset int64) ([]update, error) {
+	v := url.Values{}
+	v.Set("offset", strconv.FormatInt(offset, 10))
+	v.Set("timeout", strconv.Itoa(int(pollTimeout.Seconds())))
+	v.Set("allowed_updates", `["message"]`)
+
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodGet, b.methodURL("getUpdates")+"?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var updates []update
+	err = b.call(req, &updates)
+	return updates, err
+}
+
+func (b *Bot) sendText(chatID int64, text string) {
+	v := url.Values{}
+	v.Set("chat_id", strconv.FormatInt(chatID, 10))
+	v.Set("text", text)
+
+	req, err := http.NewRequest(http.MethodPost, b.methodURL("sendMessage"), strings.NewReader(v.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := b.call(req, nil); err != nil {
+		log.Printf("Telegram: sendMessage error: %v", err)
+	}
+}
+
+func (b *Bot) sendPhoto(chatID int64, data []byte, caption string) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("chat_id", strconv.FormatInt(chatID, 10))
+	mw.WriteField("caption", caption)
+	fw, err := mw.CreateFormFile("photo", "photo.jpg")
+	if err != nil {
+		return err
+	}
+	fw.Write(data)
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, b.methodURL("sendPhoto"), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return b.call(req, nil)
+}
+
+// downloadFile resolves a file ID and streams the file to dst.
+func (b *Bot) downloadFile(fileID, dst string) error {
+	req, err := http.NewRequest(http.MethodGet, b.methodURL("getFile")+"?file_id="+url.QueryEscape(fileID), nil)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		FilePath string `json:"file_path"`
+	}
+	if err := b.call(req, &file); err != nil {
+		return err
+	}
+
+	req, err = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/file/bot%s/%s", apiBase, b.cfg.Token, file.FilePath), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download: %s", resp.Status)
+	}
+
+	// Write to a dotfile first so a scan never indexes a partial file
+	tmp := filepath.Join(filepath.Dir(dst), ".pending-"+filepath.Base(dst))
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// uniquePath appends a counter to the filename if path already exists.
+func uniquePath(path string) string {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path
+	}
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s_%d%s", base, i, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package thumbnail
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// CollageOptions controls the output of Collage.
+type CollageOptions struct {
+	Layout  string // "grid" (uniform cells) or "mosaic" (rows keep aspect ratios)
+	Width   int
+	Height  int
+	Columns int // grid only; 0 picks a roughly square grid
+	Gap     int // pixels between cells
+}
+
+// CollageItem is one photo to place in a collage.
+type CollageItem struct {
+	Path      string
+	MediaType string
+	Width     int // display dimensions, used by the mosaic layout
+	Height    int
+}
+
+// Collage composes the items into a single JPEG. Cells are drawn from the
+// cached large thumbnails, so this never decodes full-size originals more
+// than once.
+func (g *Generator) Collage(items []CollageItem, opts CollageOptions) ([]byte, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no photos")
+	}
+
+	var cells []image.Rectangle
+	switch opts.Layout {
+	case "", "grid":
+		cells = gridCells(len(items), opts)
+	case "mosaic":
+		cells = mosaicCells(items, opts)
+	default:
+		return nil, fmt.Errorf("unknown layout %q", opts.Layout)
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+
+	for i, item := range items {
+		cell := cells[i]
+		if cell.Empty() {
+			continue
+		}
+		src, err := g.collageSource(item)
+		if err != nil {
+			continue // leave a blank cell rather than failing the whole collage
+		}
+		img := imaging.Fill(src, cell.Dx(), cell.Dy(), imaging.Center, g.filter)
+		draw.Draw(canvas, cell, img, image.Point{}, draw.Src)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, canvas, &jpeg.Options{Quality: g.config.Quality}); err != nil {
+		return nil, fmt.Errorf("encode jpeg: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// collageSource returns the large thumbnail for an item, generating it if
+// needed.
+func (g *Generator) collageSource(item CollageItem) (image.Image, error) {
+	var thumb string
+	var err error
+	if item.MediaType == "video" {
+		thumb, err = g.GetOrCreateVideo(item.Path, Large)
+	} else {
+		thumb, err = g.GetOrCreate(item.Path, Large)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return g.decodeThumb(thumb)
+}
+
+// gridCells lays n items out in uniform cells, filling rows left to right.
+func gridCells(n int, opts CollageOptions) []image.Rectangle {
+	cols := opts.Columns
+	if cols <= 0 {
+		cols = int(math.Ceil(math.Sqrt(float64(n))))
+	}
+	if cols > n {
+		cols = n
+	}
+	rows := (n + cols - 1) / cols
+
+	cellW := (opts.Width - opts.Gap*(cols+1)) / cols
+	cellH := (opts.Height - opts.Gap*(rows+1)) / rows
+	if cellW <= 0 || cellH <= 0 {
+		return make([]image.Rectangle, n) // too small to draw; all cells empty
+	}
+
+	cells := make([]image.Rectangle, n)
+	for i := range cells {
+		x := opts.Gap + (i%cols)*(cellW+opts.Gap)
+		y := opts.Gap + (i/cols)*(cellH+opts.Gap)
+		cells[i] = image.Rect(x, y, x+cellW, y+cellH)
+	}
+	return cells
+}
+
+// mosaicCells splits items into rows of equal height and sizes each cell in
+// proportion to its photo's aspect ratio, so the row spans the full width.
+func mosaicCells(items []CollageItem, opts CollageOptions) []image.Rectangle {
+	n := len(items)
+	rows := int(math.Round(math.Sqrt(float64(n) * float64(opts.Height) / float64(opts.Width))))
+	if rows < 1 {
+		rows = 1
+	}
+	if rows > n {
+		rows = n
+	}
+	rowH := (opts.Height - opts.Gap*(rows+1)) / rows
+
+	cells := make([]image.Rectangle, n)
+	if rowH <= 0 {
+		return cells
+	}
+	next := 0
+	for r := 0; r < rows; r++ {
+		// Spread any remainder over the first rows
+		count := n / rows
+		if r < n%rows {
+			count++
+		}
+		row := items[next : next+count]
+
+		var total float64
+		for _, it := range row {
+			total += aspect(it)
+		}
+		avail := float64(opts.Width - opts.Gap*(count+1))
+
+		x := opts.Gap
+		y := opts.Gap + r*(rowH+opts.Gap)
+		for i, it := range row {
+			w := int(avail * aspect(it) / total)
+			if i == count-1 {
+				w = opts.Width - opts.Gap - x // absorb rounding in the last cell
+			}
+			if w > 0 {
+				cells[next+i] = image.Rect(x, y, x+w, y+rowH)
+			}
+			x += w + opts.Gap
+		}
+		next += count
+	}
+	return cells
+}
+
+// aspect returns an item's width/height ratio, treating unknown dimensions
+// as 4:3.
+func aspect(it CollageItem) float64 {
+	if it.Width <= 0 || it.Height <= 0 {
+		return 4.0 / 3.0
+	}
+	return float64(it.Width) / float64(it.Height)
+}
@@ -0,0 +1,118 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"photog/internal/config"
+)
+
+// externalOutputs are the intermediate formats an external thumbnailer may
+// write; imaging decodes all of them.
+var externalOutputs = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".tif": true, ".tiff": true}
+
+// externalThumbnailers indexes the configured external thumbnailers by
+// lowercase extension, filling in defaults.
+func externalThumbnailers(list []config.ExternalThumbnailer) (map[string]config.ExternalThumbnailer, error) {
+	byExt := make(map[string]config.ExternalThumbnailer)
+	for _, t := range list {
+		if !strings.Contains(t.Command, "{input}") || !strings.Contains(t.Command, "{output}") {
+			return nil, fmt.Errorf("external thumbnailer %q: command needs {input} and {output}", t.Command)
+		}
+		t.Output = strings.ToLower(t.Output)
+		if t.Output == "" {
+			t.Output = ".jpg"
+		}
+		if !strings.HasPrefix(t.Output, ".") {
+			t.Output = "." + t.Output
+		}
+		if !externalOutputs[t.Output] {
+			return nil, fmt.Errorf("external thumbnailer %q: unsupported output %q", t.Command, t.Output)
+		}
+		for _, ext := range ExternalExts([]config.ExternalThumbnailer{t}) {
+			byExt[ext] = t
+		}
+	}
+	return byExt, nil
+}
+
+// ExternalExts returns the lowercase, dot-prefixed extensions handled by
+// the given external thumbnailers.
+func ExternalExts(list []config.ExternalThumbnailer) []string {
+	var exts []string
+	for _, t := range list {
+		for _, ext := range t.Extensions {
+			ext = strings.ToLower(strings.TrimSpace(ext))
+			if ext == "" {
+				continue
+			}
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// decodeExternal converts srcPath with an external thumbnailer and decodes
+// the result with auto-orientation. Runs take an ffmpeg slot, as they are
+// just as heavy.
+func (g *Generator) decodeExternal(t config.ExternalThumbnailer, srcPath string) (image.Image, error) {
+	tmpDir, err := os.MkdirTemp("", "photog-external-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	outPath := filepath.Join(tmpDir, "out"+t.Output)
+
+	args := strings.Fields(t.Command)
+	for i, arg := range args {
+		arg = strings.ReplaceAll(arg, "{input}", srcPath)
+		args[i] = strings.ReplaceAll(arg, "{output}", outPath)
+	}
+
+	timeout := time.Duration(t.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = ffmpegTimeout
+	}
+	select {
+	case g.ffmpegSem <- struct{}{}:
+	case <-g.ctx.Done():
+		return nil, g.ctx.Err()
+	}
+	defer func() { <-g.ffmpegSem }()
+
+	ctx, cancel := context.WithTimeout(g.ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%s: timed out after %v", args[0], timeout)
+		}
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			if len(msg) > 500 {
+				msg = msg[len(msg)-500:]
+			}
+			return nil, fmt.Errorf("%s: %w: %s", args[0], err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", args[0], err)
+	}
+
+	img, err := imaging.Open(outPath, imaging.AutoOrientation(true))
+	if err != nil {
+		return nil, fmt.Errorf("%s output: %w", args[0], err)
+	}
+	return img, nil
+}
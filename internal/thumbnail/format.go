@@ -0,0 +1,228 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/chai2010/webp"
+)
+
+// Format is a thumbnail file format.
+type Format string
+
+const (
+	WebP Format = "webp"
+	AVIF Format = "avif" // encoded with ffmpeg
+	JPEG Format = "jpeg"
+)
+
+// avifEncoders are the ffmpeg AV1 encoders that can write AVIF stills, in
+// order of preference.
+var avifEncoders = []string{"libaom-av1", "libsvtav1", "librav1e"}
+
+// ParseFormat returns the format named s, "" meaning WebP.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case "", WebP:
+		return WebP, nil
+	case AVIF, JPEG:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown thumbnail format %q (webp, avif or jpeg)", s)
+}
+
+// Ext returns the extension of the format's cache files.
+func (f Format) Ext() string {
+	if f == JPEG {
+		return ".jpg"
+	}
+	return "." + string(f)
+}
+
+// ContentType returns the format's MIME type.
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+// Format returns the configured thumbnail format, which GetOrCreate and
+// GetOrCreateVideo write.
+func (g *Generator) Format() Format {
+	return g.format
+}
+
+// CanEncode reports whether thumbnails can be written in format f: AVIF
+// needs ffmpeg with an AV1 encoder.
+func (g *Generator) CanEncode(f Format) bool {
+	return f != AVIF || g.getAVIFEncoder() != ""
+}
+
+// getAVIFEncoder returns the ffmpeg encoder AVIF thumbnails are written
+// with, or "" when there is none.
+func (g *Generator) getAVIFEncoder() string {
+	g.avifOnce.Do(func() {
+		ffmpeg := g.getFFmpeg()
+		if ffmpeg == "" {
+			return
+		}
+		out, err := exec.Command(ffmpeg, "-hide_banner", "-encoders").Output()
+		if err != nil {
+			return
+		}
+		for _, enc := range avifEncoders {
+			if bytes.Contains(out, []byte(" "+enc+" ")) {
+				g.avifEncoder = enc
+				return
+			}
+		}
+	})
+	return g.avifEncoder
+}
+
+// formatQuality returns the quality of a size preset in format f: the
+// format's own quality if set, or the WebP one.
+func (g *Generator) formatQuality(size Size, f Format) int {
+	switch {
+	case f == AVIF && g.config.AVIFQuality > 0:
+		return g.config.AVIFQuality
+	case f == JPEG && g.config.JPEGQuality > 0:
+		return g.config.JPEGQuality
+	}
+	return g.quality(size)
+}
+
+// writeThumb encodes img as a thumbnail of the given size in format f at
+// path, with the ICC color profile embedded when there is one (AVIF
+// thumbnails are written without). Writing AVIF runs ffmpeg; callers hold
+// an ffmpeg slot.
+func (g *Generator) writeThumb(path string, img image.Image, size Size, f Format, icc []byte) error {
+	switch f {
+	case AVIF:
+		return g.writeAVIF(path, img, g.formatQuality(size, f))
+	case JPEG:
+		return writeAtomic(path, func(w io.Writer) error {
+			return encodeJPEG(w, img, g.formatQuality(size, f), icc)
+		})
+	}
+	return g.writeWebPProfile(path, img, size, icc)
+}
+
+// encodeJPEG encodes img as a JPEG, with the ICC profile in APP2 segments
+// right after the start of image marker when there is one.
+func encodeJPEG(w io.Writer, img image.Image, quality int, icc []byte) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("encode jpeg: %w", err)
+	}
+	data := buf.Bytes()
+	if len(icc) == 0 {
+		_, err := w.Write(data)
+		return err
+	}
+
+	// Segments hold up to 65533 bytes, less the marker and chunk numbers
+	const chunkSize = 65533 - 14
+	count := (len(icc) + chunkSize - 1) / chunkSize
+	if count > 255 {
+		_, err := w.Write(data) // too big to embed
+		return err
+	}
+	out := []byte{0xFF, 0xD8}
+	for i := 0; i < count; i++ {
+		chunk := icc[i*chunkSize : min((i+1)*chunkSize, len(icc))]
+		n := 2 + len(iccMarker) + 2 + len(chunk)
+		out = append(out, 0xFF, 0xE2, byte(n>>8), byte(n))
+		out = append(out, iccMarker...)
+		out = append(out, byte(i+1), byte(count))
+		out = append(out, chunk...)
+	}
+	_, err := w.Write(append(out, data[2:]...))
+	return err
+}
+
+// writeAVIF encodes img as an AVIF still at path with ffmpeg, mapping the
+// 0-100 quality onto the encoder's 63-0 CRF scale.
+func (g *Generator) writeAVIF(path string, img image.Image, quality int) error {
+	ffmpeg, encoder := g.getFFmpeg(), g.getAVIFEncoder()
+	if encoder == "" {
+		return fmt.Errorf("encode avif: ffmpeg with an AV1 encoder not available")
+	}
+	var src bytes.Buffer
+	if err := png.Encode(&src, img); err != nil {
+		return fmt.Errorf("encode avif: %w", err)
+	}
+	crf := 63 - quality*63/100
+
+	return writeAtomic(path, func(w io.Writer) error {
+		ctx, cancel := context.WithTimeout(g.ctx, ffmpegTimeout)
+		defer cancel()
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, ffmpeg,
+			"-hide_banner", "-loglevel", "error",
+			"-f", "png_pipe", "-i", "-",
+			"-c:v", encoder, "-crf", fmt.Sprint(crf), "-still-picture", "1",
+			"-pix_fmt", "yuv420p",
+			"-f", "avif", "-",
+		)
+		cmd.Stdin = &src
+		cmd.Stdout = w
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("encode avif: ffmpeg timed out after %s", ffmpegTimeout)
+			}
+			return fmt.Errorf("encode avif: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	})
+}
+
+// decodeThumb decodes a cached thumbnail of any format. AVIF is decoded
+// with ffmpeg, in one of the ffmpeg slots.
+func (g *Generator) decodeThumb(path string) (image.Image, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case AVIF.Ext():
+		ffmpeg := g.getFFmpeg()
+		if ffmpeg == "" {
+			return nil, fmt.Errorf("decode avif: ffmpeg not available")
+		}
+		select {
+		case g.ffmpegSem <- struct{}{}:
+		case <-g.ctx.Done():
+			return nil, g.ctx.Err()
+		}
+		defer func() { <-g.ffmpegSem }()
+		ctx, cancel := context.WithTimeout(g.ctx, ffmpegTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, ffmpeg,
+			"-hide_banner", "-loglevel", "error",
+			"-i", path, "-frames:v", "1",
+			"-f", "image2pipe", "-c:v", "png", "-",
+		).Output()
+		if err != nil {
+			return nil, fmt.Errorf("decode avif: %w", err)
+		}
+		return png.Decode(bytes.NewReader(out))
+	case JPEG.Ext():
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return jpeg.Decode(f)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return webp.Decode(f)
+}
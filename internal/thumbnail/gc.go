@@ -0,0 +1,151 @@
+package thumbnail
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrGCRunning is returned by CollectGarbage while another collection runs.
+var ErrGCRunning = errors.New("cache garbage collection already running")
+
+// tmpMaxAge is how old a temporary file left by writeAtomic must be before
+// it counts as abandoned by a crash rather than still being written.
+const tmpMaxAge = time.Hour
+
+// GCResult reports what a cache garbage collection removed.
+type GCResult struct {
+	Scanned   int64 `json:"scanned"`   // cached files looked at
+	Orphaned  int64 `json:"orphaned"`  // removed: their source is gone
+	Stale     int64 `json:"stale"`     // removed: an older thumbVersion
+	Temporary int64 `json:"temporary"` // removed: abandoned partial writes
+	Reclaimed int64 `json:"reclaimed"` // bytes freed
+	Failures  int64 `json:"failures"`  // failure cache entries dropped
+	TookMS    int64 `json:"took_ms"`
+}
+
+// CollectGarbage deletes cached thumbnails, crops and conversions that no
+// longer belong to any of paths (every file that may still be shown), those
+// of an older thumbVersion, and leftover temporary files. Cache files are
+// only named by the hash of their source path, so they are matched by
+// hashing paths. Files written since the collection started are kept, as
+// their source may have been indexed after paths was read.
+func (g *Generator) CollectGarbage(ctx context.Context, paths []string) (GCResult, error) {
+	if !g.gcMu.TryLock() {
+		return GCResult{}, ErrGCRunning
+	}
+	defer g.gcMu.Unlock()
+
+	start := time.Now()
+	live := make(map[[16]byte]struct{}, len(paths))
+	for _, p := range paths {
+		live[pathKey(p)] = struct{}{}
+	}
+
+	var result GCResult
+	remove := func(path string, info fs.FileInfo, count *int64) {
+		if err := os.Remove(path); err != nil {
+			return
+		}
+		*count++
+		result.Reclaimed += info.Size()
+	}
+	err := filepath.WalkDir(g.cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // vanished or unreadable; skip it
+		}
+		if d.IsDir() {
+			return ctx.Err()
+		}
+		if path == g.failCachePath() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(start) {
+			return nil
+		}
+		result.Scanned++
+
+		name := d.Name()
+		if strings.HasPrefix(name, ".") {
+			if strings.HasSuffix(name, ".tmp") && start.Sub(info.ModTime()) > tmpMaxAge {
+				remove(path, info, &result.Temporary)
+			}
+			return nil
+		}
+		key, version, ok := parseCacheName(name)
+		if !ok {
+			return nil // not ours
+		}
+		if _, ok := live[key]; !ok {
+			remove(path, info, &result.Orphaned)
+		} else if version != thumbVersion {
+			remove(path, info, &result.Stale)
+		}
+		return nil
+	})
+	if err == nil {
+		result.Failures = int64(g.pruneFailures(live))
+	}
+	result.TookMS = time.Since(start).Milliseconds()
+
+	log.Printf("Thumbnail: cache GC removed %d orphaned, %d stale and %d temporary files (%d MB) of %d; dropped %d failure records",
+		result.Orphaned, result.Stale, result.Temporary, result.Reclaimed>>20, result.Scanned, result.Failures)
+	return result, err
+}
+
+// pathKey returns the part of a source path's hash cache filenames start
+// with.
+func pathKey(path string) [16]byte {
+	sum := sha256.Sum256([]byte(path))
+	var key [16]byte
+	copy(key[:], sum[:16])
+	return key
+}
+
+// parseCacheName splits a cache filename, "<hash>_<variant>_<version>.<ext>",
+// into its source key and thumbVersion.
+func parseCacheName(name string) (key [16]byte, version string, ok bool) {
+	base, _, _ := strings.Cut(name, ".")
+	parts := strings.Split(base, "_")
+	if len(parts) < 3 || len(parts[0]) != 32 {
+		return key, "", false
+	}
+	if _, err := hex.Decode(key[:], []byte(parts[0])); err != nil {
+		return key, "", false
+	}
+	return key, parts[len(parts)-1], true
+}
+
+// pruneFailures drops failure cache entries of sources not in live, and
+// returns how many.
+func (g *Generator) pruneFailures(live map[[16]byte]struct{}) int {
+	g.failMu.Lock()
+	defer g.failMu.Unlock()
+
+	var b strings.Builder
+	dropped := 0
+	for p := range g.failCache {
+		if _, ok := live[pathKey(p)]; !ok {
+			delete(g.failCache, p)
+			dropped++
+			continue
+		}
+		b.WriteString(p)
+		b.WriteByte('\n')
+	}
+	if dropped == 0 {
+		return 0
+	}
+	if err := os.WriteFile(g.failCachePath(), []byte(b.String()), 0644); err != nil {
+		log.Printf("Thumbnail: failed to rewrite failure cache: %v", err)
+	}
+	return dropped
+}
@@ -0,0 +1,142 @@
+//go:build heif && cgo
+
+package thumbnail
+
+/*
+#cgo pkg-config: libheif
+#include <stdlib.h>
+#include <libheif/heif.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"unsafe"
+
+	"photog/internal/hdr"
+)
+
+// HEIFSupported reports whether HEIC/HEIF/AVIF sources can be decoded.
+const HEIFSupported = true
+
+// decodeHEIF decodes the primary image of a HEIC/HEIF/AVIF file with
+// libheif. libheif applies the container's rotation and mirroring, so the
+// result is already in display orientation.
+func decodeHEIF(path string) (image.Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("heif: empty file")
+	}
+
+	ctx := C.heif_context_alloc()
+	if ctx == nil {
+		return nil, errors.New("heif: out of memory")
+	}
+	defer C.heif_context_free(ctx)
+
+	// libheif keeps pointers into the buffer while decoding, so it must
+	// live in C memory rather than the Go heap.
+	buf := C.CBytes(data)
+	defer C.free(buf)
+
+	if err := heifErr(C.heif_context_read_from_memory_without_copy(ctx, buf, C.size_t(len(data)), nil)); err != nil {
+		return nil, fmt.Errorf("heif: read: %w", err)
+	}
+
+	var handle *C.struct_heif_image_handle
+	if err := heifErr(C.heif_context_get_primary_image_handle(ctx, &handle)); err != nil {
+		return nil, fmt.Errorf("heif: primary image: %w", err)
+	}
+	defer C.heif_image_handle_release(handle)
+
+	// HDR10 and HLG code values look washed out when shown as sRGB
+	if kind, bt2020 := heifHDRProfile(handle); kind != "" {
+		return decodeHEIFToneMapped(handle, kind, bt2020)
+	}
+
+	var img *C.struct_heif_image
+	if err := heifErr(C.heif_decode_image(handle, &img, C.heif_colorspace_RGB, C.heif_chroma_interleaved_RGBA, nil)); err != nil {
+		return nil, fmt.Errorf("heif: decode: %w", err)
+	}
+	defer C.heif_image_release(img)
+
+	width := int(C.heif_image_get_width(img, C.heif_channel_interleaved))
+	height := int(C.heif_image_get_height(img, C.heif_channel_interleaved))
+	var stride C.int
+	plane := C.heif_image_get_plane_readonly(img, C.heif_channel_interleaved, &stride)
+	if plane == nil || width <= 0 || height <= 0 {
+		return nil, errors.New("heif: decoded image has no pixel data")
+	}
+
+	out := image.NewNRGBA(image.Rect(0, 0, width, height))
+	src := unsafe.Slice((*byte)(unsafe.Pointer(plane)), int(stride)*height)
+	for y := 0; y < height; y++ {
+		copy(out.Pix[y*out.Stride:y*out.Stride+width*4], src[y*int(stride):])
+	}
+	return out, nil
+}
+
+// heifHDRProfile returns the HDR kind of an image's nclx colour profile,
+// or "" for SDR images and those with an ICC profile, and whether it uses
+// BT.2020 primaries.
+func heifHDRProfile(handle *C.struct_heif_image_handle) (string, bool) {
+	var nclx *C.struct_heif_color_profile_nclx
+	if err := heifErr(C.heif_image_handle_get_nclx_color_profile(handle, &nclx)); err != nil {
+		return "", false
+	}
+	defer C.heif_nclx_color_profile_free(nclx)
+	return hdr.TransferKind(int(nclx.transfer_characteristics)), int(nclx.color_primaries) == hdr.BT2020Primaries
+}
+
+// decodeHEIFToneMapped decodes a PQ or HLG image at full bit depth and tone
+// maps it into SDR sRGB.
+func decodeHEIFToneMapped(handle *C.struct_heif_image_handle, kind string, bt2020 bool) (image.Image, error) {
+	var img *C.struct_heif_image
+	if err := heifErr(C.heif_decode_image(handle, &img, C.heif_colorspace_RGB, C.heif_chroma_interleaved_RRGGBBAA_LE, nil)); err != nil {
+		return nil, fmt.Errorf("heif: decode: %w", err)
+	}
+	defer C.heif_image_release(img)
+
+	bits := int(C.heif_image_handle_get_luma_bits_per_pixel(handle))
+	if bits < 8 || bits > 16 {
+		bits = 16
+	}
+	width := int(C.heif_image_get_width(img, C.heif_channel_interleaved))
+	height := int(C.heif_image_get_height(img, C.heif_channel_interleaved))
+	var stride C.int
+	plane := C.heif_image_get_plane_readonly(img, C.heif_channel_interleaved, &stride)
+	if plane == nil || width <= 0 || height <= 0 {
+		return nil, errors.New("heif: decoded image has no pixel data")
+	}
+
+	// Samples are little-endian and bits deep; NRGBA64 wants 16-bit
+	// big-endian, so scale them up by repeating the high bits.
+	out := image.NewNRGBA64(image.Rect(0, 0, width, height))
+	src := unsafe.Slice((*byte)(unsafe.Pointer(plane)), int(stride)*height)
+	shift := uint(16 - bits)
+	for y := 0; y < height; y++ {
+		row := src[y*int(stride):]
+		dst := out.Pix[y*out.Stride:]
+		for i := 0; i < width*4; i++ {
+			v := uint16(row[2*i]) | uint16(row[2*i+1])<<8
+			v = v<<shift | v>>(uint(bits)-shift)
+			dst[2*i] = byte(v >> 8)
+			dst[2*i+1] = byte(v)
+		}
+	}
+	return hdr.ToneMap(out, kind, bt2020), nil
+}
+
+// heifErr converts a libheif error struct into a Go error, nil on success.
+func heifErr(e C.struct_heif_error) error {
+	if e.code == C.heif_error_Ok {
+		return nil
+	}
+	return errors.New(C.GoString(e.message))
+}
@@ -0,0 +1,16 @@
+//go:build !heif || !cgo
+
+package thumbnail
+
+import (
+	"errors"
+	"image"
+)
+
+// HEIFSupported reports whether HEIC/HEIF/AVIF sources can be decoded.
+const HEIFSupported = false
+
+// decodeHEIF is unavailable without libheif; build with -tags heif.
+func decodeHEIF(path string) (image.Image, error) {
+	return nil, errors.New("HEIC/HEIF/AVIF decoding not built in (rebuild with -tags heif and libheif installed)")
+}
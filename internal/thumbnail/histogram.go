@@ -0,0 +1,49 @@
+package thumbnail
+
+// Histogram holds 256-bucket channel histograms of an image.
+type Histogram struct {
+	Red       []int `json:"r"`
+	Green     []int `json:"g"`
+	Blue      []int `json:"b"`
+	Luminance []int `json:"l"` // Rec. 709 luma
+}
+
+// Histogram computes RGB and luminance histograms from the photo's medium
+// thumbnail (generating it if needed). That is plenty of pixels for an
+// exposure display and far cheaper than decoding the original.
+func (g *Generator) Histogram(path, mediaType string) (*Histogram, error) {
+	var thumb string
+	var err error
+	if mediaType == "video" {
+		thumb, err = g.GetOrCreateVideo(path, Medium)
+	} else {
+		thumb, err = g.GetOrCreate(path, Medium)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := g.decodeThumb(thumb)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Histogram{
+		Red:       make([]int, 256),
+		Green:     make([]int, 256),
+		Blue:      make([]int, 256),
+		Luminance: make([]int, 256),
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			r8, g8, b8 := r>>8, g>>8, bl>>8
+			h.Red[r8]++
+			h.Green[g8]++
+			h.Blue[b8]++
+			h.Luminance[(2126*r8+7152*g8+722*b8)/10000]++
+		}
+	}
+	return h, nil
+}
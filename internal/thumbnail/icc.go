@@ -0,0 +1,93 @@
+package thumbnail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"photog/internal/archive"
+)
+
+// iccMarker starts the APP2 segments a JPEG's ICC profile is split across.
+var iccMarker = []byte("ICC_PROFILE\x00")
+
+// iccProfile returns the ICC color profile embedded in a JPEG, or nil when
+// it has none or isn't a JPEG. Thumbnails keep the source's pixel values,
+// so a wide-gamut (say, Display P3) photo only shows its true colors when
+// the profile travels with them.
+func iccProfile(path string) []byte {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".jpg" && ext != ".jpeg" {
+		return nil
+	}
+	f, err := archive.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	return jpegICC(bufio.NewReader(f))
+}
+
+// jpegICC reads the segments before a JPEG's image data and joins the ICC
+// profile chunks in their sequence order.
+func jpegICC(r *bufio.Reader) []byte {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil
+	}
+	var chunks [][]byte
+	for {
+		var hdr [4]byte
+		if _, err := io.ReadFull(r, hdr[:2]); err != nil || hdr[0] != 0xFF {
+			break
+		}
+		marker := hdr[1]
+		if marker == 0xD8 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			continue // no length
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			break // image data follows; metadata is all before it
+		}
+		if _, err := io.ReadFull(r, hdr[2:]); err != nil {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(hdr[2:])) - 2
+		if n < 0 {
+			break
+		}
+		if marker != 0xE2 {
+			if _, err := r.Discard(n); err != nil {
+				break
+			}
+			continue
+		}
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			break
+		}
+		// ICC_PROFILE\0, sequence number (from 1), chunk count, data
+		if len(seg) < len(iccMarker)+2 || !bytes.HasPrefix(seg, iccMarker) {
+			continue
+		}
+		seq, count := int(seg[len(iccMarker)]), int(seg[len(iccMarker)+1])
+		if chunks == nil {
+			chunks = make([][]byte, count)
+		}
+		if count != len(chunks) || seq < 1 || seq > count {
+			return nil
+		}
+		chunks[seq-1] = seg[len(iccMarker)+2:]
+	}
+
+	var profile []byte
+	for _, c := range chunks {
+		if c == nil {
+			return nil // incomplete
+		}
+		profile = append(profile, c...)
+	}
+	return profile
+}
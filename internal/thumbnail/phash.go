@@ -0,0 +1,88 @@
+package thumbnail
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// dctCos[u][x] is cos((2x+1)uπ/64), the DCT-II basis for a 32-pixel row.
+var dctCos = func() (t [8][32]float64) {
+	for u := 0; u < 8; u++ {
+		for x := 0; x < 32; x++ {
+			t[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / 64)
+		}
+	}
+	return t
+}()
+
+// PHash returns the 64-bit perceptual hash of img: one bit per low
+// frequency of a 32x32 grayscale version, set when it is above the median.
+// Re-encodes, resizes and small crops or edits flip few bits, so visually
+// similar photos have hashes a small Hamming distance apart.
+func PHash(img image.Image) uint64 {
+	small := imaging.Resize(img, 32, 32, imaging.Box)
+	var px [32][32]float64
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			i := small.PixOffset(x, y)
+			p := small.Pix[i : i+3]
+			px[y][x] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		}
+	}
+
+	// Top-left 8x8 of the 2D DCT, via rows then columns
+	var rows [32][8]float64
+	for y := 0; y < 32; y++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for x := 0; x < 32; x++ {
+				sum += px[y][x] * dctCos[u][x]
+			}
+			rows[y][u] = sum
+		}
+	}
+	coeffs := make([]float64, 0, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for y := 0; y < 32; y++ {
+				sum += rows[y][u] * dctCos[v][y]
+			}
+			coeffs = append(coeffs, sum)
+		}
+	}
+
+	// The DC term is overall brightness; leave it out of the median
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var hash uint64
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return hash
+}
+
+// PerceptualHash returns the perceptual hash of an image from its small
+// thumbnail, generating the thumbnail if needed.
+func (g *Generator) PerceptualHash(path string) (uint64, error) {
+	thumb, err := g.GetOrCreate(path, Small)
+	if err != nil {
+		return 0, err
+	}
+	img, err := g.decodeThumb(thumb)
+	if err != nil {
+		return 0, err
+	}
+	if img == nil || img.Bounds().Empty() {
+		return 0, fmt.Errorf("empty thumbnail for %s", path)
+	}
+	return PHash(img), nil
+}
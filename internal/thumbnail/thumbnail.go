@@ -2,12 +2,14 @@ package thumbnail
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"log"
 	"os"
 	"os/exec"
@@ -20,7 +22,10 @@ import (
 	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
 	"github.com/rwcarlsen/goexif/exif"
+	"photog/internal/archive"
+	"photog/internal/background"
 	"photog/internal/config"
+	"photog/internal/rawpreview"
 )
 
 // ffmpegTimeout is the maximum time allowed for a single ffmpeg invocation.
@@ -34,9 +39,22 @@ const thumbVersion = "v2"
 type Generator struct {
 	cacheDir string
 	config   config.ThumbnailConfig
+	filter   imaging.ResampleFilter
+	// output format of GetOrCreate (see Format)
+	format Format
 	// ffmpeg availability (cached)
 	ffmpegOnce sync.Once
 	ffmpegPath string
+	// ffmpeg's AV1 encoder, for AVIF (cached)
+	avifOnce    sync.Once
+	avifEncoder string
+	// ffmpegSem caps concurrent ffmpeg processes across on-demand and
+	// pregen requests
+	ffmpegSem chan struct{}
+	// parent of ffmpeg runs, canceled on shutdown (see SetContext)
+	ctx context.Context
+	// external thumbnailers by extension (see decodeExternal)
+	external map[string]config.ExternalThumbnailer
 	// failure cache: tracks files that failed thumbnail generation so we
 	// don't waste CPU retrying them every boot. Persisted to disk.
 	failMu    sync.RWMutex
@@ -44,8 +62,39 @@ type Generator struct {
 	// pregen progress tracking (readable from API)
 	pregenMu       sync.RWMutex
 	pregenProgress PregenProgress
+	// on-demand cache warming job (see Warm)
+	warmMu       sync.Mutex
+	warmProgress WarmProgress
+	// held while CollectGarbage runs
+	gcMu sync.Mutex
+
+	// OnPregenItem, if set, is called once pregen has settled an item: with a
+	// nil error when its small thumbnail exists, or the failure otherwise.
+	// Items skipped for lack of ffmpeg are not reported.
+	OnPregenItem func(item PregenItem, err error)
+
+	// OnGenerated, if set, is called after a thumbnail is generated with how
+	// long it took (excluding time spent waiting for an ffmpeg slot).
+	OnGenerated func(path string, size Size, took time.Duration)
+
+	// OnHashed, if set, is called with an image's perceptual hash (see
+	// PHash) whenever its small thumbnail is generated.
+	OnHashed func(path string, hash uint64)
 }
 
+// resampleFilters maps thumbnail.filter names to imaging filters.
+var resampleFilters = map[string]imaging.ResampleFilter{
+	"":           imaging.Lanczos,
+	"lanczos":    imaging.Lanczos,
+	"catmullrom": imaging.CatmullRom,
+	"mitchell":   imaging.MitchellNetravali,
+	"linear":     imaging.Linear,
+	"box":        imaging.Box,
+}
+
+// errPreviouslyFailed is reported for items already in the failure cache.
+var errPreviouslyFailed = fmt.Errorf("previously failed")
+
 // Size represents a thumbnail size preset.
 type Size string
 
@@ -53,6 +102,9 @@ const (
 	Small  Size = "sm"
 	Medium Size = "md"
 	Large  Size = "lg"
+	// XLarge is for zooming in the lightbox without fetching the original.
+	// It is only generated on request and keeps the source's ICC profile.
+	XLarge Size = "xl"
 )
 
 // PregenProgress tracks background thumbnail pre-generation state.
@@ -75,15 +127,48 @@ func New(cacheDir string, cfg config.ThumbnailConfig) (*Generator, error) {
 		return nil, fmt.Errorf("create thumb dir: %w", err)
 	}
 
+	concurrency := cfg.FFmpegConcurrency
+	if concurrency <= 0 {
+		concurrency = 2
+	}
+
+	filter, ok := resampleFilters[strings.ToLower(cfg.Filter)]
+	if !ok {
+		return nil, fmt.Errorf("unknown thumbnail filter %q", cfg.Filter)
+	}
+	external, err := externalThumbnailers(cfg.External)
+	if err != nil {
+		return nil, err
+	}
+	format, err := ParseFormat(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+
 	g := &Generator{
 		cacheDir:  thumbDir,
 		config:    cfg,
+		format:    format,
+		filter:    filter,
 		failCache: make(map[string]bool),
+		ffmpegSem: make(chan struct{}, concurrency),
+		ctx:       context.Background(),
+		external:  external,
+	}
+	if !g.CanEncode(format) {
+		return nil, fmt.Errorf("thumbnail format avif needs ffmpeg with an AV1 encoder (%s)", strings.Join(avifEncoders, ", "))
 	}
 	g.loadFailCache()
 	return g, nil
 }
 
+// SetContext sets the process-wide context. Canceling it kills running
+// ffmpeg children and stops pregen without marking the interrupted items
+// as failed. Call it before generating anything.
+func (g *Generator) SetContext(ctx context.Context) {
+	g.ctx = ctx
+}
+
 // failCachePath returns the path to the on-disk failure cache file.
 func (g *Generator) failCachePath() string {
 	return filepath.Join(g.cacheDir, "fail_cache.txt")
@@ -136,6 +221,81 @@ func (g *Generator) hasFailed(path string) bool {
 	return g.failCache[path]
 }
 
+// clearFailure removes a path from the failure cache and rewrites the file.
+func (g *Generator) clearFailure(path string) {
+	g.failMu.Lock()
+	defer g.failMu.Unlock()
+
+	if !g.failCache[path] {
+		return
+	}
+	delete(g.failCache, path)
+
+	var b strings.Builder
+	for p := range g.failCache {
+		b.WriteString(p)
+		b.WriteByte('\n')
+	}
+	if err := os.WriteFile(g.failCachePath(), []byte(b.String()), 0644); err != nil {
+		log.Printf("Thumbnail: failed to rewrite failure cache: %v", err)
+	}
+}
+
+// Invalidate deletes cached thumbnails for a photo, in every format, so
+// they are regenerated on the next request. With no sizes given, every size
+// (and any cropped renditions) is removed. The photo is also cleared from the failure cache.
+// Returns the number of files removed.
+func (g *Generator) Invalidate(photoPath string, sizes ...Size) int {
+	all := len(sizes) == 0
+	if all {
+		sizes = []Size{Small, Medium, Large, XLarge}
+	}
+
+	removed := 0
+	for _, size := range sizes {
+		for _, f := range []Format{WebP, AVIF, JPEG} {
+			if err := os.Remove(g.formatPath(photoPath, size, f)); err == nil {
+				removed++
+			}
+		}
+	}
+
+	if all {
+		hash := sha256.Sum256([]byte(photoPath))
+		crops, _ := filepath.Glob(filepath.Join(g.cacheDir, "crops", fmt.Sprintf("%x_*", hash[:16])))
+		converted, _ := filepath.Glob(filepath.Join(g.cacheDir, "converted", fmt.Sprintf("%x_*", hash[:16])))
+		for _, c := range append(crops, converted...) {
+			if err := os.Remove(c); err == nil {
+				removed++
+			}
+		}
+	}
+
+	g.clearFailure(photoPath)
+	return removed
+}
+
+// Retry regenerates one thumbnail size from scratch, discarding any cached
+// copy and failure record first. The returned error is the underlying
+// generation failure, which is recorded in the failure cache again.
+func (g *Generator) Retry(path, mediaType string, size Size) (string, error) {
+	os.Remove(g.thumbPath(path, size))
+	g.clearFailure(path)
+
+	var thumbPath string
+	var err error
+	if mediaType == "video" {
+		thumbPath, err = g.GetOrCreateVideo(path, size)
+	} else {
+		thumbPath, err = g.GetOrCreate(path, size)
+	}
+	if err != nil {
+		g.recordFailure(path)
+		return "", err
+	}
+	return thumbPath, nil
+}
+
 // GetPregenProgress returns the current thumbnail pre-generation progress.
 func (g *Generator) GetPregenProgress() PregenProgress {
 	g.pregenMu.RLock()
@@ -152,17 +312,25 @@ func (g *Generator) updatePregenProgress(fn func(p *PregenProgress)) {
 
 // GetOrCreate returns the path to a cached thumbnail, generating it if needed.
 func (g *Generator) GetOrCreate(photoPath string, size Size) (string, error) {
-	thumbPath := g.thumbPath(photoPath, size)
+	return g.GetOrCreateFormat(photoPath, size, g.format)
+}
+
+// GetOrCreateFormat is GetOrCreate for a thumbnail in format f, which may
+// differ from the configured one for clients that can't display that.
+func (g *Generator) GetOrCreateFormat(photoPath string, size Size, f Format) (string, error) {
+	thumbPath := g.formatPath(photoPath, size, f)
 
 	// Check if thumbnail already exists
-	if _, err := os.Stat(thumbPath); err == nil {
+	if cached(thumbPath) {
 		return thumbPath, nil
 	}
 
 	// Generate thumbnail
-	if err := g.generate(photoPath, thumbPath, size); err != nil {
+	start := time.Now()
+	if err := g.generate(photoPath, thumbPath, size, f); err != nil {
 		return "", fmt.Errorf("generate thumbnail: %w", err)
 	}
+	g.generated(photoPath, size, time.Since(start))
 
 	return thumbPath, nil
 }
@@ -170,10 +338,15 @@ func (g *Generator) GetOrCreate(photoPath string, size Size) (string, error) {
 // GetOrCreateVideo returns the path to a cached video thumbnail, generating it if needed.
 // Uses ffmpeg to extract a frame from the video.
 func (g *Generator) GetOrCreateVideo(videoPath string, size Size) (string, error) {
-	thumbPath := g.thumbPath(videoPath, size)
+	return g.GetOrCreateVideoFormat(videoPath, size, g.format)
+}
+
+// GetOrCreateVideoFormat is GetOrCreateVideo for a thumbnail in format f.
+func (g *Generator) GetOrCreateVideoFormat(videoPath string, size Size, f Format) (string, error) {
+	thumbPath := g.formatPath(videoPath, size, f)
 
 	// Check if thumbnail already exists
-	if _, err := os.Stat(thumbPath); err == nil {
+	if cached(thumbPath) {
 		return thumbPath, nil
 	}
 
@@ -183,6 +356,19 @@ func (g *Generator) GetOrCreateVideo(videoPath string, size Size) (string, error
 		return "", fmt.Errorf("ffmpeg not available")
 	}
 
+	// Wait for an ffmpeg slot. Another request may have generated this
+	// thumbnail while we waited.
+	select {
+	case g.ffmpegSem <- struct{}{}:
+	case <-g.ctx.Done():
+		return "", g.ctx.Err()
+	}
+	defer func() { <-g.ffmpegSem }()
+	if cached(thumbPath) {
+		return thumbPath, nil
+	}
+	start := time.Now()
+
 	// Ensure output directory exists
 	if err := os.MkdirAll(filepath.Dir(thumbPath), 0755); err != nil {
 		return "", err
@@ -192,15 +378,22 @@ func (g *Generator) GetOrCreateVideo(videoPath string, size Size) (string, error
 	tmpJpg := thumbPath + ".tmp.jpg"
 	defer os.Remove(tmpJpg)
 
+	// ffmpeg needs a real file; archive entries are extracted first
+	localPath, cleanup, err := archive.Local(videoPath)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
 	maxDim := g.maxDimension(size)
 	scaleFilter := fmt.Sprintf("scale='min(%d,iw)':'min(%d,ih)':force_original_aspect_ratio=decrease", maxDim, maxDim)
 
-	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	ctx, cancel := context.WithTimeout(g.ctx, ffmpegTimeout)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx,
 		ffmpeg,
-		"-i", videoPath,
+		"-i", localPath,
 		"-ss", "1",        // seek to 1 second
 		"-frames:v", "1",  // extract single frame
 		"-vf", scaleFilter,
@@ -211,13 +404,16 @@ func (g *Generator) GetOrCreateVideo(videoPath string, size Size) (string, error
 		if ctx.Err() == context.DeadlineExceeded {
 			return "", fmt.Errorf("ffmpeg timed out after %s for %s", ffmpegTimeout, videoPath)
 		}
+		if g.ctx.Err() != nil {
+			return "", g.ctx.Err()
+		}
 		// Retry at 0 seconds (video might be < 1 second)
-		ctx2, cancel2 := context.WithTimeout(context.Background(), ffmpegTimeout)
+		ctx2, cancel2 := context.WithTimeout(g.ctx, ffmpegTimeout)
 		defer cancel2()
 
 		cmd2 := exec.CommandContext(ctx2,
 			ffmpeg,
-			"-i", videoPath,
+			"-i", localPath,
 			"-frames:v", "1",
 			"-vf", scaleFilter,
 			"-y",
@@ -227,32 +423,34 @@ func (g *Generator) GetOrCreateVideo(videoPath string, size Size) (string, error
 			if ctx2.Err() == context.DeadlineExceeded {
 				return "", fmt.Errorf("ffmpeg timed out after %s for %s", ffmpegTimeout, videoPath)
 			}
+			if g.ctx.Err() != nil {
+				return "", g.ctx.Err()
+			}
 			return "", fmt.Errorf("ffmpeg error: %v: %s / %s", err, string(out), string(out2))
 		}
 	}
 
-	// Now open the extracted JPEG and convert to WebP thumbnail
+	// Now open the extracted JPEG and convert it to the thumbnail
 	src, err := openImage(tmpJpg)
 	if err != nil {
 		return "", fmt.Errorf("open extracted frame: %w", err)
 	}
 
-	thumb := imaging.Fit(src, maxDim, maxDim, imaging.Lanczos)
-
-	out, err := os.Create(thumbPath)
-	if err != nil {
-		return "", fmt.Errorf("create output: %w", err)
-	}
-	defer out.Close()
-
-	if err := webp.Encode(out, thumb, &webp.Options{Quality: float32(g.config.Quality)}); err != nil {
-		os.Remove(thumbPath)
-		return "", fmt.Errorf("encode webp: %w", err)
+	if err := g.writeThumb(thumbPath, g.resize(src, size), size, f, nil); err != nil {
+		return "", err
 	}
+	g.generated(videoPath, size, time.Since(start))
 
 	return thumbPath, nil
 }
 
+// generated reports a finished thumbnail to OnGenerated, if set.
+func (g *Generator) generated(path string, size Size, took time.Duration) {
+	if g.OnGenerated != nil {
+		g.OnGenerated(path, size, took)
+	}
+}
+
 // HasFFmpeg returns whether ffmpeg is available for video thumbnails.
 func (g *Generator) HasFFmpeg() bool {
 	return g.getFFmpeg() != ""
@@ -273,9 +471,81 @@ func (g *Generator) getFFmpeg() string {
 
 // Exists checks if a thumbnail already exists in the cache.
 func (g *Generator) Exists(photoPath string, size Size) bool {
-	thumbPath := g.thumbPath(photoPath, size)
-	_, err := os.Stat(thumbPath)
-	return err == nil
+	return cached(g.thumbPath(photoPath, size))
+}
+
+// ExistsFormat checks if a thumbnail in format f already exists in the
+// cache.
+func (g *Generator) ExistsFormat(photoPath string, size Size, f Format) bool {
+	return cached(g.formatPath(photoPath, size, f))
+}
+
+// cached reports whether a usable cache file exists at path. Empty files,
+// left by crashes or full disks before writes were atomic, are removed so
+// they get regenerated.
+func cached(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if info.Size() == 0 {
+		log.Printf("Thumbnail: removing empty cache file %s", path)
+		os.Remove(path)
+		return false
+	}
+	return true
+}
+
+// writeAtomic writes a cache file through a temp file in the same directory
+// and renames it into place, so readers never see a partial file.
+func writeAtomic(path string, encode func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create output: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if err := encode(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write output: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeWebP encodes img as a WebP thumbnail of the given size at path.
+func (g *Generator) writeWebP(path string, img image.Image, size Size) error {
+	return writeAtomic(path, func(w io.Writer) error {
+		if err := webp.Encode(w, img, &webp.Options{Quality: float32(g.quality(size))}); err != nil {
+			return fmt.Errorf("encode webp: %w", err)
+		}
+		return nil
+	})
+}
+
+// writeWebPProfile is writeWebP with an ICC color profile embedded, when
+// there is one.
+func (g *Generator) writeWebPProfile(path string, img image.Image, size Size, icc []byte) error {
+	if len(icc) == 0 {
+		return g.writeWebP(path, img, size)
+	}
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, &webp.Options{Quality: float32(g.quality(size))}); err != nil {
+		return fmt.Errorf("encode webp: %w", err)
+	}
+	data, err := webp.SetMetadata(buf.Bytes(), icc, "ICCP")
+	if err != nil {
+		return fmt.Errorf("embed color profile: %w", err)
+	}
+	return writeAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
 }
 
 // ThumbPath returns the expected cache path for a thumbnail (without generating).
@@ -284,11 +554,17 @@ func (g *Generator) ThumbPath(photoPath string, size Size) string {
 }
 
 func (g *Generator) thumbPath(photoPath string, size Size) string {
+	return g.formatPath(photoPath, size, g.format)
+}
+
+// formatPath returns the cache path of a thumbnail in format f. Formats
+// differ by extension, so switching formats doesn't reuse the old files.
+func (g *Generator) formatPath(photoPath string, size Size, f Format) string {
 	hash := sha256.Sum256([]byte(photoPath))
 	hashStr := fmt.Sprintf("%x", hash[:16]) // 32 char hex
 	// Organize into subdirectories for filesystem performance.
 	// thumbVersion is included so bumping it invalidates old caches.
-	return filepath.Join(g.cacheDir, hashStr[:2], hashStr[2:4], fmt.Sprintf("%s_%s_%s.webp", hashStr, size, thumbVersion))
+	return filepath.Join(g.cacheDir, hashStr[:2], hashStr[2:4], fmt.Sprintf("%s_%s_%s%s", hashStr, size, thumbVersion, f.Ext()))
 }
 
 func (g *Generator) maxDimension(size Size) int {
@@ -299,45 +575,237 @@ func (g *Generator) maxDimension(size Size) int {
 		return g.config.MediumSize
 	case Large:
 		return g.config.LargeSize
+	case XLarge:
+		return g.config.XLargeSize
 	default:
 		return g.config.MediumSize
 	}
 }
 
-func (g *Generator) generate(srcPath, dstPath string, size Size) error {
+func (g *Generator) generate(srcPath, dstPath string, size Size, f Format) error {
 	// Ensure output directory exists
 	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
 		return err
 	}
 
-	// Open and decode source image with auto-orientation (handles EXIF rotation)
+	src, err := g.loadSource(srcPath)
+	if err != nil {
+		return err
+	}
+
+	img := g.resize(src, size)
+	if size == Small && g.OnHashed != nil && !img.Bounds().Empty() {
+		g.OnHashed(srcPath, PHash(img))
+	}
+
+	var icc []byte
+	if size == XLarge {
+		icc = iccProfile(srcPath)
+	}
+	if f == AVIF {
+		select {
+		case g.ffmpegSem <- struct{}{}:
+		case <-g.ctx.Done():
+			return g.ctx.Err()
+		}
+		defer func() { <-g.ffmpegSem }()
+	}
+	return g.writeThumb(dstPath, img, size, f, icc)
+}
+
+// resize fits src within the size preset's box, keeping its aspect ratio,
+// then sharpens it if configured.
+func (g *Generator) resize(src image.Image, size Size) image.Image {
+	maxDim := g.maxDimension(size)
+	img := imaging.Fit(src, maxDim, maxDim, g.filter)
+	if g.config.Sharpen > 0 {
+		img = imaging.Sharpen(img, g.config.Sharpen)
+	}
+	return img
+}
+
+// quality returns the WebP quality for a size preset (see formatQuality).
+func (g *Generator) quality(size Size) int {
+	var q int
+	switch size {
+	case Small:
+		q = g.config.SmallQuality
+	case Medium:
+		q = g.config.MediumQuality
+	case Large:
+		q = g.config.LargeQuality
+	case XLarge:
+		q = g.config.XLargeQuality
+	}
+	if q <= 0 {
+		return g.config.Quality
+	}
+	return q
+}
+
+// heifExts are the formats decoded with libheif rather than imaging.
+var heifExts = map[string]bool{".heic": true, ".heif": true, ".avif": true}
+
+// loadSource opens and decodes a source image with auto-orientation
+// (handles EXIF rotation), through an external thumbnailer if one is
+// configured for its extension.
+func (g *Generator) loadSource(srcPath string) (image.Image, error) {
+	// Decoders need a real file; archive entries are extracted first
+	srcPath, cleanup, err := archive.Local(srcPath)
+	if err != nil {
+		return nil, fmt.Errorf("open source: %w", err)
+	}
+	defer cleanup()
+
+	ext := strings.ToLower(filepath.Ext(srcPath))
+	if t, ok := g.external[ext]; ok {
+		src, err := g.decodeExternal(t, srcPath)
+		if err != nil {
+			return nil, fmt.Errorf("open source: %w", err)
+		}
+		return src, nil
+	}
+	if rawpreview.Exts[ext] {
+		// The embedded preview is stored unrotated
+		src, err := rawpreview.Decode(srcPath)
+		if err != nil {
+			return nil, fmt.Errorf("open source: %w", err)
+		}
+		return applyExifOrientation(srcPath, src), nil
+	}
+	if heifExts[ext] {
+		src, err := decodeHEIF(srcPath)
+		if err != nil {
+			return nil, fmt.Errorf("open source: %w", err)
+		}
+		return src, nil
+	}
+
 	src, err := imaging.Open(srcPath, imaging.AutoOrientation(true))
 	if err != nil {
 		// Fallback to manual decode for formats imaging doesn't handle natively
 		src, err = openImage(srcPath)
 		if err != nil {
-			return fmt.Errorf("open source: %w", err)
+			return nil, fmt.Errorf("open source: %w", err)
 		}
 	}
+	return src, nil
+}
 
-	maxDim := g.maxDimension(size)
+// GetOrCreateCropped returns the path to a cached JPEG of the photo scaled and
+// center-cropped to exactly width x height, generating it if needed. Used for
+// wallpapers, where the output must fill the screen and be widely decodable.
+func (g *Generator) GetOrCreateCropped(photoPath string, width, height int) (string, error) {
+	hash := sha256.Sum256([]byte(photoPath))
+	hashStr := fmt.Sprintf("%x", hash[:16])
+	cropPath := filepath.Join(g.cacheDir, "crops", fmt.Sprintf("%s_%dx%d_%s.jpg", hashStr, width, height, thumbVersion))
 
-	// Resize while maintaining aspect ratio (fit within maxDim x maxDim)
-	thumb := imaging.Fit(src, maxDim, maxDim, imaging.Lanczos)
+	if cached(cropPath) {
+		return cropPath, nil
+	}
 
-	// Encode as WebP
-	out, err := os.Create(dstPath)
+	if err := os.MkdirAll(filepath.Dir(cropPath), 0755); err != nil {
+		return "", err
+	}
+
+	src, err := g.loadSource(photoPath)
 	if err != nil {
-		return fmt.Errorf("create output: %w", err)
+		return "", err
 	}
-	defer out.Close()
 
-	if err := webp.Encode(out, thumb, &webp.Options{Quality: float32(g.config.Quality)}); err != nil {
-		os.Remove(dstPath)
-		return fmt.Errorf("encode webp: %w", err)
+	cropped := imaging.Fill(src, width, height, imaging.Center, g.filter)
+
+	err = writeAtomic(cropPath, func(w io.Writer) error {
+		if err := jpeg.Encode(w, cropped, &jpeg.Options{Quality: g.config.Quality}); err != nil {
+			return fmt.Errorf("encode jpeg: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return cropPath, nil
+}
+
+// ConvertFormats are the formats GetOrCreateConverted can write, by name.
+var ConvertFormats = map[string]string{"jpeg": ".jpg", "png": ".png", "webp": ".webp"}
+
+// ConvertedPath returns the cache path of a photo converted to format and
+// fitted within maxDim x maxDim (without generating).
+func (g *Generator) ConvertedPath(photoPath, format string, maxDim int) string {
+	hash := sha256.Sum256([]byte(photoPath))
+	return filepath.Join(g.cacheDir, "converted", fmt.Sprintf("%x_%d_%s%s", hash[:16], maxDim, thumbVersion, ConvertFormats[format]))
+}
+
+// GetOrCreateConverted returns the path to a cached copy of the photo in
+// format (one of ConvertFormats), fitted within maxDim x maxDim and never
+// upscaled, generating it if needed. Used to show originals browsers can't
+// decode, such as HEIC, RAW and TIFF.
+func (g *Generator) GetOrCreateConverted(photoPath, format string, maxDim int) (string, error) {
+	if _, ok := ConvertFormats[format]; !ok {
+		return "", fmt.Errorf("unsupported format %q", format)
+	}
+	convPath := g.ConvertedPath(photoPath, format, maxDim)
+	if cached(convPath) {
+		return convPath, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(convPath), 0755); err != nil {
+		return "", err
+	}
+
+	src, err := g.loadSource(photoPath)
+	if err != nil {
+		return "", err
+	}
+	img := imaging.Fit(src, maxDim, maxDim, g.filter)
+
+	err = writeAtomic(convPath, func(w io.Writer) error {
+		switch format {
+		case "png":
+			if err := png.Encode(w, img); err != nil {
+				return fmt.Errorf("encode png: %w", err)
+			}
+		case "webp":
+			if err := webp.Encode(w, img, &webp.Options{Quality: float32(g.config.Quality)}); err != nil {
+				return fmt.Errorf("encode webp: %w", err)
+			}
+		default:
+			if err := jpeg.Encode(w, img, &jpeg.Options{Quality: g.config.Quality}); err != nil {
+				return fmt.Errorf("encode jpeg: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
 	}
 
-	return nil
+	return convPath, nil
+}
+
+// RenderJPEG decodes an image and returns it resized to the given preset as
+// JPEG bytes. Used when sending images to clients that can't take WebP.
+func (g *Generator) RenderJPEG(photoPath string, size Size) ([]byte, error) {
+	return g.RenderJPEGMax(photoPath, g.maxDimension(size))
+}
+
+// RenderJPEGMax is like RenderJPEG but fits the image within an arbitrary
+// maxDim x maxDim box instead of a size preset.
+func (g *Generator) RenderJPEGMax(photoPath string, maxDim int) ([]byte, error) {
+	src, err := g.loadSource(photoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	img := imaging.Fit(src, maxDim, maxDim, g.filter)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: g.config.Quality}); err != nil {
+		return nil, fmt.Errorf("encode jpeg: %w", err)
+	}
+	return buf.Bytes(), nil
 }
 
 func openImage(path string) (image.Image, error) {
@@ -415,6 +883,13 @@ func applyExifOrientation(path string, img image.Image) image.Image {
 	}
 }
 
+// pregenDone reports a settled pregen item to OnPregenItem, if set.
+func (g *Generator) pregenDone(item PregenItem, err error) {
+	if g.OnPregenItem != nil {
+		g.OnPregenItem(item, err)
+	}
+}
+
 // PregenResult holds stats from a pre-generation run.
 type PregenResult struct {
 	Generated int64
@@ -422,12 +897,12 @@ type PregenResult struct {
 	Errors    int64
 }
 
-// PregenSmallThumbnails generates small thumbnails for all provided items in slow background batches.
-// items is a slice of {Path, MediaType} pairs. It sleeps between batches to avoid resource abuse.
+// PregenSmallThumbnails generates small thumbnails for about total items in slow background batches.
+// Items are read a page at a time from next, until it returns none, so the whole list never has to be
+// in memory. It sleeps between batches to avoid resource abuse.
 // The stop channel can be closed to abort early.
-func (g *Generator) PregenSmallThumbnails(items []PregenItem, batchSize int, batchDelay time.Duration, stop <-chan struct{}, progress *atomic.Int64) PregenResult {
+func (g *Generator) PregenSmallThumbnails(total int64, next func() ([]PregenItem, error), batchSize int, batchDelay time.Duration, stop <-chan struct{}, progress *atomic.Int64) (PregenResult, error) {
 	var result PregenResult
-	total := len(items)
 	startTime := time.Now()
 	lastLogTime := startTime
 
@@ -435,65 +910,40 @@ func (g *Generator) PregenSmallThumbnails(items []PregenItem, batchSize int, bat
 	g.updatePregenProgress(func(p *PregenProgress) {
 		*p = PregenProgress{
 			Running:   true,
-			Total:     int64(total),
+			Total:     total,
 			StartedAt: startTime.Format(time.RFC3339),
 		}
 	})
 
-	for i := 0; i < total; i += batchSize {
+	var pending []PregenItem
+	for {
 		// Check for stop signal
 		select {
 		case <-stop:
-			return result
+			return result, nil
 		default:
 		}
 
-		end := i + batchSize
-		if end > total {
-			end = total
-		}
-
-		batch := items[i:end]
-		for _, item := range batch {
-			// Skip items that previously failed (persisted across restarts)
-			if g.hasFailed(item.Path) {
-				result.Skipped++
-				if progress != nil {
-					progress.Add(1)
-				}
-				continue
-			}
-
-			// Check if already cached
-			if g.Exists(item.Path, Small) {
-				result.Skipped++
-				if progress != nil {
-					progress.Add(1)
-				}
-				continue
+		if len(pending) == 0 {
+			page, err := next()
+			if err != nil {
+				return result, err
 			}
-
-			var err error
-			if item.MediaType == "video" {
-				if g.HasFFmpeg() {
-					_, err = g.GetOrCreateVideo(item.Path, Small)
-				} else {
-					result.Skipped++
-					if progress != nil {
-						progress.Add(1)
-					}
-					continue
-				}
-			} else {
-				_, err = g.GetOrCreate(item.Path, Small)
+			if len(page) == 0 {
+				break
 			}
-
-			if err != nil {
-				result.Errors++
-				g.recordFailure(item.Path)
-				log.Printf("Pregen: error generating thumb for %s: %v", item.Path, err)
-			} else {
-				result.Generated++
+			pending = page
+		}
+		n := batchSize
+		if n > len(pending) {
+			n = len(pending)
+		}
+		batch := pending[:n]
+		pending = pending[n:]
+		for _, item := range batch {
+			if !g.pregenItem(item, &result) {
+				// Shutting down: the item is retried on the next run
+				return result, nil
 			}
 			if progress != nil {
 				progress.Add(1)
@@ -509,7 +959,7 @@ func (g *Generator) PregenSmallThumbnails(items []PregenItem, batchSize int, bat
 			rate = float64(processed) / elapsed.Seconds()
 		}
 		if rate > 0 {
-			etaSeconds = int64(float64(int64(total)-processed) / rate)
+			etaSeconds = int64(float64(total-processed) / rate)
 		}
 
 		// Update API-visible progress every batch
@@ -534,10 +984,10 @@ func (g *Generator) PregenSmallThumbnails(items []PregenItem, batchSize int, bat
 		}
 
 		// Sleep between batches to avoid resource abuse
-		if end < total {
+		if processed < total {
 			select {
 			case <-stop:
-				return result
+				return result, nil
 			case <-time.After(batchDelay):
 			}
 		}
@@ -556,11 +1006,78 @@ func (g *Generator) PregenSmallThumbnails(items []PregenItem, batchSize int, bat
 		p.EtaSeconds = 0
 	})
 
+	return result, nil
+}
+
+// PregenNew generates the small thumbnails of just-indexed items right away,
+// without the pauses between batches of PregenSmallThumbnails, so new files
+// have them before the next full pregen run gets to them. The pregen
+// progress is left to that run.
+func (g *Generator) PregenNew(items []PregenItem, stop <-chan struct{}, progress *atomic.Int64) PregenResult {
+	var result PregenResult
+	for _, item := range items {
+		select {
+		case <-stop:
+			return result
+		default:
+		}
+		if !g.pregenItem(item, &result) {
+			return result
+		}
+		if progress != nil {
+			progress.Add(1)
+		}
+	}
 	return result
 }
 
+// pregenItem generates an item's small thumbnail unless it is cached or
+// failed before, counting the outcome in result. It returns false if the
+// generator is shutting down, leaving the item unsettled.
+func (g *Generator) pregenItem(item PregenItem, result *PregenResult) bool {
+	// Skip items that previously failed (persisted across restarts)
+	if g.hasFailed(item.Path) {
+		result.Skipped++
+		g.pregenDone(item, errPreviouslyFailed)
+		return true
+	}
+
+	// Check if already cached
+	if g.Exists(item.Path, Small) {
+		result.Skipped++
+		g.pregenDone(item, nil)
+		return true
+	}
+
+	var err error
+	if item.MediaType == "video" {
+		if !g.HasFFmpeg() {
+			result.Skipped++
+			return true
+		}
+		_, err = g.GetOrCreateVideo(item.Path, Small)
+	} else {
+		_, err = g.GetOrCreate(item.Path, Small)
+	}
+
+	if err != nil && g.ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		result.Errors++
+		g.recordFailure(item.Path)
+		log.Printf("Pregen: error generating thumb for %s: %v", item.Path, err)
+	} else {
+		result.Generated++
+	}
+	g.pregenDone(item, err)
+	background.Pause()
+	return true
+}
+
 // PregenItem represents a media file for pre-generation.
 type PregenItem struct {
+	ID        int64
 	Path      string
 	MediaType string
 }
@@ -0,0 +1,100 @@
+package thumbnail
+
+import (
+	"log"
+	"time"
+
+	"photog/internal/background"
+)
+
+// WarmProgress tracks an on-demand cache warming job.
+type WarmProgress struct {
+	Running    bool   `json:"running"`
+	Sizes      []Size `json:"sizes"`
+	Total      int64  `json:"total"`
+	Generated  int64  `json:"generated"`
+	Skipped    int64  `json:"skipped"`
+	Errors     int64  `json:"errors"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+}
+
+// GetWarmProgress returns the state of the current or last warming job.
+func (g *Generator) GetWarmProgress() WarmProgress {
+	g.warmMu.Lock()
+	defer g.warmMu.Unlock()
+	return g.warmProgress
+}
+
+// Warm generates the given thumbnail sizes for items in the background,
+// e.g. md/lg for an album before showing it over a slow connection. It
+// returns false without starting if a warming job is already running.
+func (g *Generator) Warm(items []PregenItem, sizes []Size) bool {
+	g.warmMu.Lock()
+	if g.warmProgress.Running {
+		g.warmMu.Unlock()
+		return false
+	}
+	started := time.Now()
+	g.warmProgress = WarmProgress{
+		Running:   true,
+		Sizes:     sizes,
+		Total:     int64(len(items) * len(sizes)),
+		StartedAt: started.Format(time.RFC3339),
+	}
+	g.warmMu.Unlock()
+
+	go func() {
+		background.Enter()
+		for _, item := range items {
+			for _, size := range sizes {
+				g.warmOne(item, size)
+			}
+		}
+
+		g.warmMu.Lock()
+		p := g.warmProgress
+		g.warmProgress.Running = false
+		g.warmProgress.FinishedAt = time.Now().Format(time.RFC3339)
+		g.warmMu.Unlock()
+
+		log.Printf("Warm: finished %d items in %s — generated %d, skipped %d, errors %d",
+			len(items), time.Since(started).Truncate(time.Second), p.Generated, p.Skipped, p.Errors)
+	}()
+	return true
+}
+
+// warmOne generates a single thumbnail and records the outcome.
+func (g *Generator) warmOne(item PregenItem, size Size) {
+	var err error
+	switch {
+	case g.Exists(item.Path, size) || g.hasFailed(item.Path):
+		g.warmMu.Lock()
+		g.warmProgress.Skipped++
+		g.warmMu.Unlock()
+		return
+	case item.MediaType == "video":
+		if !g.HasFFmpeg() {
+			g.warmMu.Lock()
+			g.warmProgress.Skipped++
+			g.warmMu.Unlock()
+			return
+		}
+		_, err = g.GetOrCreateVideo(item.Path, size)
+	default:
+		_, err = g.GetOrCreate(item.Path, size)
+	}
+
+	g.warmMu.Lock()
+	if err != nil {
+		g.warmProgress.Errors++
+	} else {
+		g.warmProgress.Generated++
+	}
+	g.warmMu.Unlock()
+
+	if err != nil {
+		log.Printf("Warm: error generating %s thumb for %s: %v", size, item.Path, err)
+	}
+	background.Pause()
+}
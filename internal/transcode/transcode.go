@@ -0,0 +1,280 @@
+// Package transcode converts videos browsers can't play to MP4 with ffmpeg,
+// caching the results on disk.
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"photog/internal/background"
+	"photog/internal/config"
+)
+
+// cacheVersion is embedded in cache filenames. Bump it to discard every
+// cached transcode after changing the encoding settings.
+const cacheVersion = "v1"
+
+var (
+	// ErrBusy is returned by Open when a new transcode would exceed the
+	// concurrency limit.
+	ErrBusy = errors.New("transcode: all slots busy")
+	// ErrNoFFmpeg is returned by Open when ffmpeg isn't installed.
+	ErrNoFFmpeg = errors.New("transcode: ffmpeg not found")
+)
+
+// Transcoder runs transcodes and manages their cache.
+type Transcoder struct {
+	dir string
+	cfg config.TranscodeConfig
+	// sem caps concurrent transcodes
+	sem chan struct{}
+	// parent of ffmpeg runs, canceled on shutdown (see SetContext)
+	ctx context.Context
+
+	ffmpegOnce sync.Once
+	ffmpegPath string
+
+	mu   sync.Mutex
+	runs map[string]*Run // by cache path
+}
+
+// Source is a video to transcode, with its codecs as probed by the indexer
+// ("" when unknown).
+type Source struct {
+	Path       string
+	VideoCodec string
+	AudioCodec string
+}
+
+// Run is a transcode in progress. Its output grows at Path as fragmented
+// MP4, which can be played while it's written, until Done is closed.
+type Run struct {
+	Path string
+	done chan struct{}
+	err  error
+}
+
+// Done is closed when the run has finished.
+func (r *Run) Done() <-chan struct{} { return r.done }
+
+// Err returns why the run failed, once Done is closed.
+func (r *Run) Err() error { return r.err }
+
+// New creates a transcoder caching under cacheDir/transcodes.
+func New(cacheDir string, cfg config.TranscodeConfig) (*Transcoder, error) {
+	dir := filepath.Join(cacheDir, "transcodes")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create transcode dir: %w", err)
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.MaxHeight <= 0 {
+		cfg.MaxHeight = 1080
+	}
+	if cfg.Preset == "" {
+		cfg.Preset = "veryfast"
+	}
+	if cfg.CRF <= 0 {
+		cfg.CRF = 23
+	}
+	if cfg.CacheMaxMB <= 0 {
+		cfg.CacheMaxMB = 10240
+	}
+
+	// Partial output from an earlier run that was killed is useless
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, e := range entries {
+			if strings.HasSuffix(e.Name(), ".tmp") {
+				os.Remove(filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+
+	return &Transcoder{
+		dir:  dir,
+		cfg:  cfg,
+		sem:  make(chan struct{}, cfg.Concurrency),
+		ctx:  context.Background(),
+		runs: make(map[string]*Run),
+	}, nil
+}
+
+// SetContext sets the process-wide context. Canceling it kills running
+// transcodes. Call it before the first Open.
+func (t *Transcoder) SetContext(ctx context.Context) {
+	t.ctx = ctx
+}
+
+// Open returns the path of src's cached transcode if there is one, or else
+// the run producing it, starting one if none is in progress.
+func (t *Transcoder) Open(src Source) (string, *Run, error) {
+	info, err := os.Stat(src.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	hash := sha256.Sum256([]byte(src.Path))
+	final := filepath.Join(t.dir, fmt.Sprintf("%x_%d_%d_%s.mp4", hash[:16], info.Size(), info.ModTime().Unix(), cacheVersion))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if run := t.runs[final]; run != nil {
+		return "", run, nil
+	}
+	if info, err := os.Stat(final); err == nil && info.Size() > 0 {
+		// Mark it recently used, so eviction keeps it
+		now := time.Now()
+		os.Chtimes(final, now, now)
+		return final, nil, nil
+	}
+
+	ffmpeg := t.getFFmpeg()
+	if ffmpeg == "" {
+		return "", nil, ErrNoFFmpeg
+	}
+	select {
+	case t.sem <- struct{}{}:
+	default:
+		return "", nil, ErrBusy
+	}
+	run := &Run{Path: final + ".tmp", done: make(chan struct{})}
+	if err := os.WriteFile(run.Path, nil, 0644); err != nil {
+		<-t.sem
+		return "", nil, err
+	}
+	t.runs[final] = run
+	go t.transcode(ffmpeg, src, final, run)
+	return "", run, nil
+}
+
+// transcode runs ffmpeg for a run, then moves the result into the cache
+// as a regular MP4 with its index up front, which browsers can seek in.
+// ffmpeg runs at background priority, so a re-encode doesn't slow down
+// browsing.
+func (t *Transcoder) transcode(ffmpeg string, src Source, final string, run *Run) {
+	background.Enter()
+	start := time.Now()
+	defer func() {
+		t.mu.Lock()
+		delete(t.runs, final)
+		t.mu.Unlock()
+		<-t.sem
+		// Readers hold the file open, so removing it doesn't cut them off
+		os.Remove(run.Path)
+		close(run.done)
+	}()
+
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", src.Path,
+		"-map", "0:v:0", "-map", "0:a:0?", "-sn", "-dn"}
+	if src.VideoCodec == "h264" {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args, "-c:v", "libx264", "-preset", t.cfg.Preset, "-crf", fmt.Sprint(t.cfg.CRF),
+			"-pix_fmt", "yuv420p", "-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", t.cfg.MaxHeight))
+	}
+	if src.AudioCodec == "aac" || src.AudioCodec == "mp3" {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", "160k", "-ac", "2")
+	}
+	args = append(args, "-movflags", "frag_keyframe+empty_moov+default_base_moof", "-f", "mp4", run.Path)
+	if run.err = t.ffmpeg(ffmpeg, args); run.err != nil {
+		log.Printf("Transcode: %s: %v", src.Path, run.err)
+		return
+	}
+
+	faststart := final + ".faststart.tmp"
+	if run.err = t.ffmpeg(ffmpeg, []string{"-hide_banner", "-loglevel", "error", "-y", "-i", run.Path,
+		"-map", "0", "-c", "copy", "-movflags", "+faststart", "-f", "mp4", faststart}); run.err != nil {
+		os.Remove(faststart)
+		log.Printf("Transcode: %s: %v", src.Path, run.err)
+		return
+	}
+	if run.err = os.Rename(faststart, final); run.err != nil {
+		os.Remove(faststart)
+		log.Printf("Transcode: %s: %v", src.Path, run.err)
+		return
+	}
+	log.Printf("Transcode: %s done in %v", src.Path, time.Since(start).Round(time.Second))
+	t.evict(final)
+}
+
+// ffmpeg runs ffmpeg with args, returning its error output on failure.
+func (t *Transcoder) ffmpeg(ffmpeg string, args []string) error {
+	cmd := exec.CommandContext(t.ctx, ffmpeg, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			if len(msg) > 500 {
+				msg = msg[len(msg)-500:]
+			}
+			return fmt.Errorf("ffmpeg: %w: %s", err, msg)
+		}
+		return fmt.Errorf("ffmpeg: %w", err)
+	}
+	return nil
+}
+
+// evict deletes the least recently used transcodes, other than keep, until
+// the cache fits within CacheMaxMB.
+func (t *Transcoder) evict(keep string) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return
+	}
+	type file struct {
+		path  string
+		size  int64
+		mtime time.Time
+	}
+	var files []file
+	var total int64
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".mp4") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{filepath.Join(t.dir, e.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	for _, f := range files {
+		if total <= t.cfg.CacheMaxMB<<20 {
+			break
+		}
+		if f.path == keep {
+			continue
+		}
+		if err := os.Remove(f.path); err == nil {
+			total -= f.size
+			log.Printf("Transcode: evicted %s from the cache", filepath.Base(f.path))
+		}
+	}
+}
+
+// getFFmpeg returns the path of ffmpeg, or "" if it isn't installed.
+func (t *Transcoder) getFFmpeg() string {
+	t.ffmpegOnce.Do(func() {
+		if path, err := exec.LookPath("ffmpeg"); err == nil {
+			t.ffmpegPath = path
+		} else {
+			log.Printf("Transcode: ffmpeg not found (video transcoding disabled)")
+		}
+	})
+	return t.ffmpegPath
+}
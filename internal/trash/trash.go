@@ -0,0 +1,271 @@
+// Package trash moves deleted files out of the library into a trash folder,
+// restores them, and purges them once they have been there long enough.
+package trash
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"photog/internal/config"
+	"photog/internal/database"
+	"photog/internal/indexer"
+	"photog/internal/models"
+	"photog/internal/thumbnail"
+)
+
+// ErrExists is returned by Restore when another file has taken the
+// trashed file's place.
+var ErrExists = errors.New("trash: a file already exists at the original path")
+
+// Trash holds deleted files. Each one gets a folder of its own in the
+// trash directory, with its sidecars next to it.
+type Trash struct {
+	dir       string
+	retention time.Duration // 0 keeps items until removed by hand
+	db        *database.DB
+	idx       *indexer.Indexer
+	thumbs    *thumbnail.Generator
+
+	// mu serializes moves, so an item isn't restored and purged at once
+	mu sync.Mutex
+}
+
+// New creates the trash in cfg.Dir, or cacheDir/trash when that's empty.
+// It must not be inside one of the photo roots.
+func New(cfg config.TrashConfig, cacheDir string, roots []string, db *database.DB, idx *indexer.Indexer, thumbs *thumbnail.Generator) (*Trash, error) {
+	dir := cfg.Dir
+	if dir == "" {
+		dir = filepath.Join(cacheDir, "trash")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(root, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("trash dir %s is inside photo path %s", dir, root)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create trash dir: %w", err)
+	}
+	return &Trash{
+		dir:       dir,
+		retention: time.Duration(cfg.RetentionDays) * 24 * time.Hour,
+		db:        db,
+		idx:       idx,
+		thumbs:    thumbs,
+	}, nil
+}
+
+// List returns the items in the trash, most recently deleted first; only
+// owner's when owner is set.
+func (t *Trash) List(owner int64) ([]*models.TrashItem, error) {
+	items, err := t.db.GetTrash(owner)
+	for _, item := range items {
+		t.setPurgeAt(item)
+	}
+	return items, err
+}
+
+// Get returns the item in the trash with the given ID, or sql.ErrNoRows.
+func (t *Trash) Get(id int64) (*models.TrashItem, error) {
+	item, err := t.db.GetTrashItem(id)
+	if err != nil {
+		return nil, err
+	}
+	t.setPurgeAt(item)
+	return item, nil
+}
+
+func (t *Trash) setPurgeAt(item *models.TrashItem) {
+	if t.retention > 0 {
+		item.PurgeAt = item.DeletedAt.Add(t.retention)
+	}
+}
+
+// File returns the path of an item's file in the trash.
+func (t *Trash) File(item *models.TrashItem) string {
+	return filepath.Join(item.Dir, filepath.Base(item.Path))
+}
+
+// Delete moves a photo's file and its own sidecars into the trash and
+// removes the photo from the library. Its cached thumbnails are kept until
+// it's purged, for listing the trash.
+func (t *Trash) Delete(photo *models.Photo) (*models.TrashItem, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	dir := filepath.Join(t.dir, fmt.Sprintf("%d-%d", now.UnixNano(), photo.ID))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	sidecars := indexer.OwnSidecars(photo.Path)
+	if err := move(photo.Path, filepath.Join(dir, filepath.Base(photo.Path))); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	var moved []string
+	for _, sc := range sidecars {
+		if err := move(sc, filepath.Join(dir, filepath.Base(sc))); err != nil {
+			log.Printf("Trash: moving sidecar %s: %v", sc, err)
+			continue
+		}
+		moved = append(moved, sc)
+	}
+
+	item := &models.TrashItem{
+		PhotoID:   photo.ID,
+		Path:      photo.Path,
+		Dir:       dir,
+		Filename:  photo.Filename,
+		MediaType: photo.MediaType,
+		TakenAt:   photo.TakenAt,
+		FileSize:  photo.FileSize,
+		Width:     photo.Width,
+		Height:    photo.Height,
+		OwnerID:   photo.OwnerID,
+		DeletedAt: now,
+	}
+	if err := t.db.TrashPhoto(item); err != nil {
+		// Put everything back, so the library and the disk still agree
+		for _, path := range append([]string{photo.Path}, moved...) {
+			if err := move(filepath.Join(dir, filepath.Base(path)), path); err != nil {
+				log.Printf("Trash: moving %s back: %v", path, err)
+			}
+		}
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	t.setPurgeAt(item)
+	log.Printf("Trash: deleted %s", photo.Path)
+	return item, nil
+}
+
+// Restore moves an item back to where it was, indexes it again and puts it
+// back in the albums it was in. Comments and view counts aren't kept.
+func (t *Trash) Restore(item *models.TrashItem) (*models.Photo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, err := os.Lstat(item.Path); err == nil {
+		return nil, ErrExists
+	}
+	if err := os.MkdirAll(filepath.Dir(item.Path), 0755); err != nil {
+		return nil, err
+	}
+	if err := move(t.File(item), item.Path); err != nil {
+		return nil, err
+	}
+	entries, _ := os.ReadDir(item.Dir)
+	for _, e := range entries {
+		dst := filepath.Join(filepath.Dir(item.Path), e.Name())
+		if _, err := os.Lstat(dst); err == nil {
+			log.Printf("Trash: not restoring sidecar %s over an existing file", dst)
+			continue
+		}
+		if err := move(filepath.Join(item.Dir, e.Name()), dst); err != nil {
+			log.Printf("Trash: restoring sidecar %s: %v", dst, err)
+		}
+	}
+	os.RemoveAll(item.Dir)
+	if err := t.db.DeleteTrashItem(item.ID); err != nil {
+		log.Printf("Trash: forgetting restored item %d: %v", item.ID, err)
+	}
+
+	photo, err := t.idx.IndexFile(item.Path)
+	if err != nil {
+		return nil, fmt.Errorf("index restored file: %w", err)
+	}
+	for _, albumID := range item.Albums {
+		if _, err := t.db.GetAlbum(albumID); err != nil {
+			continue // deleted since
+		}
+		if _, err := t.db.AddAlbumPhotos(albumID, []int64{photo.ID}, 0); err != nil {
+			log.Printf("Trash: adding %s back to album %d: %v", item.Path, albumID, err)
+		}
+	}
+	log.Printf("Trash: restored %s", item.Path)
+	return photo, nil
+}
+
+// Purge deletes an item's files for good.
+func (t *Trash) Purge(item *models.TrashItem) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := os.RemoveAll(item.Dir); err != nil {
+		return err
+	}
+	if err := t.db.DeleteTrashItem(item.ID); err != nil {
+		return err
+	}
+	// The thumbnails are shared with any file indexed at the same path since
+	if _, err := t.db.GetPhotoByPath(item.Path); errors.Is(err, sql.ErrNoRows) {
+		t.thumbs.Invalidate(item.Path)
+	}
+	t.thumbs.Invalidate(t.File(item))
+	log.Printf("Trash: purged %s", item.Path)
+	return nil
+}
+
+// Expired returns the items past the retention period.
+func (t *Trash) Expired() ([]*models.TrashItem, error) {
+	if t.retention <= 0 {
+		return nil, nil
+	}
+	return t.db.GetExpiredTrash(time.Now().Add(-t.retention))
+}
+
+// move renames src to dst, copying it across filesystems when a rename
+// can't.
+func move(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if copyFile(src, dst) != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies src to a new file dst, keeping its mode and mtime. A
+// partial copy is removed.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
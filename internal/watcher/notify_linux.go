@@ -0,0 +1,131 @@
+//go:build linux
+
+package watcher
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask selects the inotify events the realtime watcher reacts to.
+// Files are picked up on IN_CLOSE_WRITE rather than IN_CREATE so they are
+// only indexed once fully written.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_ONLYDIR
+
+// notifier delivers filesystem events for a set of watched directories
+// using inotify.
+type notifier struct {
+	fd     int
+	file   *os.File // wraps fd so reads go through the runtime poller
+	events chan event
+	done   chan struct{}
+
+	mu   sync.Mutex
+	dirs map[int32]string // watch descriptor -> directory
+}
+
+func newNotifier() (*notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	n := &notifier{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan event, 256),
+		done:   make(chan struct{}),
+		dirs:   make(map[int32]string),
+	}
+	go n.read()
+	return n, nil
+}
+
+// add watches a single directory.
+func (n *notifier) add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(n.fd, dir, watchMask)
+	if err != nil {
+		if errors.Is(err, syscall.ENOSPC) {
+			return errWatchLimit
+		}
+		return err
+	}
+	n.mu.Lock()
+	n.dirs[int32(wd)] = dir
+	n.mu.Unlock()
+	return nil
+}
+
+// close stops the notifier; the events channel is closed once the reader
+// has exited.
+func (n *notifier) close() {
+	close(n.done)
+	n.file.Close()
+}
+
+// send delivers an event unless the notifier was closed meanwhile.
+func (n *notifier) send(ev event) bool {
+	select {
+	case n.events <- ev:
+		return true
+	case <-n.done:
+		return false
+	}
+}
+
+func (n *notifier) read() {
+	defer close(n.events)
+	buf := make([]byte, 64*1024)
+	for {
+		size, err := n.file.Read(buf)
+		if err != nil {
+			return // closed
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= size; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameStart := off + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(raw.Len)
+			if nameEnd > size {
+				break
+			}
+			name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+			off = nameEnd
+
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				if !n.send(event{overflow: true}) {
+					return
+				}
+				continue
+			}
+
+			n.mu.Lock()
+			dir, ok := n.dirs[raw.Wd]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.dirs, raw.Wd)
+			}
+			n.mu.Unlock()
+			if !ok || name == "" {
+				continue
+			}
+
+			ev := event{
+				path:    filepath.Join(dir, name),
+				dir:     raw.Mask&syscall.IN_ISDIR != 0,
+				removed: raw.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0,
+			}
+			// Files are announced once written, directories as soon as
+			// they appear so their contents can be watched.
+			if raw.Mask&syscall.IN_CREATE != 0 && !ev.dir {
+				continue
+			}
+			if !n.send(ev) {
+				return
+			}
+		}
+	}
+}
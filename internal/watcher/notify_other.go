@@ -0,0 +1,19 @@
+//go:build !linux
+
+package watcher
+
+import "errors"
+
+// notifier is unavailable without inotify; the watcher keeps to periodic
+// scans.
+type notifier struct {
+	events chan event
+}
+
+func newNotifier() (*notifier, error) {
+	return nil, errors.New("realtime watching needs inotify (Linux)")
+}
+
+func (n *notifier) add(dir string) error { return errors.ErrUnsupported }
+
+func (n *notifier) close() {}
@@ -0,0 +1,228 @@
+package watcher
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"photog/internal/background"
+	"photog/internal/database"
+	"photog/internal/indexer"
+	"photog/internal/jobs"
+)
+
+// debounce is how long a path must be quiet before it is indexed, so sync
+// tools that write a file in several passes trigger one index.
+const debounce = 2 * time.Second
+
+// fallbackInterval is the periodic scan interval used when realtime
+// watching can't be set up and the configured interval is longer (or off).
+const fallbackInterval = time.Hour
+
+// errWatchLimit means the kernel's inotify watch limit was reached.
+var errWatchLimit = errors.New("inotify watch limit reached")
+
+// event is a change to one path under a watched directory.
+type event struct {
+	path     string
+	dir      bool
+	removed  bool
+	overflow bool // events were dropped; a full scan is needed
+}
+
+// WatchPaths enables realtime mode: the given photo roots are watched
+// recursively and new, moved and deleted files are indexed or removed one by
+// one as they change. Periodic scans keep running as a safety net. Call
+// before Start.
+func (w *Watcher) WatchPaths(idx *indexer.Indexer, db *database.DB, roots []string) {
+	w.idx = idx
+	w.db = db
+	w.roots = roots
+}
+
+// realtime runs the realtime watcher until Stop. If inotify is unavailable
+// or runs out of watches it falls back to periodic scanning.
+func (w *Watcher) realtime() {
+	background.Enter()
+
+	n, err := newNotifier()
+	if err != nil {
+		w.fallBack(err)
+		return
+	}
+	defer n.close()
+
+	count := 0
+	for _, root := range w.roots {
+		c, err := w.addTree(n, root, nil)
+		count += c
+		if err != nil {
+			w.fallBack(err)
+			return
+		}
+	}
+	log.Printf("Watcher: realtime watching %d directories", count)
+
+	// path -> removed, for paths waiting out the debounce
+	pending := make(map[string]bool)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case ev, ok := <-n.events:
+			if !ok {
+				return
+			}
+			switch {
+			case ev.overflow:
+				log.Printf("Watcher: event queue overflowed, queuing a full scan")
+				w.runScan()
+			case ev.dir && ev.removed:
+				// Index rows for everything under it go in one cleanup pass
+				if _, err := w.queue.Enqueue(jobs.TypeCleanup, nil); err != nil {
+					log.Printf("Watcher: failed to queue cleanup: %v", err)
+				}
+			case ev.dir:
+				if _, err := w.addTree(n, ev.path, pending); err != nil {
+					w.fallBack(err)
+					return
+				}
+				timer.Reset(debounce)
+			default:
+				pending[ev.path] = ev.removed
+				timer.Reset(debounce)
+			}
+		case <-timer.C:
+			w.flush(pending)
+			pending = make(map[string]bool)
+		}
+	}
+}
+
+// addTree watches dir and every directory below it, skipping hidden ones,
+// and returns how many were added. When pending is non-nil, files found
+// are queued for indexing: they may have been written before the watch was
+// in place.
+func (w *Watcher) addTree(n *notifier, dir string, pending map[string]bool) (int, error) {
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // unreadable; the periodic scan will report it
+		}
+		if !d.IsDir() {
+			if pending != nil {
+				pending[path] = false
+			}
+			return nil
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if err := n.add(path); err != nil {
+			if errors.Is(err, errWatchLimit) {
+				return err
+			}
+			log.Printf("Watcher: cannot watch %s: %v", path, err)
+			return nil
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// flush indexes new files, re-reads those whose size or modification time
+// changed since they were indexed and removes deleted ones from the index,
+// then queues small thumbnails for just the files that were indexed.
+func (w *Watcher) flush(pending map[string]bool) {
+	var indexed []int64
+	added, changed, removed := 0, 0, 0
+	archives := false
+	for path, gone := range pending {
+		if w.idx.IndexesArchive(path) {
+			archives = true
+			continue
+		}
+		if !indexer.IsMediaFile(path) {
+			continue
+		}
+		info, statErr := os.Stat(path)
+		if gone || os.IsNotExist(statErr) {
+			if !os.IsNotExist(statErr) {
+				continue // moved away and back again
+			}
+			ok, err := w.db.RemovePhotoByPath(path)
+			if err != nil {
+				log.Printf("Watcher: removing %s: %v", path, err)
+			} else if ok {
+				removed++
+			}
+			continue
+		}
+
+		if statErr != nil {
+			continue
+		}
+		st, err := w.db.GetFileStamp(path)
+		exists := err == nil
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		// Like scans, files indexed before mtimes were recorded only
+		// compare sizes
+		if exists && info.Size() == st.Size && (st.Mtime == 0 || info.ModTime().Unix() == st.Mtime) {
+			continue
+		}
+		photo, err := w.idx.IndexFile(path)
+		if err != nil {
+			log.Printf("Watcher: indexing %s: %v", path, err)
+			continue
+		}
+		indexed = append(indexed, photo.ID)
+		if exists {
+			changed++
+		} else {
+			added++
+		}
+		background.Pause()
+	}
+
+	// Archives are only read by full scans; the cleanup drops entries of
+	// archives that were replaced or deleted
+	if archives {
+		if _, err := w.queue.Enqueue(jobs.TypeScan, jobs.ScanPayload{Cleanup: true}); err != nil {
+			log.Printf("Watcher: failed to queue scan for changed archives: %v", err)
+		}
+	}
+
+	if len(indexed) == 0 && removed == 0 {
+		return
+	}
+	log.Printf("Watcher: indexed %d new and %d changed files, removed %d", added, changed, removed)
+	if len(indexed) > 0 {
+		if _, err := w.queue.Enqueue(jobs.TypePregenNew, jobs.PregenNewPayload{IDs: indexed}); err != nil {
+			log.Printf("Watcher: failed to queue thumbnails: %v", err)
+		}
+	}
+}
+
+// fallBack switches to periodic scanning after realtime watching failed.
+func (w *Watcher) fallBack(err error) {
+	if errors.Is(err, errWatchLimit) {
+		log.Printf("Watcher: %v (raise fs.inotify.max_user_watches); falling back to periodic scans", err)
+	} else {
+		log.Printf("Watcher: realtime watching unavailable: %v; falling back to periodic scans", err)
+	}
+	select {
+	case w.fallback <- struct{}{}:
+	case <-w.stop:
+	}
+}
@@ -6,29 +6,40 @@ import (
 
 	"photog/internal/database"
 	"photog/internal/indexer"
+	"photog/internal/jobs"
 )
 
-// Watcher periodically scans for new/deleted files.
+// Watcher periodically queues scans for new/deleted files, and in realtime
+// mode (see WatchPaths) also indexes changes as they happen.
 type Watcher struct {
-	indexer  *indexer.Indexer
-	db       *database.DB
+	queue    *jobs.Queue
 	interval time.Duration
 	stop     chan struct{}
+
+	// realtime mode, set by WatchPaths
+	idx      *indexer.Indexer
+	db       *database.DB
+	roots    []string
+	fallback chan struct{}
 }
 
-// New creates a file watcher that triggers periodic scans.
-func New(idx *indexer.Indexer, db *database.DB, interval time.Duration) *Watcher {
+// New creates a file watcher that triggers periodic scans. An interval of 0
+// disables periodic scans unless realtime watching has to fall back to them.
+func New(q *jobs.Queue, interval time.Duration) *Watcher {
 	return &Watcher{
-		indexer:  idx,
-		db:       db,
+		queue:    q,
 		interval: interval,
 		stop:     make(chan struct{}),
+		fallback: make(chan struct{}),
 	}
 }
 
 // Start begins the periodic scan loop. It runs the first scan after one full interval.
 func (w *Watcher) Start() {
 	go w.loop()
+	if w.idx != nil {
+		go w.realtime()
+	}
 }
 
 // Stop signals the watcher to stop.
@@ -37,41 +48,48 @@ func (w *Watcher) Stop() {
 }
 
 func (w *Watcher) loop() {
-	log.Printf("Watcher: periodic scan every %s", w.interval)
-	ticker := time.NewTicker(w.interval)
-	defer ticker.Stop()
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	if w.interval > 0 {
+		log.Printf("Watcher: periodic scan every %s", w.interval)
+		ticker = time.NewTicker(w.interval)
+		tick = ticker.C
+	}
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
 
 	for {
 		select {
 		case <-w.stop:
 			log.Println("Watcher: stopped")
 			return
-		case <-ticker.C:
+		case <-tick:
 			w.runScan()
+		case <-w.fallback:
+			if w.interval > 0 && w.interval <= fallbackInterval {
+				continue
+			}
+			log.Printf("Watcher: periodic scan every %s", fallbackInterval)
+			if ticker != nil {
+				ticker.Reset(fallbackInterval)
+			} else {
+				ticker = time.NewTicker(fallbackInterval)
+				tick = ticker.C
+			}
 		}
 	}
 }
 
+// runScan queues a scan followed by removal of deleted files. If a scan is
+// already queued or running, that one is reused.
 func (w *Watcher) runScan() {
-	if w.indexer.IsRunning() {
-		log.Println("Watcher: skipping scan, indexer already running")
-		return
-	}
-
-	log.Println("Watcher: starting periodic scan for new/deleted files...")
-
-	// Scan for new files
-	if err := w.indexer.Scan(); err != nil {
-		log.Printf("Watcher: scan error: %v", err)
-	}
-
-	// Remove deleted files from the database
-	removed, err := w.db.RemoveMissing()
+	job, err := w.queue.Enqueue(jobs.TypeScan, jobs.ScanPayload{Cleanup: true})
 	if err != nil {
-		log.Printf("Watcher: error removing missing files: %v", err)
-	} else if removed > 0 {
-		log.Printf("Watcher: removed %d files that no longer exist on disk", removed)
+		log.Printf("Watcher: failed to queue scan: %v", err)
+		return
 	}
-
-	log.Println("Watcher: periodic scan complete")
+	log.Printf("Watcher: periodic scan queued as job %d", job.ID)
 }
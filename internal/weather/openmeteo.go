@@ -0,0 +1,106 @@
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// openMeteoURL is Open-Meteo's historical weather API, free for
+// non-commercial use without a key.
+const openMeteoURL = "https://archive-api.open-meteo.com/v1/archive"
+
+// openMeteo is the Open-Meteo provider.
+type openMeteo struct {
+	url    string
+	client *http.Client
+}
+
+func newOpenMeteo(endpoint string) Provider {
+	if endpoint == "" {
+		endpoint = openMeteoURL
+	}
+	return &openMeteo{url: endpoint, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (o *openMeteo) Name() string { return "open-meteo" }
+
+// openMeteoResponse is the part of an archive API answer we use. Hours
+// without data are null.
+type openMeteoResponse struct {
+	Hourly struct {
+		Temperature []*float64 `json:"temperature_2m"`
+		WeatherCode []*int     `json:"weather_code"`
+	} `json:"hourly"`
+	Reason string `json:"reason"` // set on errors
+}
+
+func (o *openMeteo) Day(ctx context.Context, lat, lon float64, date string) ([]Hour, error) {
+	v := url.Values{}
+	v.Set("latitude", strconv.FormatFloat(lat, 'f', 4, 64))
+	v.Set("longitude", strconv.FormatFloat(lon, 'f', 4, 64))
+	v.Set("start_date", date)
+	v.Set("end_date", date)
+	v.Set("hourly", "temperature_2m,weather_code")
+	v.Set("timezone", "auto") // hours in local time at the position
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, o.url+"?"+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r openMeteoResponse
+	decodeErr := json.NewDecoder(resp.Body).Decode(&r)
+	switch {
+	case resp.StatusCode == http.StatusBadRequest:
+		// A date or position outside the archive; there is nothing to retry
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("HTTP %d %s", resp.StatusCode, r.Reason)
+	case decodeErr != nil:
+		return nil, fmt.Errorf("decode response: %w", decodeErr)
+	}
+
+	hours := make([]Hour, len(r.Hourly.WeatherCode))
+	for i, code := range r.Hourly.WeatherCode {
+		if code != nil {
+			hours[i].Conditions = wmoConditions(*code)
+		}
+		if i < len(r.Hourly.Temperature) {
+			hours[i].Temperature = r.Hourly.Temperature[i]
+		}
+	}
+	return hours, nil
+}
+
+// wmoConditions maps a WMO weather interpretation code to one of
+// Conditions.
+func wmoConditions(code int) string {
+	switch {
+	case code == 0:
+		return "clear"
+	case code <= 2:
+		return "partly_cloudy"
+	case code == 3:
+		return "cloudy"
+	case code == 45 || code == 48:
+		return "fog"
+	case code >= 51 && code <= 57:
+		return "drizzle"
+	case code >= 61 && code <= 67, code >= 80 && code <= 82:
+		return "rain"
+	case code >= 71 && code <= 77, code == 85 || code == 86:
+		return "snow"
+	case code >= 95 && code <= 99:
+		return "thunderstorm"
+	}
+	return ""
+}
@@ -0,0 +1,133 @@
+// Package weather looks up the historical weather at a place and time from
+// a pluggable provider, caching its answers in the database so each grid
+// cell and day is only fetched once.
+package weather
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"photog/internal/config"
+	"photog/internal/database"
+	"photog/internal/models"
+)
+
+// Conditions are the weather conditions photos are tagged with, from
+// clearest to stormiest.
+var Conditions = []string{"clear", "partly_cloudy", "cloudy", "fog", "drizzle", "rain", "snow", "thunderstorm"}
+
+// Delay is how long after a day providers have its weather for sure;
+// photos taken since are looked up later.
+const Delay = 7 * 24 * time.Hour
+
+// cellSize is the grid, in degrees, positions are snapped to for lookups
+// and caching: about 11 km, much finer than weather data varies.
+const cellSize = 0.1
+
+// requestInterval spaces out requests to the provider.
+const requestInterval = time.Second
+
+// Hour is one hourly reading. Temperature is nil when the provider doesn't
+// have it.
+type Hour struct {
+	Conditions  string   `json:"c"`
+	Temperature *float64 `json:"t,omitempty"`
+}
+
+// Provider fetches historical weather.
+type Provider interface {
+	// Name identifies the provider's answers in the cache.
+	Name() string
+	// Day returns the 24 hourly readings of date ("2006-01-02"), in local
+	// time at the position, or nil if the provider has no data for it.
+	Day(ctx context.Context, lat, lon float64, date string) ([]Hour, error)
+}
+
+// providers maps the config provider names to their constructors, which
+// get the configured API endpoint.
+var providers = map[string]func(url string) Provider{
+	"open-meteo": newOpenMeteo,
+}
+
+// Service answers weather lookups from the cache or the provider.
+type Service struct {
+	provider Provider
+	db       *database.DB
+
+	mu   sync.Mutex // serializes provider requests
+	last time.Time
+}
+
+// New returns a Service using the configured provider.
+func New(cfg config.WeatherConfig, db *database.DB) (*Service, error) {
+	newProvider, ok := providers[cfg.Provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown weather provider %q", cfg.Provider)
+	}
+	return &Service{provider: newProvider(cfg.URL), db: db}, nil
+}
+
+// Lookup returns the weather at a position at the hour of t, taken as
+// local time there as cameras record it, or nil if the provider has none.
+func (s *Service) Lookup(ctx context.Context, lat, lon float64, t time.Time) (*models.Weather, error) {
+	lat, lon = snap(lat), snap(lon)
+	cell := fmt.Sprintf("%.1f,%.1f", lat, lon)
+	day := t.Format("2006-01-02")
+
+	var hours []Hour
+	data, err := s.db.GetWeatherCache(s.provider.Name(), cell, day)
+	if err != nil {
+		return nil, err
+	}
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &hours); err != nil {
+			return nil, fmt.Errorf("decode cached weather: %w", err)
+		}
+	} else {
+		if hours, err = s.fetch(ctx, lat, lon, day); err != nil {
+			return nil, err
+		}
+		encoded, err := json.Marshal(hours)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.db.SetWeatherCache(s.provider.Name(), cell, day, string(encoded)); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.Hour() >= len(hours) || hours[t.Hour()].Conditions == "" {
+		return nil, nil
+	}
+	h := hours[t.Hour()]
+	return &models.Weather{Conditions: h.Conditions, Temperature: h.Temperature}, nil
+}
+
+// fetch asks the provider, no sooner than requestInterval after the last
+// request.
+func (s *Service) fetch(ctx context.Context, lat, lon float64, day string) ([]Hour, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if wait := requestInterval - time.Since(s.last); wait > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	s.last = time.Now()
+	hours, err := s.provider.Day(ctx, lat, lon, day)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.provider.Name(), err)
+	}
+	return hours, nil
+}
+
+// snap rounds a coordinate to the lookup grid.
+func snap(v float64) float64 {
+	return math.Round(v/cellSize) * cellSize
+}
@@ -1,26 +1,64 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
-	"sync/atomic"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
+	"photog/internal/auth"
+	"photog/internal/background"
+	"photog/internal/backup"
 	"photog/internal/config"
 	"photog/internal/database"
+	"photog/internal/events"
+	"photog/internal/export"
+	"photog/internal/folderalbums"
+	"photog/internal/geocode"
+	"photog/internal/importer"
 	"photog/internal/indexer"
+	"photog/internal/jobs"
+	"photog/internal/models"
+	"photog/internal/mqtt"
+	"photog/internal/selfcheck"
 	"photog/internal/server"
+	"photog/internal/telegram"
 	"photog/internal/thumbnail"
+	"photog/internal/transcode"
+	"photog/internal/trash"
 	"photog/internal/watcher"
+	"photog/internal/weather"
 )
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == "backup" {
+		runBackup(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify-setup" {
+		runVerifySetup(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+
 	configPath := flag.String("config", "", "Path to config.yaml (optional, uses defaults + env vars)")
 	autoIndex := flag.Bool("auto-index", true, "Automatically start indexing on startup")
 	watchInterval := flag.Duration("watch-interval", 24*time.Hour, "Interval between periodic scans for new/deleted files (0 to disable)")
+	realtime := flag.Bool("watch-realtime", true, "Index new and deleted files as they change (Linux inotify; falls back to periodic scans)")
+	devProxy := flag.String("dev-proxy", "", "Proxy frontend requests to a dev server, e.g. http://localhost:5173")
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
@@ -32,6 +70,8 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	background.Configure(cfg.Background)
+
 	log.Printf("Photo paths: %v", cfg.Photos.Paths)
 	log.Printf("Cache dir: %s", cfg.Cache.Dir)
 
@@ -42,97 +82,435 @@ func main() {
 	}
 	defer db.Close()
 
+	// Quick setup check; `photog verify-setup` runs the full version
+	for _, c := range selfcheck.Run(cfg, db, false).Checks {
+		if c.Status != selfcheck.OK {
+			log.Printf("Setup %s: %s: %s", c.Status, c.Name, c.Detail)
+		}
+	}
+
+	// Canceled on SIGINT/SIGTERM; stops jobs and kills ffmpeg/ffprobe children
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// Initialize thumbnail generator
 	thumbGen, err := thumbnail.New(cfg.Cache.Dir, cfg.Thumbnail)
 	if err != nil {
 		log.Fatalf("Failed to initialize thumbnail generator: %v", err)
 	}
+	thumbGen.SetContext(ctx)
+
+	// On-demand video transcoding for /api/media/{id}/stream
+	transcoder, err := transcode.New(cfg.Cache.Dir, cfg.Transcode)
+	if err != nil {
+		log.Fatalf("Failed to initialize transcoder: %v", err)
+	}
+	transcoder.SetContext(ctx)
+
+	// Persist pregen completion so it survives restarts
+	thumbGen.OnPregenItem = func(item thumbnail.PregenItem, err error) {
+		state := database.PregenDone
+		if err != nil {
+			state = database.PregenFailed
+		}
+		if err := db.SetPregenState(item.ID, state); err != nil {
+			log.Printf("Pregen: failed to record state for %s: %v", item.Path, err)
+		}
+	}
+
+	// Keep generation timings for the slow-file report
+	thumbGen.OnGenerated = func(path string, size thumbnail.Size, took time.Duration) {
+		if err := db.RecordThumbTiming(path, string(size), took); err != nil {
+			log.Printf("Thumbnail: failed to record timing for %s: %v", path, err)
+		}
+	}
+	thumbGen.OnHashed = func(path string, hash uint64) {
+		if err := db.SetPHash(path, hash); err != nil {
+			log.Printf("Thumbnail: failed to record perceptual hash for %s: %v", path, err)
+		}
+	}
 
 	// Initialize indexer
 	idx := indexer.New(db, cfg.Photos.Paths)
+	indexer.AddImageExts(thumbnail.ExternalExts(cfg.Thumbnail.External))
+	if err := idx.SetTagRules(cfg.TagRules); err != nil {
+		log.Fatalf("Invalid tag rules: %v", err)
+	}
+	switch cfg.Photos.RawPairs {
+	case "jpeg", "raw", "both":
+	default:
+		log.Fatalf("Invalid photos.raw_pairs %q (use jpeg, raw or both)", cfg.Photos.RawPairs)
+	}
+	switch cfg.Auth.SharedGPS {
+	case "exact", "round", "strip":
+	default:
+		log.Fatalf("Invalid auth.shared_gps %q (use exact, round or strip)", cfg.Auth.SharedGPS)
+	}
+	idx.SetLimits(cfg.Photos.Limits)
+	idx.SetIndexArchives(cfg.Photos.IndexArchives)
+	if cfg.Geocode.Enabled {
+		geo, err := geocode.New(cfg.Geocode.Dataset, cfg.Geocode.MaxDistanceKM)
+		if err != nil {
+			log.Fatalf("Failed to load geocoding dataset: %v", err)
+		}
+		idx.SetGeocoder(geo)
+	}
+	// Login accounts; photos under a user's paths, and those they upload,
+	// are theirs alone
+	owners, err := auth.Setup(db, cfg.Auth, cfg.Upload.Dir, cfg.WebDAV)
+	if err != nil {
+		log.Fatalf("Failed to set up accounts: %v", err)
+	}
+	idx.SetOwners(owners)
+	idx.SetContext(ctx)
+	idx.OnHDRDetected = func(path string) {
+		thumbGen.Invalidate(path)
+	}
+	idx.OnPhotoChanged = func(path string) {
+		thumbGen.Invalidate(path)
+	}
+	db.SetRoots(cfg.Photos.Paths)
+	idx.MonitorRoots(ctx, time.Minute)
 
-	// Stop channel for background tasks
-	pregenStop := make(chan struct{})
+	// Optional MQTT event publishing
+	var pub *mqtt.Publisher
+	if cfg.MQTT.Broker != "" {
+		pub = mqtt.New(cfg.MQTT, db)
+		idx.OnPhotoAdded = func(p *models.Photo) {
+			pub.Publish("photo_added", map[string]interface{}{
+				"path":     p.Path,
+				"filename": p.Filename,
+				"type":     p.MediaType,
+				"taken_at": p.TakenAt,
+			})
+		}
+		pub.Start()
+	}
 
-	// Auto-index on startup, then pre-generate thumbnails
-	if *autoIndex {
-		go func() {
-			log.Println("Starting initial index scan...")
-			if err := idx.Scan(); err != nil {
-				log.Printf("Initial indexing error: %v", err)
-			}
+	// Regroup events and refresh folder albums after every scan
+	idx.OnScanFinished = func(p indexer.IndexProgress) {
+		if n, err := events.Rebuild(db, cfg.Events); err != nil {
+			log.Printf("Events: rebuild failed: %v", err)
+		} else {
+			log.Printf("Events: detected %d events", n)
+		}
+		if n, err := folderalbums.Sync(db, cfg.Albums); err != nil {
+			log.Printf("Albums: syncing folder albums failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Albums: %d albums follow folders", n)
+		}
+		if pub != nil {
+			pub.Publish("scan_finished", p)
+		}
+	}
+
+	// Start optional Telegram bot
+	var bot *telegram.Bot
+	if cfg.Telegram.Token != "" {
+		bot = telegram.New(cfg.Telegram, cfg.Memories, db, idx, thumbGen)
+		bot.Start()
+	}
 
-			// Clean out any dotfiles/hidden files (.pending-*, etc.) that were
-			// indexed by older versions. They can never produce valid thumbnails.
-			if removed, err := db.RemoveDotfiles(); err != nil {
-				log.Printf("Error cleaning dotfiles from index: %v", err)
-			} else if removed > 0 {
-				log.Printf("Cleaned %d dotfiles/hidden files from index", removed)
+	// Background job queue for scans, cleanup and thumbnail pregen
+	queue := jobs.New(db, cfg.Jobs)
+	jobs.RegisterBuiltin(queue, db, idx, thumbGen, cfg.ContentURLs.Enabled, cfg.Photos.PruneMissing)
+	if err := queue.SetSchedule(cfg.Schedule); err != nil {
+		log.Fatalf("Invalid schedule: %v", err)
+	}
+	queue.SetDiskGuard(cfg.Cache.Dir, uint64(cfg.Cache.MinFreeMB)<<20, "thumbnails", "new_thumbnails")
+	queue.OnLowDisk = func(free uint64, low bool) {
+		if pub != nil {
+			pub.Publish("low_disk_space", map[string]interface{}{
+				"free_mb": free >> 20,
+				"low":     low,
+			})
+		}
+		if bot != nil {
+			if low {
+				go bot.Notify(fmt.Sprintf("Photog cache disk has only %d MB free; thumbnail generation is paused.", free>>20))
+			} else {
+				go bot.Notify("Photog cache disk has free space again; thumbnail generation resumed.")
 			}
+		}
+	}
+	bin, err := trash.New(cfg.Trash, cfg.Cache.Dir, cfg.Photos.Paths, db, idx, thumbGen)
+	if err != nil {
+		log.Fatalf("Failed to set up trash: %v", err)
+	}
+	jobs.RegisterTrash(ctx, queue, bin, time.Hour)
+	jobs.RegisterCacheGC(ctx, queue, db, thumbGen, bin, 24*time.Hour)
+	if cfg.Weather.Enabled {
+		svc, err := weather.New(cfg.Weather, db)
+		if err != nil {
+			log.Fatalf("Failed to set up weather lookups: %v", err)
+		}
+		jobs.RegisterWeather(ctx, queue, db, svc, time.Hour)
+	}
+	queue.Start(ctx)
 
-			// After indexing completes, start background thumbnail pre-generation
-			startPregen(db, thumbGen, pregenStop)
-		}()
+	// Auto-index on startup; the scan queues thumbnail pre-generation when done
+	if *autoIndex {
+		log.Println("Starting initial index scan...")
+		if _, err := queue.Enqueue(jobs.TypeScan, nil); err != nil {
+			log.Printf("Failed to queue initial scan: %v", err)
+		}
 	}
 
-	// Start periodic file watcher
+	// Start file watcher
 	var w *watcher.Watcher
-	if *watchInterval > 0 {
-		w = watcher.New(idx, db, *watchInterval)
+	if *watchInterval > 0 || *realtime {
+		w = watcher.New(queue, *watchInterval)
+		if *realtime {
+			w.WatchPaths(idx, db, cfg.Photos.Paths)
+		}
 		w.Start()
 	}
 
+	// Start scheduled exports
+	var exporter *export.Scheduler
+	if len(cfg.Exports) > 0 {
+		exporter = export.New(cfg.Exports, db, thumbGen)
+		exporter.Start()
+	}
+
 	// Start HTTP server
-	srv := server.New(cfg, db, idx, thumbGen)
+	srv := server.New(cfg, db, idx, thumbGen, queue)
+	srv.SetTranscoder(transcoder)
+	srv.SetTrash(bin)
+	if *devProxy != "" {
+		if err := srv.SetDevProxy(*devProxy); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+
+	// Let the owner know about new comments
+	if pub != nil || bot != nil {
+		srv.OnComment = func(p *models.Photo, c *models.Comment) {
+			if pub != nil {
+				pub.Publish("comment_added", map[string]interface{}{
+					"photo_id": p.ID,
+					"filename": p.Filename,
+					"author":   c.Author,
+					"body":     c.Body,
+				})
+			}
+			if bot != nil {
+				go bot.Notify(fmt.Sprintf("%s commented on %s: %s", c.Author, p.Filename, c.Body))
+			}
+		}
+	}
 
 	// Graceful shutdown
 	go func() {
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 		<-sigCh
-		log.Println("Shutting down...")
-		close(pregenStop)
+		grace := time.Duration(cfg.Server.ShutdownGraceSeconds) * time.Second
+		log.Printf("Shutting down (grace period %s)...", grace)
+		cancel()
+
+		// Jobs save their progress as they return; in-flight DB writes
+		// finish before the database is closed below
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), grace)
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Server shutdown: %v", err)
+		}
+		queue.Stop(shutdownCtx)
+		cancelShutdown()
 		if w != nil {
 			w.Stop()
 		}
+		if bot != nil {
+			bot.Stop()
+		}
+		if pub != nil {
+			pub.Stop()
+		}
+		if exporter != nil {
+			exporter.Stop()
+		}
 		db.Close()
+		log.Println("Shutdown complete")
 		os.Exit(0)
 	}()
 
-	if err := srv.Start(); err != nil {
+	if err := srv.Start(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
+	// Wait for the shutdown goroutine to finish and exit
+	select {}
 }
 
-// startPregen runs background thumbnail pre-generation in slow batches.
-func startPregen(db *database.DB, thumbGen *thumbnail.Generator, stop <-chan struct{}) {
-	items, err := db.GetAllPaths()
+// runBackup implements `photog backup`: snapshot the database, failure cache
+// and optionally thumbnails to a local directory or rclone remote.
+func runBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to config.yaml (optional, uses defaults + env vars)")
+	target := fs.String("target", "", "Backup destination: a local directory or rclone remote (e.g. b2:photog-backups)")
+	keep := fs.Int("keep", 7, "Number of snapshots to keep in the target (0 keeps all)")
+	thumbs := fs.Bool("thumbs", false, "Also back up the thumbnail cache")
+	fs.Parse(args)
+
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	cfg, err := config.Load(*configPath)
 	if err != nil {
-		log.Printf("Pregen: failed to get paths: %v", err)
-		return
+		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	if len(items) == 0 {
-		return
+	db, err := database.New(cfg.Cache.Dir)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
 	}
+	defer db.Close()
 
-	// Convert to PregenItem slice
-	pregenItems := make([]thumbnail.PregenItem, len(items))
-	for i, item := range items {
-		pregenItems[i] = thumbnail.PregenItem{
-			Path:      item.Path,
-			MediaType: item.MediaType,
+	if err := backup.Run(db, backup.Options{
+		CacheDir:      cfg.Cache.Dir,
+		Target:        *target,
+		Keep:          *keep,
+		IncludeThumbs: *thumbs,
+	}); err != nil {
+		log.Fatalf("Backup failed: %v", err)
+	}
+}
+
+// runVerifySetup implements `photog verify-setup`: check photo roots, cache
+// dir, external tools and database integrity, and print a capability report.
+// Exits non-zero if any check fails.
+func runVerifySetup(args []string) {
+	fs := flag.NewFlagSet("verify-setup", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to config.yaml (optional, uses defaults + env vars)")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	fs.Parse(args)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	var db *database.DB
+	if _, err := os.Stat(filepath.Join(cfg.Cache.Dir, "photog.db")); err == nil {
+		if db, err = database.New(cfg.Cache.Dir); err != nil {
+			log.Fatalf("Failed to open database: %v", err)
 		}
+		defer db.Close()
 	}
 
-	var progress atomic.Int64
+	report := selfcheck.Run(cfg, db, true)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, c := range report.Checks {
+			fmt.Printf("[%-4s] %-28s %s\n", c.Status, c.Name, c.Detail)
+		}
+		fmt.Println()
+		for _, name := range []string{"video_thumbnails", "video_metadata", "remote_backup"} {
+			fmt.Printf("%-18s %v\n", name, report.Capabilities[name])
+		}
+	}
+	if report.Failed {
+		os.Exit(1)
+	}
+}
 
-	log.Printf("Pregen: starting background thumbnail generation for %d items", len(pregenItems))
+// runImport implements `photog import SOURCE`: report which files under
+// SOURCE are new, already in the library or clash with a file of the same
+// name, then move the new ones into the library once confirmed. The running
+// server indexes them on its next scan, or right away when watching.
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	configPath := fs.String("config", "", "Path to config.yaml (optional, uses defaults + env vars)")
+	dest := fs.String("dest", "", "Library folder to import into (default: upload.dir, else the first photo path)")
+	yes := fs.Bool("yes", false, "Import without asking for confirmation")
+	keep := fs.Bool("keep", false, "Copy files instead of moving them, leaving the source as it is")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: photog import [flags] SOURCE")
+		fs.PrintDefaults()
+		os.Exit(2)
+	}
 
-	// Process in batches of 10, with a 2-second pause between batches
-	// This keeps resource usage low while steadily building the cache
-	result := thumbGen.PregenSmallThumbnails(pregenItems, 10, 2*time.Second, stop, &progress)
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if *dest == "" {
+		*dest = cfg.Upload.Dir
+	}
+	if *dest == "" && len(cfg.Photos.Paths) > 0 {
+		*dest = cfg.Photos.Paths[0]
+	}
+	if *dest == "" {
+		log.Fatalf("No destination: set -dest or configure photo paths")
+	}
+	db, err := database.New(cfg.Cache.Dir)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.SetRoots(cfg.Photos.Paths)
+	if abs, err := filepath.Abs(*dest); err != nil || db.RootOf(abs) == "" {
+		log.Fatalf("Destination %s is not inside a configured photo path", *dest)
+	}
+
+	report, err := importer.Plan(indexer.New(db, cfg.Photos.Paths), fs.Arg(0), *dest)
+	if err != nil {
+		log.Fatalf("Import failed: %v", err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printImportReport(report)
+	}
+	if len(report.New) == 0 {
+		return
+	}
 
-	log.Printf("Pregen: complete. Generated %d, skipped %d (already cached), errors %d",
-		result.Generated, result.Skipped, result.Errors)
+	if !*yes {
+		verb := "Move"
+		if *keep {
+			verb = "Copy"
+		}
+		fmt.Fprintf(os.Stderr, "%s %d new files into %s? [y/N] ", verb, len(report.New), report.Dest)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Fprintln(os.Stderr, "Nothing imported.")
+			return
+		}
+	}
+	n, err := importer.Apply(report, *keep)
+	if err != nil {
+		log.Fatalf("Import stopped after %d files: %v", n, err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d files into %s.\n", n, report.Dest)
+}
+
+// printImportReport prints an import report for reading in a terminal.
+func printImportReport(r *importer.Report) {
+	fmt.Printf("Import from %s into %s\n", r.Source, r.Dest)
+	fmt.Printf("  new         %d (%.1f MB)\n", len(r.New), float64(r.NewSize())/(1<<20))
+	fmt.Printf("  duplicates  %d\n", len(r.Duplicates))
+	fmt.Printf("  conflicts   %d\n", len(r.Conflicts))
+	if len(r.Duplicates) > 0 {
+		fmt.Println("\nAlready in the library (left in place):")
+		for _, item := range r.Duplicates {
+			of := item.DuplicateOf
+			if item.PhotoID != 0 {
+				of = fmt.Sprintf("photo %d", item.PhotoID)
+			}
+			fmt.Printf("  %s = %s\n", item.Source, of)
+		}
+	}
+	if len(r.Conflicts) > 0 {
+		fmt.Println("\nA different file has the name (left in place):")
+		for _, item := range r.Conflicts {
+			fmt.Printf("  %s -> %s\n", item.Source, item.Target)
+		}
+	}
+	fmt.Println()
 }
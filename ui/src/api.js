@@ -6,6 +6,10 @@ const BASE = '/api'
 
 async function request(path, options = {}) {
   const res = await fetch(`${BASE}${path}`, options)
+  if (res.status === 401 && path !== '/auth/login') {
+    // Session missing or expired: the app shows the login form
+    window.dispatchEvent(new Event('photog:unauthorized'))
+  }
   if (!res.ok) {
     const body = await res.json().catch(() => ({}))
     throw new Error(body.error || `HTTP ${res.status}`)
@@ -13,11 +17,38 @@ async function request(path, options = {}) {
   return res.json()
 }
 
+// The viewer's timezone, so timeline months follow their calendar rather
+// than the server's.
+const TZ = encodeURIComponent(Intl.DateTimeFormat().resolvedOptions().timeZone || '')
+
+/**
+ * Log in; the server sets a session cookie used by every later request.
+ */
+export function login(username, password) {
+  return request('/auth/login', {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify({ username, password }),
+  })
+}
+
+/**
+ * End the current session.
+ */
+export async function logout() {
+  await fetch(`${BASE}/auth/logout`, { method: 'POST' })
+}
+
+// The server's thumbnail format, as reported with the timeline
+let thumbFormat = 'webp'
+
 /**
  * Fetch timeline photos (paginated, grouped by month).
  */
-export function fetchTimeline(offset = 0, limit = 100) {
-  return request(`/timeline?offset=${offset}&limit=${limit}`)
+export async function fetchTimeline(offset = 0, limit = 100) {
+  const data = await request(`/timeline?offset=${offset}&limit=${limit}&tz=${TZ}`)
+  if (data.thumb_format) thumbFormat = data.thumb_format
+  return data
 }
 
 /**
@@ -25,11 +56,12 @@ export function fetchTimeline(offset = 0, limit = 100) {
  * Returns [{month, label, count, cumulative_offset}, ...] ordered newest-first.
  */
 export function fetchTimelineMonths() {
-  return request('/timeline/months')
+  return request(`/timeline/months?tz=${TZ}`)
 }
 
 /**
- * Fetch "memories" — random photos from the past at 5-year intervals (e.g. 5, 10, 15 years ago).
+ * Fetch "memories" — one group per past year with photos taken around today's date.
+ * `photos` holds the first photo of each group.
  */
 export function fetchMemories() {
   return request('/memories')
@@ -42,6 +74,19 @@ export function fetchPhoto(id) {
   return request(`/photo/${id}`)
 }
 
+/**
+ * Search photos by text and facet filters ({ q, year, type, tag, camera }).
+ * Returns { total, results, facets, has_more }; `facets` maps year, type, tag
+ * and camera to [{value, count}, ...] for rendering filter chips.
+ */
+export function searchPhotos(filters = {}, offset = 0, limit = 100) {
+  const params = new URLSearchParams({ offset, limit })
+  for (const [key, value] of Object.entries(filters)) {
+    if (value) params.set(key, value)
+  }
+  return request(`/search?${params}`)
+}
+
 /**
  * Get library statistics.
  */
@@ -77,6 +122,18 @@ export function thumbUrl(id, size = 'sm') {
   return `${BASE}/thumb/${id}/${size}`
 }
 
+/**
+ * Build a thumbnail URL for a photo object, preferring its immutable
+ * content URL once the server knows its hash. Content URLs name their
+ * format, so AVIF thumbnails come from the negotiated URL instead, for
+ * browsers that can't display them.
+ */
+export function photoThumbUrl(photo, size = 'sm') {
+  if (!photo.hash || thumbFormat === 'avif') return thumbUrl(photo.id, size)
+  const ext = thumbFormat === 'jpeg' ? 'jpg' : 'webp'
+  return `${BASE}/c/${photo.hash}/${size}.${ext}`
+}
+
 /**
  * Build a full media URL for a photo/video.
  */